@@ -0,0 +1,547 @@
+// QR code generator for Ken Burns end screens and promo overlays.
+//
+// Encodes text (typically a URL) in byte mode and writes a PNG with a quiet
+// zone. Standard library only so it cross-compiles next to the bootstrap:
+//
+//	GOOS=linux GOARCH=amd64 go build -o qrgen qr_code_generator.go
+//	./qrgen -text https://example.com -out qr.png -scale 10 -level M
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+)
+
+// ecLevel is a QR error correction level.
+type ecLevel int
+
+const (
+	levelL ecLevel = iota
+	levelM
+	levelQ
+	levelH
+)
+
+// formatBits are the two error correction bits used in the format information.
+var formatBits = map[ecLevel]int{levelL: 1, levelM: 0, levelQ: 3, levelH: 2}
+
+// blockSpec describes the Reed-Solomon block layout for one version and level.
+type blockSpec struct {
+	ecPerBlock int
+	group1     int
+	data1      int
+	group2     int
+	data2      int
+}
+
+// blockSpecs covers versions 1-10, indexed by [version-1][level].
+var blockSpecs = [10][4]blockSpec{
+	{{7, 1, 19, 0, 0}, {10, 1, 16, 0, 0}, {13, 1, 13, 0, 0}, {17, 1, 9, 0, 0}},
+	{{10, 1, 34, 0, 0}, {16, 1, 28, 0, 0}, {22, 1, 22, 0, 0}, {28, 1, 16, 0, 0}},
+	{{15, 1, 55, 0, 0}, {26, 1, 44, 0, 0}, {18, 2, 17, 0, 0}, {22, 2, 13, 0, 0}},
+	{{20, 1, 80, 0, 0}, {18, 2, 32, 0, 0}, {26, 2, 24, 0, 0}, {16, 4, 9, 0, 0}},
+	{{26, 1, 108, 0, 0}, {24, 2, 43, 0, 0}, {18, 2, 15, 2, 16}, {22, 2, 11, 2, 12}},
+	{{18, 2, 68, 0, 0}, {16, 4, 27, 0, 0}, {24, 4, 19, 0, 0}, {28, 4, 15, 0, 0}},
+	{{20, 2, 78, 0, 0}, {18, 4, 31, 0, 0}, {18, 2, 14, 4, 15}, {26, 4, 13, 1, 14}},
+	{{24, 2, 97, 0, 0}, {22, 2, 38, 2, 39}, {22, 4, 18, 2, 19}, {26, 4, 14, 2, 15}},
+	{{30, 2, 116, 0, 0}, {22, 3, 36, 2, 37}, {20, 4, 16, 4, 17}, {24, 4, 12, 4, 13}},
+	{{18, 2, 68, 2, 69}, {26, 4, 43, 1, 44}, {24, 6, 19, 2, 20}, {28, 6, 15, 2, 16}},
+}
+
+// alignmentCenters lists alignment pattern centre coordinates per version.
+var alignmentCenters = [10][]int{
+	{}, {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34},
+	{6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50},
+}
+
+// errTooLong is returned when the text does not fit in version 10.
+var errTooLong = errors.New("text too long for QR versions 1-10")
+
+// qrCode is an encoded symbol; modules[y][x] is true for dark modules.
+type qrCode struct {
+	version  int
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+func (s blockSpec) dataCodewords() int {
+	return s.group1*s.data1 + s.group2*s.data2
+}
+
+// encode builds the smallest QR symbol that holds text at the given level.
+func encode(text []byte, level ecLevel) (*qrCode, error) {
+	for version := 1; version <= 10; version++ {
+		spec := blockSpecs[version-1][level]
+		countBits := 8
+		if version >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(text) > spec.dataCodewords()*8 {
+			continue
+		}
+
+		data := encodeData(text, countBits, spec.dataCodewords())
+		codewords := interleave(data, spec)
+
+		qr := newQRCode(version)
+		qr.drawFunctionPatterns(level)
+		qr.drawCodewords(codewords)
+		qr.applyBestMask(level)
+		return qr, nil
+	}
+	return nil, errTooLong
+}
+
+// encodeData builds the byte-mode bit stream padded to capacity.
+func encodeData(text []byte, countBits, capacity int) []byte {
+	var bits []bool
+	appendBits := func(value, length int) {
+		for i := length - 1; i >= 0; i-- {
+			bits = append(bits, (value>>uint(i))&1 == 1)
+		}
+	}
+
+	appendBits(0x4, 4)
+	appendBits(len(text), countBits)
+	for _, b := range text {
+		appendBits(int(b), 8)
+	}
+
+	terminator := capacity*8 - len(bits)
+	if terminator > 4 {
+		terminator = 4
+	}
+	appendBits(0, terminator)
+	if rem := len(bits) % 8; rem != 0 {
+		appendBits(0, 8-rem)
+	}
+
+	data := make([]byte, 0, capacity)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for j := 0; j < 8; j++ {
+			if bits[i+j] {
+				b |= 1 << uint(7-j)
+			}
+		}
+		data = append(data, b)
+	}
+	for pad := byte(0xEC); len(data) < capacity; pad ^= 0xEC ^ 0x11 {
+		data = append(data, pad)
+	}
+	return data
+}
+
+// interleave splits data into blocks, appends error correction and
+// interleaves the result in transmission order.
+func interleave(data []byte, spec blockSpec) []byte {
+	var blocks, ecBlocks [][]byte
+	offset := 0
+	for i := 0; i < spec.group1+spec.group2; i++ {
+		length := spec.data1
+		if i >= spec.group1 {
+			length = spec.data2
+		}
+		block := data[offset : offset+length]
+		offset += length
+		blocks = append(blocks, block)
+		ecBlocks = append(ecBlocks, reedSolomon(block, spec.ecPerBlock))
+	}
+
+	var result []byte
+	maxData := spec.data1
+	if spec.data2 > maxData {
+		maxData = spec.data2
+	}
+	for i := 0; i < maxData; i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < spec.ecPerBlock; i++ {
+		for _, block := range ecBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// gfMultiply multiplies in GF(256) with the QR polynomial 0x11D.
+func gfMultiply(a, b byte) byte {
+	var result byte
+	for b > 0 {
+		if b&1 == 1 {
+			result ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1D
+		}
+		b >>= 1
+	}
+	return result
+}
+
+// reedSolomon computes ecCount error correction codewords for data.
+func reedSolomon(data []byte, ecCount int) []byte {
+	generator := make([]byte, ecCount)
+	generator[ecCount-1] = 1
+	root := byte(1)
+	for i := 0; i < ecCount; i++ {
+		for j := 0; j < ecCount; j++ {
+			generator[j] = gfMultiply(generator[j], root)
+			if j+1 < ecCount {
+				generator[j] ^= generator[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+
+	remainder := make([]byte, ecCount)
+	for _, b := range data {
+		factor := b ^ remainder[0]
+		copy(remainder, remainder[1:])
+		remainder[ecCount-1] = 0
+		for i := range remainder {
+			remainder[i] ^= gfMultiply(generator[i], factor)
+		}
+	}
+	return remainder
+}
+
+func newQRCode(version int) *qrCode {
+	size := version*4 + 17
+	qr := &qrCode{version: version, size: size}
+	qr.modules = make([][]bool, size)
+	qr.function = make([][]bool, size)
+	for i := range qr.modules {
+		qr.modules[i] = make([]bool, size)
+		qr.function[i] = make([]bool, size)
+	}
+	return qr
+}
+
+func (qr *qrCode) setFunction(x, y int, dark bool) {
+	qr.modules[y][x] = dark
+	qr.function[y][x] = true
+}
+
+// drawFunctionPatterns places finders, timing, alignment, version and
+// reserves the format areas (filled in once the mask is chosen).
+func (qr *qrCode) drawFunctionPatterns(level ecLevel) {
+	for i := 0; i < qr.size; i++ {
+		qr.setFunction(6, i, i%2 == 0)
+		qr.setFunction(i, 6, i%2 == 0)
+	}
+
+	qr.drawFinder(3, 3)
+	qr.drawFinder(qr.size-4, 3)
+	qr.drawFinder(3, qr.size-4)
+
+	centers := alignmentCenters[qr.version-1]
+	last := len(centers) - 1
+	for i, cx := range centers {
+		for j, cy := range centers {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			qr.drawAlignment(cx, cy)
+		}
+	}
+
+	qr.drawFormat(level, 0)
+	qr.drawVersion()
+}
+
+func (qr *qrCode) drawFinder(cx, cy int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			x, y := cx+dx, cy+dy
+			if x < 0 || x >= qr.size || y < 0 || y >= qr.size {
+				continue
+			}
+			dist := abs(dx)
+			if abs(dy) > dist {
+				dist = abs(dy)
+			}
+			qr.setFunction(x, y, dist != 2 && dist != 4)
+		}
+	}
+}
+
+func (qr *qrCode) drawAlignment(cx, cy int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			dist := abs(dx)
+			if abs(dy) > dist {
+				dist = abs(dy)
+			}
+			qr.setFunction(cx+dx, cy+dy, dist != 1)
+		}
+	}
+}
+
+// drawFormat writes both copies of the BCH-protected format information.
+func (qr *qrCode) drawFormat(level ecLevel, mask int) {
+	data := formatBits[level]<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>uint(i))&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		qr.setFunction(8, i, bit(i))
+	}
+	qr.setFunction(8, 7, bit(6))
+	qr.setFunction(8, 8, bit(7))
+	qr.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		qr.setFunction(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		qr.setFunction(qr.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		qr.setFunction(8, qr.size-15+i, bit(i))
+	}
+	qr.setFunction(8, qr.size-8, true)
+}
+
+// drawVersion writes the version information blocks (versions 7+).
+func (qr *qrCode) drawVersion() {
+	if qr.version < 7 {
+		return
+	}
+	rem := qr.version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	bits := qr.version<<12 | rem
+	for i := 0; i < 18; i++ {
+		dark := (bits>>uint(i))&1 == 1
+		a := qr.size - 11 + i%3
+		b := i / 3
+		qr.setFunction(a, b, dark)
+		qr.setFunction(b, a, dark)
+	}
+}
+
+// drawCodewords places data in the two-column zigzag from the bottom right.
+func (qr *qrCode) drawCodewords(codewords []byte) {
+	i := 0
+	for right := qr.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < qr.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = qr.size - 1 - vert
+				}
+				if !qr.function[y][x] && i < len(codewords)*8 {
+					qr.modules[y][x] = (codewords[i>>3]>>uint(7-i&7))&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+func maskApplies(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+// applyMask toggles data modules; applying the same mask twice undoes it.
+func (qr *qrCode) applyMask(mask int) {
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			if !qr.function[y][x] && maskApplies(mask, x, y) {
+				qr.modules[y][x] = !qr.modules[y][x]
+			}
+		}
+	}
+}
+
+// applyBestMask picks the mask with the lowest penalty score.
+func (qr *qrCode) applyBestMask(level ecLevel) {
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		qr.applyMask(mask)
+		qr.drawFormat(level, mask)
+		if penalty := qr.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		qr.applyMask(mask)
+	}
+	qr.applyMask(best)
+	qr.drawFormat(level, best)
+}
+
+// penalty scores runs, 2x2 blocks, finder-like patterns and dark balance.
+func (qr *qrCode) penalty() int {
+	penalty := 0
+	get := func(x, y int, horizontal bool) bool {
+		if horizontal {
+			return qr.modules[y][x]
+		}
+		return qr.modules[x][y]
+	}
+
+	for _, horizontal := range []bool{true, false} {
+		for y := 0; y < qr.size; y++ {
+			run := 1
+			for x := 1; x < qr.size; x++ {
+				if get(x, y, horizontal) == get(x-1, y, horizontal) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					penalty += run - 2
+				}
+				run = 1
+			}
+			if run >= 5 {
+				penalty += run - 2
+			}
+
+			for x := 0; x+10 < qr.size; x++ {
+				pattern := [11]bool{}
+				for k := range pattern {
+					pattern[k] = get(x+k, y, horizontal)
+				}
+				if pattern == [11]bool{true, false, true, true, true, false, true, false, false, false, false} ||
+					pattern == [11]bool{false, false, false, false, true, false, true, true, true, false, true} {
+					penalty += 40
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			if qr.modules[y][x] {
+				dark++
+			}
+			if x+1 < qr.size && y+1 < qr.size {
+				c := qr.modules[y][x]
+				if c == qr.modules[y][x+1] && c == qr.modules[y+1][x] && c == qr.modules[y+1][x+1] {
+					penalty += 3
+				}
+			}
+		}
+	}
+	total := qr.size * qr.size
+	deviation := abs(dark*20-total*10) / total
+	penalty += deviation * 10
+	return penalty
+}
+
+// image renders the symbol with a four-module quiet zone.
+func (qr *qrCode) image(scale int, foreground, background color.Color) image.Image {
+	const quiet = 4
+	dim := (qr.size + 2*quiet) * scale
+	img := image.NewPaletted(image.Rect(0, 0, dim, dim), color.Palette{background, foreground})
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			if !qr.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex((x+quiet)*scale+dx, (y+quiet)*scale+dy, 1)
+				}
+			}
+		}
+	}
+	return img
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func parseLevel(value string) (ecLevel, error) {
+	switch value {
+	case "L":
+		return levelL, nil
+	case "M":
+		return levelM, nil
+	case "Q":
+		return levelQ, nil
+	case "H":
+		return levelH, nil
+	}
+	return levelM, fmt.Errorf("unknown error correction level %q", value)
+}
+
+func main() {
+	text := flag.String("text", "", "text or URL to encode")
+	out := flag.String("out", "qr.png", "output PNG path")
+	scale := flag.Int("scale", 10, "pixels per module")
+	levelName := flag.String("level", "M", "error correction level (L, M, Q, H)")
+	flag.Parse()
+
+	if *text == "" {
+		fmt.Fprintln(os.Stderr, "qrgen: -text is required")
+		os.Exit(2)
+	}
+	level, err := parseLevel(*levelName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "qrgen:", err)
+		os.Exit(2)
+	}
+
+	qr, err := encode([]byte(*text), level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "qrgen:", err)
+		os.Exit(1)
+	}
+
+	file, err := os.Create(*out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "qrgen:", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	if err := png.Encode(file, qr.image(*scale, color.Black, color.White)); err != nil {
+		fmt.Fprintln(os.Stderr, "qrgen:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%d\n", qr.size+8)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image/color"
+	"testing"
+)
+
+func TestReedSolomonKnownVector(t *testing.T) {
+	// "HELLO WORLD" at 1-M, from the ISO 18004 worked example
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := reedSolomon(data, 10); !bytes.Equal(got, want) {
+		t.Fatalf("reedSolomon = %v, want %v", got, want)
+	}
+}
+
+func TestGFMultiply(t *testing.T) {
+	for a := 0; a < 256; a++ {
+		if got := gfMultiply(byte(a), 1); got != byte(a) {
+			t.Fatalf("gfMultiply(%d, 1) = %d", a, got)
+		}
+		for b := 0; b < 256; b += 17 {
+			if gfMultiply(byte(a), byte(b)) != gfMultiply(byte(b), byte(a)) {
+				t.Fatalf("gfMultiply(%d, %d) is not commutative", a, b)
+			}
+		}
+	}
+	// x^8 reduces by the QR polynomial 0x11D
+	if got := gfMultiply(0x80, 0x02); got != 0x1D {
+		t.Fatalf("gfMultiply(0x80, 0x02) = %#x, want 0x1d", got)
+	}
+}
+
+func TestEncodeDataPadding(t *testing.T) {
+	data := encodeData([]byte("A"), 8, 16)
+	if len(data) != 16 {
+		t.Fatalf("len = %d, want 16", len(data))
+	}
+	// mode 0100, count 00000001, 'A' 01000001, terminator 0000
+	want := []byte{0x40, 0x14, 0x10}
+	if !bytes.Equal(data[:3], want) {
+		t.Fatalf("header = %#v, want %#v", data[:3], want)
+	}
+	for i, b := range data[3:] {
+		pad := byte(0xEC)
+		if i%2 == 1 {
+			pad = 0x11
+		}
+		if b != pad {
+			t.Fatalf("pad byte %d = %#x, want %#x", i, b, pad)
+		}
+	}
+}
+
+func TestInterleaveTwoBlocks(t *testing.T) {
+	spec := blockSpec{ecPerBlock: 2, group1: 1, data1: 2, group2: 1, data2: 3}
+	data := []byte{1, 2, 3, 4, 5}
+	got := interleave(data, spec)
+	if len(got) != 5+2*2 {
+		t.Fatalf("len = %d, want 9", len(got))
+	}
+	if want := []byte{1, 3, 2, 4, 5}; !bytes.Equal(got[:5], want) {
+		t.Fatalf("data order = %v, want %v", got[:5], want)
+	}
+	ec1, ec2 := reedSolomon(data[:2], 2), reedSolomon(data[2:], 2)
+	if want := []byte{ec1[0], ec2[0], ec1[1], ec2[1]}; !bytes.Equal(got[5:], want) {
+		t.Fatalf("ec order = %v, want %v", got[5:], want)
+	}
+}
+
+func TestEncodePicksSmallestVersion(t *testing.T) {
+	tests := []struct {
+		text    string
+		level   ecLevel
+		version int
+	}{
+		{"https://example.com", levelM, 2},
+		{"hi", levelL, 1},
+		{string(bytes.Repeat([]byte("x"), 100)), levelL, 5},
+		{string(bytes.Repeat([]byte("x"), 200)), levelM, 10},
+	}
+	for _, tt := range tests {
+		qr, err := encode([]byte(tt.text), tt.level)
+		if err != nil {
+			t.Fatalf("encode(%d bytes): %v", len(tt.text), err)
+		}
+		if qr.version != tt.version || qr.size != tt.version*4+17 {
+			t.Errorf("encode(%d bytes) = version %d size %d, want version %d", len(tt.text), qr.version, qr.size, tt.version)
+		}
+	}
+}
+
+func TestEncodeTooLong(t *testing.T) {
+	if _, err := encode(bytes.Repeat([]byte("x"), 300), levelH); !errors.Is(err, errTooLong) {
+		t.Fatalf("err = %v, want errTooLong", err)
+	}
+}
+
+func TestEncodeFunctionPatterns(t *testing.T) {
+	qr, err := encode(bytes.Repeat([]byte("x"), 70), levelH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qr.version < 7 {
+		t.Fatalf("version = %d, want 7 or more to cover version information", qr.version)
+	}
+
+	// each finder is a 7x7 ring with a 3x3 core, separated by a light border
+	for _, corner := range [][2]int{{0, 0}, {qr.size - 7, 0}, {0, qr.size - 7}} {
+		for dy := 0; dy < 7; dy++ {
+			for dx := 0; dx < 7; dx++ {
+				ring := dx == 0 || dx == 6 || dy == 0 || dy == 6
+				core := dx >= 2 && dx <= 4 && dy >= 2 && dy <= 4
+				if got := qr.modules[corner[1]+dy][corner[0]+dx]; got != (ring || core) {
+					t.Fatalf("finder at %v: module (%d,%d) = %v", corner, dx, dy, got)
+				}
+			}
+		}
+	}
+	for i := 8; i < qr.size-8; i++ {
+		if qr.modules[6][i] != (i%2 == 0) || qr.modules[i][6] != (i%2 == 0) {
+			t.Fatalf("timing pattern broken at %d", i)
+		}
+	}
+	if !qr.modules[qr.size-8][8] {
+		t.Fatal("dark module missing")
+	}
+
+	// the two format copies must agree
+	for i := 0; i < 8; i++ {
+		if qr.modules[8][qr.size-1-i] != formatModule(qr, i) {
+			t.Fatalf("format bit %d differs between copies", i)
+		}
+	}
+}
+
+// formatModule reads format bit i from the copy around the top-left finder.
+func formatModule(qr *qrCode, i int) bool {
+	switch {
+	case i <= 5:
+		return qr.modules[i][8]
+	case i == 6:
+		return qr.modules[7][8]
+	default:
+		return qr.modules[8][8]
+	}
+}
+
+func TestApplyMaskTwiceRestores(t *testing.T) {
+	qr, err := encode([]byte("mask"), levelQ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := make([][]bool, qr.size)
+	for y := range qr.modules {
+		before[y] = append([]bool(nil), qr.modules[y]...)
+	}
+	for mask := 0; mask < 8; mask++ {
+		qr.applyMask(mask)
+		qr.applyMask(mask)
+	}
+	for y := range before {
+		for x := range before[y] {
+			if qr.modules[y][x] != before[y][x] {
+				t.Fatalf("module (%d,%d) changed", x, y)
+			}
+		}
+	}
+}
+
+func TestImageQuietZone(t *testing.T) {
+	qr, err := encode([]byte("quiet"), levelM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := qr.image(3, color.Black, color.White)
+	dim := (qr.size + 8) * 3
+	if b := img.Bounds(); b.Dx() != dim || b.Dy() != dim {
+		t.Fatalf("bounds = %v, want %dx%d", b, dim, dim)
+	}
+	if c := color.GrayModel.Convert(img.At(4*3-1, 4*3-1)).(color.Gray); c.Y != 0xFF {
+		t.Fatal("quiet zone is not light")
+	}
+	if c := color.GrayModel.Convert(img.At(4*3, 4*3)).(color.Gray); c.Y != 0 {
+		t.Fatal("top-left finder corner is not dark")
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, want := range map[string]ecLevel{"L": levelL, "M": levelM, "Q": levelQ, "H": levelH} {
+		if got, err := parseLevel(name); err != nil || got != want {
+			t.Errorf("parseLevel(%q) = %v, %v", name, got, err)
+		}
+	}
+	if _, err := parseLevel("X"); err == nil {
+		t.Error("parseLevel(\"X\") succeeded")
+	}
+}
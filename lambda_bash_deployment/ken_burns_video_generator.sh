@@ -5,171 +5,5644 @@
 
 set -e
 
-# Basic debug output
-echo "DEBUG: Bash script starting" >&2
-echo "DEBUG: Current directory: $(pwd)" >&2
-echo "DEBUG: Files in current directory:" >&2
-ls -la >&2
-
 # Configuration
 BUCKET_NAME="${S3_BUCKET:-burns-videos}"
 TEMP_DIR="/tmp"
 DEFAULT_FPS=24
 DEFAULT_RESOLUTION="1920x1080"
+MIN_OUTPUT_SIDE=128
+MAX_OUTPUT_PIXELS=$((3840 * 2160))
+MAX_OUTPUT_FPS=60
+DEFAULT_DURATION="5.0"
+FONT_FILE="${FONT_FILE:-./fonts/DejaVuSans.ttf}"
+BOLD_FONT_FILE="${BOLD_FONT_FILE:-./fonts/DejaVuSans-Bold.ttf}"
+FONTS_DIR="./fonts"
+
+# Named looks (options.look): bundles of option defaults, see looks.json
+LOOKS_FILE="./looks.json"
+
+# Seconds a lower third takes to slide in or out
+LOWER_THIRD_SLIDE=0.5
+
+# S3 retry policy (throttling and 5xx only); delays are full-jitter exponential
+S3_MAX_ATTEMPTS="${S3_MAX_ATTEMPTS:-5}"
+S3_RETRY_BASE_DELAY="${S3_RETRY_BASE_DELAY:-0.5}"
+S3_RETRY_MAX_DELAY="${S3_RETRY_MAX_DELAY:-10}"
+S3_METRICS_FILE="$TEMP_DIR/s3_metrics.log"
+DOWNLOAD_METRICS_FILE="$TEMP_DIR/download_metrics.log"
+RESOURCE_USAGE_FILE="$TEMP_DIR/resource_usage.log"
+RENDER_WARNINGS_FILE="$TEMP_DIR/render_warnings.log"
+
+# Cache-Control for uploaded objects (options.cache_control overrides; empty omits the header)
+UPLOAD_CACHE_CONTROL="${UPLOAD_CACHE_CONTROL:-public, max-age=86400}"
+
+# One-time container initialization (binary checks, capability probes) is cached
+# here and reused by warm invocations; the first invocation after a cold start pays for it
+RUNTIME_CACHE_DIR="$TEMP_DIR/runtime_cache"
+# Downloaded images are kept for warm invocations, least recently used first out
+# past the size budget and refetched after the TTL (options.image_cache=false skips it)
+IMAGE_CACHE_DIR="$TEMP_DIR/image_cache"
+IMAGE_CACHE_MAX_BYTES="${IMAGE_CACHE_MAX_BYTES:-268435456}"
+IMAGE_CACHE_TTL="${IMAGE_CACHE_TTL:-3600}"
+IMAGE_CACHE_STATS_FILE="$TEMP_DIR/image_cache_stats.log"
+# Color LUTs are cached the same way, keyed by their full source reference
+LUT_CACHE_DIR="$TEMP_DIR/lut_cache"
+LUT_CACHE_MAX_BYTES="${LUT_CACHE_MAX_BYTES:-67108864}"
+LUT_CACHE_TTL="${LUT_CACHE_TTL:-3600}"
+# Watermark images too
+WATERMARK_CACHE_DIR="$TEMP_DIR/watermark_cache"
+WATERMARK_CACHE_MAX_BYTES="${WATERMARK_CACHE_MAX_BYTES:-67108864}"
+WATERMARK_CACHE_TTL="${WATERMARK_CACHE_TTL:-3600}"
+# And .ttf/.otf fonts (the bundled fonts are symlinked in and never pruned)
+FONT_CACHE_DIR="$TEMP_DIR/font_cache"
+FONT_CACHE_MAX_BYTES="${FONT_CACHE_MAX_BYTES:-67108864}"
+FONT_CACHE_TTL="${FONT_CACHE_TTL:-3600}"
+COLD_START="false"
+
+# The Lambda environment supplies credentials and region as variables, so the CLI
+# never needs to probe the instance metadata service or shared config files
+export AWS_EC2_METADATA_DISABLED="true"
+export AWS_DEFAULT_REGION="${AWS_DEFAULT_REGION:-${AWS_REGION:-us-east-1}}"
+# Access point ARNs are addressed in their own region, whatever the function's region
+export AWS_S3_USE_ARN_REGION="true"
+
+# CloudFront signing for images given as a distribution path (cloudfront_path)
+# The PEM private key is read from an SSM SecureString parameter
+CLOUDFRONT_DOMAIN="${CLOUDFRONT_DOMAIN:-}"
+CLOUDFRONT_KEY_PAIR_ID="${CLOUDFRONT_KEY_PAIR_ID:-}"
+CLOUDFRONT_PRIVATE_KEY_PARAM="${CLOUDFRONT_PRIVATE_KEY_PARAM:-/burns/cloudfront-private-key}"
+CLOUDFRONT_URL_TTL="${CLOUDFRONT_URL_TTL:-3600}"
+
+# HTTP download limits (seconds / bytes); a transfer slower than 1KB/s for the
+# stall timeout is treated as a dead connection
+DOWNLOAD_CONNECT_TIMEOUT="${DOWNLOAD_CONNECT_TIMEOUT:-10}"
+DOWNLOAD_MAX_TIME="${DOWNLOAD_MAX_TIME:-120}"
+DOWNLOAD_STALL_TIMEOUT="${DOWNLOAD_STALL_TIMEOUT:-20}"
+DOWNLOAD_MAX_BYTES="${DOWNLOAD_MAX_BYTES:-52428800}"
+DOWNLOAD_MAX_REDIRECTS="${DOWNLOAD_MAX_REDIRECTS:-5}"
+# Transient download failures (timeouts, resets, 408/429/5xx) are retried with
+# full-jitter exponential delays; a segment's images download this many at a
+# time (options.download_concurrency overrides)
+DOWNLOAD_MAX_ATTEMPTS="${DOWNLOAD_MAX_ATTEMPTS:-3}"
+DOWNLOAD_RETRY_BASE_DELAY="${DOWNLOAD_RETRY_BASE_DELAY:-1}"
+DOWNLOAD_RETRY_MAX_DELAY="${DOWNLOAD_RETRY_MAX_DELAY:-8}"
+DOWNLOAD_CONCURRENCY="${DOWNLOAD_CONCURRENCY:-4}"
+MAX_DOWNLOAD_CONCURRENCY=16
+
+# Input limits; requests beyond them are rejected with a PayloadTooLarge error
+MAX_IMAGES_PER_SEGMENT="${MAX_IMAGES_PER_SEGMENT:-20}"
+MAX_IMAGE_BYTES="${MAX_IMAGE_BYTES:-26214400}"
+# Images must decode, with at least MIN_IMAGE_SIDE pixels per side and at most MAX_IMAGE_PIXELS in total
+MIN_IMAGE_SIDE="${MIN_IMAGE_SIDE:-16}"
+MAX_IMAGE_PIXELS="${MAX_IMAGE_PIXELS:-100000000}"
+# Scanned photos skewed further than this are left as they are (likely not a skew)
+SCAN_MAX_SKEW_DEGREES="${SCAN_MAX_SKEW_DEGREES:-5}"
+# Images whose long side is under UPSCALE_MIN_SIDE are upscaled with options.upscale:
+# "lanczos" (ffmpeg, with mild sharpening) or "external", which runs
+# UPSCALER_COMMAND <input> <output> <factor> (e.g. a Real-ESRGAN wrapper in a layer)
+UPSCALE_MIN_SIDE="${UPSCALE_MIN_SIDE:-1280}"
+UPSCALER_COMMAND="${UPSCALER_COMMAND:-}"
+# Moderation labels below this confidence (percent) are ignored
+MODERATION_MIN_CONFIDENCE="${MODERATION_MIN_CONFIDENCE:-80}"
+# PDF pages and SVGs are rasterized to fit this multiple of the output size, leaving
+# headroom for the zoom
+DOCUMENT_RASTER_SCALE="${DOCUMENT_RASTER_SCALE:-2}"
+MAX_EVENT_DURATION="${MAX_EVENT_DURATION:-1800}"
+MAX_SEGMENTS_PER_COMBINE="${MAX_SEGMENTS_PER_COMBINE:-500}"
+# Events too large for a Lambda payload arrive as {"payload_s3_key": ...}; response
+# bodies over this size are written to responses/ in S3 and returned as a pointer
+RESPONSE_INLINE_MAX_BYTES="${RESPONSE_INLINE_MAX_BYTES:-262144}"
+# Compressed events (payload_gzip_base64 / payload_zstd_base64) may inflate to at most this size
+MAX_DECOMPRESSED_EVENT_BYTES="${MAX_DECOMPRESSED_EVENT_BYTES:-52428800}"
+# Inline images (data: URIs or an image's base64/data field) stay well under the Lambda payload limit
+MAX_INLINE_IMAGE_BYTES="${MAX_INLINE_IMAGE_BYTES:-4194304}"
+REJECTION_FILE="$TEMP_DIR/rejection.json"
+
+# Render time budget: the Lambda deadline (LAMBDA_DEADLINE_MS in epoch milliseconds
+# when the environment sets it; the bundled bootstrap does not, so usually
+# invocation start + LAMBDA_TIMEOUT_SECONDS) against an encode-time model
+# in wall seconds per output second per megapixel at 24fps, measured with
+# REFERENCE_MEMORY_MB, plus a fixed cost per source image
+INVOCATION_START_TIME=$(date +%s)
+LAMBDA_TIMEOUT_SECONDS="${LAMBDA_TIMEOUT_SECONDS:-900}"
+ENCODE_SECONDS_PER_MEGAPIXEL="${ENCODE_SECONDS_PER_MEGAPIXEL:-0.6}"
+RENDER_OVERHEAD_SECONDS="${RENDER_OVERHEAD_SECONDS:-30}"
+IMAGE_OVERHEAD_SECONDS="${IMAGE_OVERHEAD_SECONDS:-2}"
+REFERENCE_MEMORY_MB="${REFERENCE_MEMORY_MB:-3008}"
+
+# Download host policy: comma- or semicolon-separated host patterns ("cdn.example.com", "*.example.com")
+# An empty allowlist permits any public host; private and link-local addresses are always refused
+DOWNLOAD_ALLOWED_HOSTS="${DOWNLOAD_ALLOWED_HOSTS:-}"
+DOWNLOAD_DENIED_HOSTS="${DOWNLOAD_DENIED_HOSTS:-}"
+
+# Encoder settings shared by every generated clip so segments concat cleanly
+SEGMENT_ENCODE_ARGS=(
+    -fps_mode cfr
+    -r $DEFAULT_FPS
+    -c:v libx264
+    -preset fast
+    -crf 23
+    -profile:v high
+    -level 4.1
+    -pix_fmt yuv420p
+    -g $((DEFAULT_FPS * 2))
+    -keyint_min $DEFAULT_FPS
+    -sc_threshold 0
+    -movflags +faststart
+    -threads 2
+)
+# Set by apply_encode_settings from options.two_pass
+ENCODE_TWO_PASS="false"
+
+# options.intermediate "near_lossless" writes segments at INTERMEDIATE_CRF and leaves
+# the delivery encode (options.crf, max_bitrate, two_pass) to the combine;
+# ENCODE_DELIVERY is false while the shared settings produce intermediates
+INTERMEDIATE_CRF="${INTERMEDIATE_CRF:-10}"
+ENCODE_DELIVERY="true"
+
+# Response field describing how the combine joined its segments, set by combine_videos_with_audio
+CONCAT_REPORT_FIELD=""
+
+# HDR10 output (options.hdr): HEVC Main10 signalled as BT.2020/PQ, with SDR white
+# mapped to 203 nits (BT.2408); x265 encodes cost about HDR_ENCODE_COST_FACTOR x264 ones
+HDR_OUTPUT="false"
+HDR_X265_PARAMS="hdr10=1:repeat-headers=1:colorprim=bt2020:transfer=smpte2084:colormatrix=bt2020nc:master-display=G(13250,34500)B(7500,3000)R(34000,16000)WP(15635,16450)L(10000000,50):max-cll=1000,203"
+HDR_ENCODE_COST_FACTOR="${HDR_ENCODE_COST_FACTOR:-3}"
+
+# Event options (populated from .options in main)
+OPTIONS_JSON="{}"
+
+# Segment start on the project timeline (populated from .start_time in main)
+SEGMENT_START_TIME="0"
+
+# Combine-level subtitle file (populated from .subtitles_s3_key, .subtitles_mode,
+# .subtitles_encoding and .subtitles_style in main)
+SUBTITLES_SPEC="{}"
+
+# Combine-level intro and outro cards (populated from .intro and .outro in main)
+BOOKEND_CARDS="{}"
+
+# Segment being rendered (populated from .segment_id in main); seeds motion with options.seed
+SEGMENT_ID=""
+
+# Index of the image being rendered within the segment (set by process_segment)
+IMAGE_INDEX="0"
+
+# Number of images in the segment being rendered (set by process_segment); the
+# bounce loop style only applies to single-image segments
+SEGMENT_IMAGE_COUNT="1"
+
+# Profiling (PROFILE_TRACE=true): microsecond timestamps and function names from a
+# bash xtrace (never the traced commands, which carry signed URLs, auth headers and
+# cookies), capped at PROFILE_TRACE_MAX_BYTES, plus a memory timeline are written
+# while the handler runs, then summarized and uploaded under profiles/
+PROFILE_TRACE="${PROFILE_TRACE:-false}"
+PROFILE_TRACE_FILE="$TEMP_DIR/profile.trace"
+PROFILE_TRACE_MAX_BYTES="${PROFILE_TRACE_MAX_BYTES:-20000000}"
+PROFILE_MEMORY_FILE="$TEMP_DIR/profile.memory"
+
+# Failure debug bundles (options.debug_bundle or DEBUG_BUNDLE_ON_FAILURE=true): while
+# capture is on, ffmpeg command lines, their stderr and the handler log are kept
+DEBUG_BUNDLE_ON_FAILURE="${DEBUG_BUNDLE_ON_FAILURE:-false}"
+DEBUG_BUNDLE_DIR="$TEMP_DIR/debug_bundle"
+DEBUG_CAPTURE="false"
+DEBUG_BUNDLE_S3_KEY=""
+
+# Logging function
+log() {
+    local line="[$(date '+%Y-%m-%d %H:%M:%S')] $1"
+    echo "$line"
+    if [ "$DEBUG_CAPTURE" = "true" ]; then
+        echo "$line" >> "$DEBUG_BUNDLE_DIR/handler.log"
+    fi
+}
+
+# Run the bundled ffmpeg; under debug capture the command line goes to commands.log
+# and stderr is copied to ffmpeg_stderr.log on its way to the caller
+ffmpeg() {
+    if [ "$DEBUG_CAPTURE" != "true" ]; then
+        command ffmpeg "$@"
+        return
+    fi
+    
+    printf '%q ' ffmpeg "$@" >> "$DEBUG_BUNDLE_DIR/commands.log"
+    echo >> "$DEBUG_BUNDLE_DIR/commands.log"
+    echo "== ffmpeg ${*//$'\n'/ }" | cut -c1-200 >> "$DEBUG_BUNDLE_DIR/ffmpeg_stderr.log"
+    { command ffmpeg "$@" 2>&1 1>&3 3>&- | tee -a "$DEBUG_BUNDLE_DIR/ffmpeg_stderr.log" >&2; } 3>&1
+    return "${PIPESTATUS[0]}"
+}
+
+# Error handling
+error_exit() {
+    log "ERROR: $1"
+    exit 1
+}
+
+# Record a typed rejection response (status code and body JSON) and fail the
+# current step; main emits it instead of a generic failure
+record_rejection() {
+    local status_code="$1"
+    local body_json="$2"
+    
+    echo "{\"statusCode\":$status_code,\"body\":$body_json}" > "$REJECTION_FILE"
+    return 1
+}
+
+# Reject an oversized request with a PayloadTooLarge error
+reject_payload_too_large() {
+    local message="$1"
+    local limit="$2"
+    local actual="${3:-null}"
+    
+    log "ERROR: Payload too large: $message" >&2
+    record_rejection 413 "$(./jq -nc --arg message "$message" --argjson limit "$limit" --argjson actual "$actual" \
+        '{error: "payload_too_large", error_type: "PayloadTooLarge", message: $message, limit: $limit, actual: $actual}')"
+}
+
+# Finish a failed invocation, emitting any recorded rejection response (or, with
+# debug capture on, a RenderFailed response pointing at the uploaded debug bundle)
+exit_with_rejection() {
+    if [ ! -s "$REJECTION_FILE" ] && [ "$DEBUG_CAPTURE" = "true" ]; then
+        upload_debug_bundle || true
+    fi
+    if [ -s "$REJECTION_FILE" ]; then
+        cat "$REJECTION_FILE"
+        exit 0
+    fi
+    exit 1
+}
+
+# Check image counts and durations against the input limits before any work starts
+validate_event_limits() {
+    local event="$1"
+    
+    local image_count=$(echo "$event" | ./jq '.images // [] | length')
+    if [ "$image_count" -gt "$MAX_IMAGES_PER_SEGMENT" ]; then
+        reject_payload_too_large "Segment has $image_count images (max $MAX_IMAGES_PER_SEGMENT)" "$MAX_IMAGES_PER_SEGMENT" "$image_count"
+        return 1
+    fi
+    
+    local segment_count=$(echo "$event" | ./jq '.segment_results // [] | length')
+    if [ "$segment_count" -gt "$MAX_SEGMENTS_PER_COMBINE" ]; then
+        reject_payload_too_large "Combine has $segment_count segments (max $MAX_SEGMENTS_PER_COMBINE)" "$MAX_SEGMENTS_PER_COMBINE" "$segment_count"
+        return 1
+    fi
+    
+    # Segment events carry their own duration; combines sum their segments
+    local total_duration=$(echo "$event" | ./jq 'if .segment_results then ([.segment_results[] | .duration // 0 | tonumber] | add // 0) else (.duration // 0 | tonumber) end')
+    if awk -v d="$total_duration" -v m="$MAX_EVENT_DURATION" 'BEGIN { exit !(d > m) }'; then
+        reject_payload_too_large "Event duration ${total_duration}s exceeds ${MAX_EVENT_DURATION}s" "$MAX_EVENT_DURATION" "$total_duration"
+        return 1
+    fi
+}
+
+# Seconds left before the Lambda deadline
+get_remaining_seconds() {
+    local now=$(date +%s)
+    if [ -n "$LAMBDA_DEADLINE_MS" ]; then
+        echo $((LAMBDA_DEADLINE_MS / 1000 - now))
+    else
+        echo $((INVOCATION_START_TIME + LAMBDA_TIMEOUT_SECONDS - now))
+    fi
+}
+
+# Estimate wall-clock render seconds for an event
+# Segments encode once; combines only re-encode for crossfades and burned captions
+# Lambda CPU scales with memory, but ffmpeg runs two threads, so memory past two
+# vCPUs (3538MB) buys no speed
+estimate_render_seconds() {
+    local event="$1"
+    
+    local total_duration passes images=0
+    if echo "$event" | ./jq -e '.segment_results' > /dev/null 2>&1; then
+        total_duration=$(echo "$event" | ./jq '[.segment_results[] | .duration // 0 | tonumber] | add // 0')
+        passes=0
+        if [ "$(get_default_transition)" != "cut" ] || \
+            echo "$event" | ./jq -e 'any(.segment_results[]; .transition // "cut" | (.type? // .) != "cut")' > /dev/null 2>&1 || \
+            uses_intermediate_segments; then
+            passes=$((passes + 1))
+        fi
+        if [ "$(get_option_json "watermark" | ./jq -r 'objects | .apply_to // empty')" = "combine" ]; then
+            passes=$((passes + 1))
+        fi
+        if [ "$(get_option_json "lower_thirds" | ./jq 'if type == "array" then length else 0 end')" -gt 0 ]; then
+            passes=$((passes + 1))
+        fi
+        if get_option_json "progress_bar" | ./jq -e '. == true or type == "object"' > /dev/null 2>&1; then
+            passes=$((passes + 1))
+        fi
+        if echo "$event" | ./jq -e '.subtitles_s3_key and (.subtitles_mode // "sidecar") != "sidecar"' > /dev/null 2>&1; then
+            passes=$((passes + 1))
+        fi
+        local captions=$(get_option_json "captions")
+        if [ "$captions" != "null" ]; then
+            passes=$((passes + 1))
+            if [ "$(get_option "caption_variants" "false")" = "true" ]; then
+                passes=$((passes + $(echo "$captions" | ./jq 'length')))
+            fi
+        fi
+        # Each streaming package encodes its ladder, together about one master's pixels
+        passes=$((passes + $(get_packaging_formats | grep -c .)))
+        if [ -n "$(get_option "mezzanine" "")" ]; then
+            passes=$((passes + 1))
+        fi
+    else
+        total_duration=$(echo "$event" | ./jq '.duration // 0 | tonumber')
+        images=$(echo "$event" | ./jq '.images // [] | length')
+        # high_quality_motion renders zoompan at the supersample factor per side, so
+        # the Ken Burns pass handles factor squared the pixels
+        local supersample=$(get_motion_supersample)
+        passes=$((supersample * supersample))
+        # Image transitions join the clips through an xfade encode
+        if echo "$event" | ./jq -e 'any(.images[]?; .transition // "cut" | (.type? // .) != "cut")' > /dev/null 2>&1; then
+            passes=$((passes + 1))
+        fi
+    fi
+    # Intermediate segments are single-pass; the combine's delivery encode is not
+    if [ "$ENCODE_TWO_PASS" = "true" ] && { [ "$images" -eq 0 ] || ! uses_intermediate_segments; }; then
+        passes=$((passes * 2))
+    fi
+    if [ "$HDR_OUTPUT" = "true" ]; then
+        passes=$((passes * HDR_ENCODE_COST_FACTOR))
+    fi
+    
+    awk -v d="$total_duration" -v p="$passes" -v encode="$(estimate_encode_seconds "$total_duration")" \
+        -v images="$images" -v per_image="$IMAGE_OVERHEAD_SECONDS" -v overhead="$RENDER_OVERHEAD_SECONDS" 'BEGIN {
+        # Stream-copy concat and muxing still read the whole timeline once
+        printf "%d", encode * p + images * per_image + d * 0.05 + overhead + 0.5
+    }'
+}
+
+# Estimated seconds for one encode pass of a timeline at the output size and rate
+estimate_encode_seconds() {
+    local duration="$1"
+    
+    awk -v d="$duration" -v r="$DEFAULT_RESOLUTION" -v fps="$DEFAULT_FPS" \
+        -v memory="${AWS_LAMBDA_FUNCTION_MEMORY_SIZE:-$REFERENCE_MEMORY_MB}" -v reference="$REFERENCE_MEMORY_MB" \
+        -v rate="$ENCODE_SECONDS_PER_MEGAPIXEL" 'BEGIN {
+        split(r, size, "x")
+        megapixels = size[1] * size[2] / 1000000
+        speed = (memory < 3538 ? memory : 3538) / reference
+        printf "%.3f\n", d * megapixels * rate * fps / 24 / speed
+    }'
+}
+
+# Step the output down one rung for options.allow_downgrade: 60fps to 30, the long
+# side to 1920, then 24fps, then the long side to 1280; fails when nothing is left
+downgrade_output() {
+    local width="${DEFAULT_RESOLUTION%x*}" height="${DEFAULT_RESOLUTION#*x}"
+    local long=$((width > height ? width : height))
+    local target=0
+    if [ "$DEFAULT_FPS" -gt 30 ]; then
+        set_output_fps 30
+        return 0
+    elif [ "$long" -gt 1920 ]; then
+        target=1920
+    elif [ "$DEFAULT_FPS" -gt 24 ]; then
+        set_output_fps 24
+        return 0
+    elif [ "$long" -gt 1280 ]; then
+        target=1280
+    else
+        return 1
+    fi
+    
+    # Keep the aspect ratio with even dimensions
+    DEFAULT_RESOLUTION=$(awk -v w="$width" -v h="$height" -v l="$long" -v t="$target" 'BEGIN {
+        printf "%dx%d\n", int(w * t / l / 2 + 0.5) * 2, int(h * t / l / 2 + 0.5) * 2
+    }')
+    set_output_fps "$DEFAULT_FPS"
+}
+
+# Refuse events whose estimated render time exceeds the remaining Lambda time
+check_render_deadline() {
+    local event="$1"
+    
+    local estimated=$(estimate_render_seconds "$event")
+    local remaining=$(get_remaining_seconds)
+    log "Estimated render time: ${estimated}s (remaining: ${remaining}s)"
+    if [ "$estimated" -gt "$remaining" ] && [ "$(get_option "allow_downgrade" "false")" = "true" ]; then
+        local requested="${DEFAULT_RESOLUTION}@${DEFAULT_FPS}fps"
+        while [ "$estimated" -gt "$remaining" ] && downgrade_output; do
+            estimated=$(estimate_render_seconds "$event")
+            log "Downgraded output to ${DEFAULT_RESOLUTION}@${DEFAULT_FPS}fps (estimated: ${estimated}s)"
+        done
+        if [ "$estimated" -le "$remaining" ]; then
+            record_warning "output_downgraded" "Rendered at ${DEFAULT_RESOLUTION}@${DEFAULT_FPS}fps instead of $requested to finish before the Lambda deadline"
+        fi
+    fi
+    if [ "$estimated" -gt "$remaining" ]; then
+        log "ERROR: Render cannot finish before the Lambda deadline" >&2
+        record_rejection 422 "$(./jq -nc --argjson estimated "$estimated" --argjson remaining "$remaining" '{
+            error: "insufficient_time_remaining",
+            error_type: "InsufficientTimeRemaining",
+            message: "Estimated render time \($estimated)s exceeds the \($remaining)s left in this invocation; use the worker path, a lower resolution or fps, or allow_downgrade",
+            estimated_seconds: $estimated,
+            remaining_seconds: $remaining,
+            suggested_path: "worker"
+        }')"
+        return 1
+    fi
+}
+
+# Refuse events carrying presigned URLs (SigV4 X-Amz-Date + X-Amz-Expires, or a
+# SigV2/CloudFront Expires epoch) that have expired or will expire before the
+# estimated render finishes, so nothing fails halfway through its downloads
+check_presigned_url_expiry() {
+    local event="$1"
+    
+    local now=$(date +%s)
+    local finish=$((now + $(estimate_render_seconds "$event")))
+    local rejection=$(echo "$event" | ./jq -c --argjson now "$now" --argjson finish "$finish" '
+        def param($name): (capture("[?&]" + $name + "=(?<value>[^&#]*)").value) // null;
+        [.. | strings | select(test("^https?://.*[?&](X-Amz-Expires|Expires)="))
+            | { url: sub("[?#].*$"; ""),
+                expires_at: (try (if param("X-Amz-Expires") and param("X-Amz-Date") then
+                        (param("X-Amz-Date") | strptime("%Y%m%dT%H%M%SZ") | mktime) + (param("X-Amz-Expires") | tonumber)
+                    else param("Expires") | tonumber end) catch null) }
+            | select(.expires_at != null and .expires_at < $finish)]
+        | min_by(.expires_at)
+        | if . == null then empty
+          elif .expires_at <= $now then {
+              error: "presigned_url_expired",
+              error_type: "PresignedUrlExpired",
+              message: "Presigned URL expired at \(.expires_at | todate): \(.url)",
+              url: .url,
+              expires_at: (.expires_at | todate)
+          } else {
+              error: "presigned_url_expires_during_render",
+              error_type: "PresignedUrlExpiresDuringRender",
+              message: "Presigned URL expires at \(.expires_at | todate), before the estimated render finish at \($finish | todate): \(.url)",
+              url: .url,
+              expires_at: (.expires_at | todate),
+              estimated_finish_at: ($finish | todate)
+          } end')
+    
+    if [ -n "$rejection" ]; then
+        log "ERROR: $(echo "$rejection" | ./jq -r '.message')" >&2
+        record_rejection 422 "$rejection"
+        return 1
+    fi
+}
+
+# Read a value from the event options, falling back to a default (an explicit false is kept)
+get_option() {
+    local key="$1"
+    local default_value="$2"
+    
+    local value=$(echo "$OPTIONS_JSON" | ./jq -r --arg key "$key" 'if .[$key] == null then empty else .[$key] end' 2>/dev/null)
+    if [ -n "$value" ]; then
+        echo "$value"
+    else
+        echo "$default_value"
+    fi
+}
+
+# Read a JSON value (object/array) from the event options, or null
+get_option_json() {
+    local key="$1"
+    echo "$OPTIONS_JSON" | ./jq -c --arg key "$key" '.[$key] // null' 2>/dev/null || echo "null"
+}
+
+# Convert a (possibly fractional) duration in seconds to a frame count
+frames_for_duration() {
+    local duration="$1"
+    awk -v d="$duration" -v fps="$DEFAULT_FPS" 'BEGIN { f = int(d * fps + 0.5); if (f < 1) f = 1; print f }'
+}
+
+# Merge the named look's option defaults under the event's own options
+# (options.look); explicit options win, unknown looks are reported and ignored
+apply_look() {
+    local look=$(get_option "look" "")
+    if [ -z "$look" ]; then
+        return 0
+    fi
+    if ! ./jq -e --arg look "$look" 'has($look)' "$LOOKS_FILE" > /dev/null 2>&1; then
+        record_warning "unknown_look" "Unknown look '$look'; using event options only"
+        return 0
+    fi
+    OPTIONS_JSON=$(./jq -c --arg look "$look" --argjson options "$OPTIONS_JSON" '.[$look].options * $options' "$LOOKS_FILE")
+    log "Applied look: $look"
+}
+
+# x264 CRF for generated clips (options.crf, else 23)
+get_encode_crf() {
+    get_option "crf" "23"
+}
+
+# Replace the value following a flag in the shared segment encoder settings
+set_segment_encode_arg() {
+    local flag="$1"
+    local value="$2"
+    local i
+    for i in "${!SEGMENT_ENCODE_ARGS[@]}"; do
+        if [ "${SEGMENT_ENCODE_ARGS[$i]}" = "$flag" ]; then
+            SEGMENT_ENCODE_ARGS[$((i + 1))]="$value"
+        fi
+    done
+}
+
+# x264 preset (options.preset, ultrafast through veryslow, else fast)
+get_encode_preset() {
+    local preset=$(get_option "preset" "fast")
+    case "$preset" in
+        ultrafast|superfast|veryfast|faster|fast|medium|slow|slower|veryslow)
+            echo "$preset"
+            ;;
+        *)
+            echo "fast"
+            ;;
+    esac
+}
+
+# Bitrate cap in kbit/s from options.max_bitrate ("8M", "4500k" or bits), else nothing
+get_max_bitrate_kbps() {
+    local max_bitrate=$(get_option "max_bitrate" "")
+    [[ "$max_bitrate" =~ ^[0-9]+(\.[0-9]+)?[kKmM]?$ ]] || return 0
+    echo "$max_bitrate" | awk '{
+        value = $0 + 0
+        if ($0 ~ /[mM]$/) value *= 1000; else if ($0 !~ /[kK]$/) value /= 1000
+        if (value >= 1) printf "%d\n", value
+    }'
+}
+
+# x264 rate control: CRF, capped by options.max_bitrate through the VBV; two-pass
+# encodes target 80% of the cap instead, since x264 only runs two passes on a bitrate
+# Pass "crf" to keep CRF mode regardless, for outputs sized unlike the master
+get_encode_rate_args() {
+    local mode="${1:-}"
+    local kbps=$(get_max_bitrate_kbps)
+    if [ -n "$kbps" ] && [ "$ENCODE_TWO_PASS" = "true" ] && [ "$mode" != "crf" ]; then
+        echo "-b:v $((kbps * 4 / 5))k -maxrate ${kbps}k -bufsize $((kbps * 2))k"
+    elif [ -n "$kbps" ]; then
+        echo "-crf $(get_encode_crf) -maxrate ${kbps}k -bufsize $((kbps * 2))k"
+    else
+        echo "-crf $(get_encode_crf)"
+    fi
+}
+
+# Drop a flag and its value from the shared segment encoder settings
+remove_segment_encode_arg() {
+    local flag="$1"
+    local args=() i
+    for ((i = 0; i < ${#SEGMENT_ENCODE_ARGS[@]}; i++)); do
+        if [ "${SEGMENT_ENCODE_ARGS[$i]}" = "$flag" ]; then
+            i=$((i + 1))
+        else
+            args+=("${SEGMENT_ENCODE_ARGS[$i]}")
+        fi
+    done
+    SEGMENT_ENCODE_ARGS=("${args[@]}")
+}
+
+# Point the shared segment encoder settings at the configured preset and rate control
+# options.two_pass needs options.max_bitrate to size its bitrate; without one, or with
+# HDR output (x265 keeps its own pass files), it is ignored
+apply_encode_settings() {
+    ENCODE_TWO_PASS="false"
+    if [ "$(get_option "two_pass" "false")" = "true" ]; then
+        if [ "$HDR_OUTPUT" = "true" ]; then
+            record_warning "two_pass_ignored" "two_pass is not supported with hdr; encoding in a single CRF pass"
+        elif [ -n "$(get_max_bitrate_kbps)" ]; then
+            ENCODE_TWO_PASS="true"
+        else
+            record_warning "two_pass_ignored" "two_pass needs a max_bitrate; encoding in a single CRF pass"
+        fi
+    fi
+    if [ -n "$(get_option "max_bitrate" "")" ] && [ -z "$(get_max_bitrate_kbps)" ]; then
+        record_warning "invalid_encode_option" "max_bitrate '$(get_option "max_bitrate" "")' is not a bitrate like 8M or 4500k; ignored"
+    fi
+    if [ "$(get_option "preset" "fast")" != "$(get_encode_preset)" ]; then
+        record_warning "invalid_encode_option" "preset '$(get_option "preset" "")' is not an x264 preset; using fast"
+    fi
+    
+    set_segment_encode_arg "-preset" "$(get_encode_preset)"
+    remove_segment_encode_arg "-crf"
+    if uses_intermediate_segments; then
+        ENCODE_DELIVERY="false"
+        SEGMENT_ENCODE_ARGS+=(-crf "$INTERMEDIATE_CRF")
+    else
+        ENCODE_DELIVERY="true"
+        SEGMENT_ENCODE_ARGS+=($(get_encode_rate_args))
+    fi
+}
+
+# Whether segments are written as near-lossless intermediates (options.intermediate)
+uses_intermediate_segments() {
+    [ "$(get_option "intermediate" "")" = "near_lossless" ]
+}
+
+# Switch the shared settings from intermediates to the delivery rate control, for
+# encodes that produce the final video
+use_delivery_encode() {
+    if [ "$ENCODE_DELIVERY" = "true" ]; then
+        return 0
+    fi
+    local flag
+    for flag in -crf -b:v -maxrate -bufsize; do
+        remove_segment_encode_arg "$flag"
+    done
+    SEGMENT_ENCODE_ARGS+=($(get_encode_rate_args))
+    ENCODE_DELIVERY="true"
+}
+
+# Encoder and pixel format for the output: H.264 8-bit, or HEVC Main10 with HDR10
+# signalling when HDR output is on
+get_video_codec_args() {
+    if [ "$HDR_OUTPUT" = "true" ]; then
+        echo "-c:v libx265 -profile:v main10 -pix_fmt yuv420p10le -tag:v hvc1 -color_primaries bt2020 -color_trc smpte2084 -colorspace bt2020nc -x265-params $HDR_X265_PARAMS"
+    else
+        echo "-c:v libx264 -pix_fmt yuv420p"
+    fi
+}
+
+# Switch the shared segment encoder settings to HDR10 for options.hdr; without
+# zscale, tonemap or libx265 in this ffmpeg build the render stays SDR
+apply_hdr_output() {
+    HDR_OUTPUT="false"
+    if [ "$(get_option "hdr" "false")" != "true" ]; then
+        return 0
+    fi
+    if ! has_ffmpeg_filter "zscale" || ! has_ffmpeg_filter "tonemap" || ! has_ffmpeg_encoder "libx265"; then
+        record_warning "hdr_unavailable" "This ffmpeg build lacks zscale, tonemap or libx265; rendering SDR"
+        return 0
+    fi
+    
+    HDR_OUTPUT="true"
+    local flag
+    for flag in -c:v -profile:v -level -pix_fmt; do
+        remove_segment_encode_arg "$flag"
+    done
+    SEGMENT_ENCODE_ARGS+=($(get_video_codec_args))
+    log "HDR10 output enabled"
+}
+
+# zscale mapping for an encode's first input into BT.2020/PQ, or nothing when the
+# input is already PQ video (or a concat list of this pipeline's clips); images keep a tagged wide gamut (Display P3 from
+# iPhone HEIF, BT.2020), anything untagged is treated as sRGB/BT.709
+get_hdr_input_conversion() {
+    local input="" format="" previous=""
+    local arg
+    for arg in "$@"; do
+        if [ "$previous" = "-f" ] && [ -z "$input" ]; then
+            format="$arg"
+        elif [ "$previous" = "-i" ]; then
+            input="$arg"
+            break
+        fi
+        previous="$arg"
+    done
+    
+    if [ "$format" = "concat" ]; then
+        return 0
+    fi
+    local primaries="bt709"
+    if [ "$format" != "lavfi" ] && [ -f "$input" ]; then
+        local probed=$(ffprobe -v error -select_streams v:0 -show_entries stream=color_primaries,color_transfer \
+            -of csv=p=0 "$input" 2>/dev/null | head -1)
+        case "$probed" in
+            *smpte2084*)
+                return 0
+                ;;
+            bt2020*|smpte432*|smpte431*)
+                primaries="${probed%%,*}"
+                log "Wide-gamut source $(basename "$input") ($primaries)" >&2
+                ;;
+        esac
+    fi
+    echo "zscale=pin=$primaries:tin=iec61966-2-1:p=bt2020:t=smpte2084:m=bt2020nc:r=tv:npl=203,format=yuv420p10le"
+}
+
+# Run an ffmpeg encode whose last argument is the output file; with two-pass
+# encoding an analysis pass first writes x264 stats to a passlog in TEMP_DIR
+# With HDR output the input conversion is appended to the encode's filter graph
+# (or added as one), which must end in a single unlabeled chain
+encode_ffmpeg() {
+    if [ "$HDR_OUTPUT" = "true" ]; then
+        local conversion=$(get_hdr_input_conversion "$@")
+        if [ -n "$conversion" ]; then
+            local converted=() previous="" injected="false"
+            local arg
+            for arg in "${@:1:$#-1}"; do
+                if [ "$injected" = "false" ] && { [ "$previous" = "-vf" ] || [ "$previous" = "-filter_complex" ]; }; then
+                    arg="${arg%"${arg##*[![:space:]]}"},$conversion"
+                    injected="true"
+                fi
+                converted+=("$arg")
+                previous="$arg"
+            done
+            if [ "$injected" = "false" ]; then
+                converted+=(-vf "$conversion")
+            fi
+            set -- "${converted[@]}" "${@: -1}"
+        fi
+    fi
+    
+    if [ "$ENCODE_TWO_PASS" != "true" ] || [ "$ENCODE_DELIVERY" != "true" ]; then
+        ffmpeg "$@"
+        return
+    fi
+    
+    local output="${@: -1}"
+    local args=("${@:1:$#-1}")
+    local passlog="$TEMP_DIR/x264_passlog_$(basename "$output" .mp4)"
+    ffmpeg "${args[@]}" -pass 1 -passlogfile "$passlog" -an -f null /dev/null || { rm -f "$passlog"*; return 1; }
+    ffmpeg "${args[@]}" -pass 2 -passlogfile "$passlog" "$output"
+    local status=$?
+    rm -f "$passlog"*
+    return $status
+}
+
+# Lowest H.264 level whose frame size and macroblock rate fit the output (4.1 covers 1080p30)
+get_h264_level() {
+    awk -v w="${DEFAULT_RESOLUTION%x*}" -v h="${DEFAULT_RESOLUTION#*x}" -v fps="$DEFAULT_FPS" 'BEGIN {
+        mbs = int((w + 15) / 16) * int((h + 15) / 16)
+        split("4.1 4.2 5.1 5.2", levels, " ")
+        split("8192 8704 36864 36864", frame_limits, " ")
+        split("245760 522240 983040 2073600", rate_limits, " ")
+        for (i = 1; i < 4; i++) if (mbs <= frame_limits[i] && mbs * fps <= rate_limits[i]) break
+        print levels[i]
+    }'
+}
+
+# Switch the output frame rate; keyframe spacing and the H.264 level follow it
+set_output_fps() {
+    DEFAULT_FPS="$1"
+    set_segment_encode_arg "-r" "$DEFAULT_FPS"
+    set_segment_encode_arg "-g" "$((DEFAULT_FPS * 2))"
+    set_segment_encode_arg "-keyint_min" "$DEFAULT_FPS"
+    set_segment_encode_arg "-level" "$(get_h264_level)"
+}
+
+# Frame rate (options.fps, a whole number up to MAX_OUTPUT_FPS, else 24); applied
+# after apply_output_format so the level matches the resolution
+apply_output_fps() {
+    local fps=$(get_option "fps" "$DEFAULT_FPS")
+    if [[ ! "$fps" =~ ^[0-9]+$ ]] || [ "$fps" -lt 1 ] || [ "$fps" -gt "$MAX_OUTPUT_FPS" ]; then
+        log "ERROR: fps '$fps' must be a whole number from 1 to $MAX_OUTPUT_FPS" >&2
+        record_rejection 422 "$(./jq -nc --arg fps "$fps" --argjson max "$MAX_OUTPUT_FPS" '{
+            error: "invalid_fps",
+            error_type: "InvalidFps",
+            message: "fps \($fps) must be a whole number from 1 to \($max)",
+            fps: $fps
+        }')"
+        return 1
+    fi
+    set_output_fps "$fps"
+}
+
+# Combines adopt the smallest size and lowest frame rate their segments report,
+# since each segment may have downgraded on its own
+align_output_to_segments() {
+    local event="$1"
+    
+    local smallest=$(echo "$event" | ./jq -r '[.segment_results[]? | .resolution // empty | tostring
+        | select(test("^[0-9]+x[0-9]+$"))] | min_by(split("x") | map(tonumber) | .[0] * .[1]) // empty')
+    local slowest=$(echo "$event" | ./jq -r '[.segment_results[]? | .fps // empty | tonumber] | min // empty')
+    
+    if [ -n "$smallest" ] && [ $((${smallest%x*} * ${smallest#*x})) -lt $((${DEFAULT_RESOLUTION%x*} * ${DEFAULT_RESOLUTION#*x})) ]; then
+        log "Segments were rendered at $smallest; combining at that size"
+        DEFAULT_RESOLUTION="$smallest"
+    fi
+    if [ -n "$slowest" ] && [ "$slowest" -lt "$DEFAULT_FPS" ]; then
+        log "Segments were rendered at ${slowest}fps; combining at that rate"
+        DEFAULT_FPS="$slowest"
+    fi
+    set_output_fps "$DEFAULT_FPS"
+}
+
+# Re-encode a downloaded segment whose size or frame rate differs from the output
+# (a segment that downgraded on its own, or a combine that downgraded below it)
+normalize_segment_video() {
+    local video_path="$1"
+    
+    local probed=$(ffprobe -v error -select_streams v:0 -show_entries stream=width,height,r_frame_rate -of csv=p=0 "$video_path" 2>/dev/null)
+    if [ -z "$probed" ] || [ "$probed" = "${DEFAULT_RESOLUTION/x/,},$DEFAULT_FPS/1" ]; then
+        return 0
+    fi
+    
+    local width="${DEFAULT_RESOLUTION%x*}" height="${DEFAULT_RESOLUTION#*x}"
+    log "Normalizing $(basename "$video_path") ($probed) to ${DEFAULT_RESOLUTION}@${DEFAULT_FPS}fps"
+    encode_ffmpeg -i "$video_path" \
+        -vf "scale=$width:$height:force_original_aspect_ratio=increase:flags=lanczos,crop=$width:$height,setsar=1" \
+        "${SEGMENT_ENCODE_ARGS[@]}" \
+        -c:a copy \
+        -y "$video_path.normalized.mp4" || { rm -f "$video_path.normalized.mp4"; return 1; }
+    mv "$video_path.normalized.mp4" "$video_path"
+}
+
+# Style presets bundle a consistent look across segments and combine
+get_style() {
+    get_option "style" ""
+}
+
+# Filter chain appended to every segment for the active style
+get_style_filter() {
+    case "$(get_style)" in
+        documentary)
+            # Desaturated grade, subtle temporal grain, 2.39:1 letterbox matte
+            echo "eq=saturation=0.7:contrast=1.05:brightness=-0.02,noise=c0s=6:c0f=t,drawbox=x=0:y=0:w=iw:h='(ih-iw/2.39)/2':color=black:t=fill,drawbox=x=0:y='ih-(ih-iw/2.39)/2':w=iw:h='(ih-iw/2.39)/2':color=black:t=fill"
+            ;;
+        real_estate)
+            # Clean, slightly brightened grade for interiors
+            echo "eq=saturation=1.08:contrast=1.03:brightness=0.02"
+            ;;
+        tribute)
+            # Warm, soft grade with optional drifting light particles
+            local grade="colorbalance=rs=0.06:gs=0.02:bs=-0.06:rm=0.04:bm=-0.04,eq=saturation=0.9:contrast=0.97"
+            if [ "$(get_option "particles" "false")" = "true" ]; then
+                echo "$grade,format=yuv420p[base];$(get_particle_source)[particles];[base][particles]blend=all_mode=screen:all_opacity=0.35"
+            else
+                echo "$grade"
+            fi
+            ;;
+    esac
+}
+
+# Era grading presets (options.grade, which a segment's own grade overrides) as
+# curves/eq/hue chains; unknown names are warned about and left ungraded
+get_grade_filter() {
+    local grade=$(get_option "grade" "")
+    case "$grade" in
+        "")
+            ;;
+        archival_1940s)
+            # Monochrome with a faint warm tone, lifted blacks and soft highlights
+            echo "hue=s=0,colorchannelmixer=rr=0.36:rg=0.62:rb=0.14:gr=0.33:gg=0.58:gb=0.13:br=0.27:bg=0.49:bb=0.11,curves=all='0/0.08 0.5/0.5 1/0.9',eq=contrast=0.95"
+            ;;
+        kodachrome)
+            # Saturated reds and warm mids against deep, slightly cool shadows
+            echo "curves=r='0/0 0.5/0.56 1/1':g='0/0 0.5/0.5 1/0.98':b='0/0.03 0.5/0.45 1/0.94',eq=saturation=1.3:contrast=1.1"
+            ;;
+        modern_clean)
+            # Gentle S-curve with neutral color and a touch of extra saturation
+            echo "curves=all='0/0 0.25/0.23 0.75/0.78 1/1',eq=saturation=1.05:gamma=1.02"
+            ;;
+        noir)
+            # High-contrast monochrome with crushed shadows
+            echo "hue=s=0,curves=all='0/0 0.3/0.18 0.7/0.84 1/1',eq=contrast=1.2:brightness=-0.03"
+            ;;
+        *)
+            record_warning "unknown_grade" "Unknown grade '$grade'; rendering ungraded"
+            ;;
+    esac
+}
+
+# Procedural twinkling particle layer sized to the output frame
+get_particle_source() {
+    echo "color=c=black:s=480x270:r=$DEFAULT_FPS,noise=alls=100:allf=t+u,lutyuv=y='if(gt(val,250),255,0)':u=128:v=128,tmix=frames=8,boxblur=2,scale=$DEFAULT_RESOLUTION,setsar=1,format=yuv420p"
+}
+
+# Film-look filter chain for options.effects, run after the Ken Burns move and the
+# grade: gate_weave (0-1, frame jitter), grain (0-1), vignette (0-1), bars (true for
+# a 2.39:1 matte or a ratio such as 1.85) and fade ({"in": s, "out": s} through
+# black at each image's start and end). Out-of-range values are warned about and
+# skipped; prints nothing when no effects are set
+get_effects_filter() {
+    local clip_duration="$1"
+    
+    local effects=$(get_option_json "effects")
+    if [ "$(echo "$effects" | ./jq -r 'type')" != "object" ]; then
+        return 0
+    fi
+    local width="${DEFAULT_RESOLUTION%x*}" height=$(get_output_height)
+    local filters=() amount
+    
+    if amount=$(get_effect_amount "$effects" gate_weave) && [ -n "$amount" ]; then
+        # Crop a few pixels in and wander the window on two incommensurate sines
+        local weave=$(awk -v a="$amount" -v h="$height" 'BEGIN { p = int(a * h * 0.004 + 0.5); if (p < 1) p = 1; print p }')
+        filters+=("crop=iw-$((weave * 2)):ih-$((weave * 2)):x='$weave+$weave*sin(n*1.7)*sin(n*0.31)':y='$weave+$weave*sin(n*1.3)*cos(n*0.23)',scale=$width:$height")
+    fi
+    if amount=$(get_effect_amount "$effects" grain) && [ -n "$amount" ]; then
+        filters+=("noise=c0s=$(awk -v a="$amount" 'BEGIN { printf "%d", a * 24 + 0.5 }'):c0f=t+u")
+    fi
+    if amount=$(get_effect_amount "$effects" vignette) && [ -n "$amount" ]; then
+        filters+=("vignette=angle=$(awk -v a="$amount" 'BEGIN { printf "%.3f", a * 3.14159265 / 3 }')")
+    fi
+    
+    local bars=$(echo "$effects" | ./jq -r '.bars // empty | if . == true then 2.39 elif . == false then empty else . end')
+    if [ -n "$bars" ]; then
+        if [[ ! "$bars" =~ ^[0-9]+(\.[0-9]+)?$ ]]; then
+            record_warning "invalid_effect" "effects.bars '$bars' is not true or an aspect ratio; skipped"
+        elif [ "$(awk -v r="$bars" -v w="$width" -v h="$height" 'BEGIN { print (r > w / h) }')" = "1" ]; then
+            filters+=("drawbox=x=0:y=0:w=iw:h='(ih-iw/$bars)/2':color=black:t=fill,drawbox=x=0:y='ih-(ih-iw/$bars)/2':w=iw:h='(ih-iw/$bars)/2':color=black:t=fill")
+        fi
+    fi
+    
+    local fade_in=$(echo "$effects" | ./jq -r '.fade.in // empty') fade_out=$(echo "$effects" | ./jq -r '.fade.out // empty')
+    local seconds
+    for seconds in "$fade_in" "$fade_out"; do
+        if [ -n "$seconds" ] && [[ ! "$seconds" =~ ^[0-9]+(\.[0-9]+)?$ ]]; then
+            record_warning "invalid_effect" "effects.fade '$seconds' is not a number of seconds; skipped"
+        fi
+    done
+    if [[ "$fade_in" =~ ^[0-9]+(\.[0-9]+)?$ ]]; then
+        filters+=("fade=t=in:st=0:d=$fade_in")
+    fi
+    if [[ "$fade_out" =~ ^[0-9]+(\.[0-9]+)?$ ]]; then
+        filters+=("fade=t=out:st=$(awk -v c="$clip_duration" -v f="$fade_out" 'BEGIN { s = c - f; if (s < 0) s = 0; printf "%.3f", s }'):d=$fade_out")
+    fi
+    
+    (IFS=,; echo "${filters[*]}")
+}
+
+# An effects amount in 0-1; prints nothing when unset and warns (failing) when
+# out of range
+get_effect_amount() {
+    local effects="$1"
+    local name="$2"
+    
+    local amount=$(echo "$effects" | ./jq -r --arg name "$name" '.[$name] // empty')
+    if [ -z "$amount" ] || [ "$amount" = "0" ]; then
+        return 0
+    fi
+    if [[ ! "$amount" =~ ^(0(\.[0-9]+)?|1(\.0+)?)$ ]]; then
+        record_warning "invalid_effect" "effects.$name '$amount' is not between 0 and 1; skipped"
+        return 1
+    fi
+    echo "$amount"
+}
+
+# Per-image text overlays for the active style
+get_style_overlay_filter() {
+    local segment_id="$1"
+    local image_json="$2"
+    
+    case "$(get_style)" in
+        real_estate)
+            get_real_estate_overlay_filter "$segment_id" "$image_json"
+            ;;
+    esac
+}
+
+# QA overlay for options.debug_overlay: segment and image, the live frame number
+# and clip time, and the Ken Burns parameters chosen for the clip (motion, length,
+# focal point, roll and the start of the zoom expression) in the top-left corner.
+# Uses drawtext directly since the %{...} expansions must not go through libass
+get_debug_overlay_filter() {
+    local motion="$1"
+    local duration="$2"
+    local ken_burns_filter="$3"
+    local image_json="$4"
+    local segment_id="$5"
+    
+    if [ "$(get_option "debug_overlay" "false")" != "true" ]; then
+        return 0
+    fi
+    local height=$(get_output_height)
+    local zoom=$(echo "$ken_burns_filter" | grep -o "zoompan=z='[^']*'" | head -1 | cut -c12- | tr -d "'" | cut -c1-72)
+    local focal=$(get_focal_point "$image_json") rotation=$(get_rotation_degrees "$image_json")
+    
+    local debug_file="$TEMP_DIR/debug_overlay_${SEGMENT_ID}.txt"
+    {
+        echo "segment $segment_id  image $IMAGE_INDEX  frame %{frame_num}  t %{pts:flt}"
+        echo "motion $motion  ${duration}s  $(frames_for_duration "$duration") frames @ ${DEFAULT_FPS}fps"
+        echo "focal ${focal:-none}  roll ${rotation:-0}"
+        if [ -n "$zoom" ]; then
+            echo "z=$zoom"
+        fi
+    } > "$debug_file"
+    echo "drawtext=fontfile=$FONT_FILE:textfile=$debug_file:fontsize=$((height / 45)):fontcolor=yellow:x=$((height / 60)):y=$((height / 60)):box=1:boxcolor=black@0.6:boxborderw=$((height / 120)):line_spacing=$((height / 180))"
+}
+
+# Per-image overlays: the style's own plus the image's burned-in caption
+get_image_overlay_filter() {
+    local segment_id="$1"
+    local image_json="$2"
+    local filters=()
+    local filter
+    
+    for filter in \
+        "$(get_style_overlay_filter "$segment_id" "$image_json")" \
+        "$(get_caption_overlay_filter "$segment_id" "$image_json")"; do
+        if [ -n "$filter" ]; then
+            filters+=("$filter")
+        fi
+    done
+    
+    local IFS=","
+    echo "${filters[*]}"
+}
+
+# Burned-in caption for one image, shown for that image's whole clip. caption is
+# text or {text, font (regular, bold or a .ttf/.otf source), size (pixels, or a
+# fraction of the frame height), color, position (top, center, bottom), box,
+# box_color}; options.caption_style supplies defaults. Long captions wrap to 80%
+# of the frame width
+get_caption_overlay_filter() {
+    local segment_id="$1"
+    local image_json="$2"
+    
+    local caption=$(echo "$image_json" | ./jq -c --argjson defaults "$(get_option_json "caption_style")" '
+        .caption // empty | (if type == "object" then . else {text: tostring} end) as $c
+        | ($defaults | if type == "object" then . else {} end) * $c')
+    local text=$(echo "$caption" | ./jq -r '.text // empty')
+    if [ -z "$text" ]; then
+        return 0
+    fi
+    # The real estate style already shows a plain-text caption as the room name
+    if [ "$(get_style)" = "real_estate" ] && echo "$image_json" | ./jq -e '.room == null and (.caption | type) == "string"' > /dev/null; then
+        return 0
+    fi
+    
+    local width="${DEFAULT_RESOLUTION%x*}" height=$(get_output_height)
+    local size=$(echo "$caption" | ./jq -r '.size // empty')
+    if [[ "$size" =~ ^0?\.[0-9]+$ ]]; then
+        size=$(awk -v s="$size" -v h="$height" 'BEGIN { printf "%d", s * h }')
+    elif [[ ! "$size" =~ ^[0-9]+$ ]]; then
+        size=$((height / 24))
+    fi
+    local min_size=$(get_min_caption_size)
+    if [ "$size" -lt "$min_size" ]; then
+        size="$min_size"
+    fi
+    
+    local font_file=$(get_text_font_file "$(echo "$caption" | ./jq -r '.font // "regular"')" "$FONT_FILE" "caption")
+    
+    local y
+    case "$(echo "$caption" | ./jq -r '.position // "bottom"')" in
+        top) y="h*0.06" ;;
+        center) y="(h-th)/2" ;;
+        *) y="h*0.92-th" ;;
+    esac
+    
+    local color=$(get_caption_color "$(echo "$caption" | ./jq -r '.color // "white"')" "white")
+    local extra="alpha='min(1,t/0.4)'"
+    if [ "$(echo "$caption" | ./jq -r '.box != false')" = "true" ]; then
+        local box_color=$(get_caption_color "$(echo "$caption" | ./jq -r '.box_color // "black@0.5"')" "black@0.5")
+        extra="box=1:boxcolor=$box_color:boxborderw=$((size / 3)):$extra"
+    fi
+    
+    # Average glyph width is roughly half the font size
+    local columns=$((width * 8 / 10 * 2 / size))
+    local text_file=$(write_overlay_text "segment_${segment_id}_caption" "$(wrap_text "$text" "$columns")")
+    build_drawtext_filter "$text_file" "$size" "(w-tw)/2" "$y" "$extra" "$font_file" "$color"
+}
+
+# Small attribution for an image's credit (e.g. "Photo: Library of Congress") in
+# the options.credit_position corner (bottom_right by default). Consecutive images
+# sharing a credit show it as one continuous line: the fade in is skipped when the
+# previous image had the same credit and the fade out when the next one does
+get_credit_overlay_filter() {
+    local segment_id="$1"
+    local images_json="$2"
+    local index="$3"
+    local duration="$4"
+    
+    local credit=$(echo "$images_json" | ./jq -r --argjson i "$index" '.[$i].credit // empty | strings')
+    if [ -z "$credit" ]; then
+        return 0
+    fi
+    local height=$(get_output_height)
+    local margin=$((height / 40))
+    
+    local x y
+    case "$(get_option "credit_position" "bottom_right")" in
+        bottom_left) x="$margin"; y="h-th-$margin" ;;
+        top_left) x="$margin"; y="$margin" ;;
+        top_right) x="w-tw-$margin"; y="$margin" ;;
+        *) x="w-tw-$margin"; y="h-th-$margin" ;;
+    esac
+    
+    local fade_in="1" fade_out="1"
+    if [ "$index" -gt 0 ] && [ "$(echo "$images_json" | ./jq -r --argjson i "$index" '.[$i - 1].credit == .[$i].credit')" = "true" ]; then
+        fade_in=""
+    fi
+    if [ "$(echo "$images_json" | ./jq -r --argjson i "$index" '.[$i + 1].credit == .[$i].credit')" = "true" ]; then
+        fade_out=""
+    fi
+    local alpha="0.85"
+    if [ -n "$fade_in" ] && [ -n "$fade_out" ]; then
+        alpha="'0.85*min(1,min(t,$duration-t)/0.4)'"
+    elif [ -n "$fade_in" ]; then
+        alpha="'0.85*min(1,t/0.4)'"
+    elif [ -n "$fade_out" ]; then
+        alpha="'0.85*min(1,($duration-t)/0.4)'"
+    fi
+    
+    local credit_file=$(write_overlay_text "segment_${segment_id}_credit" "$credit")
+    build_drawtext_filter "$credit_file" $((height / 50)) "$x" "$y" "borderw=$((height / 540 + 1)):bordercolor=black@0.6:alpha=$alpha"
+}
+
+# Font file for a caption or slide font: regular, bold or a .ttf/.otf source
+# fetched through the font cache (falling back to the given default; a kind such
+# as "caption" prefixes the warning code)
+get_text_font_file() {
+    local font="$1"
+    local default_file="$2"
+    local kind="$3"
+    
+    case "$font" in
+        regular) echo "$FONT_FILE" ;;
+        bold) echo "$BOLD_FONT_FILE" ;;
+        *)
+            mkdir -p "$FONT_CACHE_DIR"
+            if ! get_cached_font "$font" "$FONT_CACHE_DIR"; then
+                record_warning "${kind:+${kind}_}font_unavailable" "Could not load ${kind:+$kind }font ${font%%\?*}; using the default font"
+                echo "$default_file"
+            fi
+            ;;
+    esac
+}
+
+# Caption colors accept #RRGGBB or 0xRRGGBB or an ffmpeg color name, each with an
+# optional @alpha; anything else is warned about and replaced by the default
+get_caption_color() {
+    local color="$1"
+    local default_color="$2"
+    
+    local alpha=""
+    if [[ "$color" == *@* ]]; then
+        alpha="@${color##*@}"
+        color="${color%@*}"
+    fi
+    if [ -n "$alpha" ] && [[ ! "$alpha" =~ ^@(0|0?\.[0-9]+|1(\.0+)?)$ ]]; then
+        record_warning "invalid_caption_color" "Caption color '$1' has an alpha outside 0-1; using $default_color"
+        echo "$default_color"
+    elif parse_hex_color "$color" > /dev/null; then
+        color="${color#\#}"
+        echo "0x${color#0x}$alpha"
+    elif [[ "$color" =~ ^[A-Za-z]+$ ]]; then
+        echo "$color$alpha"
+    else
+        record_warning "invalid_caption_color" "Caption color '$1' is not #RRGGBB or a color name; using $default_color"
+        echo "$default_color"
+    fi
+}
+
+# Random effect indexes the active style allows (empty means all)
+get_style_effect_indexes() {
+    case "$(get_style)" in
+        documentary)
+            # Slow zooms and gentle pans only
+            echo "2 3 6 10"
+            ;;
+        real_estate)
+            # Walkthrough-style pans that keep the room readable
+            echo "2 3 4 5 8 9"
+            ;;
+        tribute)
+            # Gentle push-ins only
+            echo "0 6 10"
+            ;;
+    esac
+}
+
+# Maximum push-in zoom for subject-targeted motion (options.max_zoom overrides)
+get_style_max_zoom() {
+    local max_zoom=$(get_option "max_zoom" "")
+    if [ -n "$max_zoom" ]; then
+        echo "$max_zoom"
+        return 0
+    fi
+    case "$(get_style)" in
+        documentary|tribute) echo "1.4" ;;
+        *) echo "3.0" ;;
+    esac
+}
+
+# Segment duration used when the event does not supply one (options.default_duration overrides)
+get_style_default_duration() {
+    local duration=$(get_option "default_duration" "")
+    if [ -n "$duration" ]; then
+        echo "$duration"
+        return 0
+    fi
+    case "$(get_style)" in
+        real_estate) echo "3.5" ;;
+        *) echo "$DEFAULT_DURATION" ;;
+    esac
+}
+
+# Crossfade length in seconds between segments at combine (0 means hard cuts;
+# options.crossfade overrides)
+get_style_crossfade() {
+    local crossfade=$(get_option "crossfade" "")
+    if [ -n "$crossfade" ]; then
+        echo "$crossfade"
+        return 0
+    fi
+    case "$(get_style)" in
+        documentary) echo "1.5" ;;
+        tribute) echo "2.0" ;;
+        *) echo "0" ;;
+    esac
+}
+
+# High-contrast palette (options.high_contrast): every text/background pair
+# clears the WCAG AAA 7:1 ratio and avoids red/green distinctions
+HIGH_CONTRAST_TEXT="white"
+HIGH_CONTRAST_BACKGROUND="black"
+HIGH_CONTRAST_ACCENT="0xffd200"
+
+is_high_contrast() {
+    [ "$(get_option "high_contrast" "false")" = "true" ]
+}
+
+# Resolve an overlay color for a role (text, background, accent), swapping in
+# the high-contrast palette when enabled
+get_palette_color() {
+    local role="$1"
+    local default_color="$2"
+    
+    if ! is_high_contrast; then
+        echo "$default_color"
+        return 0
+    fi
+    case "$role" in
+        text) echo "$HIGH_CONTRAST_TEXT" ;;
+        background) echo "$HIGH_CONTRAST_BACKGROUND" ;;
+        accent) echo "$HIGH_CONTRAST_ACCENT" ;;
+        *) echo "$default_color" ;;
+    esac
+}
+
+# Minimum caption font size in output pixels (options.min_caption_size)
+# High-contrast mode defaults to 1/16 of the frame height
+get_min_caption_size() {
+    local default_size=0
+    if is_high_contrast; then
+        default_size=$(($(get_output_height) / 16))
+    fi
+    get_option "min_caption_size" "$default_size"
+}
+
+# Output frame height in pixels
+get_output_height() {
+    echo "${DEFAULT_RESOLUTION#*x}"
+}
+
+# Output aspect ratio (width / height)
+get_output_aspect() {
+    awk -v w="${DEFAULT_RESOLUTION%x*}" -v h="${DEFAULT_RESOLUTION#*x}" 'BEGIN { printf "%.6f\n", w / h }'
+}
+
+# Ken Burns working frame "width height": the output size oversampled 2x, so
+# moves have pixels to spare before the final lanczos scale
+get_working_frame() {
+    echo "$((${DEFAULT_RESOLUTION%x*} * 2)) $((${DEFAULT_RESOLUTION#*x} * 2))"
+}
+
+# WIDTHxHEIGHT for a named resolution (1080p, vertical_1080, ...) or a literal size
+resolve_resolution() {
+    case "$1" in
+        480p) echo "854x480" ;;
+        720p) echo "1280x720" ;;
+        1080p) echo "1920x1080" ;;
+        1440p) echo "2560x1440" ;;
+        2160p|4k) echo "3840x2160" ;;
+        vertical_720) echo "720x1280" ;;
+        vertical_1080) echo "1080x1920" ;;
+        square_1080) echo "1080x1080" ;;
+        *) echo "$1" ;;
+    esac
+}
+
+# Why a resolution cannot be encoded (not WIDTHxHEIGHT, odd or out of range), or nothing
+get_resolution_problem() {
+    local resolution="$1"
+    local width="${resolution%x*}" height="${resolution#*x}"
+    if [[ ! "$resolution" =~ ^[0-9]+x[0-9]+$ ]]; then
+        echo "is not WIDTHxHEIGHT or a known name"
+    elif [ $((width % 2)) -ne 0 ] || [ $((height % 2)) -ne 0 ]; then
+        echo "has an odd dimension, which yuv420p cannot encode"
+    elif [ "$width" -lt "$MIN_OUTPUT_SIDE" ] || [ "$height" -lt "$MIN_OUTPUT_SIDE" ] || \
+        [ $((width * height)) -gt "$MAX_OUTPUT_PIXELS" ]; then
+        echo "must be at least ${MIN_OUTPUT_SIDE}px per side and at most $MAX_OUTPUT_PIXELS pixels"
+    fi
+}
+
+# Record a 422 rejection for an unusable resolution
+reject_invalid_resolution() {
+    local requested="$1"
+    local problem="$2"
+    
+    log "ERROR: Resolution '$requested' $problem" >&2
+    record_rejection 422 "$(./jq -nc --arg resolution "$requested" --arg problem "$problem" '{
+        error: "invalid_resolution",
+        error_type: "InvalidResolution",
+        message: "Resolution \($resolution) \($problem)",
+        resolution: $resolution
+    }')"
+}
+
+# Output format (options.format): "vertical" renders 1080x1920 for Shorts, Reels
+# and TikTok; options.resolution (WIDTHxHEIGHT or a name like 720p) overrides it
+# Segments and the combine both apply it so their sizes match; sizes yuv420p
+# cannot encode (odd or out of range) are rejected
+apply_output_format() {
+    case "$(get_option "format" "landscape")" in
+        vertical)
+            DEFAULT_RESOLUTION="1080x1920"
+            ;;
+    esac
+    
+    local requested=$(get_option "resolution" "")
+    if [ -z "$requested" ]; then
+        return 0
+    fi
+    local resolution=$(resolve_resolution "$requested")
+    local problem=$(get_resolution_problem "$resolution")
+    if [ -n "$problem" ]; then
+        reject_invalid_resolution "$requested" "$problem"
+        return 1
+    fi
+    DEFAULT_RESOLUTION="$resolution"
+}
+
+# Rejects any options.renditions entry that cannot be encoded before work starts
+validate_renditions() {
+    local rendition
+    while IFS= read -r rendition; do
+        [ -z "$rendition" ] && continue
+        local problem=$(get_resolution_problem "$(resolve_resolution "$rendition")")
+        if [ -n "$problem" ]; then
+            reject_invalid_resolution "$rendition" "$problem"
+            return 1
+        fi
+    done <<< "$(get_option_json "renditions" | ./jq -r 'if type == "array" then .[] | tostring else empty end')"
+}
+
+# Tonemap an HDR10 master to an SDR BT.709 H.264 copy (Hable curve), upload it
+# next to the master and print the sdr_video_s3_key field; the copy stays at
+# sdr_video for the renditions
+encode_sdr_fallback() {
+    local project_id="$1"
+    local final_video="$2"
+    local sdr_video="$3"
+    local download_filename="$4"
+    
+    log "Tonemapping SDR fallback..." >&2
+    ffmpeg -i "$final_video" \
+        -map 0:v -map "0:a?" \
+        -vf "zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709,tonemap=tonemap=hable:desat=0,zscale=t=bt709:m=bt709:r=tv,format=yuv420p" \
+        -c:v libx264 -preset "$(get_encode_preset)" $(get_encode_rate_args crf) \
+        -color_primaries bt709 -color_trc bt709 -colorspace bt709 \
+        -c:a copy -movflags +faststart -threads 2 \
+        -y "$sdr_video" >&2 || {
+        record_warning "sdr_fallback_failed" "The SDR fallback could not be tonemapped from the HDR master"
+        rm -f "$sdr_video"
+        return 0
+    }
+    
+    local sdr_s3_key=$(get_rendition_s3_key "$project_id" "sdr")
+    local sdr_filename=""
+    if [ -n "$download_filename" ]; then
+        sdr_filename="${download_filename%.*}_sdr.mp4"
+    fi
+    if upload_s3_file "$sdr_video" "$sdr_s3_key" "$sdr_filename" >&2; then
+        echo ",\"sdr_video_s3_key\":\"$sdr_s3_key\""
+    else
+        record_warning "sdr_fallback_failed" "The SDR fallback could not be uploaded"
+    fi
+}
+
+# Looping motion previews of the final video (options.preview: "gif", "webp" or
+# both in an array), options.preview_duration seconds (5, at most 30) from
+# options.preview_start (0) at options.preview_width pixels wide (480, 32-1280),
+# uploaded under previews/; prints preview_gif_s3_key / preview_webp_s3_key
+render_previews() {
+    local project_id="$1"
+    local source_video="$2"
+    
+    local formats=$(get_option_json "preview" | ./jq -r '(if type == "array" then .[] elif . == true then "gif" else . end)
+        | strings | ascii_downcase | select(. == "gif" or . == "webp")' | awk '!seen[$0]++')
+    [ -z "$formats" ] && return 0
+    
+    local start=$(get_option "preview_start" "0")
+    local duration=$(get_option "preview_duration" "5")
+    local width=$(get_option "preview_width" "480")
+    if [[ ! "$start" =~ ^[0-9]+(\.[0-9]+)?$ ]]; then
+        record_warning "invalid_preview" "preview_start '$start' is not a number of seconds; using 0"
+        start="0"
+    fi
+    if [[ ! "$duration" =~ ^[0-9]+(\.[0-9]+)?$ ]] || ! awk -v d="$duration" 'BEGIN { exit !(d > 0 && d <= 30) }'; then
+        record_warning "invalid_preview" "preview_duration '$duration' is not between 0 and 30 seconds; using 5"
+        duration="5"
+    fi
+    if [[ ! "$width" =~ ^[0-9]+$ ]] || [ "$width" -lt 32 ] || [ "$width" -gt 1280 ]; then
+        record_warning "invalid_preview" "preview_width '$width' is not a whole number of pixels from 32 to 1280; using 480"
+        width="480"
+    fi
+    # Previews play at a reduced rate to stay small
+    local scale="fps=12,scale=$width:-2:flags=lanczos"
+    
+    local fields="" format
+    for format in $formats; do
+        local preview="$TEMP_DIR/preview.$format"
+        local s3_key="previews/${project_id}_preview.$format"
+        local status=0
+        log "Rendering ${duration}s $format preview..." >&2
+        if [ "$format" = "gif" ]; then
+            # A palette generated from the clip itself keeps the 256 colours faithful
+            ffmpeg -ss "$start" -t "$duration" -i "$source_video" \
+                -filter_complex "[0:v]$scale,split[preview][palette_source];[palette_source]palettegen=stats_mode=diff[palette];[preview][palette]paletteuse=dither=bayer:bayer_scale=4" \
+                -loop 0 -an -y "$preview" >&2 || status=1
+        elif has_ffmpeg_encoder "libwebp_anim" || has_ffmpeg_encoder "libwebp"; then
+            ffmpeg -ss "$start" -t "$duration" -i "$source_video" \
+                -vf "$scale" -c:v libwebp -lossless 0 -quality 70 -loop 0 -an -y "$preview" >&2 || status=1
+        else
+            record_warning "preview_failed" "This ffmpeg build has no WebP encoder; skipped the webp preview"
+            continue
+        fi
+        
+        if [ "$status" -eq 0 ] && upload_s3_file "$preview" "$s3_key" >&2; then
+            fields+=",\"preview_${format}_s3_key\":\"$s3_key\""
+        else
+            record_warning "preview_failed" "The $format preview could not be rendered or uploaded"
+        fi
+        rm -f "$preview"
+    done
+    echo "$fields"
+}
+
+# Poster JPEG for the final video (options.poster: seconds into the video, or
+# "best"/true for the most representative frame of a 1fps sample via the thumbnail
+# filter), uploaded as videos/<project>_poster.jpg; prints poster_s3_key
+render_poster() {
+    local project_id="$1"
+    local source_video="$2"
+    local duration="$3"
+    
+    local poster=$(get_option "poster" "")
+    if [ -z "$poster" ] || [ "$poster" = "false" ]; then
+        return 0
+    fi
+    
+    local poster_file="$TEMP_DIR/poster.jpg"
+    local s3_key="videos/${project_id}_poster.jpg"
+    local status=0
+    if [[ "$poster" =~ ^[0-9]+(\.[0-9]+)?$ ]]; then
+        log "Extracting poster frame at ${poster}s..." >&2
+        ffmpeg -ss "$poster" -i "$source_video" -frames:v 1 -q:v 2 -y "$poster_file" >&2 || status=1
+    else
+        # One sample per second, at most 300, in a single thumbnail batch. The filter
+        # buffers the whole batch, so it picks on small frames and the chosen
+        # timestamp is then extracted at full size
+        local samples=$(awk -v d="$duration" 'BEGIN { n = int(d); if (n < 1) n = 1; if (n > 300) n = 300; print n }')
+        log "Picking the best poster frame from $samples samples..." >&2
+        local best=$(ffmpeg -i "$source_video" -vf "fps=$samples/$duration,scale=160:-2,thumbnail=n=$samples,showinfo" \
+            -frames:v 1 -f null - 2>&1 | sed -n 's/.*pts_time:\([0-9.]*\).*/\1/p' | head -n 1)
+        if [ -n "$best" ]; then
+            ffmpeg -ss "$best" -i "$source_video" -frames:v 1 -q:v 2 -y "$poster_file" >&2 || status=1
+        else
+            status=1
+        fi
+    fi
+    
+    if [ "$status" -eq 0 ] && [ -s "$poster_file" ] && upload_s3_file "$poster_file" "$s3_key" >&2; then
+        echo ",\"poster_s3_key\":\"$s3_key\""
+    else
+        record_warning "poster_failed" "The poster frame could not be extracted or uploaded"
+    fi
+    rm -f "$poster_file"
+}
+
+# Scrubber thumbnails (options.thumbnails): one sprite sheet of
+# options.thumbnail_width (160, 32-640) wide tiles, ten per row, every
+# options.thumbnail_interval seconds (5, widened to keep at most 100 tiles), plus a
+# WebVTT track pointing into it with #xywh fragments; prints the sprite and track keys
+render_thumbnail_sprites() {
+    local project_id="$1"
+    local source_video="$2"
+    local duration="$3"
+    
+    if [ "$(get_option "thumbnails" "false")" != "true" ]; then
+        return 0
+    fi
+    
+    local columns=10
+    local tile_width=$(get_option "thumbnail_width" "160")
+    if [[ ! "$tile_width" =~ ^[0-9]+$ ]] || [ "$tile_width" -lt 32 ] || [ "$tile_width" -gt 640 ]; then
+        record_warning "invalid_thumbnails" "thumbnail_width '$tile_width' is not a whole number of pixels from 32 to 640; using 160"
+        tile_width="160"
+    fi
+    local thumbnail_interval=$(get_option "thumbnail_interval" "5")
+    if [[ ! "$thumbnail_interval" =~ ^[0-9]+(\.[0-9]+)?$ ]] || ! awk -v i="$thumbnail_interval" 'BEGIN { exit !(i > 0) }'; then
+        record_warning "invalid_thumbnails" "thumbnail_interval '$thumbnail_interval' is not a positive number of seconds; using 5"
+        thumbnail_interval="5"
+    fi
+    local tile_height=$(awk -v w="${DEFAULT_RESOLUTION%x*}" -v h="${DEFAULT_RESOLUTION#*x}" -v t="$tile_width" \
+        'BEGIN { printf "%d", int(t * h / w / 2 + 0.5) * 2 }')
+    local interval count rows
+    read interval count rows <<< "$(awk -v d="$duration" -v i="$thumbnail_interval" -v c="$columns" 'BEGIN {
+        if (d / i > 100) i = d / 100
+        n = int(d / i); if (n * i < d) n++; if (n < 1) n = 1
+        printf "%.3f %d %d", i, n, int((n + c - 1) / c)
+    }')"
+    
+    local sprite_file="$TEMP_DIR/thumbnails.jpg"
+    local vtt_file="$TEMP_DIR/thumbnails.vtt"
+    local sprite_key="videos/${project_id}_thumbnails.jpg"
+    local vtt_key="videos/${project_id}_thumbnails.vtt"
+    
+    log "Rendering $count scrubber thumbnails every ${interval}s..." >&2
+    if ! ffmpeg -i "$source_video" \
+        -vf "fps=1/$interval,scale=$tile_width:$tile_height:flags=lanczos,tile=${columns}x$rows" \
+        -frames:v 1 -q:v 4 -y "$sprite_file" >&2; then
+        record_warning "thumbnails_failed" "The thumbnail sprite sheet could not be rendered"
+        rm -f "$sprite_file"
+        return 0
+    fi
+    
+    # Cues reference the sprite by its file name, which sits next to the track in S3
+    awk -v d="$duration" -v i="$interval" -v n="$count" -v c="$columns" -v w="$tile_width" -v h="$tile_height" \
+        -v sprite="$(basename "$sprite_key")" '
+        function stamp(t) { return sprintf("%02d:%02d:%06.3f", int(t / 3600), int(t % 3600 / 60), t - int(t / 60) * 60) }
+        BEGIN {
+            print "WEBVTT"
+            for (k = 0; k < n; k++) {
+                start = k * i; end = (k + 1) * i; if (end > d) end = d
+                printf "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n", stamp(start), stamp(end), sprite, (k % c) * w, int(k / c) * h, w, h
+            }
+        }' > "$vtt_file"
+    
+    if upload_s3_file "$sprite_file" "$sprite_key" >&2 && upload_s3_file "$vtt_file" "$vtt_key" >&2; then
+        echo ",\"thumbnails_sprite_s3_key\":\"$sprite_key\",\"thumbnails_vtt_s3_key\":\"$vtt_key\""
+    else
+        record_warning "thumbnails_failed" "The thumbnail sprite sheet or track could not be uploaded"
+    fi
+    rm -f "$sprite_file" "$vtt_file"
+}
+
+# Encoder settings and the 1080p24 bitrate (Mbit/s, for /tmp sizing) of a mezzanine codec
+get_mezzanine_profile() {
+    case "$1" in
+        prores_422)
+            echo "117 prores_ks -c:v prores_ks -profile:v 2 -vendor apl0 -pix_fmt yuv422p10le"
+            ;;
+        dnxhr_hq)
+            echo "116 dnxhd -c:v dnxhd -profile:v dnxhr_hq -pix_fmt yuv422p"
+            ;;
+    esac
+}
+
+# Export an editing master (options.mezzanine: "prores_422" or "dnxhr_hq") as
+# videos/<project>_mezzanine.mov with PCM audio; prints mezzanine_s3_key
+# These run to gigabytes, so when /tmp cannot hold the estimated size the .mov is
+# written fragmented and streamed to S3 as a multipart upload instead
+export_mezzanine() {
+    local project_id="$1"
+    local final_video="$2"
+    local duration="$3"
+    
+    local mezzanine=$(get_option "mezzanine" "")
+    [ -z "$mezzanine" ] && return 0
+    local profile=$(get_mezzanine_profile "$mezzanine")
+    if [ -z "$profile" ]; then
+        record_warning "mezzanine_failed" "Unknown mezzanine '$mezzanine'; use prores_422 or dnxhr_hq"
+        return 0
+    fi
+    local mbps encoder codec_args
+    read mbps encoder codec_args <<< "$profile"
+    if ! has_ffmpeg_encoder "$encoder"; then
+        record_warning "mezzanine_failed" "This ffmpeg build has no $encoder encoder; skipped the $mezzanine mezzanine"
+        return 0
+    fi
+    
+    local expected_bytes=$(awk -v m="$mbps" -v w="${DEFAULT_RESOLUTION%x*}" -v h="${DEFAULT_RESOLUTION#*x}" \
+        -v fps="$DEFAULT_FPS" -v d="$duration" 'BEGIN { printf "%.0f", m * 125000 * w * h / 2073600 * fps / 24 * d * 1.1 }')
+    local available_bytes=$(($(df /tmp | tail -1 | awk '{print $4}') * 1024))
+    local s3_key="videos/${project_id}_mezzanine.mov"
+    
+    log "Exporting $mezzanine mezzanine (~$((expected_bytes / 1048576))MB)..." >&2
+    if [ "$expected_bytes" -lt $((available_bytes * 3 / 4)) ]; then
+        local mezzanine_file="$TEMP_DIR/final_video_mezzanine.mov"
+        if ffmpeg -i "$final_video" -map 0:v -map "0:a?" $codec_args -c:a pcm_s16le -threads 2 -y "$mezzanine_file" >&2 && \
+            upload_s3_file "$mezzanine_file" "$s3_key" >&2; then
+            rm -f "$mezzanine_file"
+            echo ",\"mezzanine_s3_key\":\"$s3_key\""
+            return 0
+        fi
+        rm -f "$mezzanine_file"
+    else
+        # A stream cannot be replayed, so the upload is one attempt (counted in the S3
+        # metrics like s3_with_retry's), and a failed encode deletes the truncated object
+        log "Streaming the mezzanine to S3 (${available_bytes} bytes free in /tmp)" >&2
+        ffmpeg -i "$final_video" -map 0:v -map "0:a?" $codec_args -c:a pcm_s16le -threads 2 \
+            -movflags frag_keyframe+empty_moov -f mov pipe:1 | \
+            AWS_MAX_ATTEMPTS=1 aws s3 cp - "s3://$BUCKET_NAME/$s3_key" \
+                --expected-size "$expected_bytes" --content-type "$(get_content_type "$s3_key")" >&2
+        local statuses=("${PIPESTATUS[@]}")
+        if [ "${statuses[0]}" -eq 0 ] && [ "${statuses[1]}" -eq 0 ]; then
+            echo "1 ok" >> "$S3_METRICS_FILE"
+            echo ",\"mezzanine_s3_key\":\"$s3_key\""
+            return 0
+        fi
+        echo "1 failed" >> "$S3_METRICS_FILE"
+        if [ "${statuses[1]}" -eq 0 ]; then
+            s3_with_retry s3 rm "s3://$BUCKET_NAME/$s3_key" > /dev/null || \
+                log "Warning: Could not delete the truncated mezzanine $s3_key" >&2
+        fi
+    fi
+    record_warning "mezzanine_failed" "The $mezzanine mezzanine could not be encoded or uploaded"
+}
+
+# ABR ladder for streaming packages as "WIDTHxHEIGHT kbps" lines: up to three rungs
+# (short side 1080, 720, 480, 360) no larger than the output, keeping its aspect
+get_abr_ladder() {
+    local width="${DEFAULT_RESOLUTION%x*}" height="${DEFAULT_RESOLUTION#*x}"
+    awk -v w="$width" -v h="$height" -v fps="$DEFAULT_FPS" 'BEGIN {
+        short = (w < h) ? w : h
+        split("1080 720 480 360", sides, " ")
+        split("5000 2800 1400 800", rates, " ")
+        # High frame rates need more bits for the same quality
+        factor = (fps > 30) ? 1.5 : 1
+        for (i = 1; i <= 4 && count < 3; i++) {
+            if (sides[i] > short && !(i == 4 && count == 0)) continue
+            side = (sides[i] < short) ? sides[i] : short
+            printf "%dx%d %d\n", int(w * side / short / 2 + 0.5) * 2, int(h * side / short / 2 + 0.5) * 2, rates[i] * factor
+            count++
+        }
+    }'
+}
+
+# Streaming formats requested by options.packaging ("hls", "dash" or both in an array)
+get_packaging_formats() {
+    get_option_json "packaging" | ./jq -r '(if type == "array" then .[] else . end) | strings
+        | ascii_downcase | select(. == "hls" or . == "dash")' | awk '!seen[$0]++'
+}
+
+# Upload every file under a local package directory to the same layout under an S3 prefix
+upload_package_dir() {
+    local package_dir="$1"
+    local s3_prefix="$2"
+    local file
+    
+    while IFS= read -r file; do
+        upload_s3_file "$file" "$s3_prefix/${file#$package_dir/}" >&2 || return 1
+    done < <(find "$package_dir" -type f | sort)
+}
+
+# Package the final video as HLS (fMP4 segments, master.m3u8) and/or DASH
+# (manifest.mpd) with the ABR ladder, uploaded under videos/<project>/hls/ and
+# videos/<project>/dash/; prints the hls/dash fields with playlist keys and bitrates
+package_streaming_outputs() {
+    local project_id="$1"
+    local source_video="$2"
+    
+    local formats=$(get_packaging_formats)
+    [ -z "$formats" ] && return 0
+    
+    local sizes=() rates=() size rate
+    while read -r size rate; do
+        sizes+=("$size")
+        rates+=("$rate")
+    done <<< "$(get_abr_ladder)"
+    local count=${#sizes[@]}
+    
+    local has_audio="false"
+    if ffprobe -v error -select_streams a -show_entries stream=index -of csv=p=0 "$source_video" 2>/dev/null | grep -q .; then
+        has_audio="true"
+    fi
+    
+    local filter="[0:v]split=$count" i
+    for ((i = 0; i < count; i++)); do
+        filter+="[s$i]"
+    done
+    local video_args=()
+    for ((i = 0; i < count; i++)); do
+        filter+=";[s$i]scale=${sizes[$i]%x*}:${sizes[$i]#*x}:flags=lanczos,setsar=1[o$i]"
+        video_args+=(-b:v:$i "${rates[$i]}k" -maxrate:v:$i "$((rates[$i] * 107 / 100))k" -bufsize:v:$i "$((rates[$i] * 3 / 2))k")
+    done
+    local encode_args=(-c:v libx264 -preset "$(get_encode_preset)" -profile:v high -pix_fmt yuv420p
+        -g $((DEFAULT_FPS * 2)) -keyint_min $DEFAULT_FPS -sc_threshold 0 "${video_args[@]}"
+        -c:a aac -b:a 128k -threads 2)
+    
+    local fields="" ladder_json=$(for ((i = 0; i < count; i++)); do
+        echo "${sizes[$i]} ${rates[$i]}"
+    done | ./jq -Rsc 'split("\n") | map(select(. != "") | split(" ") | {resolution: .[0], bitrate_kbps: (.[1] | tonumber)})')
+    local format
+    for format in $formats; do
+        log "Packaging $format with $count renditions..." >&2
+        local package_dir="$TEMP_DIR/package_$format"
+        local s3_prefix="videos/$project_id/$format"
+        rm -rf "$package_dir"
+        mkdir -p "$package_dir"
+        
+        local maps=() stream_map=() playlist_key status=0
+        for ((i = 0; i < count; i++)); do
+            maps+=(-map "[o$i]")
+        done
+        if [ "$format" = "hls" ]; then
+            # Each variant carries its own copy of the audio
+            for ((i = 0; i < count; i++)); do
+                if [ "$has_audio" = "true" ]; then
+                    maps+=(-map 0:a:0)
+                    stream_map+=("v:$i,a:$i")
+                else
+                    stream_map+=("v:$i")
+                fi
+            done
+            ffmpeg -i "$source_video" -filter_complex "$filter" "${maps[@]}" "${encode_args[@]}" \
+                -f hls -hls_time 6 -hls_playlist_type vod -hls_segment_type fmp4 -hls_flags independent_segments \
+                -master_pl_name master.m3u8 -hls_fmp4_init_filename "v%v_init.mp4" \
+                -hls_segment_filename "$package_dir/v%v_%03d.m4s" \
+                -var_stream_map "${stream_map[*]}" -y "$package_dir/v%v.m3u8" >&2 || status=1
+            playlist_key="$s3_prefix/master.m3u8"
+        else
+            local adaptation_sets="id=0,streams=v"
+            if [ "$has_audio" = "true" ]; then
+                maps+=(-map 0:a:0)
+                adaptation_sets+=" id=1,streams=a"
+            fi
+            ffmpeg -i "$source_video" -filter_complex "$filter" "${maps[@]}" "${encode_args[@]}" \
+                -f dash -seg_duration 6 -use_template 1 -use_timeline 1 \
+                -adaptation_sets "$adaptation_sets" -y "$package_dir/manifest.mpd" >&2 || status=1
+            playlist_key="$s3_prefix/manifest.mpd"
+        fi
+        
+        if [ "$status" -eq 0 ] && upload_package_dir "$package_dir" "$s3_prefix"; then
+            local key_field="playlist_s3_key"
+            [ "$format" = "dash" ] && key_field="manifest_s3_key"
+            fields+=",\"$format\":{\"$key_field\":\"$playlist_key\",\"renditions\":$ladder_json}"
+        else
+            record_warning "packaging_failed" "The $format package could not be encoded or uploaded"
+        fi
+        rm -rf "$package_dir"
+    done
+    echo "$fields"
+}
+
+# S3 key of a rendition of the final video, e.g. videos/<project>_final_video_720p.mp4
+get_rendition_s3_key() {
+    local project_id="$1"
+    local rendition="$2"
+    echo "videos/${project_id}_final_video_$(echo "$rendition" | tr -c 'A-Za-z0-9_\n' '_').mp4"
+}
+
+# Encode every options.renditions size from the combined master in a single ffmpeg
+# pass (split, cover-crop, scale), upload each and print the renditions field
+# Audio tracks are copied; a rendition at the master size reuses the master upload
+encode_renditions() {
+    local project_id="$1"
+    local final_video="$2"
+    local final_s3_key="$3"
+    local download_filename="$4"
+    
+    local renditions=$(get_option_json "renditions" | ./jq -r 'if type == "array" then .[] | tostring else empty end' | awk '!seen[$0]++')
+    [ -z "$renditions" ] && return 0
+    
+    local names=() sizes=() keys=() outputs=() encoded=()
+    local rendition
+    while IFS= read -r rendition; do
+        [ -z "$rendition" ] && continue
+        names+=("$rendition")
+        sizes+=("$(resolve_resolution "$rendition")")
+        if [ "${sizes[-1]}" = "$DEFAULT_RESOLUTION" ]; then
+            keys+=("$final_s3_key")
+        else
+            keys+=("$(get_rendition_s3_key "$project_id" "$rendition")")
+            encoded+=($((${#names[@]} - 1)))
+        fi
+    done <<< "$renditions"
+    
+    if [ ${#encoded[@]} -gt 0 ]; then
+        log "Encoding ${#encoded[@]} renditions from the master..." >&2
+        local filter="[0:v]split=${#encoded[@]}"
+        local i
+        for i in "${encoded[@]}"; do
+            filter+="[s$i]"
+        done
+        local output_args=()
+        for i in "${encoded[@]}"; do
+            local width="${sizes[$i]%x*}" height="${sizes[$i]#*x}"
+            filter+=";[s$i]scale=$width:$height:force_original_aspect_ratio=increase:flags=lanczos,crop=$width:$height,setsar=1[r$i]"
+            outputs[$i]="$TEMP_DIR/final_video_rendition_$i.mp4"
+            output_args+=(-map "[r$i]" -map "0:a?" -c:v libx264 -preset "$(get_encode_preset)" $(get_encode_rate_args crf) \
+                -pix_fmt yuv420p -c:a copy -movflags +faststart -threads 2 "${outputs[$i]}")
+        done
+        ffmpeg -y -i "$final_video" -filter_complex "$filter" "${output_args[@]}" >&2 || {
+            log "Warning: Rendition encode failed" >&2
+            record_warning "rendition_failed" "Renditions could not be encoded from the master"
+            rm -f "${outputs[@]}"
+            return 1
+        }
+        for i in "${encoded[@]}"; do
+            local rendition_filename=""
+            if [ -n "$download_filename" ]; then
+                rendition_filename="${download_filename%.*}_${names[$i]}.mp4"
+            fi
+            upload_s3_file "${outputs[$i]}" "${keys[$i]}" "$rendition_filename" >&2 || keys[$i]=""
+            rm -f "${outputs[$i]}"
+        done
+    fi
+    
+    local fields=()
+    for i in "${!names[@]}"; do
+        if [ -n "${keys[$i]}" ]; then
+            fields+=("$(./jq -nc --arg name "${names[$i]}" --arg resolution "${sizes[$i]}" --arg key "${keys[$i]}" \
+                '{name: $name, resolution: $resolution, video_s3_key: $key}')")
+        else
+            record_warning "rendition_failed" "Rendition ${names[$i]} could not be uploaded"
+        fi
+    done
+    echo ",\"renditions\":[$(IFS=,; echo "${fields[*]}")]"
+}
+
+# Write overlay text to a temp file so drawtext never needs filter escaping
+write_overlay_text() {
+    local name="$1"
+    local text="$2"
+    local path="$TEMP_DIR/${name}.txt"
+    
+    printf '%s' "$text" > "$path"
+    echo "$path"
+}
+
+# Word-wrap text to a number of columns per line; fold counts bytes and wraps
+# non-Latin text early. Characters are counted from UTF-8 lead bytes so this works
+# under any locale and awk; CJK and Hangul (U+3000-U+DFFF) take two columns, and
+# words longer than a line are split between characters
+wrap_text() {
+    local text="$1"
+    local columns="$2"
+    
+    printf '%s\n' "$text" | LC_ALL=C awk -v width="$columns" '
+        function chars(s,   t, u) {
+            t = s; u = s
+            return length(s) - gsub(/[\200-\277]/, "", t) + gsub(/[\343-\355]/, "", u)
+        }
+        function head(s, n,   i, c, count) {
+            for (i = 1; i <= length(s); i++) {
+                c = substr(s, i, 1)
+                if (c ~ /[\200-\277]/) {
+                    continue
+                }
+                count += (c ~ /[\343-\355]/) ? 2 : 1
+                if (count > n) {
+                    break
+                }
+            }
+            return substr(s, 1, i - 1)
+        }
+        BEGIN { if (width < 2) width = 2 }
+        {
+            line = ""; used = 0
+            for (i = 1; i <= NF; i++) {
+                word = $i
+                while (chars(word) > width) {
+                    if (used > 0) {
+                        print line; line = ""; used = 0
+                    }
+                    part = head(word, width)
+                    print part
+                    word = substr(word, length(part) + 1)
+                }
+                if (used == 0) {
+                    line = word; used = chars(word)
+                } else if (used + 1 + chars(word) <= width) {
+                    line = line " " word; used += 1 + chars(word)
+                } else {
+                    print line; line = word; used = chars(word)
+                }
+            }
+            print line
+        }'
+}
+
+# Build a drawtext filter reading from a text file
+# Extra drawtext options (colors, box, alpha) are appended verbatim
+build_drawtext_filter() {
+    local text_file="$1"
+    local font_size="$2"
+    local x="$3"
+    local y="$4"
+    local extra="$5"
+    local font_file="${6:-$FONT_FILE}"
+    local font_color=$(get_palette_color text "${7:-white}")
+    
+    # High contrast keeps boxes opaque black and outlines unboxed text
+    if is_high_contrast; then
+        if [[ "$extra" == *"box=1"* ]]; then
+            extra=$(echo "$extra" | sed "s/boxcolor=[^:]*/boxcolor=$HIGH_CONTRAST_BACKGROUND/")
+        else
+            extra="${extra:+$extra:}borderw=$((font_size / 12 + 1)):bordercolor=$HIGH_CONTRAST_BACKGROUND"
+        fi
+    fi
+    
+    # Complex scripts (Arabic, Hebrew) need libass shaping and bidi; emoji need
+    # libass font switching since drawtext has no glyph fallback
+    if [ "$(get_option "text_renderer" "auto")" = "ass" ] || text_needs_shaping "$text_file" || text_has_emoji "$text_file"; then
+        local ass_filter=$(build_ass_text_filter "$text_file" "$font_size" "$x" "$y" "$extra" "$font_color")
+        if [ -n "$ass_filter" ]; then
+            echo "$ass_filter"
+            return 0
+        fi
+    fi
+    
+    local filter="drawtext=fontfile=$font_file:textfile=$text_file:fontsize=$font_size:fontcolor=$font_color:x=$x:y=$y"
+    if [ -n "$extra" ]; then
+        filter="$filter:$extra"
+    fi
+    echo "$filter"
+}
+
+# Detect right-to-left scripts by their UTF-8 lead bytes (Hebrew, Arabic, presentation forms)
+text_needs_shaping() {
+    local text_file="$1"
+    LC_ALL=C grep -qE $'[\xd6-\xdf]|\xe0[\xa0-\xa3]|\xef[\xac-\xb7\xb9-\xbb]' "$text_file" 2>/dev/null
+}
+
+# Detect emoji (pictographs, misc symbols, dingbats) by their UTF-8 byte sequences
+EMOJI_PATTERN=$'(\xf0\x9f[\x80-\xab][\x80-\xbf]|\xe2[\x98-\x9e][\x80-\xbf]|\xe2\x80\x8d|\xef\xb8\x8f)'
+
+text_has_emoji() {
+    local text_file="$1"
+    LC_ALL=C grep -qE "$EMOJI_PATTERN" "$text_file" 2>/dev/null
+}
+
+# Wrap emoji runs in ASS overrides selecting the bundled Noto Emoji font
+# libass cannot draw color bitmap glyphs, so emoji render as outlines in the text color
+wrap_emoji_runs() {
+    LC_ALL=C sed -E "s/${EMOJI_PATTERN}+/{\\\\fnNoto Emoji}&{\\\\fn}/g"
+}
+
+# Convert a drawtext color (name or 0xRRGGBB, optional @alpha) to an ASS &HAABBGGRR& value
+ass_color() {
+    local color="$1"
+    
+    echo "$color" | awk -F@ '{
+        n = split("white=FFFFFF black=000000 red=FF0000 yellow=FFFF00 green=00FF00 blue=0000FF", names, " ")
+        rgb = "FFFFFF"
+        for (i = 1; i <= n; i++) { split(names[i], kv, "="); if (kv[1] == $1) rgb = kv[2] }
+        if ($1 ~ /^(0x|#)/) rgb = toupper(substr($1, length($1) - 5))
+        alpha = ($2 == "") ? 0 : int((1 - $2) * 255 + 0.5)
+        printf "&H%02X%s%s%s&\n", alpha, substr(rgb, 5, 2), substr(rgb, 3, 2), substr(rgb, 1, 2)
+    }'
+}
+
+# Evaluate a static drawtext position expression (w, h, tw=th=0, + - * /)
+evaluate_position() {
+    local expression="$1"
+    local width="${DEFAULT_RESOLUTION%x*}"
+    local height=$(get_output_height)
+    
+    expression="${expression//\'/}"
+    expression="${expression//tw/0}"
+    expression="${expression//th/0}"
+    expression="${expression//w/$width}"
+    expression="${expression//h/$height}"
+    awk "BEGIN { printf \"%d\", $expression }" 2>/dev/null
+}
+
+# Render static text through libass so bidi and shaping are handled correctly
+# Alignment is inferred from the (w-tw)/2 and w-tw idioms; animated positions
+# (anything using t or functions) and ffmpeg builds without libass print nothing
+# so callers fall back to drawtext
+build_ass_text_filter() {
+    local text_file="$1"
+    local font_size="$2"
+    local x="$3"
+    local y="$4"
+    local extra="$5"
+    local font_color="$6"
+    local width="${DEFAULT_RESOLUTION%x*}"
+    local height=$(get_output_height)
+    
+    if [[ "$(echo "$x$y" | sed -e 's/tw\|th\|w\|h//g')" =~ [a-z] ]] || ! has_ffmpeg_filter "ass"; then
+        return 0
+    fi
+    
+    local horizontal=1 vertical=7
+    case "$x" in
+        *"(w-tw)/2"*) horizontal=2 ;;
+        *"w-tw"*) horizontal=3 ;;
+    esac
+    case "$y" in
+        *"(h-th)/2"*) vertical=4 ;;
+        *"h-th"*) vertical=1 ;;
+    esac
+    local alignment=$((vertical + horizontal - 1))
+    local px=$(evaluate_position "$x")
+    local py=$(evaluate_position "$y")
+    if [ -z "$px" ] || [ -z "$py" ]; then
+        return 0
+    fi
+    
+    local fade=""
+    if [[ "$extra" == *"alpha='min(1,t/"* ]]; then
+        fade='\fad(500,0)'
+    fi
+    local border_style=1 back_color="&H80000000&"
+    if [[ "$extra" == *"box=1"* ]]; then
+        border_style=3
+        local box_color=$(echo "$extra" | grep -o 'boxcolor=[^:]*' | cut -d= -f2)
+        back_color=$(ass_color "${box_color:-black@0.55}")
+    fi
+    
+    local font_name=$(get_option "font_family" "Noto Sans")
+    if LC_ALL=C grep -qE $'[\xd8-\xdb]|\xef[\xad-\xb7\xb9-\xbb]' "$text_file" 2>/dev/null; then
+        font_name="Noto Sans Arabic"
+    elif LC_ALL=C grep -qE $'[\xd6-\xd7]|\xef\xac' "$text_file" 2>/dev/null; then
+        font_name="Noto Sans Hebrew"
+    fi
+    
+    # Escape ASS override braces and backslashes; newlines become \N
+    local text=$(sed -e 's/\\/\\\\/g' -e 's/{/\\{/g' -e 's/}/\\}/g' "$text_file" | awk 'NR > 1 { printf "\\N" } { printf "%s", $0 }' | wrap_emoji_runs)
+    local ass_file="${text_file%.txt}.ass"
+    cat > "$ass_file" << EOF
+[Script Info]
+ScriptType: v4.00+
+PlayResX: $width
+PlayResY: $height
+WrapStyle: 2
+    
+[V4+ Styles]
+Format: Name, Fontname, Fontsize, PrimaryColour, SecondaryColour, OutlineColour, BackColour, Bold, Italic, Underline, StrikeOut, ScaleX, ScaleY, Spacing, Angle, BorderStyle, Outline, Shadow, Alignment, MarginL, MarginR, MarginV, Encoding
+Style: Overlay,$font_name,$font_size,$(ass_color "$font_color"),&H000000FF&,$back_color,$back_color,0,0,0,0,100,100,0,0,$border_style,$((font_size / 6)),0,$alignment,0,0,0,1
+    
+[Events]
+Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text
+Dialogue: 0,0:00:00.00,9:59:59.00,Overlay,,0,0,0,,{\an$alignment\pos($px,$py)$fade}$text
+EOF
+    
+    echo "ass=$ass_file:fontsdir=$FONTS_DIR:shaping=complex"
+}
+
+# Room-name lower-third per image plus the persistent listing banner
+get_real_estate_overlay_filter() {
+    local segment_id="$1"
+    local image_json="$2"
+    local height=$(get_output_height)
+    local filters=()
+    
+    local room=$(echo "$image_json" | ./jq -r '.room // (.caption | strings) // empty')
+    if [ -n "$room" ]; then
+        local room_file=$(write_overlay_text "segment_${segment_id}_room" "$room")
+        filters+=("$(build_drawtext_filter "$room_file" $((height / 22)) "w*0.05" "h*0.82" "box=1:boxcolor=black@0.55:boxborderw=$((height / 60)):alpha='min(1,t/0.5)'" "$BOLD_FONT_FILE")")
+    fi
+    
+    # Banner reads price/beds/baths from options.metadata
+    local banner=$(get_option_json "metadata" | ./jq -r '[
+        (.price // empty | tostring),
+        (.beds // empty | "\(.) bd"),
+        (.baths // empty | "\(.) ba"),
+        (.sqft // empty | "\(.) sq ft")
+    ] | join("  |  ")' 2>/dev/null)
+    if [ -n "$banner" ]; then
+        local banner_file=$(write_overlay_text "segment_${segment_id}_banner" "$banner")
+        filters+=("$(build_drawtext_filter "$banner_file" $((height / 30)) "w-tw-w*0.04" "h*0.05" "box=1:boxcolor=0x1f3a5f@0.85:boxborderw=$((height / 72))")")
+    fi
+    
+    local IFS=","
+    echo "${filters[*]}"
+}
+
+# Check whether an overlay spec applies to a segment (no "segments" list means all)
+overlay_applies_to_segment() {
+    local spec="$1"
+    local segment_id="$2"
+    
+    echo "$spec" | ./jq -e --arg id "$segment_id" '(.segments // null) == null or ((.segments | map(tostring)) | index($id)) != null' > /dev/null 2>&1
+}
+
+# Persistent branded lower-third (name/title) and scrolling ticker
+get_news_overlay_filter() {
+    local segment_id="$1"
+    local height=$(get_output_height)
+    local brand_color=$(get_palette_color background "$(get_option "brand_color" "0xc8102e")")
+    local filters=()
+    
+    local lower_third=$(get_option_json "lower_third")
+    if [ "$lower_third" != "null" ] && overlay_applies_to_segment "$lower_third" "$segment_id"; then
+        local name=$(echo "$lower_third" | ./jq -r '.name // empty')
+        local title=$(echo "$lower_third" | ./jq -r '.title // empty')
+        if [ -n "$name" ]; then
+            filters+=("drawbox=x=0:y=ih*0.72:w=iw*0.45:h=ih*0.1:color=$brand_color@0.92:t=fill")
+            filters+=("$(build_drawtext_filter "$(write_overlay_text "segment_${segment_id}_lt_name" "$name")" $((height / 24)) "w*0.03" "h*0.735" "" "$BOLD_FONT_FILE")")
+        fi
+        if [ -n "$title" ]; then
+            filters+=("drawbox=x=0:y=ih*0.82:w=iw*0.45:h=ih*0.055:color=black@0.8:t=fill")
+            filters+=("$(build_drawtext_filter "$(write_overlay_text "segment_${segment_id}_lt_title" "$title")" $((height / 40)) "w*0.03" "h*0.833")")
+        fi
+    fi
+    
+    local ticker=$(get_option_json "ticker")
+    if [ "$ticker" != "null" ] && overlay_applies_to_segment "$ticker" "$segment_id"; then
+        local text=$(echo "$ticker" | ./jq -r '.text // empty')
+        local speed=$(echo "$ticker" | ./jq -r '.speed // 160 | numbers | select(. > 0)')
+        if [ -z "$speed" ]; then
+            record_warning "invalid_ticker" "ticker speed must be a positive number; using 160"
+            speed=160
+        fi
+        if [ -n "$text" ]; then
+            # Position follows the project timeline so the crawl is continuous across segments
+            filters+=("drawbox=x=0:y=ih*0.93:w=iw:h=ih*0.07:color=black@0.85:t=fill")
+            filters+=("$(build_drawtext_filter "$(write_overlay_text "segment_${segment_id}_ticker" "$text")" $((height / 36)) "w-mod((t+$SEGMENT_START_TIME)*$speed\,w+tw)" "h*0.93+(h*0.07-th)/2")")
+        fi
+    fi
+    
+    local IFS=","
+    echo "${filters[*]}"
+}
+
+# Resolve a named position (or explicit normalized x/y) to overlay coordinates
+# Prints nothing when x/y are not fractions in [0, 1]
+get_overlay_position() {
+    local spec="$1"
+    
+    echo "$spec" | ./jq -r '
+        if .x != null and .y != null then
+            if all(.x, .y; type == "number" and . >= 0 and . <= 1) then "W*\(.x):H*\(.y)" else empty end
+        else {
+            "top_left": "H*0.04:H*0.04",
+            "top_right": "W-w-H*0.04:H*0.04",
+            "bottom_left": "H*0.04:H-h-H*0.04",
+            "center": "(W-w)/2:(H-h)/2"
+        }[.position // "bottom_right"] // "W-w-H*0.04:H-h-H*0.04"
+        end'
+}
+
+# QR codes or supplied images shown during time ranges on the project timeline
+get_promo_overlay_filter() {
+    local segment_id="$1"
+    local duration="$2"
+    local height=$(get_output_height)
+    local filters=()
+    local index=0
+    local spec
+    
+    while IFS= read -r spec; do
+        [ -z "$spec" ] && continue
+        
+        # Convert the project-timeline range to this segment's local time
+        local range=$(echo "$spec" | ./jq -r --argjson offset "$SEGMENT_START_TIME" '"\((.start // 0) - $offset) \((.end // 1e9) - $offset)"')
+        local local_start=${range% *}
+        local local_end=${range#* }
+        if ! awk -v s="$local_start" -v e="$local_end" -v d="$duration" 'BEGIN { exit !(e > 0 && s < d) }'; then
+            continue
+        fi
+        
+        local image="$TEMP_DIR/segment_${segment_id}_promo_${index}.png"
+        local size=$(echo "$spec" | ./jq -r '.size // 0.25 | numbers | select(. > 0 and . <= 1)')
+        local position=$(get_overlay_position "$spec")
+        if [ -z "$size" ] || [ -z "$position" ]; then
+            record_warning "invalid_promo_overlay" "promo overlay size must be in (0, 1] and x/y in [0, 1]; skipping it"
+            continue
+        fi
+        
+        local url=$(echo "$spec" | ./jq -r '.url // empty')
+        local image_url=$(echo "$spec" | ./jq -r '.image_url // empty')
+        if [ -n "$image_url" ]; then
+            download_image "$image_url" "$image" >&2 || continue
+        elif [ -n "$url" ]; then
+            ./qrgen -text "$url" -out "$image" -scale 10 -level M > /dev/null || continue
+        else
+            continue
+        fi
+        
+        local pixels=$(awk -v s="$size" -v h="$height" 'BEGIN { printf "%d", s * h }')
+        local scale_flags="lanczos"
+        if [ -z "$image_url" ]; then
+            scale_flags="neighbor"
+        fi
+        
+        # "null" lets the labelled sub-graph join the comma-separated overlay chain
+        filters+=("null[promo_base_$index];movie=$image,scale=-1:$pixels:flags=$scale_flags[promo_$index];[promo_base_$index][promo_$index]overlay=$position:enable='between(t,$local_start,$local_end)'")
+        index=$((index + 1))
+    done < <(get_option_json "promo_overlays" | ./jq -c '.[]?')
+    
+    local IFS=","
+    echo "${filters[*]}"
+}
+
+# All per-segment overlays (style, branding, promos) joined into one filter chain
+get_segment_overlay_filter() {
+    local segment_id="$1"
+    local image_json="$2"
+    local duration="$3"
+    local filters=()
+    local filter
+    
+    for filter in \
+        "$(get_image_overlay_filter "$segment_id" "$image_json")" \
+        "$(get_news_overlay_filter "$segment_id")" \
+        "$(get_promo_overlay_filter "$segment_id" "$duration")"; do
+        if [ -n "$filter" ]; then
+            filters+=("$filter")
+        fi
+    done
+    
+    local IFS=","
+    echo "${filters[*]}"
+}
+
+# Download a color LUT (.cube or .3dl; S3 key, s3:// or URL) once per container,
+# keyed by its full source reference (signed URLs differ only in the query) and
+# refetched after LUT_CACHE_TTL
+get_cached_lut() {
+    local source="$1"
+    local cache_dir="$LUT_CACHE_DIR"
+    
+    local extension=$(echo "${source%%\?*}" | sed 's/.*\.//' | tr '[:upper:]' '[:lower:]')
+    case "$extension" in
+        cube|3dl) ;;
+        *)
+            log "Warning: Unsupported LUT type for ${source%%\?*} (expected .cube or .3dl)" >&2
+            return 1
+            ;;
+    esac
+    
+    mkdir -p "$cache_dir"
+    local cached="$cache_dir/$(printf '%s' "$source" | md5sum | cut -c1-32).$extension"
+    if [ -s "$cached" ] && [ $(($(date +%s) - $(stat -c %Y "$cached"))) -lt "$LUT_CACHE_TTL" ]; then
+        touch -a "$cached"
+    else
+        fetch_input_file "$source" "$cached.part" >&2 || { rm -f "$cached.part"; return 1; }
+        if [ "$extension" = "cube" ] && ! grep -q '^LUT_3D_SIZE' "$cached.part"; then
+            log "Warning: ${source%%\?*} is not a 3D .cube LUT" >&2
+            rm -f "$cached.part"
+            return 1
+        fi
+        mv "$cached.part" "$cached"
+        prune_cache_dir "$cache_dir" "$LUT_CACHE_MAX_BYTES" "$LUT_CACHE_TTL" "$cached"
+    fi
+    echo "$cached"
+}
+
+# Download the options.watermark image once per container, keyed by its full
+# source reference and refetched after WATERMARK_CACHE_TTL
+get_cached_watermark() {
+    local source="$1"
+    local cache_dir="$WATERMARK_CACHE_DIR"
+    
+    mkdir -p "$cache_dir"
+    local cached="$cache_dir/$(printf '%s' "$source" | md5sum | cut -c1-32).img"
+    if [ -s "$cached" ] && [ $(($(date +%s) - $(stat -c %Y "$cached"))) -lt "$WATERMARK_CACHE_TTL" ]; then
+        touch -a "$cached"
+    else
+        fetch_input_file "$source" "$cached.part" >&2 || { rm -f "$cached.part"; return 1; }
+        mv "$cached.part" "$cached"
+        prune_cache_dir "$cache_dir" "$WATERMARK_CACHE_MAX_BYTES" "$WATERMARK_CACHE_TTL" "$cached"
+    fi
+    echo "$cached"
+}
+
+# Watermark from options.watermark ({source (URL, s3:// or key), position:
+# top_left, top_right, bottom_left, bottom_right (default), center or {x, y} as
+# fractions of the frame, scale (logo width as a fraction of the frame, default
+# 0.12), opacity (default 0.8), fade_in (seconds), apply_to: segments (default;
+# every image clip, generated segment and card encode appends it) or combine})
+# as a graph suffix for a chain ending in an unlabeled stream.
+# Prints nothing unless the watermark applies to the given stage
+get_watermark_graph() {
+    local stage="$1"
+    
+    local spec=$(get_option_json "watermark")
+    local source=$(echo "$spec" | ./jq -r 'objects | .source // empty')
+    if [ -z "$source" ] || [ "$(echo "$spec" | ./jq -r '.apply_to // "segments"')" != "$stage" ]; then
+        return 0
+    fi
+    local logo
+    if ! logo=$(get_cached_watermark "$source"); then
+        record_warning "watermark_unavailable" "Could not load watermark ${source%%\?*}; rendering without it"
+        return 0
+    fi
+    
+    local width="${DEFAULT_RESOLUTION%x*}" height=$(get_output_height)
+    local scale=$(echo "$spec" | ./jq -r '.scale // 0.12 | numbers')
+    local opacity=$(echo "$spec" | ./jq -r '.opacity // 0.8 | numbers')
+    local fade_in=$(echo "$spec" | ./jq -r '.fade_in // 0 | numbers')
+    if [ -z "$scale" ] || [ -z "$opacity" ] || ! awk -v s="$scale" -v o="$opacity" 'BEGIN { exit !(s > 0 && s <= 1 && o >= 0 && o <= 1) }'; then
+        record_warning "invalid_watermark" "watermark scale must be in (0, 1] and opacity in [0, 1]; rendering without it"
+        return 0
+    fi
+    
+    local margin=$((height / 30)) x y
+    case "$(echo "$spec" | ./jq -r '.position | if type == "object" then "custom" else . // "bottom_right" end')" in
+        top_left) x="$margin"; y="$margin" ;;
+        top_right) x="W-w-$margin"; y="$margin" ;;
+        bottom_left) x="$margin"; y="H-h-$margin" ;;
+        center) x="(W-w)/2"; y="(H-h)/2" ;;
+        custom)
+            local fractions=$(echo "$spec" | ./jq -r '[.position.x // 0.5, .position.y // 0.5] | if all(.[]; type == "number" and . >= 0 and . <= 1) then "\(.[0]) \(.[1])" else empty end')
+            if [ -z "$fractions" ]; then
+                record_warning "invalid_watermark" "watermark position x and y must be numbers in [0, 1]; rendering without it"
+                return 0
+            fi
+            x="${fractions% *}*(W-w)"
+            y="${fractions#* }*(H-h)"
+            ;;
+        *) x="W-w-$margin"; y="H-h-$margin" ;;
+    esac
+    
+    # The looped movie source gives the logo a timeline to fade in on
+    local logo_chain="movie=$logo:loop=0,setpts=N/$DEFAULT_FPS/TB,scale=$(awk -v s="$scale" -v w="$width" 'BEGIN { printf "%d", int(s * w / 2) * 2 }'):-1,format=rgba,colorchannelmixer=aa=$opacity"
+    if awk -v f="$fade_in" 'BEGIN { exit !(f > 0) }'; then
+        logo_chain="$logo_chain,fade=t=in:st=0:d=$fade_in:alpha=1"
+    fi
+    echo "[watermark_base];$logo_chain[watermark];[watermark_base][watermark]overlay=x=$x:y=$y:shortest=1"
+}
+
+# Composite a combine-stage watermark onto the final video, copying the audio untouched
+apply_watermark() {
+    local final_video="$1"
+    
+    local graph=$(get_watermark_graph "combine")
+    if [ -z "$graph" ]; then
+        return 0
+    fi
+    log "Compositing watermark onto final video"
+    encode_ffmpeg -i "$final_video" \
+        -filter_complex "[0:v]null$graph" \
+        "${SEGMENT_ENCODE_ARGS[@]}" \
+        -c:a copy \
+        -y "$final_video.watermarked.mp4" && mv "$final_video.watermarked.mp4" "$final_video" || {
+        rm -f "$final_video.watermarked.mp4"
+        record_warning "watermark_failed" "Could not composite the watermark; delivering without it"
+    }
+}
+
+# Download a brand font once per container, keyed by its full source reference
+# and refetched after FONT_CACHE_TTL
+get_cached_font() {
+    local source="$1"
+    local cache_dir="$2"
+    
+    # Presigned URLs carry the signature in the query, so keep it out of the extension and the logs
+    local path="${source%%\?*}"
+    local extension=$(echo "${path##*.}" | tr '[:upper:]' '[:lower:]')
+    case "$extension" in
+        ttf|otf) ;;
+        *)
+            log "Warning: Unsupported font type for $path (expected .ttf or .otf)" >&2
+            return 1
+            ;;
+    esac
+    
+    local cached="$cache_dir/$(printf '%s' "$source" | md5sum | cut -c1-32).$extension"
+    if [ -s "$cached" ] && [ $(($(date +%s) - $(stat -c %Y "$cached"))) -lt "$FONT_CACHE_TTL" ]; then
+        touch -a "$cached"
+    else
+        fetch_input_file "$source" "$cached.part" >&2 || { rm -f "$cached.part"; return 1; }
+        mv "$cached.part" "$cached"
+        prune_cache_dir "$cache_dir" "$FONT_CACHE_MAX_BYTES" "$FONT_CACHE_TTL" "$cached"
+    fi
+    echo "$cached"
+}
+
+# Swap in brand fonts from options.font_file / options.bold_font_file (S3 key, s3:// or URL)
+# Cached fonts live outside the per-segment temp files so warm containers reuse them
+load_custom_fonts() {
+    local source=$(get_option "font_file" "")
+    local bold_source=$(get_option "bold_font_file" "")
+    if [ -z "$source" ] && [ -z "$bold_source" ]; then
+        return 0
+    fi
+    
+    local cache_dir="$FONT_CACHE_DIR"
+    mkdir -p "$cache_dir"
+    
+    local font
+    if [ -n "$source" ] && font=$(get_cached_font "$source" "$cache_dir"); then
+        FONT_FILE="$font"
+        BOLD_FONT_FILE="$font"
+        log "Using custom font: ${source%%\?*}"
+    fi
+    if [ -n "$bold_source" ] && font=$(get_cached_font "$bold_source" "$cache_dir"); then
+        BOLD_FONT_FILE="$font"
+        log "Using custom bold font: ${bold_source%%\?*}"
+    fi
+    
+    # libass looks fonts up by family name in a single directory, so expose bundled fonts there too
+    if [ -d ./fonts ]; then
+        ln -sf "$(pwd)"/fonts/* "$cache_dir/"
+    fi
+    FONTS_DIR="$cache_dir"
+}
+
+# Run an aws s3/s3api command, retrying throttling (SlowDown, 503) and 5xx errors
+# Each call appends "<attempts> <status>" to S3_METRICS_FILE
+s3_with_retry() {
+    local attempt=1
+    local error_file=$(mktemp)
+    
+    while true; do
+        # The CLI's own retries are disabled so attempt counts are accurate
+        if AWS_MAX_ATTEMPTS=1 aws "$@" 2> "$error_file"; then
+            echo "$attempt ok" >> "$S3_METRICS_FILE"
+            rm -f "$error_file"
+            return 0
+        fi
+        
+        if [ "$attempt" -ge "$S3_MAX_ATTEMPTS" ] || \
+            ! grep -qiE 'SlowDown|Throttl|TooManyRequests|RequestLimitExceeded|InternalError|ServiceUnavailable|\(5[0-9][0-9]\)|status code: 5[0-9][0-9]' "$error_file"; then
+            cat "$error_file" >&2
+            echo "$attempt failed" >> "$S3_METRICS_FILE"
+            rm -f "$error_file"
+            return 1
+        fi
+        
+        local delay=$(awk -v a="$attempt" -v b="$S3_RETRY_BASE_DELAY" -v m="$S3_RETRY_MAX_DELAY" -v s="$RANDOM" 'BEGIN {
+            srand(s); d = b * 2 ^ (a - 1); if (d > m) d = m; printf "%.3f", rand() * d }')
+        log "S3 retry $attempt/$S3_MAX_ATTEMPTS in ${delay}s: $(tail -1 "$error_file")" >&2
+        sleep "$delay"
+        attempt=$((attempt + 1))
+    done
+}
+
+# Mark the start of a pipeline stage, sampling memory in use and /tmp usage
+# Lines are "<stage> <epoch ms> <memory KB> <tmp KB>" in RESOURCE_USAGE_FILE
+mark_stage() {
+    local stage="$1"
+    
+    local memory_kb=$(awk '/^MemTotal:/ { total = $2 } /^MemAvailable:/ { available = $2 } END { print total - available }' /proc/meminfo 2>/dev/null)
+    local tmp_kb=$(df -k "$TEMP_DIR" | tail -1 | awk '{ print $3 }')
+    echo "$stage $(date +%s%3N) ${memory_kb:-0} ${tmp_kb:-0}" >> "$RESOURCE_USAGE_FILE"
+}
+
+# Peak memory from the cgroup when exposed (v2, then v1), else 0
+get_cgroup_peak_memory() {
+    cat /sys/fs/cgroup/memory.peak /sys/fs/cgroup/memory/memory.max_usage_in_bytes 2>/dev/null | head -1 || true
+}
+
+# Summarize CPU time, peak memory, peak /tmp usage and wall time per stage as a
+# response field; called from a command substitution, so CPU time is read from the
+# calling shell (its own time plus every finished child such as ffmpeg)
+get_resource_usage_field() {
+    mark_stage "end"
+    
+    local self=$BASHPID
+    local caller=$(awk '{ print $4 }' "/proc/$self/stat")
+    local cpu_seconds=$(awk -v hz="$(getconf CLK_TCK 2>/dev/null || echo 100)" \
+        '{ printf "%.2f", ($14 + $15 + $16 + $17) / hz }' "/proc/$caller/stat" 2>/dev/null)
+    local cgroup_peak=$(get_cgroup_peak_memory)
+    
+    awk -v cpu="${cpu_seconds:-0}" -v cgroup_peak="${cgroup_peak:-0}" -v cold_start="$COLD_START" '
+        NR > 1 { stages[NR - 1] = name; wall[NR - 1] = $2 - started }
+        NR == 1 { first = $2 }
+        { name = $1; started = $2; if ($3 > memory) memory = $3; if ($4 > tmp) tmp = $4 }
+        END {
+            peak = (cgroup_peak > 0) ? cgroup_peak : memory * 1024
+            printf ",\"resource_usage\":{\"cold_start\":%s,\"cpu_seconds\":%s,\"peak_memory_bytes\":%.0f,\"peak_tmp_bytes\":%.0f,\"wall_seconds\":%.3f,\"stages\":{", cold_start, cpu, peak, tmp * 1024, (started - first) / 1000
+            for (i = 1; i < NR; i++) printf "%s\"%s\":%.3f", (i > 1 ? "," : ""), stages[i], wall[i] / 1000
+            printf "}}"
+        }' "$RESOURCE_USAGE_FILE"
+}
+
+# CPU ticks used by finished children (ffmpeg and friends) of the calling shell;
+# called from a command substitution, so read the parent of this subshell
+get_children_cpu_ticks() {
+    local self=$BASHPID
+    local caller=$(awk '{ print $4 }' "/proc/$self/stat")
+    awk '{ print $16 + $17 }' "/proc/$caller/stat" 2>/dev/null || echo 0
+}
+
+# Report the render cost of options.high_quality_motion as a response field, from
+# the render's wall time and the CPU ticks its children used
+get_motion_quality_field() {
+    local render_ms="$1"
+    local cpu_ticks="$2"
+    
+    local factor=$(get_motion_supersample)
+    if [ "$factor" -le 1 ]; then
+        return 0
+    fi
+    awk -v factor="$factor" -v ms="$render_ms" -v ticks="$cpu_ticks" -v hz="$(getconf CLK_TCK 2>/dev/null || echo 100)" \
+        'BEGIN { printf ",\"motion_quality\":{\"mode\":\"high_quality\",\"supersample\":%d,\"render_seconds\":%.3f,\"render_cpu_seconds\":%.2f}", factor, ms / 1000, ticks / hz }'
+}
+
+# Summarize S3 attempt counts for this invocation as a response field
+get_s3_metrics_field() {
+    if [ ! -s "$S3_METRICS_FILE" ]; then
+        return 0
+    fi
+    awk '{ ops++; attempts += $1; retries += $1 - 1; if ($2 != "ok") failures++ }
+        END { printf ",\"s3_metrics\":{\"operations\":%d,\"attempts\":%d,\"retries\":%d,\"failures\":%d}", ops, attempts, retries, failures }' "$S3_METRICS_FILE"
+}
+
+# Download file from S3
+download_s3_file() {
+    local s3_key="$1"
+    local local_path="$2"
+    
+    log "Downloading from S3: $s3_key"
+    s3_with_retry s3 cp "s3://$BUCKET_NAME/$s3_key" "$local_path" || return 1
+    log "Downloaded: $local_path"
+}
+
+# MIME type for an object key, by extension
+get_content_type() {
+    local extension=$(echo "${1##*.}" | tr '[:upper:]' '[:lower:]')
+    case "$extension" in
+        mp4) echo "video/mp4" ;;
+        mov) echo "video/quicktime" ;;
+        m4a) echo "audio/mp4" ;;
+        mp3) echo "audio/mpeg" ;;
+        wav) echo "audio/wav" ;;
+        jpg|jpeg) echo "image/jpeg" ;;
+        png) echo "image/png" ;;
+        webp) echo "image/webp" ;;
+        gif) echo "image/gif" ;;
+        vtt) echo "text/vtt; charset=utf-8" ;;
+        srt) echo "application/x-subrip; charset=utf-8" ;;
+        json) echo "application/json" ;;
+        gz) echo "application/gzip" ;;
+        m3u8) echo "application/vnd.apple.mpegurl" ;;
+        m4s) echo "video/iso.segment" ;;
+        mpd) echo "application/dash+xml" ;;
+        *) echo "application/octet-stream" ;;
+    esac
+}
+
+# Content-Disposition offering a friendly filename; quotes and control characters are
+# dropped from the plain filename and the UTF-8 name is sent percent-encoded (RFC 6266)
+# options.content_disposition chooses inline (play in browser) or attachment
+build_content_disposition() {
+    local filename="$1"
+    
+    local disposition=$(get_option "content_disposition" "inline")
+    if [ "$disposition" != "attachment" ]; then
+        disposition="inline"
+    fi
+    local ascii_name=$(printf '%s' "$filename" | LC_ALL=C tr -d '"\\\000-\037\177' | LC_ALL=C tr '\200-\377' '_')
+    local encoded_name=$(./jq -rn --arg name "$filename" '$name | @uri')
+    echo "$disposition; filename=\"$ascii_name\"; filename*=UTF-8''$encoded_name"
+}
+
+# Upload file to S3 with its Content-Type and Cache-Control
+# An optional download filename sets Content-Disposition
+upload_s3_file() {
+    local local_path="$1"
+    local s3_key="$2"
+    local download_filename="$3"
+    
+    local upload_args=(--content-type "$(get_content_type "$s3_key")")
+    local cache_control=$(get_option "cache_control" "$UPLOAD_CACHE_CONTROL")
+    if [ -n "$cache_control" ]; then
+        upload_args+=(--cache-control "$cache_control")
+    fi
+    if [ -n "$download_filename" ]; then
+        upload_args+=(--content-disposition "$(build_content_disposition "$download_filename")")
+    fi
+    
+    log "Uploading to S3: $s3_key"
+    s3_with_retry s3 cp "$local_path" "s3://$BUCKET_NAME/$s3_key" "${upload_args[@]}" || return 1
+    log "Uploaded: $s3_key"
+}
+
+# Tag an uploaded per-segment video as intermediate so a bucket lifecycle rule
+# can expire it; options.segment_expiry_days adds an explicit expires-on date
+tag_intermediate_object() {
+    local s3_key="$1"
+    
+    local tags="{Key=lifecycle,Value=intermediate}"
+    local expiry_days=$(get_option "segment_expiry_days" "${SEGMENT_EXPIRY_DAYS:-}")
+    if [ -n "$expiry_days" ]; then
+        tags="$tags,{Key=expires-on,Value=$(date -u -d "+$expiry_days days" '+%Y-%m-%d')}"
+    fi
+    
+    s3_with_retry s3api put-object-tagging --bucket "$BUCKET_NAME" --key "$s3_key" \
+        --tagging "TagSet=[$tags]" > /dev/null || log "Warning: Could not tag $s3_key as intermediate"
+}
+
+# Check whether a host matches a comma- or semicolon-separated pattern list
+host_matches_list() {
+    local host="$1"
+    local list="$2"
+    local patterns pattern
+    
+    IFS=',;' read -ra patterns <<< "$list"
+    for pattern in "${patterns[@]}"; do
+        pattern="${pattern//[[:space:]]/}"
+        pattern="${pattern,,}"
+        if [[ "$host" == $pattern ]] || [[ "$pattern" == "*."* && "$host" == "${pattern#\*.}" ]]; then
+            return 0
+        fi
+    done
+    return 1
+}
+
+# Check whether an IP address is loopback, private, link-local or otherwise internal
+is_internal_address() {
+    local ip="${1,,}"
+    
+    if [[ "$ip" == *:* ]]; then
+        # IPv4-mapped IPv6 addresses are judged by their IPv4 part
+        if [[ "$ip" =~ ^::ffff:([0-9.]+)$ ]]; then
+            is_internal_address "${BASH_REMATCH[1]}"
+            return
+        fi
+        [[ "$ip" == "::" || "$ip" == "::1" || "$ip" =~ ^f[cd] || "$ip" =~ ^fe[89ab] || "$ip" =~ ^64:ff9b: ]]
+        return
+    fi
+    
+    local a b c d
+    IFS=. read -r a b c d <<< "$ip"
+    [ "$a" -eq 0 ] || [ "$a" -eq 10 ] || [ "$a" -eq 127 ] || [ "$a" -ge 224 ] ||
+        { [ "$a" -eq 100 ] && [ "$b" -ge 64 ] && [ "$b" -le 127 ]; } ||
+        { [ "$a" -eq 169 ] && [ "$b" -eq 254 ]; } ||
+        { [ "$a" -eq 172 ] && [ "$b" -ge 16 ] && [ "$b" -le 31 ]; } ||
+        { [ "$a" -eq 192 ] && [ "$b" -eq 168 ]; } ||
+        { [ "$a" -eq 192 ] && [ "$b" -eq 0 ] && [ "$c" -eq 0 ]; } ||
+        { [ "$a" -eq 198 ] && [ "$b" -ge 18 ] && [ "$b" -le 19 ]; }
+}
+
+# Validate a URL against the host policy and resolve it to a public address
+# Prints a curl --resolve entry pinning the checked address (prevents DNS rebinding)
+resolve_download_host() {
+    local url="$1"
+    
+    if [[ ! "$url" =~ ^(https?)://([^/?#]*) ]]; then
+        log "ERROR: Unsupported URL: ${url%%\?*}" >&2
+        return 1
+    fi
+    local scheme="${BASH_REMATCH[1]}"
+    local authority="${BASH_REMATCH[2]##*@}"
+    local host port
+    if [[ "$authority" =~ ^\[([^]]+)\](:([0-9]+))?$ ]] || [[ "$authority" =~ ^([^:]+)(:([0-9]+))?$ ]]; then
+        host="${BASH_REMATCH[1],,}"
+        port="${BASH_REMATCH[3]}"
+    else
+        log "ERROR: Invalid host in URL: ${url%%\?*}" >&2
+        return 1
+    fi
+    if [ -z "$port" ]; then
+        port=$([ "$scheme" = "https" ] && echo 443 || echo 80)
+    fi
+    
+    if [ -n "$DOWNLOAD_DENIED_HOSTS" ] && host_matches_list "$host" "$DOWNLOAD_DENIED_HOSTS"; then
+        log "ERROR: Host is denied: $host" >&2
+        return 1
+    fi
+    if [ -n "$DOWNLOAD_ALLOWED_HOSTS" ] && ! host_matches_list "$host" "$DOWNLOAD_ALLOWED_HOSTS"; then
+        log "ERROR: Host is not in the download allowlist: $host" >&2
+        return 1
+    fi
+    
+    # Every resolved address must be public, otherwise a second lookup could pick the internal one
+    local addresses=$(getent ahosts "$host" 2>/dev/null | awk '{ print $1 }' | sort -u)
+    if [ -z "$addresses" ]; then
+        log "ERROR: Could not resolve host: $host" >&2
+        return 1
+    fi
+    local address
+    for address in $addresses; do
+        if is_internal_address "$address"; then
+            log "ERROR: Host $host resolves to internal address $address" >&2
+            return 1
+        fi
+    done
+    
+    address=$(echo "$addresses" | head -1)
+    if [[ "$address" == *:* ]]; then
+        address="[$address]"
+    fi
+    echo "$host:$port:$address"
+}
+
+# Download a URL with timeouts, a redirect cap and a body size limit
+# Optional request JSON supplies headers ({"Name": "value"}) and cookies
+# ({"name": "value"} or a raw "a=b; c=d" string); an optional regex restricts
+# the response Content-Type. Returns 2 when the body exceeds the size limit and 3
+# for failures worth retrying
+http_download() {
+    local url="$1"
+    local local_path="$2"
+    local request_json="${3:-null}"
+    local content_type_pattern="$4"
+    local max_bytes="${5:-$DOWNLOAD_MAX_BYTES}"
+    local curl_args=()
+    
+    while IFS= read -r header; do
+        if [ -n "$header" ]; then
+            curl_args+=(-H "$header")
+        fi
+    done < <(echo "$request_json" | ./jq -r '(.headers // {}) | to_entries[] | "\(.key): \(.value)"' 2>/dev/null)
+    local cookies=$(echo "$request_json" | ./jq -r '.cookies // empty | if type == "object" then (to_entries | map("\(.key)=\(.value)") | join("; ")) else . end' 2>/dev/null)
+    if [ -n "$cookies" ]; then
+        curl_args+=(--cookie "$cookies")
+    fi
+    
+    # Query strings may hold signatures, so only the path is logged
+    log "Downloading: ${url%%\?*}"
+    
+    # The body is streamed through head so servers without Content-Length
+    # cannot fill /tmp; one byte past the cap marks the download as oversized
+    # Redirects are followed here so every hop passes the host policy, and
+    # request headers/cookies are only sent to the original host
+    local header_file="$local_path.headers"
+    local origin_host="" redirects=0 pinned curl_status
+    while true; do
+        pinned=$(resolve_download_host "$url") || { rm -f "$local_path" "$header_file"; return 1; }
+        if [ -z "$origin_host" ]; then
+            origin_host="${pinned%%:*}"
+        elif [ "${pinned%%:*}" != "$origin_host" ]; then
+            curl_args=()
+        fi
+        
+        curl -sS --fail \
+            --proto =http,https \
+            --resolve "$pinned" \
+            --connect-timeout "$DOWNLOAD_CONNECT_TIMEOUT" \
+            --max-time "$DOWNLOAD_MAX_TIME" \
+            --speed-limit 1024 --speed-time "$DOWNLOAD_STALL_TIMEOUT" \
+            --max-filesize "$max_bytes" \
+            "${curl_args[@]}" \
+            -D "$header_file" "$url" | head -c $((max_bytes + 1)) > "$local_path"
+        curl_status=${PIPESTATUS[0]}
+        
+        local status=$(head -1 "$header_file" 2>/dev/null | awk '{ print $2 }')
+        local location=$(tr -d '\r' < "$header_file" 2>/dev/null | awk 'tolower($1) == "location:" { print $2 }' | tail -1)
+        if [ "$curl_status" -ne 0 ] || [[ ! "$status" =~ ^30[12378]$ ]] || [ -z "$location" ]; then
+            break
+        fi
+        if [ "$redirects" -ge "$DOWNLOAD_MAX_REDIRECTS" ]; then
+            log "ERROR: More than $DOWNLOAD_MAX_REDIRECTS redirects: ${url%%\?*}" >&2
+            rm -f "$local_path" "$header_file"
+            return 1
+        fi
+        case "$location" in
+            http://*|https://*) url="$location" ;;
+            //*) url="${url%%://*}:$location" ;;
+            /*) url="$(echo "$url" | grep -oE '^https?://[^/?#]+')$location" ;;
+            *) url="${url%%\?*}"; url="${url%/*}/$location" ;;
+        esac
+        redirects=$((redirects + 1))
+        log "Following redirect to: ${url%%\?*}"
+    done
+    local content_type=$(tr -d '\r' < "$header_file" 2>/dev/null | grep -i '^content-type:' | tail -1 | cut -d: -f2- | tr -d ' ')
+    rm -f "$header_file"
+    
+    local size=$(wc -c < "$local_path")
+    if [ "$size" -gt "$max_bytes" ] || [ "$curl_status" -eq 63 ]; then
+        log "ERROR: Download exceeds ${max_bytes} bytes: ${url%%\?*}" >&2
+        rm -f "$local_path"
+        return 2
+    fi
+    if [ "$curl_status" -ne 0 ]; then
+        log "ERROR: Download failed (curl exit $curl_status${status:+, HTTP $status}): ${url%%\?*}" >&2
+        rm -f "$local_path"
+        if [[ " 6 7 18 28 35 52 55 56 " == *" $curl_status "* ]] || [[ "$status" =~ ^(408|429|5[0-9][0-9])$ ]]; then
+            return 3
+        fi
+        return 1
+    fi
+    if [ -n "$content_type_pattern" ] && ! echo "$content_type" | grep -qiE "$content_type_pattern"; then
+        log "ERROR: Unexpected content type '$content_type' for ${url%%\?*}" >&2
+        rm -f "$local_path"
+        return 1
+    fi
+    log "Downloaded: $local_path ($size bytes)"
+}
+
+# Download a URL, retrying transient failures up to DOWNLOAD_MAX_ATTEMPTS times,
+# and record per-host latency, bytes and failures for every attempt
+# Arguments are the same as http_download
+download_url() {
+    local url="$1"
+    local local_path="$2"
+    local host=$(echo "$url" | sed -E 's#^[a-zA-Z]+://([^@/?#]*@)?([^/?#:]+|\[[^]]*\]).*#\2#')
+    local attempt=1 status
+    
+    while true; do
+        local started=$(date +%s%N)
+        status=0
+        http_download "$@" || status=$?
+        
+        local elapsed_ms=$((($(date +%s%N) - started) / 1000000))
+        local bytes=$(wc -c < "$local_path" 2>/dev/null || echo 0)
+        echo "$host $elapsed_ms $bytes $([ "$status" -eq 0 ] && echo ok || echo failed)" >> "$DOWNLOAD_METRICS_FILE"
+        if [ "$status" -ne 3 ] || [ "$attempt" -ge "$DOWNLOAD_MAX_ATTEMPTS" ]; then
+            break
+        fi
+        
+        local delay=$(awk -v a="$attempt" -v b="$DOWNLOAD_RETRY_BASE_DELAY" -v m="$DOWNLOAD_RETRY_MAX_DELAY" -v s="$RANDOM" 'BEGIN {
+            srand(s); d = b * 2 ^ (a - 1); if (d > m) d = m; printf "%.3f", rand() * d }')
+        log "Download retry $attempt/$DOWNLOAD_MAX_ATTEMPTS in ${delay}s: ${url%%\?*}" >&2
+        sleep "$delay"
+        attempt=$((attempt + 1))
+    done
+    if [ "$status" -eq 3 ]; then
+        status=1
+    fi
+    return $status
+}
+
+# Number of a segment's images to download at once (options.download_concurrency,
+# 1 to MAX_DOWNLOAD_CONCURRENCY)
+get_download_concurrency() {
+    local concurrency=$(get_option "download_concurrency" "$DOWNLOAD_CONCURRENCY")
+    if [[ ! "$concurrency" =~ ^[0-9]+$ ]] || [ "$concurrency" -lt 1 ]; then
+        concurrency=1
+    elif [ "$concurrency" -gt "$MAX_DOWNLOAD_CONCURRENCY" ]; then
+        concurrency="$MAX_DOWNLOAD_CONCURRENCY"
+    fi
+    echo "$concurrency"
+}
+
+# Summarize HTTP downloads by source host as a response field
+get_download_metrics_field() {
+    if [ ! -s "$DOWNLOAD_METRICS_FILE" ]; then
+        return 0
+    fi
+    awk '{
+            requests[$1]++; ms[$1] += $2; if ($2 > max[$1]) max[$1] = $2
+            if ($4 == "ok") bytes[$1] += $3; else failures[$1]++
+        }
+        END {
+            printf ",\"download_metrics\":{"
+            sep = ""
+            for (h in requests) {
+                printf "%s\"%s\":{\"requests\":%d,\"failures\":%d,\"bytes\":%d,\"avg_ms\":%d,\"max_ms\":%d}", sep, h, requests[h], failures[h], bytes[h], ms[h] / requests[h], max[h]
+                sep = ","
+            }
+            printf "}"
+        }' "$DOWNLOAD_METRICS_FILE"
+}
+
+# Decode a base64 data: URI to a file, as if it had been downloaded
+# Returns 2 if the decoded image would exceed max_bytes (MAX_INLINE_IMAGE_BYTES at most)
+decode_data_uri() {
+    local uri="$1"
+    local local_path="$2"
+    local max_bytes="${3:-$MAX_INLINE_IMAGE_BYTES}"
+    if [ "$max_bytes" -gt "$MAX_INLINE_IMAGE_BYTES" ]; then
+        max_bytes="$MAX_INLINE_IMAGE_BYTES"
+    fi
+    
+    local header="${uri%%,*}"
+    local payload="${uri#*,}"
+    local media_type="${header#data:}"
+    media_type="${media_type%%;*}"
+    if [[ "$header" != *";base64" ]]; then
+        log "ERROR: Only base64 data URIs are supported" >&2
+        return 1
+    fi
+    if [ -n "$media_type" ] && [[ ! "$media_type" =~ ^(image/|application/pdf|application/octet-stream) ]]; then
+        log "ERROR: Unexpected content type '$media_type' for inline image" >&2
+        return 1
+    fi
+    
+    # Every 4 base64 characters decode to 3 bytes
+    if [ $((${#payload} / 4 * 3)) -gt "$max_bytes" ]; then
+        log "ERROR: Inline image exceeds ${max_bytes} bytes" >&2
+        return 2
+    fi
+    if ! printf '%s' "$payload" | tr -d ' \r\n' | base64 -d > "$local_path" 2>/dev/null || [ ! -s "$local_path" ]; then
+        log "ERROR: Invalid base64 data in inline image" >&2
+        rm -f "$local_path"
+        return 1
+    fi
+    log "Decoded inline image: $local_path ($(wc -c < "$local_path") bytes)"
+}
+
+# Inputs that need converting before ffmpeg filters can read them, sniffed from the
+# content rather than the URL: ISO base media images (iPhone HEIC, AVIF) by their
+# ftyp brand, PDFs by their magic and SVGs by a root <svg> element (the first
+# element in the first 64KB once the XML declaration, comments and doctype are
+# skipped); prints heif, avif, pdf, svg or nothing
+get_image_container() {
+    local image_path="$1"
+    
+    local header=$(head -c 12 "$image_path" 2>/dev/null | tail -c 8)
+    case "$header" in
+        ftypavif|ftypavis) echo "avif"; return 0 ;;
+        ftypheic|ftypheix|ftypheim|ftypheis|ftyphevc|ftyphevx|ftypmif1|ftypmsf1) echo "heif"; return 0 ;;
+    esac
+    if [ "$(head -c 5 "$image_path" 2>/dev/null)" = "%PDF-" ]; then
+        echo "pdf"
+    elif head -c 65536 "$image_path" 2>/dev/null | tr -d '\000' | tr '\r\n' '  ' | \
+            sed -E 's/^\xEF\xBB\xBF//; s/<\?[^>]*\?>//g; s/<!--([^-]|-[^-])*-->//g; s/<!DOCTYPE[^[>]*(\[[^]]*\])?[^>]*>//Ig' | \
+            grep -qiE '^[[:space:]]*<svg[[:space:]>]'; then
+        echo "svg"
+    fi
+}
+
+# Image items drawn by the Lambda (text slides, maps) rather than fetched
+is_generated_image() {
+    local image_json="$1"
+    echo "$image_json" | ./jq -e '.type == "text_slide" or .type == "map"' > /dev/null 2>&1
+}
+
+# Render a map image item ({type: "map", lat, lon, path: [[lat, lon], ...], zoom
+# (the closest zoom to use; 12 for a lone point, 16 with a path), line_color})
+# as a still of the tile composite with the route and a marker at lat/lon, so the
+# Ken Burns chain can zoom into it. The still is twice the output size, one tile
+# zoom closer, so zooming in stays sharp. Prints the marker's "x y" as frame fractions
+render_map_image() {
+    local image_json="$1"
+    local output_path="$2"
+    local name="$(basename "$output_path" .jpg)"
+    local width=$((${DEFAULT_RESOLUTION%x*} * 2)) height=$(($(get_output_height) * 2))
+    
+    if ! echo "$image_json" | ./jq -e '
+            def coordinate: type == "array" and length == 2 and (map(type == "number") | all)
+                and (.[0] | fabs <= 85.05) and (.[1] | fabs <= 180);
+            ((.lat == null and .lon == null) or ([.lat, .lon] | coordinate))
+            and ((.path // []) | type == "array" and all(coordinate))
+            and ((.zoom // 0) | type == "number")' > /dev/null 2>&1; then
+        log "ERROR: map item lat/lon and path points must be numbers within [-85.05, 85.05] and [-180, 180], and zoom a number" >&2
+        return 1
+    fi
+    local coordinates=$(echo "$image_json" | ./jq -c '(.path // []) + (if .lat != null then [[.lat, .lon]] else [] end)')
+    if [ "$(echo "$coordinates" | ./jq 'length')" -lt 1 ]; then
+        log "ERROR: map item needs lat/lon or a path" >&2
+        return 1
+    fi
+    local max_zoom=$(echo "$image_json" | ./jq -r '.zoom // (if (.path // []) | length > 0 then 16 else 12 end) | floor
+        | if . < 2 then 2 elif . > 18 then 18 else . end')
+    local color=$(get_palette_color accent "$(echo "$image_json" | ./jq -r '.line_color // "0xd7263d"')")
+    
+    local projection=$(project_map_coordinates "$coordinates" "$max_zoom" 2)
+    local zoom left top
+    read zoom left top <<< "$(echo "$projection" | head -1)"
+    log "Rendering map item at zoom $zoom" >&2
+    
+    local background="$TEMP_DIR/${name}_map.png"
+    render_map_background "$background" "$zoom" "$left" "$top" "$width" "$height" || return 1
+    
+    # The route reveals over its first two seconds; keep the frame where it is complete
+    local route_filter=$(echo "$projection" | tail -n +2 | build_map_route_filter 3 "$color" 2)
+    ffmpeg -v error -framerate 1 -loop 1 -i "$background" -vf "$route_filter" -t 4 -update 1 -c:v png -y "$output_path" >&2 || {
+        rm -f "$background"
+        return 1
+    }
+    rm -f "$background"
+    
+    echo "$projection" | tail -1 | awk -v W="$width" -v H="$height" '{ printf "%.4f %.4f\n", $1 / W, $2 / H }'
+}
+
+# Render a text_slide image item ({type: "text_slide", title, body, background,
+# gradient (as pad_gradient), text_color, title_font (default bold), body_font,
+# align: center|left}) as a still at the output size, so it takes the Ken Burns
+# chain like any photo. Title and body wrap to 80% of the width and are centred
+# vertically as one block
+render_text_slide_image() {
+    local image_json="$1"
+    local output_path="$2"
+    local name="$(basename "$output_path" .jpg)"
+    local width="${DEFAULT_RESOLUTION%x*}" height=$(get_output_height)
+    
+    local title=$(echo "$image_json" | ./jq -r '.title // empty')
+    local body=$(echo "$image_json" | ./jq -r '.body // empty')
+    if [ -z "$title" ] && [ -z "$body" ]; then
+        log "ERROR: text_slide needs a title or body" >&2
+        return 1
+    fi
+    
+    # The options' pad defaults are for photos, not slides
+    local background=$(OPTIONS_JSON="{}" get_pad_background "$(echo "$image_json" | ./jq -c '{pad_color: (.background // "black"), pad_gradient: .gradient}')" "$width" "$height")
+    local text_color=$(get_caption_color "$(echo "$image_json" | ./jq -r '.text_color // "white"')" "white")
+    local title_font=$(get_text_font_file "$(echo "$image_json" | ./jq -r '.title_font // "bold"')" "$BOLD_FONT_FILE")
+    local body_font=$(get_text_font_file "$(echo "$image_json" | ./jq -r '.body_font // "regular"')" "$FONT_FILE")
+    local x="(w-tw)/2"
+    if [ "$(echo "$image_json" | ./jq -r '.align // "center"')" = "left" ]; then
+        x="w*0.1"
+    fi
+    
+    # Average glyph width is roughly half the font size; lines advance 1.25 sizes
+    local title_size=$((height / 12)) body_size=$((height / 24))
+    local title_text=$(wrap_text "$title" $((width * 8 / 10 * 2 / title_size)))
+    local body_text=$(wrap_text "$body" $((width * 8 / 10 * 2 / body_size)))
+    local title_height=0 body_height=0 gap=0
+    if [ -n "$title" ]; then
+        title_height=$(($(printf '%s\n' "$title_text" | wc -l) * title_size * 5 / 4))
+    fi
+    if [ -n "$body" ]; then
+        body_height=$(($(printf '%s\n' "$body_text" | wc -l) * body_size * 5 / 4))
+    fi
+    if [ -n "$title" ] && [ -n "$body" ]; then
+        gap=$((body_size * 3 / 2))
+    fi
+    local top=$(((height - title_height - gap - body_height) / 2))
+    
+    local filter="null"
+    if [ -n "$title" ]; then
+        filter="$filter,$(build_drawtext_filter "$(write_overlay_text "${name}_title" "$title_text")" "$title_size" "$x" "$top" "line_spacing=$((title_size / 4))" "$title_font" "$text_color")"
+    fi
+    if [ -n "$body" ]; then
+        filter="$filter,$(build_drawtext_filter "$(write_overlay_text "${name}_body" "$body_text")" "$body_size" "$x" "$((top + title_height + gap))" "line_spacing=$((body_size / 4))" "$body_font" "$text_color")"
+    fi
+    
+    ffmpeg -v error -f lavfi -i "$background" -vf "$filter" -frames:v 1 -f image2 -c:v png -y "$output_path" >&2 || return 1
+    rm -f "$TEMP_DIR/${name}_title.txt" "$TEMP_DIR/${name}_body.txt"
+}
+
+# Rasterize a PDF page (poppler's pdftoppm) or an SVG (librsvg's rsvg-convert) to a
+# PNG fitting DOCUMENT_RASTER_SCALE times the output size, on white; the tools come
+# from PATH (a Lambda layer), and without them the image is rejected
+rasterize_document_image() {
+    local image_path="$1"
+    local container="$2"
+    local page="${3:-1}"
+    
+    local width=$((${DEFAULT_RESOLUTION%x*} * DOCUMENT_RASTER_SCALE))
+    local height=$((${DEFAULT_RESOLUTION#*x} * DOCUMENT_RASTER_SCALE))
+    local raster_path="${image_path%.*}_raster.png"
+    case "$container" in
+        pdf)
+            if ! command -v pdftoppm > /dev/null 2>&1; then
+                log "ERROR: pdftoppm is not available to rasterize $image_path" >&2
+                return 1
+            fi
+            local long_side=$((width > height ? width : height))
+            pdftoppm -png -f "$page" -l "$page" -scale-to "$long_side" -singlefile \
+                "$image_path" "${raster_path%.png}" > /dev/null 2>&1 || return 1
+            ;;
+        svg)
+            if ! command -v rsvg-convert > /dev/null 2>&1; then
+                log "ERROR: rsvg-convert is not available to rasterize $image_path" >&2
+                return 1
+            fi
+            rsvg-convert --keep-aspect-ratio -w "$width" -h "$height" -b white \
+                -o "$raster_path" "$image_path" > /dev/null 2>&1 || return 1
+            ;;
+    esac
+    [ -s "$raster_path" ] && mv "$raster_path" "$image_path"
+}
+
+# Convert a HEIF/AVIF image, PDF page or SVG in place to a PNG intermediate the
+# filter chains read reliably; the bundled ffmpeg decodes HEIF and AVIF (HEIC tile
+# grids are stitched and rotation applied on the way)
+convert_image_to_intermediate() {
+    local image_path="$1"
+    local container="$2"
+    local image_json="${3:-{\}}"
+    
+    log "Converting $container image $image_path to PNG" >&2
+    if [ "$container" = "pdf" ] || [ "$container" = "svg" ]; then
+        local page=$(echo "$image_json" | ./jq -r '.page // 1')
+        if [[ ! "$page" =~ ^[1-9][0-9]*$ ]]; then
+            log "ERROR: Invalid PDF page '$page'" >&2
+            return 1
+        fi
+        if ! rasterize_document_image "$image_path" "$container" "$page"; then
+            log "ERROR: Could not rasterize $container image $image_path" >&2
+            rm -f "${image_path%.*}_raster.png"
+            return 1
+        fi
+        return 0
+    fi
+    local converted_path="${image_path%.*}_converted.png"
+    if ! ffmpeg -v error -i "$image_path" -frames:v 1 -map_metadata -1 -y "$converted_path" > /dev/null 2>&1 || \
+            [ ! -s "$converted_path" ]; then
+        log "ERROR: Could not decode $container image $image_path" >&2
+        rm -f "$converted_path"
+        return 1
+    fi
+    mv "$converted_path" "$image_path"
+}
+
+# Check a downloaded image before rendering: not empty, not an HTML error page,
+# decodable, and between MIN_IMAGE_SIDE per side and MAX_IMAGE_PIXELS; prints the
+# result as JSON ({index, status, reason?, bytes, format, width, height}, plus
+# source_format when it was converted from HEIF/AVIF)
+validate_image() {
+    local image_path="$1"
+    local index="$2"
+    local source_format="$3"
+    
+    local bytes=$(wc -c < "$image_path" 2>/dev/null || echo 0)
+    local reason="" format="" width=0 height=0
+    if [ "$bytes" -eq 0 ]; then
+        reason="empty download"
+    elif head -c 1024 "$image_path" | tr -d '\000' | grep -qiE '<(!doctype html|html|head|body)[ >]'; then
+        reason="HTML page instead of an image"
+    else
+        local probed=$(ffprobe -v error -select_streams v:0 -show_entries stream=codec_name,width,height \
+            -of csv=p=0 "$image_path" 2>/dev/null | head -1)
+        IFS=, read format width height <<< "$probed"
+        if [ -z "$format" ] || [[ ! "$width" =~ ^[0-9]+$ ]] || [[ ! "$height" =~ ^[0-9]+$ ]] || \
+            ! ffmpeg -v error -i "$image_path" -frames:v 1 -f null - > /dev/null 2>&1; then
+            reason="not a decodable image"
+            width=0 height=0
+        elif [ "$width" -lt "$MIN_IMAGE_SIDE" ] || [ "$height" -lt "$MIN_IMAGE_SIDE" ]; then
+            reason="${width}x$height is smaller than ${MIN_IMAGE_SIDE}px per side"
+        elif [ $((width * height)) -gt "$MAX_IMAGE_PIXELS" ]; then
+            reason="${width}x$height exceeds $MAX_IMAGE_PIXELS pixels"
+        fi
+    fi
+    
+    if [ -n "$reason" ]; then
+        log "Image $index is invalid: $reason" >&2
+    fi
+    ./jq -nc --argjson index "$index" --arg reason "$reason" --argjson bytes "$bytes" --arg format "$format" \
+        --argjson width "${width:-0}" --argjson height "${height:-0}" --arg source_format "$source_format" '
+        {index: $index, status: (if $reason == "" then "ok" else "invalid" end)}
+        + (if $reason == "" then {} else {reason: $reason} end)
+        + {bytes: $bytes, format: (if $format == "" then null else $format end), width: $width, height: $height}
+        + (if $source_format == "" then {} else {source_format: $source_format} end)'
+    [ -z "$reason" ]
+}
+
+# Filter that turns an image upright: the EXIF Orientation tag phone cameras write
+# instead of rotating pixels, or a display matrix rotation; prints nothing when
+# the image is already upright
+get_orientation_filter() {
+    local image_path="$1"
+    
+    local orientation=$(ffprobe -v error -select_streams v:0 -read_intervals "%+#1" \
+        -show_entries frame_tags=Orientation -of default=nw=1:nk=1 "$image_path" 2>/dev/null | head -1)
+    case "$orientation" in
+        2) echo "hflip" ;;
+        3) echo "hflip,vflip" ;;
+        4) echo "vflip" ;;
+        5) echo "transpose=0" ;;
+        6) echo "transpose=1" ;;
+        7) echo "transpose=3" ;;
+        8) echo "transpose=2" ;;
+        *)
+            local rotation=$(ffprobe -v error -select_streams v:0 -show_entries stream_side_data=rotation \
+                -of default=nw=1:nk=1 "$image_path" 2>/dev/null | head -1)
+            case "${rotation%.*}" in
+                -90|270) echo "transpose=1" ;;
+                90|-270) echo "transpose=2" ;;
+                180|-180) echo "hflip,vflip" ;;
+            esac
+            ;;
+    esac
+}
+
+# Rewrite an image with its orientation applied to the pixels and the tag dropped,
+# so the Ken Burns filters, subject detection and depth maps all see it upright
+# (options.auto_orient=false keeps the stored pixel order)
+auto_orient_image() {
+    local image_path="$1"
+    
+    if [ "$(get_option "auto_orient" "true")" != "true" ]; then
+        return 0
+    fi
+    local orientation_filter=$(get_orientation_filter "$image_path")
+    if [ -z "$orientation_filter" ]; then
+        return 0
+    fi
+    
+    log "Correcting orientation of $image_path ($orientation_filter)" >&2
+    local oriented_path="${image_path%.*}_oriented.png"
+    if ffmpeg -v error -noautorotate -i "$image_path" -vf "$orientation_filter" -map_metadata -1 \
+            -frames:v 1 -y "$oriented_path" > /dev/null 2>&1; then
+        mv "$oriented_path" "$image_path"
+    else
+        log "WARNING: Could not correct orientation of $image_path, using it as stored" >&2
+        rm -f "$oriented_path"
+    fi
+}
+
+# Request JSON for an image download: options.headers and options.cookies (e.g. an
+# auth token for a private image host) apply to every image, under its own
+get_image_request_json() {
+    local image_json="${1:-null}"
+    echo "$image_json" | ./jq -c --argjson headers "$(get_option_json "headers")" --argjson cookies "$(get_option_json "cookies")" '
+        .headers = ((if ($headers | type) == "object" then $headers else {} end) + (.headers // {}))
+        | if .cookies == null and $cookies != null then .cookies = $cookies else . end'
+}
+
+# Cache file for an image source: the full URL, presigning parameters included,
+# hashed with any headers and cookies, so an image fetched with one caller's
+# signature or credentials is never served for another's (a presigned URL only
+# hits the cache when the same signed URL is fetched again)
+get_image_cache_file() {
+    local url="$1"
+    local request_json="${2:-null}"
+    
+    local credentials=$(echo "$request_json" | ./jq -c '{headers, cookies}' 2>/dev/null)
+    echo "$IMAGE_CACHE_DIR/$(printf '%s %s' "$url" "$credentials" | md5sum | cut -c1-32)"
+}
+
+# download_image through the warm-container image cache; data: URIs are already
+# local and skip it. Hits and misses go to IMAGE_CACHE_STATS_FILE
+cached_download_image() {
+    local url="$1"
+    local local_path="$2"
+    local request_json="${3:-null}"
+    
+    if [[ "$url" == data:* ]] || [ "$(get_option "image_cache" "true")" != "true" ]; then
+        download_image "$@"
+        return
+    fi
+    
+    local cache_file=$(get_image_cache_file "$url" "$request_json")
+    if [ -s "$cache_file" ] && [ $(($(date +%s) - $(stat -c %Y "$cache_file"))) -lt "$IMAGE_CACHE_TTL" ]; then
+        ln -f "$cache_file" "$local_path" 2>/dev/null || cp "$cache_file" "$local_path" || return 1
+        touch -a "$cache_file"
+        echo "hit $(wc -c < "$cache_file")" >> "$IMAGE_CACHE_STATS_FILE"
+        log "Image cache hit: ${url%%\?*}"
+        return 0
+    fi
+    
+    download_image "$@" || return
+    mkdir -p "$IMAGE_CACHE_DIR"
+    if ln -f "$local_path" "$cache_file.part" 2>/dev/null || cp "$local_path" "$cache_file.part"; then
+        mv "$cache_file.part" "$cache_file"
+    fi
+    echo "miss $(wc -c < "$local_path")" >> "$IMAGE_CACHE_STATS_FILE"
+}
+
+# Drop expired images, then the least recently used until the cache fits
+# IMAGE_CACHE_MAX_BYTES
+prune_image_cache() {
+    prune_cache_dir "$IMAGE_CACHE_DIR" "$IMAGE_CACHE_MAX_BYTES" "$IMAGE_CACHE_TTL"
+}
+
+# Drop a cache directory's files older than the TTL (seconds), then the least
+# recently used until it fits max_bytes; an optional file just added is kept
+prune_cache_dir() {
+    local cache_dir="$1"
+    local max_bytes="$2"
+    local ttl="$3"
+    local keep="$4"
+    
+    if [ ! -d "$cache_dir" ]; then
+        return 0
+    fi
+    find "$cache_dir" -type f ! -newermt "@$(($(date +%s) - ttl))" -delete 2>/dev/null
+    find "$cache_dir" -type f ! -name '*.part' -printf '%A@ %s %p\n' 2>/dev/null | sort -rn | \
+        awk -v max="$max_bytes" -v keep="$keep" '{ total += $2; if (total > max && $3 != keep) print $3 }' | xargs -r rm -f
+}
+
+# Image cache hits, misses and bytes not downloaded for the response, plus what the
+# cache holds after pruning
+get_image_cache_field() {
+    if [ ! -s "$IMAGE_CACHE_STATS_FILE" ]; then
+        return 0
+    fi
+    local cached=$(find "$IMAGE_CACHE_DIR" -type f ! -name '*.part' -printf '%s\n' 2>/dev/null | \
+        awk '{ files++; bytes += $1 } END { printf "%d %.0f", files, bytes }')
+    awk -v files="${cached% *}" -v cached_bytes="${cached#* }" '
+        $1 == "hit" { hits++; saved += $2 } $1 == "miss" { misses++ }
+        END { printf ",\"image_cache\":{\"hits\":%d,\"misses\":%d,\"bytes_saved\":%.0f,\"entries\":%d,\"bytes\":%.0f}", hits, misses, saved, files, cached_bytes }' "$IMAGE_CACHE_STATS_FILE"
+}
+
+# Remove the listed images (space-separated indices) from a segment's downloaded
+# images, renumbering the files that remain; prints the remaining image entries
+drop_segment_images() {
+    local segment_id="$1"
+    local images_json="$2"
+    local image_count="$3"
+    local drop=" $4 "
+    
+    local kept=0 index kept_indices=()
+    for ((index = 0; index < image_count; index++)); do
+        local image_path="$TEMP_DIR/segment_${segment_id}_image_$index.jpg"
+        if [[ "$drop" == *" $index "* ]]; then
+            rm -f "$image_path" "${image_path%.*}_depth.png"
+            continue
+        fi
+        if [ "$index" -ne "$kept" ]; then
+            mv "$image_path" "$TEMP_DIR/segment_${segment_id}_image_$kept.jpg"
+        fi
+        kept_indices+=("$index")
+        kept=$((kept + 1))
+    done
+    echo "$images_json" | ./jq -c --arg kept "${kept_indices[*]}" '. as $images | [$kept | split(" ")[] | tonumber | $images[.]]'
+}
+
+# Unsafe content labels for an image from Rekognition DetectModerationLabels at
+# MODERATION_MIN_CONFIDENCE or options.moderation_min_confidence, limited to the
+# categories in options.moderation_labels when given; prints [{name, parent,
+# confidence}] ([] when clean) and fails when the image could not be screened
+get_moderation_labels() {
+    local image_path="$1"
+    
+    local min_confidence=$(get_option "moderation_min_confidence" "$MODERATION_MIN_CONFIDENCE")
+    local response
+    response=$(rekognition_detect detect-moderation-labels "$image_path" --min-confidence "$min_confidence") || return 1
+    echo "$response" | ./jq -c --argjson categories "$(get_option_json "moderation_labels")" '
+        [.ModerationLabels[]?
+            | select($categories == null or ([.Name, .ParentName] | any(. as $name | $categories | index([$name]))))
+            | {name: .Name, parent: (if .ParentName == "" then null else .ParentName end), confidence: (.Confidence * 10 | round / 10)}]'
+}
+
+# Still-image filters for options.enhancements, applied in the listed order; entries
+# are names or {"name": ..., parameters}. Prints "<name> <filter> <condition>"
+# lines, where condition "upscaled" limits a filter to images smaller than the
+# output. Unknown names, bad parameters and filters missing from the ffmpeg build
+# are reported as warnings
+get_enhancement_filters() {
+    local entry
+    get_option_json "enhancements" | ./jq -c 'if type == "array" then .[] else empty end' | while read -r entry; do
+        local name=$(echo "$entry" | ./jq -r 'if type == "object" then .name // "" else tostring end')
+        local filter="" condition="always" required=""
+        case "$name" in
+            auto_levels)
+                # Stretch the darkest and brightest pixels towards black and white
+                filter="normalize=smoothing=0:independence=0:strength=$(get_enhancement_param "$entry" strength 0.8)"
+                required="normalize"
+                ;;
+            contrast)
+                filter="eq=contrast=$(get_enhancement_param "$entry" contrast 1.1):brightness=$(get_enhancement_param "$entry" brightness 0):saturation=$(get_enhancement_param "$entry" saturation 1.05)"
+                ;;
+            sharpen)
+                filter="unsharp=5:5:$(get_enhancement_param "$entry" amount 0.6):5:5:0"
+                if [ "$(echo "$entry" | ./jq -r 'if type == "object" then .only_when_upscaled else null end')" != "false" ]; then
+                    condition="upscaled"
+                fi
+                ;;
+            denoise)
+                local strength=$(get_enhancement_param "$entry" strength 4)
+                filter="hqdn3d=$strength:$(awk -v s="$strength" 'BEGIN { print s * 0.75 }'):0:0"
+                ;;
+            *)
+                record_warning "invalid_enhancement" "Unknown enhancement '$name'; ignored"
+                continue
+                ;;
+        esac
+        if [ -n "$required" ] && ! has_ffmpeg_filter "$required"; then
+            record_warning "enhancement_unavailable" "Enhancement '$name' needs the $required filter, which this ffmpeg build lacks; skipped"
+            continue
+        fi
+        echo "$name $filter $condition"
+    done
+}
+
+# Numeric parameter of an enhancement entry, falling back to (and warning about) the
+# default when it is missing or not a number
+get_enhancement_param() {
+    local entry="$1"
+    local key="$2"
+    local default_value="$3"
+    
+    local value=$(echo "$entry" | ./jq -r --arg key "$key" 'if type == "object" and .[$key] != null then .[$key] else empty end')
+    if [ -z "$value" ]; then
+        echo "$default_value"
+    elif [[ "$value" =~ ^-?[0-9]+(\.[0-9]+)?$ ]]; then
+        echo "$value"
+    else
+        record_warning "invalid_enhancement" "Enhancement parameter $key '$value' is not a number; using $default_value"
+        echo "$default_value"
+    fi
+}
+
+# Apply preprocessing filter lines (see get_enhancement_filters) to an image in
+# place in one pass; prints the names of the filters applied as a JSON array
+preprocess_image() {
+    local image_path="$1"
+    local filters="$2"
+    
+    local upscaled="" chain="" applied=() name filter condition
+    while read -r name filter condition; do
+        if [ -z "$name" ]; then
+            continue
+        fi
+        if [ "$condition" = "upscaled" ]; then
+            if [ -z "$upscaled" ]; then
+                local dimensions=($(get_image_dimensions "$image_path"))
+                upscaled="false"
+                if [ "${dimensions[0]:-0}" -lt "${DEFAULT_RESOLUTION%x*}" ] || [ "${dimensions[1]:-0}" -lt "${DEFAULT_RESOLUTION#*x}" ]; then
+                    upscaled="true"
+                fi
+            fi
+            if [ "$upscaled" != "true" ]; then
+                continue
+            fi
+        fi
+        chain="${chain:+$chain,}$filter"
+        applied+=("$name")
+    done <<< "$filters"
+    
+    if [ -n "$chain" ]; then
+        local processed_path="${image_path%.*}_preprocessed.png"
+        if ffmpeg -v error -i "$image_path" -vf "$chain" -frames:v 1 -y "$processed_path" > /dev/null 2>&1; then
+            mv "$processed_path" "$image_path"
+        else
+            log "WARNING: Preprocessing failed for $image_path ($chain), using it unprocessed" >&2
+            rm -f "$processed_path"
+            applied=()
+        fi
+    fi
+    printf '%s\n' "${applied[@]}" | ./jq -R . | ./jq -sc 'map(select(. != ""))'
+}
+
+# Rotation (degrees, clockwise positive) that straightens a photo scanned on a
+# flatbed, from where its left edge meets the (white) scanner bed a quarter and
+# three quarters of the way down; prints nothing when the edge is not found or
+# the skew is implausible
+detect_scan_skew() {
+    local image_path="$1"
+    
+    local dimensions=($(get_image_dimensions "$image_path"))
+    local height="${dimensions[1]:-0}"
+    if [ "$height" -lt 40 ]; then
+        return 0
+    fi
+    local band=$((height / 20))
+    local upper_y=$((height / 4)) lower_y=$((height * 3 / 4))
+    local upper_x=$(detect_scan_crop "$image_path" "negate,crop=iw:$band:0:$upper_y" | cut -d: -f3)
+    local lower_x=$(detect_scan_crop "$image_path" "negate,crop=iw:$band:0:$lower_y" | cut -d: -f3)
+    if [ -z "$upper_x" ] || [ -z "$lower_x" ]; then
+        return 0
+    fi
+    awk -v dx="$((lower_x - upper_x))" -v dy="$((lower_y - upper_y))" -v max="$SCAN_MAX_SKEW_DEGREES" 'BEGIN {
+        degrees = atan2(dx, dy) * 180 / 3.14159265
+        if (degrees <= max && degrees >= -max) printf "%.2f", degrees }'
+}
+
+# Content box ("w:h:x:y") cropdetect finds in an image after a prefilter
+detect_scan_crop() {
+    local image_path="$1"
+    local prefilter="$2"
+    
+    ffmpeg -hide_banner -loop 1 -i "$image_path" -frames:v 2 -vf "$prefilter,cropdetect=limit=24:round=2:reset=0" \
+        -f null - 2>&1 | grep -o 'crop=[0-9]*:[0-9]*:[0-9]*:[0-9]*' | tail -1 | cut -d= -f2
+}
+
+# Scanner bed around a photo, white or black, as a crop ("w:h:x:y") inset by 1%
+# to lose the edge shadow; prints nothing when no border stands out
+detect_scan_border() {
+    local image_path="$1"
+    
+    local dimensions=($(get_image_dimensions "$image_path"))
+    local width="${dimensions[0]:-0}" height="${dimensions[1]:-0}"
+    local area=$((width * height))
+    if [ "$area" -eq 0 ]; then
+        return 0
+    fi
+    
+    local best="" best_area="$area" prefilter
+    for prefilter in negate null; do
+        local crop=$(detect_scan_crop "$image_path" "$prefilter")
+        local box=(${crop//:/ })
+        if [ "${#box[@]}" -ne 4 ]; then
+            continue
+        fi
+        local crop_area=$((box[0] * box[1]))
+        # A real border removes at least 2% of the scan and leaves at least 40% of it
+        if [ $((crop_area * 100)) -le $((area * 98)) ] && [ $((crop_area * 100)) -ge $((area * 40)) ] && \
+                [ "$crop_area" -lt "$best_area" ]; then
+            best="${box[*]}"
+            best_area="$crop_area"
+        fi
+    done
+    if [ -z "$best" ]; then
+        return 0
+    fi
+    local box=($best)
+    local inset_x=$((box[0] / 100)) inset_y=$((box[1] / 100))
+    echo "$((box[0] - 2 * inset_x)):$((box[1] - 2 * inset_y)):$((box[2] + inset_x)):$((box[3] + inset_y))"
+}
+
+# The scanned_photo restoration preset (options.restoration): straighten a skewed
+# scan, crop away the scanner bed, median-filter dust and scratches, and balance
+# levels with the channels linked so sepia and faded tints survive. Each step is
+# applied in place; prints {applied: [...], details: {...}} for the response
+restore_scanned_image() {
+    local image_path="$1"
+    
+    local applied=() details="{}"
+    local skew=$(detect_scan_skew "$image_path")
+    if [ -n "$skew" ] && [ "$(awk -v d="$skew" 'BEGIN { print (d >= 0.3 || d <= -0.3) }')" = "1" ]; then
+        local straightened_path="${image_path%.*}_straightened.png"
+        if ffmpeg -v error -i "$image_path" -vf "rotate=$skew*PI/180:fillcolor=white" -frames:v 1 -y "$straightened_path" > /dev/null 2>&1; then
+            mv "$straightened_path" "$image_path"
+            applied+=("deskew")
+            details=$(echo "$details" | ./jq -c --argjson degrees "$skew" '.deskew = {degrees: $degrees}')
+        else
+            rm -f "$straightened_path"
+        fi
+    fi
+    
+    local filters=() border=$(detect_scan_border "$image_path")
+    if [ -n "$border" ]; then
+        filters+=("crop=$border")
+        applied+=("border_crop")
+        details=$(echo "$details" | ./jq -c --arg crop "$border" '.border_crop = {crop: $crop}')
+    fi
+    if has_ffmpeg_filter "median"; then
+        filters+=("median=radius=1")
+        applied+=("dust_removal")
+    fi
+    if has_ffmpeg_filter "normalize"; then
+        filters+=("normalize=smoothing=0:independence=0:strength=0.6")
+        applied+=("color_balance")
+    fi
+    
+    if [ "${#filters[@]}" -gt 0 ]; then
+        local restored_path="${image_path%.*}_restored.png"
+        if ffmpeg -v error -i "$image_path" -vf "$(IFS=,; echo "${filters[*]}")" -frames:v 1 -y "$restored_path" > /dev/null 2>&1; then
+            mv "$restored_path" "$image_path"
+        else
+            log "WARNING: Restoration failed for $image_path, using it as scanned" >&2
+            rm -f "$restored_path"
+            applied=("${applied[@]/border_crop}")
+            applied=("${applied[@]/dust_removal}")
+            applied=("${applied[@]/color_balance}")
+            details=$(echo "$details" | ./jq -c 'del(.border_crop)')
+        fi
+    fi
+    log "Restored $image_path: ${applied[*]:-nothing to do}" >&2
+    printf '%s\n' "${applied[@]}" | ./jq -R . | ./jq -sc --argjson details "$details" '{applied: map(select(. != "")), details: $details}'
+}
+
+# Upscale a small image in place so it covers the Ken Burns working frame instead of
+# being stretched there by the oversample; prints {method, applied, source,
+# effective_resolution} for the preprocessing report
+upscale_image() {
+    local image_path="$1"
+    local method="$2"
+    
+    local dimensions=($(get_image_dimensions "$image_path"))
+    local width="${dimensions[0]:-0}" height="${dimensions[1]:-0}"
+    local working=($(get_working_frame))
+    local result="$width $height" applied="false"
+    local long_side=$((width > height ? width : height))
+    # Smallest whole factor (2 or 4 for external upscalers) covering the working frame
+    local factor=$(awk -v w="$width" -v h="$height" -v ww="${working[0]}" -v wh="${working[1]}" -v method="$method" 'BEGIN {
+        f = ww / w; if (wh / h > f) f = wh / h
+        f = (f == int(f)) ? f : int(f) + 1
+        if (method == "external") f = (f <= 2) ? 2 : 4
+        if (f > 4) f = 4
+        print f }')
+    
+    if [ "$width" -gt 0 ] && [ "$long_side" -lt "$UPSCALE_MIN_SIDE" ] && [ "$factor" -gt 1 ]; then
+        local upscaled_path="${image_path%.*}_upscaled.png"
+        case "$method" in
+            lanczos)
+                ffmpeg -v error -i "$image_path" -vf "scale=iw*$factor:ih*$factor:flags=lanczos+accurate_rnd,unsharp=5:5:0.5:5:5:0" \
+                    -frames:v 1 -y "$upscaled_path" > /dev/null 2>&1
+                ;;
+            external)
+                if [ -z "$UPSCALER_COMMAND" ]; then
+                    record_warning "upscaler_unavailable" "upscale \"external\" needs UPSCALER_COMMAND; image left at ${width}x$height"
+                else
+                    $UPSCALER_COMMAND "$image_path" "$upscaled_path" "$factor" > /dev/null 2>&1
+                fi
+                ;;
+        esac
+        if [ -s "$upscaled_path" ]; then
+            mv "$upscaled_path" "$image_path"
+            result=$(get_image_dimensions "$image_path")
+            applied="true"
+            log "Upscaled $image_path ${factor}x ($method) from ${width}x$height to ${result/ /x}" >&2
+        else
+            log "WARNING: Could not upscale $image_path ($method)" >&2
+            rm -f "$upscaled_path"
+        fi
+    fi
+    ./jq -nc --arg method "$method" --argjson applied "$applied" --arg source "${width}x$height" --arg effective "${result/ /x}" \
+        '{method: $method, applied: $applied, source: $source, effective_resolution: $effective}'
+}
+
+# Red, green and blue (0-255) of a #RRGGBB or 0xRRGGBB color; fails for anything else
+parse_hex_color() {
+    local color="$1"
+    
+    color="${color#\#}"
+    color="${color#0x}"
+    if [[ ! "$color" =~ ^[0-9A-Fa-f]{6}$ ]]; then
+        return 1
+    fi
+    echo "$((16#${color:0:2})) $((16#${color:2:2})) $((16#${color:4:2}))"
+}
+
+# Background source for fit "contain", sized to the canvas: a pad_gradient
+# ({"from", "to", "direction": vertical|horizontal} or ["#top", "#bottom"]) or
+# a pad_color (#RRGGBB, 0xRRGGBB or an ffmpeg color name, default black), taken
+# from the image entry or the options
+get_pad_background() {
+    local image_json="$1"
+    local canvas_width="$2"
+    local canvas_height="$3"
+    
+    local gradient=$(echo "$image_json" | ./jq -c --argjson default "$(get_option_json "pad_gradient")" '.pad_gradient // $default
+        | if type == "array" then {from: .[0], to: .[1]} elif type == "object" then . else empty end')
+    if [ -n "$gradient" ]; then
+        local from to
+        if from=($(parse_hex_color "$(echo "$gradient" | ./jq -r '.from // ""')")) && \
+                to=($(parse_hex_color "$(echo "$gradient" | ./jq -r '.to // ""')")); then
+            local axis="Y/H"
+            if [ "$(echo "$gradient" | ./jq -r '.direction // "vertical"')" = "horizontal" ]; then
+                axis="X/W"
+            fi
+            echo "color=c=black:s=${canvas_width}x$canvas_height,format=rgb24,geq=r='${from[0]}+(${to[0]}-${from[0]})*$axis':g='${from[1]}+(${to[1]}-${from[1]})*$axis':b='${from[2]}+(${to[2]}-${from[2]})*$axis'"
+            return 0
+        fi
+        record_warning "invalid_pad_color" "pad_gradient needs #RRGGBB from/to colors; using pad_color"
+    fi
+    
+    local color=$(echo "$image_json" | ./jq -r --arg default "$(get_option "pad_color" "black")" '.pad_color // $default')
+    local rgb
+    if rgb=($(parse_hex_color "$color")); then
+        color=$(printf '0x%02X%02X%02X' "${rgb[@]}")
+    elif [[ ! "$color" =~ ^[a-zA-Z]+$ ]]; then
+        record_warning "invalid_pad_color" "pad_color '$color' is not #RRGGBB or a color name; using black"
+        color="black"
+    fi
+    echo "color=c=$color:s=${canvas_width}x$canvas_height"
+}
+
+# Pad an image in place to the output aspect ratio for a fit mode other than the
+# default "cover" (which leaves the Ken Burns chain to crop it): "blur_pad" sets
+# the whole image over a blurred, zoomed copy of itself and "contain" over a solid
+# color or gradient (see get_pad_background). The motion then moves over the padded
+# canvas, and keyframe rects and focal points refer to it. Prints the canvas size
+# when the image was padded
+fit_image_to_output() {
+    local image_path="$1"
+    local fit="$2"
+    local image_json="${3:-{\}}"
+    
+    local dimensions=($(get_image_dimensions "$image_path"))
+    local width="${dimensions[0]:-0}" height="${dimensions[1]:-0}"
+    local output_width="${DEFAULT_RESOLUTION%x*}" output_height="${DEFAULT_RESOLUTION#*x}"
+    if [ "$width" -eq 0 ] || [ "$height" -eq 0 ]; then
+        return 0
+    fi
+    
+    local canvas_width="$width" canvas_height="$height"
+    if [ $((width * output_height)) -gt $((height * output_width)) ]; then
+        canvas_height=$(((width * output_height / output_width + 1) / 2 * 2))
+    else
+        canvas_width=$(((height * output_width / output_height + 1) / 2 * 2))
+    fi
+    # Within 1% of the output shape there is nothing worth padding
+    if [ $((canvas_width * canvas_height * 100)) -le $((width * height * 101)) ]; then
+        return 0
+    fi
+    # The Ken Burns chain scales everything to the working frame, so a wide
+    # panorama is shrunk first rather than padded to a canvas of hundreds of
+    # megapixels
+    local image="[0:v]"
+    local work_width work_height
+    read work_width work_height <<< "$(get_working_frame)"
+    if [ "$canvas_width" -gt "$work_width" ]; then
+        canvas_width="$work_width"
+        canvas_height="$work_height"
+        image="[0:v]scale=$canvas_width:$canvas_height:force_original_aspect_ratio=decrease:flags=lanczos,"
+    fi
+    
+    local filter
+    case "$fit" in
+        blur_pad)
+            filter="${image}split[background][foreground];
+                [background]scale=$((canvas_width / 4 + 1)):$((canvas_height / 4 + 1)):force_original_aspect_ratio=increase,crop=$((canvas_width / 4 + 1)):$((canvas_height / 4 + 1)),gblur=sigma=12,eq=brightness=-0.08:saturation=0.85,scale=$canvas_width:$canvas_height[blurred];
+                [blurred][foreground]overlay=(W-w)/2:(H-h)/2"
+            ;;
+        contain)
+            filter="$(get_pad_background "$image_json" "$canvas_width" "$canvas_height")[background];
+                ${image}null[foreground];
+                [background][foreground]overlay=(W-w)/2:(H-h)/2"
+            ;;
+        *)
+            record_warning "invalid_fit" "Unknown fit '$fit'; cropping to cover instead"
+            return 0
+            ;;
+    esac
+    
+    local fitted_path="${image_path%.*}_fitted.png"
+    if ffmpeg -v error -i "$image_path" -filter_complex "$filter" -frames:v 1 -y "$fitted_path" > /dev/null 2>&1; then
+        mv "$fitted_path" "$image_path"
+        log "Padded $image_path from ${width}x$height to ${canvas_width}x$canvas_height ($fit)" >&2
+        echo "${canvas_width}x$canvas_height"
+    else
+        log "WARNING: Could not pad $image_path ($fit), cropping it instead" >&2
+        rm -f "$fitted_path"
+    fi
+}
+
+# Blur an image beyond recognition in place (moderation "blur" policy)
+blur_image() {
+    local image_path="$1"
+    
+    local blurred_path="${image_path%.*}_blurred.png"
+    if ffmpeg -v error -i "$image_path" -vf "gblur=sigma=60:steps=3" -frames:v 1 -y "$blurred_path" > /dev/null 2>&1; then
+        mv "$blurred_path" "$image_path"
+    else
+        log "WARNING: Could not blur $image_path" >&2
+        rm -f "$blurred_path"
+        return 1
+    fi
+}
+
+# For each of a segment's downloaded images, the index of the first image with the
+# same content (its own index when it is not a repeat)
+get_duplicate_image_map() {
+    local segment_id="$1"
+    local image_count="$2"
+    
+    local index
+    for ((index = 0; index < image_count; index++)); do
+        md5sum < "$TEMP_DIR/segment_${segment_id}_image_$index.jpg" | cut -c1-32
+    done | awk '{ if (!($1 in first)) first[$1] = NR - 1; print first[$1] }'
+}
+
+# Give every showing of a repeated image its own preset move; images with an
+# explicit motion keep it
+vary_duplicate_motion() {
+    local images_json="$1"
+    local first_of="$2"
+    
+    echo "$images_json" | ./jq -c --arg first_of "$first_of" '
+        ($first_of | split(" ") | map(tonumber)) as $first
+        | ["zoom_in", "zoom_out", "pan_left", "pan_right", "diagonal"] as $presets
+        | [$first[] as $f | $first | map(select(. == $f)) | length] as $counts
+        | reduce range(0; length) as $i (.;
+            if $i >= ($first | length) or $counts[$i] < 2 or (.[$i] | has("motion") or .start_rect or .end_rect) then .
+            else .[$i].motion = $presets[([$first[0:$i][] | select(. == $first[$i])] | length) % 5] end)'
+}
+
+# Download image from URL, data: URI or s3:// URI, rejecting non-image responses
+# S3 and some CDNs serve images as generic binary streams, so those pass too
+download_image() {
+    local url="$1"
+    local local_path="$2"
+    local request_json="${3:-null}"
+    local max_bytes="$4"
+    
+    if [[ "$url" == data:* ]]; then
+        decode_data_uri "$url" "$local_path" "$max_bytes"
+        return
+    fi
+    if [[ "$url" == s3://* ]]; then
+        fetch_input_file "$url" "$local_path" || return 1
+        local size=$(wc -c < "$local_path")
+        if [ -n "$max_bytes" ] && [ "$size" -gt "$max_bytes" ]; then
+            log "ERROR: Download exceeds ${max_bytes} bytes: $url" >&2
+            rm -f "$local_path"
+            return 2
+        fi
+        return 0
+    fi
+    download_url "$url" "$local_path" "$request_json" '^(image/|application/pdf|application/octet-stream|binary/octet-stream)' "$max_bytes"
+}
+
+# Sign a CloudFront distribution path with the configured key pair (canned policy)
+get_cloudfront_signed_url() {
+    local path="$1"
+    local key_file="$TEMP_DIR/cloudfront_private_key.pem"
+    
+    if [ -z "$CLOUDFRONT_DOMAIN" ] || [ -z "$CLOUDFRONT_KEY_PAIR_ID" ]; then
+        log "ERROR: CloudFront signing requires CLOUDFRONT_DOMAIN and CLOUDFRONT_KEY_PAIR_ID" >&2
+        return 1
+    fi
+    
+    if [ ! -s "$key_file" ]; then
+        (umask 077; aws ssm get-parameter --name "$CLOUDFRONT_PRIVATE_KEY_PARAM" --with-decryption \
+            --query Parameter.Value --output text > "$key_file") || { rm -f "$key_file"; return 1; }
+    fi
+    
+    aws cloudfront sign \
+        --url "https://$CLOUDFRONT_DOMAIN/${path#/}" \
+        --key-pair-id "$CLOUDFRONT_KEY_PAIR_ID" \
+        --private-key "file://$key_file" \
+        --date-less-than $(($(date +%s) + CLOUDFRONT_URL_TTL))
+}
+
+# Resolve an image entry to a download URL, signing cloudfront_path entries,
+# turning an inline base64 (or data) field into a data: URI and an s3_key (in the project
+# bucket unless the entry names a bucket or access point ARN) into an s3:// URI
+get_image_source_url() {
+    local image_json="$1"
+    
+    local url=$(echo "$image_json" | ./jq -r '.url // empty')
+    if [ -n "$url" ]; then
+        echo "$url"
+        return 0
+    fi
+    local s3_key=$(echo "$image_json" | ./jq -r '.s3_key // empty')
+    if [ -n "$s3_key" ]; then
+        echo "s3://$(echo "$image_json" | ./jq -r --arg bucket "$BUCKET_NAME" '.bucket // $bucket')/${s3_key#/}"
+        return 0
+    fi
+    local base64_data=$(echo "$image_json" | ./jq -r '.base64 // .data // empty')
+    if [ -n "$base64_data" ]; then
+        echo "data:$(echo "$image_json" | ./jq -r '.content_type // "application/octet-stream"');base64,$base64_data"
+        return 0
+    fi
+    local cloudfront_path=$(echo "$image_json" | ./jq -r '.cloudfront_path // empty')
+    if [ -n "$cloudfront_path" ]; then
+        get_cloudfront_signed_url "$cloudfront_path"
+    fi
+}
+
+# Bucket name, or access point ARN, of an s3:// URI
+get_s3_uri_bucket() {
+    local path="${1#s3://}"
+    
+    if [[ "$path" == arn:* ]]; then
+        echo "$path" | sed -E 's#^(arn:[^:]+:[^:]+:[^:]*:[^:]*:accesspoint/[^/]+).*#\1#'
+    else
+        echo "${path%%/*}"
+    fi
+}
+
+# Check whether reads from a bucket or access point should pay as requester
+# options.requester_pays is true (every bucket but our own) or a list of buckets/ARNs
+is_requester_pays_source() {
+    local bucket="$1"
+    
+    if [ "$bucket" = "$BUCKET_NAME" ]; then
+        return 1
+    fi
+    get_option_json "requester_pays" | \
+        ./jq -e --arg bucket "$bucket" 'if type == "array" then index($bucket) != null else . == true end' > /dev/null
+}
+
+# Fetch an input referenced by URL, s3:// URI, S3 access point ARN, or key in the project bucket
+fetch_input_file() {
+    local source="$1"
+    local local_path="$2"
+    
+    case "$source" in
+        http://*|https://*)
+            download_url "$source" "$local_path"
+            ;;
+        arn:aws*:s3*:*:accesspoint/*)
+            fetch_input_file "s3://$source" "$local_path"
+            ;;
+        s3://*)
+            local s3_args=()
+            if is_requester_pays_source "$(get_s3_uri_bucket "$source")"; then
+                s3_args+=(--request-payer requester)
+            fi
+            log "Downloading from S3: $source${s3_args:+ (requester pays)}"
+            s3_with_retry s3 cp "$source" "$local_path" "${s3_args[@]}" || return 1
+            ;;
+        *)
+            download_s3_file "$source" "$local_path"
+            ;;
+    esac
+}
+
+# Generate Ken Burns video from image with variety of effects
+generate_ken_burns_video() {
+    local input_image="$1"
+    local output_video="$2"
+    local duration="$3"
+    local motion="${4:-random}"
+    local overlay_filter="$5"
+    local image_json="${6:-{\}}"
+    local segment_id="${7:-$SEGMENT_ID}"
+    
+    log "Generating Ken Burns video: $input_image -> $output_video (motion: $motion)"
+    
+    # options.loop_style "bounce" plays the move forward then reversed so the clip
+    # loops seamlessly; the move itself gets half the clip
+    local clip_duration="$duration"
+    local bounce="false"
+    if [ "$(get_option "loop_style" "none")" = "bounce" ] && [ "$SEGMENT_IMAGE_COUNT" -le 1 ]; then
+        bounce="true"
+        duration=$(awk -v d="$duration" 'BEGIN { printf "%.3f", d / 2 }')
+    fi
+    
+    # Check available memory before processing
+    local available_mem=$(df /tmp | tail -1 | awk '{print $4}')
+    log "Available /tmp space before processing: ${available_mem}KB"
+    
+    # Parallax layers random motion by depth, smart crop frames it around detected
+    # faces and the saliency pan strategy steers it across the detailed part of
+    # wide and tall images
+    if [ "$motion" = "random" ] && { [ "$(get_option "parallax" "false")" = "true" ] || \
+            [ -n "$(echo "$image_json" | ./jq -r '.depth_map_url // empty')" ]; }; then
+        motion="parallax"
+    elif [ "$motion" = "random" ] && [ "$(get_option "smart_crop" "false")" = "true" ]; then
+        motion="smart_crop"
+    elif [ "$motion" = "random" ] && [ "$(get_option "pan_strategy" "random")" = "saliency" ]; then
+        motion="saliency_pan"
+    fi
+    
+    # Long images can chain several moves instead of one (options.phases, once the
+    # image is on screen for options.phases_min_duration seconds)
+    local phases=$(get_option "phases" "1")
+    if [ "$motion" = "random" ] && [[ "$phases" =~ ^[23]$ ]] && \
+            [ "$(awk -v d="$duration" -v min="$(get_option "phases_min_duration" "8")" 'BEGIN { print (d >= min) }')" = "1" ]; then
+        motion="multi_phase"
+    fi
+    
+    # The legacy random crops cannot serve every render, so pick a preset instead
+    local focal=$(get_focal_point "$image_json")
+    if [ "$motion" = "random" ] && needs_motion_preset "$focal"; then
+        motion=$(get_random_motion_preset)
+        log "Using $motion motion${focal:+ around focal point $focal}"
+    fi
+    
+    # Pick the Ken Burns effect for the requested motion
+    local ken_burns_filter
+    case "$motion" in
+        zoom_to_subject)
+            ken_burns_filter=$(get_zoom_to_subject_effect "$input_image" "$duration")
+            ;;
+        smart_crop)
+            ken_burns_filter=$(get_smart_crop_effect "$input_image" "$duration")
+            if [ -z "$ken_burns_filter" ]; then
+                log "Smart crop found no faces, using random motion"
+                ken_burns_filter=$(get_random_motion_effect "$duration" "$input_image" "$focal")
+            fi
+            ;;
+        parallax)
+            local depth_map=$(get_depth_map "$input_image" "$image_json")
+            if [ -n "$depth_map" ]; then
+                ken_burns_filter=$(get_parallax_effect "$input_image" "$depth_map" "$duration" "$focal")
+            else
+                log "WARNING: No depth map for parallax, using random motion"
+                ken_burns_filter=$(get_random_motion_effect "$duration" "$input_image" "$focal")
+            fi
+            ;;
+        saliency_pan)
+            ken_burns_filter=$(get_saliency_pan_effect "$input_image" "$duration")
+            if [ -z "$ken_burns_filter" ]; then
+                ken_burns_filter=$(get_random_motion_effect "$duration" "$input_image" "$focal")
+            fi
+            ;;
+        multi_phase)
+            ken_burns_filter=$(get_multi_phase_effect "$duration" "$phases" "$input_image" "$focal")
+            ;;
+        keyframes)
+            ken_burns_filter=$(get_keyframe_effect "$input_image" "$image_json" "$duration")
+            ;;
+        zoom_in|zoom_out|pan_left|pan_right|diagonal)
+            ken_burns_filter=$(get_motion_preset_effect "$motion" "$duration" "$input_image" "$focal")
+            ;;
+        *)
+            if [ "$motion" != "random" ]; then
+                log "Warning: Unknown motion '$motion', using random motion"
+            fi
+            ken_burns_filter=$(get_random_motion_effect "$duration" "$input_image" "$focal")
+            ;;
+    esac
+    
+    # Optional slow roll layered on top of the zoom/pan
+    local rotation=$(get_rotation_degrees "$image_json")
+    if [ -n "$rotation" ] && [ "$(awk -v d="$rotation" 'BEGIN { print (d != 0) }')" = "1" ]; then
+        ken_burns_filter="$ken_burns_filter,$(get_rotation_filter "$rotation" "$duration")"
+    fi
+    
+    # Rack focus over the moving frame
+    local pull_focus_filter=$(get_pull_focus_filter "$image_json" "$duration")
+    if [ -n "$pull_focus_filter" ]; then
+        ken_burns_filter="$ken_burns_filter,$pull_focus_filter"
+    fi
+    
+    # The reversed half skips its first frame so the turnaround does not stutter;
+    # it runs after the downscale because reverse buffers every frame of the half
+    local bounce_filter=""
+    if [ "$bounce" = "true" ]; then
+        bounce_filter=",split[bounce_forward][bounce_source];
+        [bounce_source]reverse,trim=start_frame=1,setpts=PTS-STARTPTS[bounce_back];
+        [bounce_forward][bounce_back]concat=n=2:v=1:a=0"
+    fi
+    
+    # Style presets add their grade/matte after scaling so every segment matches
+    local style_filter=$(get_style_filter)
+    if [ -n "$style_filter" ]; then
+        style_filter=",$style_filter"
+    fi
+    
+    # Era grades (options.grade) run ahead of the style's own grade and matte
+    local grade_filter=$(get_grade_filter)
+    if [ -n "$grade_filter" ]; then
+        style_filter=",$grade_filter$style_filter"
+    fi
+    
+    # A LUT (the image's lut, else options.lut) grades the frame ahead of the style
+    local lut_source=$(echo "$image_json" | ./jq -r --arg lut "$(get_option "lut" "")" '.lut // $lut')
+    if [ -n "$lut_source" ]; then
+        local lut_file
+        if lut_file=$(get_cached_lut "$lut_source"); then
+            style_filter=",lut3d=file=$lut_file:interp=tetrahedral$style_filter"
+        else
+            record_warning "lut_unavailable" "Could not load LUT ${lut_source%%\?*}; rendering without it"
+        fi
+    fi
+    local effects_filter=$(get_effects_filter "$clip_duration")
+    if [ -n "$effects_filter" ]; then
+        style_filter="$style_filter,$effects_filter"
+    fi
+    if [ -n "$overlay_filter" ]; then
+        style_filter="$style_filter,$overlay_filter"
+    fi
+    # The watermark sits above every other overlay, and the QA overlay above that
+    style_filter="$style_filter$(get_watermark_graph "segments")"
+    local debug_filter=$(get_debug_overlay_filter "$motion" "$clip_duration" "$ken_burns_filter" "$image_json" "$segment_id")
+    if [ -n "$debug_filter" ]; then
+        style_filter="$style_filter,$debug_filter"
+    fi
+    
+    # Create ultra-smooth Ken Burns effect with memory-optimized settings
+    # Reduced quality for memory efficiency while maintaining smoothness
+    local frame_count=$(frames_for_duration "$duration")
+    
+    # Use faster preset and higher CRF to reduce memory usage
+    encode_ffmpeg -i "$input_image" \
+        -filter_complex "
+        $ken_burns_filter,
+        scale=$DEFAULT_RESOLUTION:flags=lanczos$bounce_filter$style_filter
+        " \
+        -t "$clip_duration" \
+        "${SEGMENT_ENCODE_ARGS[@]}" \
+        -y "$output_video" || return 1
+    
+    # Immediately verify file was created and log size
+    if [ -f "$output_video" ]; then
+        local video_size=$(stat -f%z "$output_video" 2>/dev/null || echo "unknown")
+        log "Generated video: $output_video (${video_size} bytes)"
+    else
+        log "ERROR: Video file was not created: $output_video"
+        return 1
+    fi
+}
+
+# Whether random motion needs a preset: the legacy random crops are sized for
+# 1920x1080 (other output sizes and aspects would stretch) and cannot follow a
+# focal point, be supersampled, hold or shake
+needs_motion_preset() {
+    local focal="$1"
+    
+    [ -n "$focal" ] || [ "$(get_motion_supersample)" -gt 1 ] || \
+        [ "$DEFAULT_RESOLUTION" != "1920x1080" ] || \
+        [ "$(get_option "motion_profile" "linear")" = "hold" ] || [ -n "$(get_shake_term x)" ]
+}
+
+# A motion preset picked by the motion roll
+get_random_motion_preset() {
+    local presets=(zoom_in zoom_out pan_left pan_right diagonal)
+    echo "${presets[$(($(get_motion_roll) % ${#presets[@]}))]}"
+}
+
+# Random motion for a fallback (smart crop without faces, parallax without a depth
+# map, saliency with nothing to steer toward, unknown motions): a preset when
+# needs_motion_preset says so, else a legacy random crop
+get_random_motion_effect() {
+    local duration="$1"
+    local input_image="$2"
+    local focal="$3"
+    
+    if needs_motion_preset "$focal"; then
+        local preset=$(get_random_motion_preset)
+        log "Using $preset motion${focal:+ around focal point $focal}" >&2
+        get_motion_preset_effect "$preset" "$duration" "$input_image" "$focal"
+        return
+    fi
+    get_random_ken_burns_effect "$duration"
+}
+
+# Roll for random effect selection; with options.seed the roll comes from the seed
+# and segment id instead, so re-running a segment picks the same motion
+get_motion_roll() {
+    local seed=$(get_option "seed" "")
+    if [ -z "$seed" ]; then
+        echo "$RANDOM"
+        return 0
+    fi
+    printf '%s:%s' "$seed" "$SEGMENT_ID" | cksum | awk '{ print $1 }'
+}
+
+# Keep a legacy scale+crop effect's window inside the scaled source: sample its
+# x/y/w/h expressions over the clip and, when the window would leave the source,
+# clamp the offsets in the filter and record a motion_clamped warning
+clamp_crop_effect() {
+    local effect="$1"
+    local duration="$2"
+    
+    local pattern="^scale=([0-9]+):([0-9]+)(:[^,]*)?,crop='([^']*)':'([^']*)':x='([^']*)':y='([^']*)'$"
+    if ! [[ "$effect" =~ $pattern ]]; then
+        echo "$effect"
+        return 0
+    fi
+    local scaled_w="${BASH_REMATCH[1]}" scaled_h="${BASH_REMATCH[2]}" scale_args="${BASH_REMATCH[3]}"
+    local w_expr="${BASH_REMATCH[4]}" h_expr="${BASH_REMATCH[5]}" x_expr="${BASH_REMATCH[6]}" y_expr="${BASH_REMATCH[7]}"
+    
+    # The expressions only use t, arithmetic, sin and cos, which awk evaluates as-is
+    local overshoot=$(awk -v sw="$scaled_w" -v sh="$scaled_h" "BEGIN {
+        worst = 0
+        for (i = 0; i <= 48; i++) {
+            t = $duration * i / 48
+            w = $w_expr; h = $h_expr; x = $x_expr; y = $y_expr
+            if (-x > worst) worst = -x
+            if (-y > worst) worst = -y
+            if (x + w - sw > worst) worst = x + w - sw
+            if (y + h - sh > worst) worst = y + h - sh
+        }
+        printf \"%d\", worst
+    }")
+    if [ "${overshoot:-0}" -lt 1 ]; then
+        echo "$effect"
+        return 0
+    fi
+    
+    record_warning "motion_clamped" "Motion left the ${scaled_w}x${scaled_h} source by up to ${overshoot}px; offsets clamped to its edges"
+    echo "scale=$scaled_w:$scaled_h$scale_args,crop='$w_expr':'$h_expr':x='max(0,min(iw-ow,$x_expr))':y='max(0,min(ih-oh,$y_expr))'"
+}
+
+# Get random Ken Burns effect for variety
+get_random_ken_burns_effect() {
+    local duration="$1"
+    local frames=$(frames_for_duration "$duration")
+    
+    # ULTRA-SMOOTH KEN BURNS EFFECTS - Complete rewrite using scale/crop approach
+    # NEW APPROACH: Use time-based interpolation instead of incremental zoom
+    # This provides perfectly smooth motion without jitter
+    local total_frames=$frames
+    
+    local effects=(
+        # 1. Ultra-smooth zoom in from center using time-based interpolation
+        "scale=2560:1440:flags=lanczos,crop='1920+200*sin(t/($duration)*3.14159)':'1080+150*sin(t/($duration)*3.14159)':x='320-100*sin(t/($duration)*3.14159)':y='180-75*sin(t/($duration)*3.14159)'"
+        
+        # 2. Smooth zoom out from center
+        "scale=3840:2160:flags=lanczos,crop='1920+960*cos(t/($duration)*3.14159)':'1080+540*cos(t/($duration)*3.14159)':x='960-480*cos(t/($duration)*3.14159)':y='540-270*cos(t/($duration)*3.14159)'"
+        
+        # 3. Gentle pan left to right with slight zoom
+        "scale=2560:1440:flags=lanczos,crop='1920+100*sin(t/($duration)*3.14159)':'1080+50*sin(t/($duration)*3.14159)':x='320*t/($duration)':y='180-25*sin(t/($duration)*3.14159)'"
+        
+        # 4. Gentle pan right to left with slight zoom  
+        "scale=2560:1440:flags=lanczos,crop='1920+100*sin(t/($duration)*3.14159)':'1080+50*sin(t/($duration)*3.14159)':x='320*(1-t/($duration))':y='180-25*sin(t/($duration)*3.14159)'"
+        
+        # 5. Smooth diagonal pan (top-left to bottom-right)
+        "scale=2560:1440:flags=lanczos,crop='1920+150*sin(t/($duration)*3.14159)':'1080+75*sin(t/($duration)*3.14159)':x='320*t/($duration)':y='180*t/($duration)'"
+        
+        # 6. Smooth diagonal pan (bottom-right to top-left)
+        "scale=2560:1440:flags=lanczos,crop='1920+150*sin(t/($duration)*3.14159)':'1080+75*sin(t/($duration)*3.14159)':x='320*(1-t/($duration))':y='180*(1-t/($duration))'"
+        
+        # 7. Cinematic slow zoom with subtle movement
+        "scale=2048:1152:flags=lanczos,crop='1920+64*sin(t/($duration)*3.14159)':'1080+36*sin(t/($duration)*3.14159)':x='64*sin(t/($duration)*1.5)':y='36*cos(t/($duration)*1.5)'"
+        
+        # 8. Gentle circular motion
+        "scale=2560:1440:flags=lanczos,crop='1920+100*sin(t/($duration)*3.14159)':'1080+100*sin(t/($duration)*3.14159)':x='320+100*sin(t/($duration)*6.28)':y='180+100*cos(t/($duration)*6.28)'"
+        
+        # 9. Smooth focus shift top to bottom
+        "scale=2560:1440:flags=lanczos,crop='1920+120*sin(t/($duration)*3.14159)':'1080+60*sin(t/($duration)*3.14159)':x='320-60*sin(t/($duration)*3.14159)':y='180*t/($duration)'"
+        
+        # 10. Smooth focus shift bottom to top
+        "scale=2560:1440:flags=lanczos,crop='1920+120*sin(t/($duration)*3.14159)':'1080+60*sin(t/($duration)*3.14159)':x='320-60*sin(t/($duration)*3.14159)':y='180*(1-t/($duration))'"
+        
+        # 11. Ultra-cinematic slow zoom with drift
+        "scale=2304:1296:flags=lanczos,crop='1920+192*sin(t/($duration)*3.14159)':'1080+108*sin(t/($duration)*3.14159)':x='192*sin(t/($duration)*2)':y='108*cos(t/($duration)*2)'"
+        
+        # 12. Subtle breathing effect (zoom in/out)
+        "scale=2560:1440:flags=lanczos,crop='1920+320*sin(t/($duration)*6.28)':'1080+180*sin(t/($duration)*6.28)':x='320*sin(t/($duration)*6.28)':y='180*sin(t/($duration)*6.28)'"
+        
+        # 13. Gentle S-curve pan
+        "scale=2560:1440:flags=lanczos,crop='1920+100*sin(t/($duration)*3.14159)':'1080+50*sin(t/($duration)*3.14159)':x='320*sin(t/($duration)*3.14159)':y='180*cos(t/($duration)*3.14159)'"
+        
+        # 14. Smooth arc motion
+        "scale=2560:1440:flags=lanczos,crop='1920+150*sin(t/($duration)*3.14159)':'1080+75*sin(t/($duration)*3.14159)':x='320*cos(t/($duration)*3.14159)':y='180*sin(t/($duration)*3.14159)'"
+        
+        # 15. Cinematic reveal (zoom out with drift)
+        "scale=3840:2160:flags=lanczos,crop='1920+960*cos(t/($duration)*3.14159)':'1080+540*cos(t/($duration)*3.14159)':x='960*cos(t/($duration)*3.14159)+200*sin(t/($duration)*2)':y='540*cos(t/($duration)*3.14159)+150*cos(t/($duration)*2)'"
+    )
+    
+    # Styles may restrict the pool to gentler moves
+    local roll=$(get_motion_roll)
+    local allowed=($(get_style_effect_indexes))
+    if [ ${#allowed[@]} -gt 0 ]; then
+        clamp_crop_effect "${effects[${allowed[$((roll % ${#allowed[@]}))]}]}" "$duration"
+        return 0
+    fi
+    
+    # Get random effect
+    local effect_count=${#effects[@]}
+    local random_index=$((roll % effect_count))
+    clamp_crop_effect "${effects[$random_index]}" "$duration"
+}
+
+# Get image dimensions as "width height"
+get_image_dimensions() {
+    local image_path="$1"
+    ffprobe -v quiet -select_streams v:0 -show_entries stream=width,height -of csv=p=0:s=' ' "$image_path" 2>/dev/null
+}
+
+# Run a Rekognition image operation (detect-faces, detect-labels) on a local image,
+# printing the JSON response; images over the 5MB request limit are sent downscaled
+rekognition_detect() {
+    local operation="$1"
+    local image_path="$2"
+    shift 2
+    
+    local request_image="$image_path"
+    if [ "$(wc -c < "$image_path")" -gt 5000000 ]; then
+        request_image="${image_path%.*}_rekognition.jpg"
+        ffmpeg -i "$image_path" -vf "scale='min(1920,iw)':-2" -q:v 3 -y "$request_image" > /dev/null 2>&1 || return 1
+    fi
+    
+    local status=0
+    aws rekognition "$operation" --image-bytes "fileb://$request_image" --output json "$@" 2>/dev/null || status=$?
+    if [ "$request_image" != "$image_path" ]; then
+        rm -f "$request_image"
+    fi
+    return $status
+}
+
+# Detect the largest face with Rekognition, printing a normalized box "x y w h"
+detect_face_box() {
+    local image_path="$1"
+    rekognition_detect detect-faces "$image_path" | \
+        ./jq -r '[.FaceDetails[]?.BoundingBox] | max_by(.Width * .Height) // empty | "\(.Left) \(.Top) \(.Width) \(.Height)"' 2>/dev/null
+}
+
+# Detect every confident face with Rekognition, printing the normalized box "x y w h"
+# enclosing all of them
+detect_faces_union_box() {
+    local image_path="$1"
+    rekognition_detect detect-faces "$image_path" | \
+        ./jq -r '[.FaceDetails[]? | select(.Confidence >= 80) | .BoundingBox] | select(length > 0)
+            | { left: (map(.Left) | min), top: (map(.Top) | min),
+                right: (map(.Left + .Width) | max), bottom: (map(.Top + .Height) | max) }
+            | "\(.left) \(.top) \(.right - .left) \(.bottom - .top)"' 2>/dev/null
+}
+
+# Detect the largest person or pet with Rekognition, printing a normalized box "x y w h"
+detect_label_box() {
+    local image_path="$1"
+    rekognition_detect detect-labels "$image_path" --max-labels 20 | \
+        ./jq -r '[.Labels[]? | select(.Name | IN("Person", "Dog", "Cat", "Pet", "Animal", "Bird", "Horse")) | .Instances[]?.BoundingBox] | max_by(.Width * .Height) // empty | "\(.Left) \(.Top) \(.Width) \(.Height)"' 2>/dev/null
+}
+
+# Detect the largest salient region from edge density, printing a normalized box "x y w h"
+detect_salient_box() {
+    local image_path="$1"
+    
+    # Edges are detected on a fixed 320x320 thumbnail so the crop box is trivially normalized
+    local crop=$(ffmpeg -loop 1 -i "$image_path" -frames:v 4 \
+        -vf "scale=320:320,edgedetect=low=0.1:high=0.3,cropdetect=limit=0.1:round=2:reset=0" \
+        -f null - 2>&1 | grep -o 'crop=[0-9]*:[0-9]*:[0-9]*:[0-9]*' | tail -1)
+    
+    [ -z "$crop" ] && return 0
+    echo "${crop#crop=}" | awk -F: '{ printf "%.4f %.4f %.4f %.4f\n", $3 / 320, $4 / 320, $1 / 320, $2 / 320 }'
+}
+
+# Detect the dominant subject (face, then person/pet, then salient region)
+detect_subject_box() {
+    local image_path="$1"
+    
+    local box=$(detect_face_box "$image_path")
+    if [ -z "$box" ]; then
+        box=$(detect_label_box "$image_path")
+    fi
+    if [ -z "$box" ]; then
+        box=$(detect_salient_box "$image_path")
+    fi
+    echo "$box"
+}
+
+# Map a normalized box on the source image into the cover-cropped output-aspect frame
+# The crop is centered on the focal point "x y" (default the image center) as far as the edges allow
+map_box_to_frame() {
+    local image_path="$1"
+    local box="$2"
+    local focal="${3:-0.5 0.5}"
+    
+    local dimensions=$(get_image_dimensions "$image_path")
+    [ -z "$dimensions" ] && dimensions="${DEFAULT_RESOLUTION/x/ }"
+    
+    echo "$dimensions $box $focal" | awk -v aspect="$(get_output_aspect)" '{
+        iw = $1; ih = $2; x = $3; y = $4; w = $5; h = $6; fx = $7; fy = $8
+        if (iw / ih > aspect) {
+            cw = ih * aspect; ox = fx * iw - cw / 2
+            if (ox < 0) ox = 0
+            if (ox > iw - cw) ox = iw - cw
+            x = (x * iw - ox) / cw; w = w * iw / cw
+        } else {
+            ch = iw / aspect; oy = fy * ih - ch / 2
+            if (oy < 0) oy = 0
+            if (oy > ih - ch) oy = ih - ch
+            y = (y * ih - oy) / ch; h = h * ih / ch
+        }
+        if (x < 0) { w += x; x = 0 }
+        if (y < 0) { h += y; y = 0 }
+        if (x + w > 1) w = 1 - x
+        if (y + h > 1) h = 1 - y
+        if (w <= 0 || h <= 0) { x = 0.25; y = 0.25; w = 0.5; h = 0.5 }
+        printf "%.4f %.4f %.4f %.4f\n", x, y, w, h
+    }'
+}
+
+# Normalized focal point "x y" of an image entry (focal_point: {x, y}), or nothing
+get_focal_point() {
+    local image_json="$1"
+    echo "$image_json" | ./jq -r '.focal_point // empty | [.x // 0.5, .y // 0.5]
+        | map(tonumber | if . < 0 then 0 elif . > 1 then 1 else . end) | join(" ")' 2>/dev/null
+}
+
+# Rotation in degrees over the clip: the image's rotation_degrees, else a roll
+# within +/- options.random_rotation degrees, else nothing
+get_rotation_degrees() {
+    local image_json="$1"
+    
+    local degrees=$(echo "$image_json" | ./jq -r '.rotation_degrees // empty | tonumber' 2>/dev/null)
+    if [ -n "$degrees" ]; then
+        echo "$degrees"
+        return 0
+    fi
+    local max_degrees=$(get_option "random_rotation" "0")
+    awk -v max="$max_degrees" -v roll="$(get_motion_roll)" 'BEGIN {
+        if (max + 0 != 0) printf "%.2f\n", max * ((int(roll / 7) % 201) / 100 - 1)
+    }'
+}
+
+# Eased rotation from level to the given degrees over the clip, cropped in just
+# enough that the rotated corners never show
+get_rotation_filter() {
+    local degrees="$1"
+    local duration="$2"
+    
+    local p="min(t/$duration,1)"
+    local crop_factor=$(awk -v d="$degrees" -v r="$(get_output_aspect)" 'BEGIN {
+        a = (d < 0 ? -d : d) * atan2(0, -1) / 180
+        printf "%.4f", cos(a) + sin(a) * (r > 1 ? r : 1 / r)
+    }')
+    echo "rotate=a='$degrees*PI/180*$p*$p*(3-2*$p)':ow=iw:oh=ih:c=black,crop=iw/$crop_factor:ih/$crop_factor"
+}
+
+# Simulated rack focus for options.pull_focus (or an image's pull_focus): "in"
+# starts soft and sharpens over options.pull_focus_seconds, "out" softens over the
+# clip's last seconds; a gblur copy (options.pull_focus_strength sigma) is
+# crossfaded against the sharp frame since gblur cannot animate its sigma
+get_pull_focus_filter() {
+    local image_json="$1"
+    local duration="$2"
+    
+    local direction=$(echo "$image_json" | ./jq -r --arg fallback "$(get_option "pull_focus" "")" '.pull_focus // $fallback')
+    local strength=$(get_option "pull_focus_strength" "6")
+    local seconds=$(awk -v s="$(get_option "pull_focus_seconds" "1.5")" -v d="$duration" 'BEGIN { print (s > d) ? d : s }')
+    
+    local p
+    case "$direction" in
+        in)
+            p="(1-min(T/$seconds,1))"
+            ;;
+        out)
+            p="min(1,max(0,(T-($duration-$seconds))/$seconds))"
+            ;;
+        *)
+            return 0
+            ;;
+    esac
+    echo "split[focus_sharp][focus_source];[focus_source]gblur=sigma=$strength[focus_soft];
+        [focus_sharp][focus_soft]blend=all_expr='A+(B-A)*$p*$p*(3-2*$p)'"
+}
+
+# Scale and cover-crop the source to the working frame, centering the crop on
+# the focal point "x y" (default the image center) as far as the edges allow
+get_cover_crop_filter() {
+    local focal="${1:-0.5 0.5}"
+    local width height
+    read width height <<< "$(get_working_frame)"
+    echo "scale=$width:$height:force_original_aspect_ratio=increase:flags=lanczos,crop=$width:$height:x='min(max(0,${focal% *}*iw-$((width / 2))),iw-$width)':y='min(max(0,${focal#* }*ih-$((height / 2))),ih-$height)'"
+}
+
+# Shift a frame rectangle "x y w h" so the frame point "x y" sits inside its middle
+# 60%, keeping the rectangle within the frame
+fit_rect_to_point() {
+    local rect="$1"
+    local point="$2"
+    
+    echo "$rect $point" | awk '{
+        x = $1; y = $2; w = $3; h = $4; px = $5; py = $6
+        if (px < x + w * 0.2) x = px - w * 0.2
+        if (px > x + w * 0.8) x = px - w * 0.8
+        if (py < y + h * 0.2) y = py - h * 0.2
+        if (py > y + h * 0.8) y = py - h * 0.8
+        if (x > 1 - w) x = 1 - w
+        if (y > 1 - h) y = 1 - h
+        if (x < 0) x = 0
+        if (y < 0) y = 0
+        printf "%.4f %.4f %.4f %.4f\n", x, y, w, h
+    }'
+}
+
+# Named motion presets: "<start rect>;<end rect>" as normalized "x y w h" boxes on
+# the 16:9 cover-cropped frame
+declare -A MOTION_PRESETS=(
+    [zoom_in]="0 0 1 1;0.125 0.125 0.75 0.75"
+    [zoom_out]="0.125 0.125 0.75 0.75;0 0 1 1"
+    [pan_left]="0.2 0.1 0.8 0.8;0 0.1 0.8 0.8"
+    [pan_right]="0 0.1 0.8 0.8;0.2 0.1 0.8 0.8"
+    [diagonal]="0 0 0.8 0.8;0.2 0.2 0.8 0.8"
+)
+
+# Supersampling factor for zoompan moves: options.high_quality_motion renders them
+# at 4x the output resolution from an upscaled source, so pan offsets and window
+# sizes land on sub-pixel positions, and the final lanczos scale brings them down
+get_motion_supersample() {
+    if [ "$(get_option "high_quality_motion" "false")" = "true" ]; then
+        echo 4
+    else
+        echo 1
+    fi
+}
+
+# Source upscale ahead of zoompan at the motion supersampling factor (empty at 1x)
+get_zoompan_prescale() {
+    local factor=$(get_motion_supersample)
+    
+    if [ "$factor" -gt 1 ]; then
+        echo ",scale=$((${DEFAULT_RESOLUTION%x*} * factor)):$((${DEFAULT_RESOLUTION#*x} * factor)):flags=lanczos"
+    fi
+}
+
+# zoompan output size at the motion supersampling factor
+get_zoompan_size() {
+    local factor=$(get_motion_supersample)
+    
+    echo "$((${DEFAULT_RESOLUTION%x*} * factor))x$((${DEFAULT_RESOLUTION#*x} * factor))"
+}
+
+# zoompan progress (0 to 1) over a clip of the given frame count; the "hold"
+# options.motion_profile keeps the start framing for options.hold_in seconds and
+# the end framing for the last options.hold_out seconds (0.5 each by default)
+get_zoompan_progress() {
+    local frames="$1"
+    local last=$((frames > 1 ? frames - 1 : 1))
+    
+    if [ "$(get_option "motion_profile" "linear")" != "hold" ]; then
+        echo "(on/$last)"
+        return 0
+    fi
+    local hold_in hold_out
+    read hold_in hold_out <<< $(awk -v fps="$DEFAULT_FPS" -v last="$last" \
+        -v hold_in="$(get_option "hold_in" "0.5")" -v hold_out="$(get_option "hold_out" "0.5")" 'BEGIN {
+            a = int(hold_in * fps + 0.5); b = int(hold_out * fps + 0.5)
+            if (a < 0) a = 0; if (b < 0) b = 0
+            # Leave at least half the clip for the move itself
+            if (a + b > last / 2) { s = (last / 2) / (a + b); a = int(a * s); b = int(b * s) }
+            print a, b
+        }')
+    echo "min(1,max(0,(on-$hold_in)/$((last - hold_in - hold_out))))"
+}
+
+# Handheld jitter for zoompan x/y (options.shake: true, or {amplitude, frequency}):
+# two detuned sines with rolled phases, amplitude a fraction of the visible window
+# (0.004 by default) and base frequency in Hz (0.5); prints a "+<offset>" term for
+# the axis (x or y), or nothing without shake; phases follow options.seed
+get_shake_term() {
+    local axis="$1"
+    
+    local shake=$(get_option_json "shake")
+    if [ "$shake" = "null" ] || [ "$shake" = "false" ]; then
+        return 0
+    fi
+    local amplitude=$(echo "$shake" | ./jq -r 'if type == "object" then .amplitude // 0.004 else 0.004 end')
+    local frequency=$(echo "$shake" | ./jq -r 'if type == "object" then .frequency // 0.5 else 0.5 end')
+    local roll=$(get_motion_roll)
+    local size=$([ "$axis" = "x" ] && echo "iw" || echo "ih")
+    
+    awk -v a="$amplitude" -v f="$frequency" -v roll="$roll" -v axis="$axis" -v size="$size" -v fps="$DEFAULT_FPS" 'BEGIN {
+        if (axis == "y") roll = int(roll / 49)
+        p1 = (roll % 6283) / 1000; p2 = (int(roll / 7) % 6283) / 1000
+        w = 6.2832 * f / fps
+        printf "+%s/zoom*%s*(sin(on*%.5f+%.4f)+0.5*sin(on*%.5f+%.4f))/1.5", size, a, w, p1, w * 2.3, p2
+    }'
+}
+
+# Eased pan/zoom from one normalized frame rectangle to another; zoom follows the
+# larger rectangle side so the whole box stays in view
+# An optional source focal point "x y" positions the cover crop and is kept inside both rectangles
+build_rect_motion_effect() {
+    local start_rect="$1"
+    local end_rect="$2"
+    local duration="$3"
+    local input_image="$4"
+    local focal="$5"
+    local frames=$(frames_for_duration "$duration")
+    
+    if [ -n "$focal" ]; then
+        local frame_point=$(map_box_to_frame "$input_image" "$focal 0.0001 0.0001" "$focal" | awk '{ print $1, $2 }')
+        start_rect=$(fit_rect_to_point "$start_rect" "$frame_point")
+        end_rect=$(fit_rect_to_point "$end_rect" "$frame_point")
+    fi
+    
+    local start_zoom start_cx start_cy end_zoom end_cx end_cy
+    read start_zoom start_cx start_cy end_zoom end_cx end_cy <<< $(echo "$start_rect $end_rect" | \
+        awk -v max_zoom="$(get_style_max_zoom)" 'function zoom(w, h) {
+            z = 1 / (w > h ? w : h)
+            return z < 1 ? 1 : (z > max_zoom ? max_zoom : z)
+        } {
+            printf "%.4f %.4f %.4f %.4f %.4f %.4f\n", zoom($3, $4), $1 + $3 / 2, $2 + $4 / 2, zoom($7, $8), $5 + $7 / 2, $6 + $8 / 2
+        }')
+    
+    local p="($(get_zoompan_progress "$frames"))"
+    local ease="($p*$p*(3-2*$p))"
+    
+    echo "$(get_cover_crop_filter "$focal")$(get_zoompan_prescale),zoompan=z='$start_zoom+($end_zoom-$start_zoom)*$ease':x='max(0,min(iw-iw/zoom,iw*($start_cx+($end_cx-$start_cx)*$ease)-iw/zoom/2$(get_shake_term x)))':y='max(0,min(ih-ih/zoom,ih*($start_cy+($end_cy-$start_cy)*$ease)-ih/zoom/2$(get_shake_term y)))':d=$frames:s=$(get_zoompan_size):fps=$DEFAULT_FPS"
+}
+
+# Shrink a "<start rect>;<end rect>" move so short clips do not feel frantic: the
+# zoom change stays within options.motion_zoom_velocity zoom units per second and
+# the center travel within options.motion_pan_velocity frame widths per second
+# Both rects move toward the anchor ("mid", or keep the "start"/"end" rect as is)
+limit_rect_motion() {
+    local rects="$1"
+    local duration="$2"
+    local anchor="${3:-mid}"
+    
+    echo "${rects%;*} ${rects#*;}" | awk -v d="$duration" -v anchor="$anchor" \
+        -v zoom_velocity="$(get_option "motion_zoom_velocity" "0.07")" \
+        -v pan_velocity="$(get_option "motion_pan_velocity" "0.08")" '{
+        for (i = 1; i <= 4; i++) { a[i] = $i; b[i] = $(i + 4) }
+        dz = 1 / (b[3] > b[4] ? b[3] : b[4]) - 1 / (a[3] > a[4] ? a[3] : a[4]); if (dz < 0) dz = -dz
+        dx = (b[1] + b[3] / 2) - (a[1] + a[3] / 2); dy = (b[2] + b[4] / 2) - (a[2] + a[4] / 2)
+        dp = sqrt(dx * dx + dy * dy)
+        f = 1
+        if (dz > zoom_velocity * d) f = zoom_velocity * d / dz
+        if (dp > pan_velocity * d && pan_velocity * d / dp < f) f = pan_velocity * d / dp
+        for (i = 1; i <= 4; i++) {
+            m = (anchor == "start") ? a[i] : (anchor == "end") ? b[i] : (a[i] + b[i]) / 2
+            a[i] = m + (a[i] - m) * f; b[i] = m + (b[i] - m) * f
+        }
+        printf "%.4f %.4f %.4f %.4f;%.4f %.4f %.4f %.4f\n", a[1], a[2], a[3], a[4], b[1], b[2], b[3], b[4]
+    }'
+}
+
+# Deterministic motion for a named preset (zoom_in, zoom_out, pan_left, pan_right, diagonal)
+# shifted to keep an optional focal point in view; the move is scaled to the duration
+get_motion_preset_effect() {
+    local preset="$1"
+    local duration="$2"
+    local input_image="$3"
+    local focal="$4"
+    
+    local rects=$(limit_rect_motion "${MOTION_PRESETS[$preset]}" "$duration")
+    build_rect_motion_effect "${rects%;*}" "${rects#*;}" "$duration" "$input_image" "$focal"
+}
+
+# Corner framings visited by multi-phase motion, in drift order around the frame
+PHASE_CORNER_RECTS=("0 0 0.65 0.65" "0.35 0 0.65 0.65" "0.35 0.35 0.65 0.65" "0 0.35 0.65 0.65")
+
+# Several chained moves over one long image (options.phases, 2 or 3): zoom from the
+# full frame into a corner, drift to the next corner, and with a third phase pull
+# back out; each phase renders from its own copy of the source and the sub-clips
+# are concatenated inside the same filter graph
+get_multi_phase_effect() {
+    local duration="$1"
+    local phases="$2"
+    local input_image="$3"
+    local focal="$4"
+    
+    local phase_duration=$(awk -v d="$duration" -v n="$phases" 'BEGIN { printf "%.3f", d / n }')
+    local corner=$(($(get_motion_roll) % ${#PHASE_CORNER_RECTS[@]}))
+    local next=$(((corner + 1) % ${#PHASE_CORNER_RECTS[@]}))
+    local waypoints=("0 0 1 1" "${PHASE_CORNER_RECTS[$corner]}" "${PHASE_CORNER_RECTS[$next]}" "0 0 1 1")
+    
+    local graph="split=$phases"
+    local outputs=""
+    local i
+    for ((i = 0; i < phases; i++)); do
+        graph="$graph[phase_$i]"
+        outputs="$outputs[phase_out_$i]"
+    done
+    for ((i = 0; i < phases; i++)); do
+        graph="$graph;
+        [phase_$i]$(build_rect_motion_effect "${waypoints[$i]}" "${waypoints[$((i + 1))]}" "$phase_duration" "$input_image" "$focal")[phase_out_$i]"
+    done
+    echo "$graph;
+        ${outputs}concat=n=$phases:v=1:a=0"
+}
+
+# Pan/zoom between the image's start_rect and end_rect ({x, y, w, h} normalized to
+# the source image); a missing rect defaults to the full frame
+get_keyframe_effect() {
+    local input_image="$1"
+    local image_json="$2"
+    local duration="$3"
+    
+    local rect_boxes=$(echo "$image_json" | ./jq -r 'def box: if type == "object" then
+            [.x // 0, .y // 0, .w // 1, .h // 1] | map(tonumber | if . < 0 then 0 elif . > 1 then 1 else . end) | join(" ")
+        else "0 0 1 1" end;
+        "\(.start_rect | box);\(.end_rect | box)"')
+    local focal=$(get_focal_point "$image_json")
+    local start_rect=$(map_box_to_frame "$input_image" "${rect_boxes%;*}" "$focal")
+    local end_rect=$(map_box_to_frame "$input_image" "${rect_boxes#*;}" "$focal")
+    build_rect_motion_effect "$start_rect" "$end_rect" "$duration" "$input_image" "$focal"
+}
+
+# Edge energy of an image along one axis (x: columns, y: rows) as 64 numbers,
+# computed from a 64x64 grayscale edge map
+get_saliency_profile() {
+    local image_path="$1"
+    local axis="$2"
+    
+    ffmpeg -i "$image_path" -frames:v 1 -vf "scale=64:64,format=gray,edgedetect=low=0.1:high=0.3" \
+        -f rawvideo -pix_fmt gray - 2>/dev/null | od -An -v -tu1 -w64 | \
+        awk -v axis="$axis" '{
+            for (i = 1; i <= NF; i++) if (axis == "x") energy[i] += $i; else energy[NR] += $i
+        } END {
+            for (i = 1; i <= 64; i++) printf "%d%s", energy[i], (i < 64 ? " " : "\n")
+        }'
+}
+
+# Pan across the most detailed part of a panorama or portrait image
+# (options.pan_strategy "saliency"): the full image height (or width) stays in frame
+# and the move travels along the long axis from the emptier side of the detailed
+# region toward its busier side; prints nothing for images close to the output aspect
+get_saliency_pan_effect() {
+    local input_image="$1"
+    local duration="$2"
+    
+    local dimensions=$(get_image_dimensions "$input_image")
+    [ -z "$dimensions" ] && return 0
+    local axis=$(echo "$dimensions" | awk -v r="$(get_output_aspect)" '{ a = $1 / $2; print (a > r * 1.2) ? "x" : (a < r / 1.2) ? "y" : "" }')
+    [ -z "$axis" ] && return 0
+    
+    # Fraction of the long axis visible in one frame
+    local visible=$(echo "$dimensions" | awk -v axis="$axis" -v r="$(get_output_aspect)" '{ a = $1 / $2; printf "%.4f", (axis == "x") ? r / a : a / r }')
+    local profile=$(get_saliency_profile "$input_image" "$axis")
+    [ -z "$profile" ] && return 0
+    
+    local from to
+    read from to <<< $(echo "$profile" | awk -v v="$visible" '{
+        n = NF; win = int(v * n + 0.5); if (win < 1) win = 1; if (win > n) win = n
+        best = -1
+        for (s = 1; s + win - 1 <= n; s++) {
+            sum = 0; for (i = s; i < s + win; i++) sum += $i
+            if (sum > best) { best = sum; start = s }
+        }
+        center = (start - 1 + win / 2) / n
+        span = v * 1.5; if (span > 1) span = 1
+        lo = center - span / 2; if (lo < 0) lo = 0; if (lo > 1 - span) lo = 1 - span
+        left = 0; right = 0
+        for (i = 1; i <= n; i++) {
+            p = (i - 0.5) / n
+            if (p >= lo && p < lo + span / 2) left += $i
+            else if (p >= lo + span / 2 && p <= lo + span) right += $i
+        }
+        a = lo; b = lo + span - v
+        if (right >= left) printf "%.4f %.4f\n", a, b; else printf "%.4f %.4f\n", b, a
+    }')
+    
+    local frames=$(frames_for_duration "$duration")
+    local p="min(t/$duration,1)"
+    local position="($from+($to-$from)*$p*$p*(3-2*$p))"
+    local hold="loop=loop=$((frames > 1 ? frames - 1 : 0)):size=1,setpts=N/$DEFAULT_FPS/TB"
+    local width height
+    read width height <<< "$(get_working_frame)"
+    if [ "$axis" = "x" ]; then
+        echo "scale=-2:$height:flags=lanczos,$hold,crop=$width:$height:x='min(iw-$width,iw*$position)':y=0"
+    else
+        echo "scale=$width:-2:flags=lanczos,$hold,crop=$width:$height:x=0:y='min(ih-$height,ih*$position)'"
+    fi
+}
+
+# Depth map for the parallax mode (bright = near): the image's depth_map_url when
+# given, otherwise a crude one mixing edge detail with a bottom-is-nearer gradient
+get_depth_map() {
+    local input_image="$1"
+    local image_json="$2"
+    local depth_map="${input_image%.*}_depth.png"
+    
+    local depth_url=$(echo "$image_json" | ./jq -r '.depth_map_url // empty')
+    if [ -n "$depth_url" ]; then
+        if download_image "$depth_url" "$depth_map" "$(get_image_request_json)" "$MAX_IMAGE_BYTES" >&2; then
+            echo "$depth_map"
+            return 0
+        fi
+        log "WARNING: Depth map download failed, generating one: $depth_url" >&2
+    fi
+    
+    ffmpeg -i "$input_image" -frames:v 1 -filter_complex "
+        scale=640:-2,format=gray,split[luma][edges];
+        [edges]edgedetect=low=0.05:high=0.2,boxblur=16:2[detail];
+        [luma]geq=lum='255*Y/H'[ground];
+        [detail][ground]blend=all_expr='min(255,A*2)*0.5+B*0.5'
+        " -y "$depth_map" 2>/dev/null || return 1
+    echo "$depth_map"
+}
+
+# 2.5D parallax (options.parallax): the near layer, cut out of the image by the
+# thresholded depth map, drifts further than the background over the same ease
+# so the camera appears to slide sideways past the subject
+get_parallax_effect() {
+    local input_image="$1"
+    local depth_map="$2"
+    local duration="$3"
+    local focal="$4"
+    
+    local frames=$(frames_for_duration "$duration")
+    local hold="loop=loop=$((frames > 1 ? frames - 1 : 0)):size=1,setpts=N/$DEFAULT_FPS/TB"
+    local crop=$(get_cover_crop_filter "$focal")
+    local direction=$(( $(get_motion_roll) % 2 ? 1 : -1 ))
+    local p="min(t/$duration,1)"
+    local drift="($direction)*(2*$p*$p*(3-2*$p)-1)"
+    
+    # 110% layers leave 5% of margin on each side for the drift
+    local width height
+    read width height <<< "$(get_working_frame)"
+    local layer_width=$((width * 11 / 20 * 2)) layer_height=$((height * 11 / 20 * 2))
+    local margin_x=$(((layer_width - width) / 2)) margin_y=$(((layer_height - height) / 2))
+    echo "$crop,scale=$layer_width:$layer_height:flags=lanczos,$hold,split=2[bgsrc][fgsrc];
+        movie='$depth_map',$crop,scale=$layer_width:$layer_height,format=gray,lut=y='if(gt(val,150),255,0)',boxblur=8:1,$hold[mask];
+        [bgsrc]crop=$width:$height:x='$margin_x+$((width / 80))*$drift':y=$margin_y[bg];
+        [fgsrc][mask]alphamerge,crop=$width:$height:x='$margin_x+$((width * 3 / 64))*$drift':y='$margin_y+$((height / 90))*$drift'[fg];
+        [bg][fg]overlay=format=auto"
+}
+
+# Face-aware framing (options.smart_crop): move between the full frame and a
+# close framing that keeps every detected face inside, pushing in or pulling out
+# by the motion roll; prints nothing when no faces are found
+get_smart_crop_effect() {
+    local input_image="$1"
+    local duration="$2"
+    
+    local faces=$(detect_faces_union_box "$input_image")
+    if [ -z "$faces" ]; then
+        return 0
+    fi
+    faces=$(map_box_to_frame "$input_image" "$faces")
+    
+    # Faces plus a 40% margin, never tighter than half the frame
+    local close_rect=$(echo "$faces" | awk '{
+        cx = $1 + $3 / 2; cy = $2 + $4 / 2
+        w = $3 * 1.4; h = $4 * 1.4
+        if (w < 0.5) w = 0.5
+        if (h < 0.5) h = 0.5
+        if (w > 1) w = 1
+        if (h > 1) h = 1
+        x = cx - w / 2; y = cy - h / 2
+        if (x < 0) x = 0
+        if (y < 0) y = 0
+        if (x > 1 - w) x = 1 - w
+        if (y > 1 - h) y = 1 - h
+        printf "%.4f %.4f %.4f %.4f\n", x, y, w, h
+    }')
+    
+    # The face framing end of the move is kept when short clips scale it down
+    local rects
+    if [ $(($(get_motion_roll) % 2)) -eq 0 ]; then
+        rects=$(limit_rect_motion "0 0 1 1;$close_rect" "$duration" "end")
+    else
+        rects=$(limit_rect_motion "$close_rect;0 0 1 1" "$duration" "start")
+    fi
+    build_rect_motion_effect "${rects%;*}" "${rects#*;}" "$duration"
+}
+
+# Slow push-in that ends tightly framed on the detected subject
+get_zoom_to_subject_effect() {
+    local input_image="$1"
+    local duration="$2"
+    local frames=$(frames_for_duration "$duration")
+    
+    local box=$(detect_subject_box "$input_image")
+    if [ -z "$box" ]; then
+        box="0.25 0.25 0.5 0.5"
+    fi
+    box=$(map_box_to_frame "$input_image" "$box")
+    
+    # End zoom leaves a little headroom around the subject, clamped to a sensible range
+    local cx cy zoom_end
+    read cx cy zoom_end <<< $(echo "$box" | awk -v max_zoom="$(get_style_max_zoom)" '{
+        z = 1 / (($3 > $4 ? $3 : $4) * 1.25)
+        if (z < 1.15) z = 1.15
+        if (z > max_zoom) z = max_zoom
+        printf "%.4f %.4f %.4f\n", $1 + $3 / 2, $2 + $4 / 2, z
+    }')
+    
+    # Smoothstep progress so the move eases in and settles on the subject
+    local p="($(get_zoompan_progress "$frames"))"
+    local ease="($p*$p*(3-2*$p))"
+    
+    echo "$(get_cover_crop_filter)$(get_zoompan_prescale),zoompan=z='1+($zoom_end-1)*$ease':x='max(0,min(iw-iw/zoom,iw*(0.5+($cx-0.5)*$ease)-iw/zoom/2$(get_shake_term x)))':y='max(0,min(ih-ih/zoom,ih*(0.5+($cy-0.5)*$ease)-ih/zoom/2$(get_shake_term y)))':d=$frames:s=$(get_zoompan_size):fps=$DEFAULT_FPS"
+}
+
+# Render a text card clip: a title and optional subtitle over a solid background.
+# The optional card JSON adds text_color, background_image (URL, s3:// or key;
+# darkened so text stays legible) and fade: fade (default), fade_in, fade_out,
+# rise or none
+render_title_card() {
+    local output_video="$1"
+    local duration="$2"
+    local title="$3"
+    local subtitle="$4"
+    local background=$(get_palette_color background "${5:-black}")
+    local card_json="${6:-"{}"}"
+    local name="$(basename "$output_video" .mp4)"
+    local width="${DEFAULT_RESOLUTION%x*}"
+    local height=$(get_output_height)
+    
+    local text_color=$(echo "$card_json" | ./jq -r '.text_color // "white"')
+    local background_image=$(echo "$card_json" | ./jq -r '.background_image // empty')
+    
+    local inputs=(-f lavfi -i "color=c=$background:s=$DEFAULT_RESOLUTION:r=$DEFAULT_FPS:d=$duration")
+    local filter="[0:v]null"
+    if [ -n "$background_image" ]; then
+        local image_path="$TEMP_DIR/${name}_background"
+        if fetch_input_file "$background_image" "$image_path"; then
+            inputs=(-loop 1 -framerate "$DEFAULT_FPS" -i "$image_path")
+            filter="[0:v]scale=$width:$height:force_original_aspect_ratio=increase,crop=$width:$height,setsar=1,drawbox=x=0:y=0:w=iw:h=ih:color=black@0.4:t=fill"
+        else
+            log "Warning: Could not fetch card background $background_image, using $background"
+        fi
+    fi
+    
+    local fade=$(echo "$card_json" | ./jq -r '.fade // "fade"')
+    local title_y="(h-th)/2-h*0.05" title_extra=""
+    if [ "$fade" = "rise" ]; then
+        title_y="'(h-th)/2-h*0.05+h*0.04*max(0,1-t/1.5)'"
+        title_extra="alpha='min(1,max(0,(t-0.3)/1.2))'"
+    fi
+    if [ -n "$title" ]; then
+        filter="$filter,$(build_drawtext_filter "$(write_overlay_text "${name}_title" "$title")" $((height / 14)) "(w-tw)/2" "$title_y" "$title_extra" "$BOLD_FONT_FILE" "$text_color")"
+    fi
+    if [ -n "$subtitle" ]; then
+        filter="$filter,$(build_drawtext_filter "$(write_overlay_text "${name}_subtitle" "$subtitle")" $((height / 28)) "(w-tw)/2" "h/2+h*0.06" "alpha=0.85" "" "$text_color")"
+    fi
+    local fade_out_start=$(awk -v d="$duration" 'BEGIN { printf "%.3f", (d > 2 ? d - 0.75 : d / 2) }')
+    case "$fade" in
+        fade) filter="$filter,fade=t=in:st=0:d=0.75,fade=t=out:st=$fade_out_start:d=0.75" ;;
+        fade_in) filter="$filter,fade=t=in:st=0:d=0.75" ;;
+        fade_out|rise) filter="$filter,fade=t=out:st=$fade_out_start:d=0.75" ;;
+    esac
+    
+    encode_ffmpeg "${inputs[@]}" \
+        -filter_complex "$filter,format=yuv420p$(get_watermark_graph "segments")" \
+        -t "$duration" \
+        "${SEGMENT_ENCODE_ARGS[@]}" \
+        -y "$output_video" || return 1
+    
+    rm -f "$TEMP_DIR/${name}_background" "$TEMP_DIR/${name}_title.txt" "$TEMP_DIR/${name}_subtitle.txt"
+}
+
+# Animated title: text rises and fades in over a solid background
+generate_title_reveal_video() {
+    local spec="$1"
+    local output_video="$2"
+    local duration="$3"
+    local name="$(basename "$output_video" .mp4)"
+    local height=$(get_output_height)
+    
+    local text=$(echo "$spec" | ./jq -r '.text // empty')
+    if [ -z "$text" ]; then
+        log "ERROR: title_reveal segment requires text"
+        return 1
+    fi
+    local subtitle=$(echo "$spec" | ./jq -r '.subtitle // empty')
+    local background=$(get_palette_color background "$(echo "$spec" | ./jq -r '.background // "black"')")
+    local text_color=$(get_palette_color text "$(echo "$spec" | ./jq -r '.text_color // "white"')")
+    local accent_color=$(get_palette_color accent "$(echo "$spec" | ./jq -r '.accent_color // .text_color // "white"')")
+    
+    # Accent rule grows out from the centre under the title: drawbox sizes are fixed
+    # once, so the full rule is drawn and two background-coloured halves that cover
+    # it slide apart (overlay positions are evaluated per frame)
+    local rule_half=$(( ${DEFAULT_RESOLUTION%x*} * 3 / 20 ))
+    local filter="[1:v]split[rule_left][rule_right];[0:v]drawbox=x=(iw-$((rule_half * 2)))/2:y=ih*0.52:w=$((rule_half * 2)):h=4:color=$accent_color:t=fill[rule]"
+    filter="$filter;[rule][rule_left]overlay=x='W/2-w-w*min(1,t/1.5)':y=H*0.52[rule_opening]"
+    filter="$filter;[rule_opening][rule_right]overlay=x='W/2+w*min(1,t/1.5)':y=H*0.52"
+    filter="$filter,$(build_drawtext_filter "$(write_overlay_text "${name}_title" "$text")" $((height / 12)) "(w-tw)/2" "'(h-th)/2-h*0.05+h*0.04*max(0,1-t/1.5)'" "alpha='min(1,max(0,(t-0.3)/1.2))'" "$BOLD_FONT_FILE" "$text_color")"
+    if [ -n "$subtitle" ]; then
+        filter="$filter,$(build_drawtext_filter "$(write_overlay_text "${name}_subtitle" "$subtitle")" $((height / 28)) "(w-tw)/2" "h*0.56" "alpha='min(1,max(0,(t-1.2)/1.0))'" "" "$text_color")"
+    fi
+    local fade_out_start=$(awk -v d="$duration" 'BEGIN { printf "%.3f", (d > 2 ? d - 0.75 : d / 2) }')
+    filter="$filter,fade=t=out:st=$fade_out_start:d=0.75"
+    
+    encode_ffmpeg -f lavfi -i "color=c=$background:s=$DEFAULT_RESOLUTION:r=$DEFAULT_FPS:d=$duration" \
+        -f lavfi -i "color=c=$background:s=${rule_half}x4:r=$DEFAULT_FPS:d=$duration" \
+        -filter_complex "$filter$(get_watermark_graph "segments")" \
+        -t "$duration" \
+        "${SEGMENT_ENCODE_ARGS[@]}" \
+        -y "$output_video" || return 1
+}
+
+# Countdown: one number per second with a draining progress bar
+generate_countdown_video() {
+    local spec="$1"
+    local output_video="$2"
+    local duration="$3"
+    local name="$(basename "$output_video" .mp4)"
+    local height=$(get_output_height)
+    
+    local background=$(get_palette_color background "$(echo "$spec" | ./jq -r '.background // "black"')")
+    local text_color=$(get_palette_color text "$(echo "$spec" | ./jq -r '.text_color // "white"')")
+    local accent_color=$(get_palette_color accent "$(echo "$spec" | ./jq -r '.accent_color // "0xc8102e"')")
+    local from=$(echo "$spec" | ./jq -r '.from // empty')
+    if [ -z "$from" ]; then
+        from=$(awk -v d="$duration" 'BEGIN { printf "%d", d }')
+    fi
+    
+    # drawtext expands %{eif:...} per frame; the text file avoids filter escaping
+    local number_file=$(write_overlay_text "${name}_number" "%{eif:max(1,ceil($from-t)):d}")
+    # The bar slides out to the left each second (overlay x is evaluated per frame;
+    # drawbox sizes are not)
+    local bar_height=$(( height * 15 / 1000 > 0 ? height * 15 / 1000 : 1 ))
+    local filter="[0:v][1:v]overlay=x='-W*mod(t,1)':y=H*0.7"
+    filter="$filter,$(build_drawtext_filter "$number_file" $((height / 3)) "(w-tw)/2" "(h-th)/2" "" "$BOLD_FONT_FILE" "$text_color")"
+    
+    encode_ffmpeg -f lavfi -i "color=c=$background:s=$DEFAULT_RESOLUTION:r=$DEFAULT_FPS:d=$duration" \
+        -f lavfi -i "color=c=$accent_color:s=${DEFAULT_RESOLUTION%x*}x$bar_height:r=$DEFAULT_FPS:d=$duration" \
+        -filter_complex "$filter$(get_watermark_graph "segments")" \
+        -t "$duration" \
+        "${SEGMENT_ENCODE_ARGS[@]}" \
+        -y "$output_video" || return 1
+}
+
+# Prepend a generated opening card to the video list when the style calls for one
+# Prints the card duration (0 when no card was added) so audio can be offset
+prepend_opening_card() {
+    local video_list="$1"
+    
+    if [ "$(get_style)" != "tribute" ]; then
+        echo "0"
+        return 0
+    fi
+    
+    local metadata=$(get_option_json "metadata")
+    local name=$(echo "$metadata" | ./jq -r '.name // empty')
+    if [ -z "$name" ]; then
+        echo "0"
+        return 0
+    fi
+    local dates=$(echo "$metadata" | ./jq -r '.dates // ([.born, .died] | map(select(. != null) | tostring) | join(" – "))')
+    
+    local card_duration=$(get_option "opening_card_duration" "4")
+    local card_video="$TEMP_DIR/segment_opening_card_segment.mp4"
+    if ! render_title_card "$card_video" "$card_duration" "$name" "$dates" "0x1a1410" >&2; then
+        log "Warning: Failed to render opening card, continuing without it" >&2
+        echo "0"
+        return 0
+    fi
+    
+    { echo "file '$card_video'"; cat "$video_list"; } > "$video_list.tmp"
+    mv "$video_list.tmp" "$video_list"
+    echo "$card_duration"
+}
+
+# Add the event's intro (first) or outro (last) card to the video list: a title
+# card from {title, subtitle, background (color), duration (default 4) and the
+# card options of render_title_card}
+# Prints the card duration (0 when there is no card) so audio can be offset or padded
+add_bookend_card() {
+    local video_list="$1"
+    local kind="$2"
+    
+    local spec=$(echo "$BOOKEND_CARDS" | ./jq -c --arg kind "$kind" '.[$kind] // empty | objects')
+    if [ -z "$spec" ]; then
+        echo "0"
+        return 0
+    fi
+    local duration=$(echo "$spec" | ./jq -r '.duration // 4')
+    if [[ ! "$duration" =~ ^[0-9]+(\.[0-9]+)?$ ]] || ! awk -v d="$duration" 'BEGIN { exit !(d > 0 && d <= 30) }'; then
+        record_warning "invalid_${kind}" "The $kind duration '$duration' is not between 0 and 30 seconds; skipped"
+        echo "0"
+        return 0
+    fi
+    
+    local card_video="$TEMP_DIR/segment_${kind}_card_segment.mp4"
+    local title=$(echo "$spec" | ./jq -r '.title // empty')
+    local subtitle=$(echo "$spec" | ./jq -r '.subtitle // empty')
+    local background=$(echo "$spec" | ./jq -r '.background // "black"')
+    if ! render_title_card "$card_video" "$duration" "$title" "$subtitle" "$background" "$spec" >&2; then
+        record_warning "${kind}_failed" "Could not render the $kind card; continuing without it"
+        echo "0"
+        return 0
+    fi
+    
+    if [ "$kind" = "intro" ]; then
+        { echo "file '$card_video'"; cat "$video_list"; } > "$video_list.tmp"
+        mv "$video_list.tmp" "$video_list"
+    else
+        echo "file '$card_video'" >> "$video_list"
+    fi
+    echo "$duration"
+}
+
+# Tile server for map segments ({z}/{x}/{y} placeholders)
+get_map_tile_url() {
+    get_option "map_tile_url" "https://tile.openstreetmap.org/{z}/{x}/{y}.png"
+}
+
+# Fit coordinates into the output frame using Web Mercator, zooming in no further
+# than max_zoom (default 16). A detail of 2 frames the same area one zoom level
+# closer on a canvas twice the output size
+# Prints "zoom left top" followed by one "x y" screen position per coordinate
+project_map_coordinates() {
+    local coordinates="$1"
+    local max_zoom="${2:-16}"
+    local detail="${3:-1}"
+    local width="${DEFAULT_RESOLUTION%x*}"
+    local height=$(get_output_height)
+    
+    echo "$coordinates" | ./jq -r '.[] | "\(.[0]) \(.[1])"' | awk -v W="$width" -v H="$height" -v max_zoom="$max_zoom" -v detail="$detail" '
+        function wx(lon, z) { return (lon + 180) / 360 * 256 * 2 ^ z }
+        function wy(lat, z,    r) { r = lat * 3.14159265 / 180; return (1 - log((1 + sin(r)) / cos(r)) / 3.14159265) / 2 * 256 * 2 ^ z }
+        { lat[NR] = $1; lon[NR] = $2 }
+        END {
+            for (z = max_zoom; z > 1; z--) {
+                minx = maxx = wx(lon[1], z); miny = maxy = wy(lat[1], z)
+                for (i = 2; i <= NR; i++) {
+                    x = wx(lon[i], z); y = wy(lat[i], z)
+                    if (x < minx) minx = x; if (x > maxx) maxx = x
+                    if (y < miny) miny = y; if (y > maxy) maxy = y
+                }
+                if (maxx - minx <= W * 0.75 && maxy - miny <= H * 0.75) break
+            }
+            if (detail == 2) {
+                z++; W *= 2; H *= 2; minx *= 2; maxx *= 2; miny *= 2; maxy *= 2
+            }
+            left = int((minx + maxx) / 2 - W / 2); top = int((miny + maxy) / 2 - H / 2)
+            print z, left, top
+            for (i = 1; i <= NR; i++) printf "%d %d\n", wx(lon[i], z) - left, wy(lat[i], z) - top
+        }'
+}
+
+# Stitch map tiles covering the viewport (the output size unless given) into a
+# single background image
+# Falls back to a plain sea-blue background when tiles are unavailable
+render_map_background() {
+    local output_image="$1"
+    local zoom="$2"
+    local left="$3"
+    local top="$4"
+    local width="${5:-${DEFAULT_RESOLUTION%x*}}"
+    local height="${6:-$(get_output_height)}"
+    local tile_dir="$TEMP_DIR/map_tiles_$$"
+    local tile_url=$(get_map_tile_url)
+    local tiles=$((1 << zoom))
+    
+    mkdir -p "$tile_dir"
+    local tx0=$(((left >= 0 ? left : left - 255) / 256)) ty0=$(((top >= 0 ? top : top - 255) / 256))
+    local tx1=$(((left + width - 1) / 256)) ty1=$(((top + height - 1) / 256))
+    local inputs=() layout=() index=0 tx ty
+    local concurrency=$(get_download_concurrency)
+    
+    # Fetch the tiles a few at a time, then fill any gaps with sea-blue tiles. The
+    # subshell keeps jobs and wait away from the caller's background work
+    (
+        for ((ty = ty0; ty <= ty1; ty++)); do
+            for ((tx = tx0; tx <= tx1; tx++)); do
+                if [ "$ty" -lt 0 ] || [ "$ty" -ge "$tiles" ]; then
+                    continue
+                fi
+                while [ "$(jobs -rp | wc -l)" -ge "$concurrency" ]; do
+                    sleep 0.1
+                done
+                wrapped_x=$(((tx % tiles + tiles) % tiles))
+                url="${tile_url//\{z\}/$zoom}"
+                url="${url//\{x\}/$wrapped_x}"
+                url="${url//\{y\}/$ty}"
+                download_image "$url" "$tile_dir/${tx}_${ty}.png" '{"headers": {"User-Agent": "ken-burns-video-generator"}}' > /dev/null &
+            done
+        done
+        wait
+    )
+    
+    for ((ty = ty0; ty <= ty1; ty++)); do
+        for ((tx = tx0; tx <= tx1; tx++)); do
+            local tile="$tile_dir/${tx}_${ty}.png"
+            if [ ! -s "$tile" ]; then
+                ffmpeg -f lavfi -i "color=c=0xaad3df:s=256x256" -frames:v 1 -y "$tile" > /dev/null 2>&1 || return 1
+            fi
+            inputs+=(-i "$tile")
+            layout+=("$(((tx - tx0) * 256))_$(((ty - ty0) * 256))")
+            index=$((index + 1))
+        done
+    done
+    
+    local layout_spec=$(IFS="|"; echo "${layout[*]}")
+    local stack="xstack=inputs=$index:layout=$layout_spec:fill=0xaad3df"
+    if [ "$index" -eq 1 ]; then
+        stack="null"
+    fi
+    ffmpeg "${inputs[@]}" \
+        -filter_complex "$stack,crop=$width:$height:$((left - tx0 * 256)):$((top - ty0 * 256)),format=yuv420p" \
+        -frames:v 1 -y "$output_image" > /dev/null 2>&1
+    local status=$?
+    rm -rf "$tile_dir"
+    
+    if [ $status -ne 0 ]; then
+        log "Warning: Map tiles unavailable, using plain background" >&2
+        ffmpeg -f lavfi -i "color=c=0xaad3df:s=${width}x$height" -frames:v 1 -y "$output_image" > /dev/null 2>&1 || return 1
+    fi
+}
+
+# Route drawn progressively as dots along the polyline, with markers at each stop
+# Reads "x y" screen positions on stdin; marker and dot sizes are multiplied by scale
+build_map_route_filter() {
+    local duration="$1"
+    local color="$2"
+    local scale="${3:-1}"
+    
+    awk -v D="$duration" -v C="$color" -v S="$scale" '
+        { x[NR] = $1; y[NR] = $2 }
+        END {
+            total = 0
+            for (i = 2; i <= NR; i++) { seg[i] = sqrt((x[i] - x[i-1]) ^ 2 + (y[i] - y[i-1]) ^ 2); total += seg[i] }
+            lead = 0.5; draw = D - lead - 1.0; if (draw < 0.5) draw = D / 2
+            step = total / 400; if (step < 6 * S) step = 6 * S
+            out = ""
+            for (i = 1; i <= NR; i++) {
+                before = 0; for (j = 2; j <= i; j++) before += seg[j]
+                t = (total > 0) ? lead + before / total * draw : lead
+                out = out sprintf("drawbox=x=%d:y=%d:w=%d:h=%d:color=white:t=fill:enable=gte(t\\,%.3f),drawbox=x=%d:y=%d:w=%d:h=%d:color=%s:t=fill:enable=gte(t\\,%.3f),", x[i] - 9 * S, y[i] - 9 * S, 18 * S, 18 * S, t, x[i] - 6 * S, y[i] - 6 * S, 12 * S, 12 * S, C, t)
+            }
+            travelled = 0
+            for (i = 2; i <= NR; i++) {
+                for (d = 0; d < seg[i]; d += step) {
+                    f = d / seg[i]
+                    t = lead + (travelled + d) / total * draw
+                    out = out sprintf("drawbox=x=%d:y=%d:w=%d:h=%d:color=%s:t=fill:enable=gte(t\\,%.3f),", x[i-1] + (x[i] - x[i-1]) * f - 3 * S, y[i-1] + (y[i] - y[i-1]) * f - 3 * S, 6 * S, 6 * S, C, t)
+                }
+                travelled += seg[i]
+            }
+            sub(/,$/, "", out)
+            print out
+        }'
+}
+
+# Render an animated travel-map segment from a list of [lat, lon] coordinates
+generate_map_video() {
+    local spec="$1"
+    local output_video="$2"
+    local duration="$3"
+    local name="$(basename "$output_video" .mp4)"
+    
+    local coordinates=$(echo "$spec" | ./jq -c '.coordinates // []')
+    if [ "$(echo "$coordinates" | ./jq 'length')" -lt 1 ]; then
+        log "ERROR: Map segment requires at least one coordinate"
+        return 1
+    fi
+    local color=$(get_palette_color accent "$(echo "$spec" | ./jq -r '.line_color // "0xd7263d"')")
+    
+    local projection=$(project_map_coordinates "$coordinates")
+    local zoom left top
+    read zoom left top <<< "$(echo "$projection" | head -1)"
+    log "Rendering map segment at zoom $zoom"
+    
+    local background="$TEMP_DIR/${name}_map.png"
+    render_map_background "$background" "$zoom" "$left" "$top" || return 1
+    
+    local route_filter=$(echo "$projection" | tail -n +2 | build_map_route_filter "$duration" "$color")
+    encode_ffmpeg -loop 1 -i "$background" \
+        -filter_complex "$route_filter$(get_watermark_graph "segments")" \
+        -t "$duration" \
+        "${SEGMENT_ENCODE_ARGS[@]}" \
+        -y "$output_video" || return 1
+    
+    rm -f "$background"
+}
 
-# Logging function
-log() {
-    echo "[$(date '+%Y-%m-%d %H:%M:%S')] $1"
+# Render the end screen: title, call to action and a QR code linking to a URL
+# Writes the element layout (pixel and normalized boxes) to layout_json
+render_end_screen() {
+    local spec="$1"
+    local output_video="$2"
+    local layout_json="$3"
+    local width="${DEFAULT_RESOLUTION%x*}"
+    local height=$(get_output_height)
+    local name="$(basename "$output_video" .mp4)"
+    
+    local url=$(echo "$spec" | ./jq -r '.url // empty')
+    local title=$(echo "$spec" | ./jq -r '.title // empty')
+    local cta=$(echo "$spec" | ./jq -r '.cta // "Scan to learn more"')
+    local duration=$(echo "$spec" | ./jq -r '.duration // 5')
+    local background=$(get_palette_color background "$(echo "$spec" | ./jq -r '.background // "black"')")
+    
+    local qr_image="$TEMP_DIR/${name}_qr.png"
+    ./qrgen -text "$url" -out "$qr_image" -scale 10 -level M > /dev/null || return 1
+    
+    # Layout: text column on the left, QR code on the right
+    local qr_size=$((height * 45 / 100))
+    local qr_x=$((width * 62 / 100))
+    local qr_y=$(((height - qr_size) / 2))
+    local text_x=$((width * 8 / 100))
+    local title_size=$((height / 14))
+    local cta_size=$((height / 28))
+    local title_y=$((height * 38 / 100))
+    local cta_y=$((title_y + title_size + height / 30))
+    
+    local filter="[1:v]scale=$qr_size:$qr_size:flags=neighbor[qr];[0:v][qr]overlay=$qr_x:$qr_y"
+    if [ -n "$title" ]; then
+        filter="$filter,$(build_drawtext_filter "$(write_overlay_text "${name}_title" "$title")" $title_size $text_x $title_y "" "$BOLD_FONT_FILE")"
+    fi
+    filter="$filter,$(build_drawtext_filter "$(write_overlay_text "${name}_cta" "$cta")" $cta_size $text_x $cta_y "alpha=0.85")"
+    filter="$filter,fade=t=in:st=0:d=0.75"
+    
+    encode_ffmpeg -f lavfi -i "color=c=$background:s=$DEFAULT_RESOLUTION:r=$DEFAULT_FPS:d=$duration" \
+        -i "$qr_image" \
+        -filter_complex "$filter$(get_watermark_graph "segments")" \
+        -t "$duration" \
+        "${SEGMENT_ENCODE_ARGS[@]}" \
+        -y "$output_video" || return 1
+    
+    # Timings are relative to the end screen; combine rebases them onto the final video
+    ./jq -n \
+        --arg url "$url" --arg title "$title" --arg cta "$cta" \
+        --argjson width "$width" --argjson height "$height" --argjson duration "$duration" \
+        --argjson qr "[$qr_x, $qr_y, $qr_size, $qr_size]" \
+        --argjson title_box "[$text_x, $title_y, $((qr_x - text_x * 2)), $title_size]" \
+        --argjson cta_box "[$text_x, $cta_y, $((qr_x - text_x * 2)), $cta_size]" '
+        def box($b): {x: $b[0], y: $b[1], width: $b[2], height: $b[3],
+            normalized: {x: ($b[0] / $width), y: ($b[1] / $height), width: ($b[2] / $width), height: ($b[3] / $height)}};
+        {
+            resolution: {width: $width, height: $height},
+            duration: $duration,
+            elements: ([
+                {type: "link", url: $url, box: box($qr), start: 0, end: $duration},
+                (if $title != "" then {type: "title", text: $title, box: box($title_box), start: 0, end: $duration} else empty end),
+                {type: "text", text: $cta, box: box($cta_box), start: 0, end: $duration}
+            ])
+        }' > "$layout_json" || return 1
+    
+    rm -f "$qr_image" "$TEMP_DIR/${name}_title.txt" "$TEMP_DIR/${name}_cta.txt"
 }
 
-# Error handling
-error_exit() {
-    log "ERROR: $1"
-    exit 1
+# Append the end screen to the video list when options.end_screen has a URL
+# Prints the end screen duration (0 when none was added)
+append_end_screen() {
+    local video_list="$1"
+    local layout_json="$2"
+    
+    local spec=$(get_option_json "end_screen")
+    if [ "$spec" = "null" ] || [ -z "$(echo "$spec" | ./jq -r '.url // empty')" ]; then
+        echo "0"
+        return 0
+    fi
+    local duration=$(echo "$spec" | ./jq -r '.duration // 5')
+    if [[ ! "$duration" =~ ^[0-9]+(\.[0-9]+)?$ ]] || ! awk -v d="$duration" 'BEGIN { exit !(d > 0 && d <= 30) }'; then
+        record_warning "invalid_end_screen" "The end screen duration '$duration' is not between 0 and 30 seconds; skipped"
+        echo "0"
+        return 0
+    fi
+    
+    local end_video="$TEMP_DIR/segment_end_screen_segment.mp4"
+    if ! render_end_screen "$spec" "$end_video" "$layout_json" >&2; then
+        log "Warning: Failed to render end screen, continuing without it" >&2
+        rm -f "$layout_json"
+        echo "0"
+        return 0
+    fi
+    
+    echo "file '$end_video'" >> "$video_list"
+    ./jq -r '.duration' "$layout_json"
 }
 
-# Download file from S3
-download_s3_file() {
-    local s3_key="$1"
-    local local_path="$2"
+# Timed lower thirds from options.lower_thirds ([{text, subtext, start, end, style}],
+# times in seconds on the project timeline, offset past any opening card) as one
+# drawtext chain for the combined video. Each slides in from the left edge and back
+# out; style "boxed" (default) sets them on brand_color and dark boxes, "minimal"
+# draws outlined text only. Entries missing text or a valid start/end are skipped
+get_lower_thirds_filter() {
+    local offset="${1:-0}"
     
-    log "Downloading from S3: $s3_key"
-    aws s3 cp "s3://$BUCKET_NAME/$s3_key" "$local_path" || return 1
-    log "Downloaded: $local_path"
+    local entries=$(get_option_json "lower_thirds")
+    if [ "$(echo "$entries" | ./jq -r 'type')" != "array" ]; then
+        return 0
+    fi
+    local height=$(get_output_height)
+    local brand_color=$(get_palette_color background "$(get_option "brand_color" "0xc8102e")")
+    local text_size=$((height / 22)) subtext_size=$((height / 36))
+    local filters=()
+    local index entry
+    
+    for index in $(echo "$entries" | ./jq -r 'keys[]'); do
+        entry=$(echo "$entries" | ./jq -c --argjson i "$index" '.[$i]')
+        local text=$(echo "$entry" | ./jq -r '.text // empty')
+        local subtext=$(echo "$entry" | ./jq -r '.subtext // empty')
+        local window=$(echo "$entry" | ./jq -r --argjson offset "$offset" '
+            if (.start | type) == "number" and (.end | type) == "number" and .end > .start
+            then "\(.start + $offset) \(.end + $offset)" else empty end')
+        if [ -z "$text" ] || [ -z "$window" ]; then
+            record_warning "invalid_lower_third" "lower_thirds[$index] needs text and a start before its end; skipped"
+            continue
+        fi
+        local start="${window% *}" end="${window#* }"
+        
+        # Off-screen share of the slide: 1 before start and after end, easing to 0 while held
+        local slide="pow(min(1,max(0,max(1-(t-$start)/$LOWER_THIRD_SLIDE,1-($end-t)/$LOWER_THIRD_SLIDE))),2)"
+        local x="'w*0.05-(w*0.05+tw+$((height / 40)))*$slide'"
+        local timing="enable='between(t,$start,$end)'"
+        local text_extra="$timing" subtext_extra="$timing"
+        case "$(echo "$entry" | ./jq -r '.style // "boxed"')" in
+            minimal)
+                text_extra="borderw=$((text_size / 14 + 1)):bordercolor=black@0.7:$timing"
+                subtext_extra="borderw=$((subtext_size / 14 + 1)):bordercolor=black@0.7:$timing"
+                ;;
+            *)
+                text_extra="box=1:boxcolor=$brand_color@0.92:boxborderw=$((height / 72)):$timing"
+                subtext_extra="box=1:boxcolor=black@0.8:boxborderw=$((height / 90)):$timing"
+                ;;
+        esac
+        
+        filters+=("$(build_drawtext_filter "$(write_overlay_text "lower_third_${index}_text" "$text")" "$text_size" "$x" "h*0.74" "$text_extra" "$BOLD_FONT_FILE")")
+        if [ -n "$subtext" ]; then
+            filters+=("$(build_drawtext_filter "$(write_overlay_text "lower_third_${index}_subtext" "$subtext")" "$subtext_size" "$x" "h*0.74+$((text_size * 3 / 2))" "$subtext_extra")")
+        fi
+    done
+    
+    local IFS=","
+    echo "${filters[*]}"
 }
 
-# Upload file to S3
-upload_s3_file() {
-    local local_path="$1"
-    local s3_key="$2"
+# Progress bar from options.progress_bar (true or {color (default brand_color),
+# track_color, height (pixels), position: bottom|top, chapters (tick marks at the
+# given clip boundaries, default true), tick_color}) as a graph suffix for a chain
+# ending in an unlabeled stream. The bar is a color strip slid in by overlay,
+# which evaluates its position per frame
+get_progress_bar_graph() {
+    local final_video="$1"
+    local boundaries="$2"
     
-    log "Uploading to S3: $s3_key"
-    aws s3 cp "$local_path" "s3://$BUCKET_NAME/$s3_key" || return 1
-    log "Uploaded: $s3_key"
+    local spec=$(get_option_json "progress_bar" | ./jq -c 'if . == true then {} else objects end')
+    if [ -z "$spec" ]; then
+        return 0
+    fi
+    local duration=$(get_video_duration "$final_video")
+    if ! awk -v d="$duration" 'BEGIN { exit !(d > 0) }'; then
+        return 0
+    fi
+    
+    local width="${DEFAULT_RESOLUTION%x*}" height=$(get_output_height)
+    local bar_height=$(echo "$spec" | ./jq -r '.height // empty | numbers | floor')
+    if [ -z "$bar_height" ] || [ "$bar_height" -lt 1 ]; then
+        bar_height=$((height / 120 > 4 ? height / 120 : 4))
+    fi
+    local y=$((height - bar_height))
+    if [ "$(echo "$spec" | ./jq -r '.position // "bottom"')" = "top" ]; then
+        y=0
+    fi
+    local color=$(get_caption_color "$(echo "$spec" | ./jq -r --arg brand "$(get_option "brand_color" "0xc8102e")" '.color // $brand')" "0xc8102e")
+    local track_color=$(get_caption_color "$(echo "$spec" | ./jq -r '.track_color // "black@0.35"')" "black@0.35")
+    local tick_color=$(get_caption_color "$(echo "$spec" | ./jq -r '.tick_color // "white"')" "white")
+    
+    local graph=",drawbox=x=0:y=$y:w=iw:h=$bar_height:color=$track_color:t=fill[progress_base];"
+    graph+="color=c=$color:s=${width}x$bar_height:r=$DEFAULT_FPS[progress];"
+    graph+="[progress_base][progress]overlay=x='W*t/$duration-w':y=$y:shortest=1"
+    
+    # Chapter ticks at each clip boundary (cards and segments alike)
+    if [ "$(echo "$spec" | ./jq -r '.chapters != false')" = "true" ]; then
+        local start
+        for start in $boundaries; do
+            graph+=",drawbox=x=$(awk -v s="$start" -v d="$duration" -v w="$width" 'BEGIN { x = int(s / d * w - 1); print (x > 0 ? x : 0) }'):y=$y:w=2:h=$bar_height:color=$tick_color:t=fill"
+        done
+    fi
+    echo "$graph"
 }
 
-# Download image from URL
-download_image() {
-    local url="$1"
-    local local_path="$2"
+# Seconds into the combined video where each clip after the first starts, measured
+# from the video list before combining removes the segment files
+get_clip_boundaries() {
+    local video_list="$1"
     
-    log "Downloading image: $url"
-    curl -L -o "$local_path" "$url" || return 1
-    log "Downloaded image: $local_path"
+    local start=0 clip boundaries=()
+    local clips=($(sed -n "s/^file '\(.*\)'$/\1/p" "$video_list"))
+    for clip in "${clips[@]:0:${#clips[@]}-1}"; do
+        start=$(awk -v s="$start" -v d="$(get_video_duration "$clip")" 'BEGIN { print s + d }')
+        boundaries+=("$start")
+    done
+    echo "${boundaries[*]}"
 }
 
-# Generate Ken Burns video from image with variety of effects
-generate_ken_burns_video() {
-    local input_image="$1"
-    local output_video="$2"
-    local duration="$3"
+# Draw options.lower_thirds onto the combined video, copying the audio untouched
+apply_lower_thirds() {
+    local final_video="$1"
+    local offset="$2"
     
-    log "Generating Ken Burns video: $input_image -> $output_video"
+    local filter=$(get_lower_thirds_filter "$offset")
+    if [ -z "$filter" ]; then
+        return 0
+    fi
+    log "Drawing lower thirds onto final video"
+    encode_ffmpeg -i "$final_video" \
+        -vf "$filter" \
+        "${SEGMENT_ENCODE_ARGS[@]}" \
+        -c:a copy \
+        -y "$final_video.lower_thirds.mp4" && mv "$final_video.lower_thirds.mp4" "$final_video" || {
+        rm -f "$final_video.lower_thirds.mp4"
+        record_warning "lower_thirds_failed" "Could not draw lower thirds; delivering without them"
+    }
+}
+
+# Draw options.progress_bar onto the combined video, copying the audio untouched
+apply_progress_bar() {
+    local final_video="$1"
+    local boundaries="$2"
     
-    # Check available memory before processing
-    local available_mem=$(df /tmp | tail -1 | awk '{print $4}')
-    log "Available /tmp space before processing: ${available_mem}KB"
+    local graph=$(get_progress_bar_graph "$final_video" "$boundaries")
+    if [ -z "$graph" ]; then
+        return 0
+    fi
+    log "Drawing progress bar onto final video"
+    encode_ffmpeg -i "$final_video" \
+        -filter_complex "[0:v]null$graph" \
+        "${SEGMENT_ENCODE_ARGS[@]}" \
+        -c:a copy \
+        -y "$final_video.progress_bar.mp4" && mv "$final_video.progress_bar.mp4" "$final_video" || {
+        rm -f "$final_video.progress_bar.mp4"
+        record_warning "progress_bar_failed" "Could not draw the progress bar; delivering without it"
+    }
+}
+
+# Burn subtitles into a video, copying the audio stream untouched
+# An optional style ({font_size (output pixels), color, outline_color, back_color,
+# box, bold, position: top|bottom, margin (output pixels)}) is forced onto every cue
+burn_captions() {
+    local input_video="$1"
+    local caption_file="$2"
+    local output_video="$3"
+    local style_json="$4"
     
-    # Get random Ken Burns effect
-    local ken_burns_filter=$(get_random_ken_burns_effect "$duration")
+    # Convert to ASS so emoji runs can be pinned to the bundled emoji font
+    if text_has_emoji "$caption_file"; then
+        local ass_file="${caption_file%.*}.ass"
+        ffmpeg -i "$caption_file" -y "$ass_file" 2>/dev/null || return 1
+        LC_ALL=C sed -i -E "/^Dialogue:/s/${EMOJI_PATTERN}+/{\\\\fnNoto Emoji}&{\\\\fn}/g" "$ass_file"
+        caption_file="$ass_file"
+    fi
     
-    # Create ultra-smooth Ken Burns effect with memory-optimized settings
-    # Reduced quality for memory efficiency while maintaining smoothness
-    local frame_count=$((duration * DEFAULT_FPS))
+    # libass scales SRT/VTT styles from a 288-line script, where the default size is 16
+    local subtitles_filter="subtitles=$caption_file:fontsdir=$FONTS_DIR"
+    local style=()
+    local height=$(get_output_height)
+    local min_size=$(get_min_caption_size)
+    local font_size=$(echo "$style_json" | ./jq -r '.font_size // empty | numbers')
+    if [ -n "$font_size" ] && awk -v f="$font_size" -v m="$min_size" 'BEGIN { exit !(f > m) }'; then
+        min_size="$font_size"
+    fi
+    local script_size=$(awk -v s="$min_size" -v h="$height" 'BEGIN { printf "%d", s * 288 / h + 0.999 }')
+    if [ "$script_size" -gt 16 ] || [ -n "$font_size" ]; then
+        style+=("Fontsize=$script_size")
+    fi
+    local key name
+    for key in color:PrimaryColour outline_color:OutlineColour back_color:BackColour; do
+        name=$(echo "$style_json" | ./jq -r --arg key "${key%%:*}" '.[$key] // empty')
+        if [ -n "$name" ]; then
+            style+=("${key#*:}=$(ass_color "$(get_caption_color "$name" "white")")")
+        fi
+    done
+    if [ "$(echo "$style_json" | ./jq -r '.box == true')" = "true" ]; then
+        style+=("BorderStyle=3")
+    fi
+    if [ "$(echo "$style_json" | ./jq -r '.bold == true')" = "true" ]; then
+        style+=("Bold=1")
+    fi
+    if [ "$(echo "$style_json" | ./jq -r '.position // empty')" = "top" ]; then
+        style+=("Alignment=8")
+    fi
+    local margin=$(echo "$style_json" | ./jq -r '.margin // empty | numbers')
+    if [ -n "$margin" ]; then
+        style+=("MarginV=$(awk -v m="$margin" -v h="$height" 'BEGIN { printf "%d", m * 288 / h + 0.5 }')")
+    fi
+    if is_high_contrast; then
+        style+=("PrimaryColour=$(ass_color "$HIGH_CONTRAST_TEXT")" "OutlineColour=$(ass_color "$HIGH_CONTRAST_BACKGROUND")" "BackColour=$(ass_color "$HIGH_CONTRAST_BACKGROUND")" "BorderStyle=3")
+    fi
+    if [ ${#style[@]} -gt 0 ]; then
+        subtitles_filter="$subtitles_filter:force_style='$(IFS=","; echo "${style[*]}")'"
+    fi
     
-    # Use faster preset and higher CRF to reduce memory usage
-    ffmpeg -i "$input_image" \
-        -filter_complex "
-        $ken_burns_filter,
-        scale=$DEFAULT_RESOLUTION:flags=lanczos
-        " \
-        -t "$duration" \
-        -fps_mode cfr \
-        -r $DEFAULT_FPS \
-        -c:v libx264 \
-        -preset fast \
-        -crf 23 \
-        -profile:v high \
-        -level 4.1 \
-        -pix_fmt yuv420p \
-        -g $((DEFAULT_FPS * 2)) \
-        -keyint_min $DEFAULT_FPS \
-        -sc_threshold 0 \
-        -movflags +faststart \
-        -threads 2 \
+    encode_ffmpeg -i "$input_video" \
+        -vf "$subtitles_filter" \
+        "${SEGMENT_ENCODE_ARGS[@]}" \
+        -c:a copy \
         -y "$output_video" || return 1
+}
+
+# Re-encode a subtitle file as BOM-less UTF-8 in place, printing the source
+# encoding: a UTF-16 BOM, valid UTF-8, or else the given fallback (Windows-1252,
+# the usual legacy SRT encoding, unless subtitles_encoding names another)
+normalize_subtitle_encoding() {
+    local subtitle_file="$1"
+    local fallback="${2:-WINDOWS-1252}"
     
-    # Immediately verify file was created and log size
-    if [ -f "$output_video" ]; then
-        local video_size=$(stat -f%z "$output_video" 2>/dev/null || echo "unknown")
-        log "Generated video: $output_video (${video_size} bytes)"
+    local encoding
+    case "$(head -c 3 "$subtitle_file" | od -An -tx1 | tr -d ' \n')" in
+        fffe*) encoding="UTF-16LE" ;;
+        feff*) encoding="UTF-16BE" ;;
+        efbbbf) encoding="UTF-8" ;;
+        *)
+            if iconv -f UTF-8 -t UTF-8 "$subtitle_file" > /dev/null 2>&1; then
+                encoding="UTF-8"
+            else
+                encoding="$fallback"
+            fi
+            ;;
+    esac
+    
+    if [ "$encoding" = "UTF-16LE" ] || [ "$encoding" = "UTF-16BE" ]; then
+        tail -c +3 "$subtitle_file" > "$subtitle_file.raw"
     else
-        log "ERROR: Video file was not created: $output_video"
+        cp "$subtitle_file" "$subtitle_file.raw"
+    fi
+    # Convert into a temp file first so a failed conversion is caught (a pipe
+    # would report sed's status) and leaves the original in place
+    if ! iconv -f "$encoding" -t UTF-8 "$subtitle_file.raw" > "$subtitle_file.utf8" 2>/dev/null; then
+        rm -f "$subtitle_file.raw" "$subtitle_file.utf8"
         return 1
     fi
+    sed '1s/^\xef\xbb\xbf//; s/\r$//' "$subtitle_file.utf8" > "$subtitle_file"
+    rm -f "$subtitle_file.raw" "$subtitle_file.utf8"
+    echo "$encoding"
 }
 
-# Get random Ken Burns effect for variety
-get_random_ken_burns_effect() {
-    local duration="$1"
-    local frames=$((duration * DEFAULT_FPS))
+# Combine-level subtitles (event subtitles_s3_key, SRT or WebVTT): burned into the
+# final video (subtitles_mode "burn", styled by subtitles_style), uploaded next
+# to it as a sidecar ("sidecar", the default), or both ("both")
+process_subtitles() {
+    local project_id="$1"
+    local final_video="$2"
     
-    # ULTRA-SMOOTH KEN BURNS EFFECTS - Complete rewrite using scale/crop approach
-    # NEW APPROACH: Use time-based interpolation instead of incremental zoom
-    # This provides perfectly smooth motion without jitter
-    local total_frames=$((duration * DEFAULT_FPS))
+    local key=$(echo "$SUBTITLES_SPEC" | ./jq -r '.key // empty')
+    if [ -z "$key" ]; then
+        return 0
+    fi
+    local mode=$(echo "$SUBTITLES_SPEC" | ./jq -r '.mode // "sidecar"')
+    case "$mode" in
+        burn|sidecar|both) ;;
+        *)
+            record_warning "invalid_subtitles_mode" "Unknown subtitles_mode '$mode'; uploading a sidecar instead"
+            mode="sidecar"
+            ;;
+    esac
     
-    local effects=(
-        # 1. Ultra-smooth zoom in from center using time-based interpolation
-        "scale=2560:1440:flags=lanczos,crop='1920+200*sin(t/($duration)*3.14159)':'1080+150*sin(t/($duration)*3.14159)':x='320-100*sin(t/($duration)*3.14159)':y='180-75*sin(t/($duration)*3.14159)'"
-        
-        # 2. Smooth zoom out from center
-        "scale=3840:2160:flags=lanczos,crop='1920+960*cos(t/($duration)*3.14159)':'1080+540*cos(t/($duration)*3.14159)':x='960-480*cos(t/($duration)*3.14159)':y='540-270*cos(t/($duration)*3.14159)'"
-        
-        # 3. Gentle pan left to right with slight zoom
-        "scale=2560:1440:flags=lanczos,crop='1920+100*sin(t/($duration)*3.14159)':'1080+50*sin(t/($duration)*3.14159)':x='320*t/($duration)':y='180-25*sin(t/($duration)*3.14159)'"
-        
-        # 4. Gentle pan right to left with slight zoom  
-        "scale=2560:1440:flags=lanczos,crop='1920+100*sin(t/($duration)*3.14159)':'1080+50*sin(t/($duration)*3.14159)':x='320*(1-t/($duration))':y='180-25*sin(t/($duration)*3.14159)'"
-        
-        # 5. Smooth diagonal pan (top-left to bottom-right)
-        "scale=2560:1440:flags=lanczos,crop='1920+150*sin(t/($duration)*3.14159)':'1080+75*sin(t/($duration)*3.14159)':x='320*t/($duration)':y='180*t/($duration)'"
-        
-        # 6. Smooth diagonal pan (bottom-right to top-left)
-        "scale=2560:1440:flags=lanczos,crop='1920+150*sin(t/($duration)*3.14159)':'1080+75*sin(t/($duration)*3.14159)':x='320*(1-t/($duration))':y='180*(1-t/($duration))'"
-        
-        # 7. Cinematic slow zoom with subtle movement
-        "scale=2048:1152:flags=lanczos,crop='1920+64*sin(t/($duration)*3.14159)':'1080+36*sin(t/($duration)*3.14159)':x='64*sin(t/($duration)*1.5)':y='36*cos(t/($duration)*1.5)'"
-        
-        # 8. Gentle circular motion
-        "scale=2560:1440:flags=lanczos,crop='1920+100*sin(t/($duration)*3.14159)':'1080+100*sin(t/($duration)*3.14159)':x='320+100*sin(t/($duration)*6.28)':y='180+100*cos(t/($duration)*6.28)'"
-        
-        # 9. Smooth focus shift top to bottom
-        "scale=2560:1440:flags=lanczos,crop='1920+120*sin(t/($duration)*3.14159)':'1080+60*sin(t/($duration)*3.14159)':x='320-60*sin(t/($duration)*3.14159)':y='180*t/($duration)'"
-        
-        # 10. Smooth focus shift bottom to top
-        "scale=2560:1440:flags=lanczos,crop='1920+120*sin(t/($duration)*3.14159)':'1080+60*sin(t/($duration)*3.14159)':x='320-60*sin(t/($duration)*3.14159)':y='180*(1-t/($duration))'"
-        
-        # 11. Ultra-cinematic slow zoom with drift
-        "scale=2304:1296:flags=lanczos,crop='1920+192*sin(t/($duration)*3.14159)':'1080+108*sin(t/($duration)*3.14159)':x='192*sin(t/($duration)*2)':y='108*cos(t/($duration)*2)'"
+    local subtitle_file="$TEMP_DIR/subtitles.txt"
+    if ! fetch_input_file "$key" "$subtitle_file" >&2; then
+        record_warning "subtitles_unavailable" "Could not fetch subtitles $key; delivering without them"
+        return 0
+    fi
+    local encoding
+    if ! encoding=$(normalize_subtitle_encoding "$subtitle_file" "$(echo "$SUBTITLES_SPEC" | ./jq -r '.encoding // empty')"); then
+        record_warning "subtitles_unavailable" "Could not decode subtitles $key; delivering without them"
+        return 0
+    fi
+    
+    # Sniff the format rather than trusting the key's extension
+    local format
+    if head -1 "$subtitle_file" | grep -q '^WEBVTT'; then
+        format="vtt"
+    elif grep -q -- '-->' "$subtitle_file"; then
+        format="srt"
+    else
+        record_warning "subtitles_unavailable" "Subtitles $key are neither SRT nor WebVTT; delivering without them"
+        return 0
+    fi
+    mv "$subtitle_file" "$TEMP_DIR/subtitles.$format"
+    subtitle_file="$TEMP_DIR/subtitles.$format"
+    
+    local burned="false" sidecar_key=""
+    if [ "$mode" != "sidecar" ]; then
+        log "Burning $format subtitles into final video" >&2
+        if burn_captions "$final_video" "$subtitle_file" "$final_video.subtitled.mp4" "$(echo "$SUBTITLES_SPEC" | ./jq -c '.style // {}')" >&2 && \
+            mv "$final_video.subtitled.mp4" "$final_video"; then
+            burned="true"
+        else
+            rm -f "$final_video.subtitled.mp4"
+            record_warning "subtitles_burn_failed" "Could not burn subtitles $key; delivering without them"
+        fi
+    fi
+    if [ "$mode" != "burn" ]; then
+        sidecar_key="videos/${project_id}_final_video.$format"
+        if ! upload_s3_file "$subtitle_file" "$sidecar_key" >&2; then
+            record_warning "subtitles_upload_failed" "Could not upload the subtitle sidecar for $key"
+            sidecar_key=""
+        fi
+    fi
+    
+    rm -f "$subtitle_file"
+    ./jq -nc --arg source "$key" --arg format "$format" --arg encoding "$encoding" --argjson burned "$burned" --arg sidecar "$sidecar_key" \
+        '",\"subtitles\":" + ({source: $source, format: $format, encoding: $encoding, burned: $burned} + (if $sidecar == "" then {} else {sidecar_key: $sidecar} end) | tojson)' -r
+}
+
+# Multi-language captions from options.captions ({"en": "<key or url>", ...})
+# Burns options.primary_language into the final video, uploads every language as
+# a sidecar VTT, and optionally renders per-language variants (caption_variants)
+# Prints extra response fields
+process_caption_tracks() {
+    local project_id="$1"
+    local final_video="$2"
+    
+    local captions=$(get_option_json "captions")
+    if [ "$captions" = "null" ] || [ "$(echo "$captions" | ./jq 'length')" -eq 0 ]; then
+        return 0
+    fi
+    
+    local primary=$(get_option "primary_language" "$(echo "$captions" | ./jq -r 'keys_unsorted[0]')")
+    local render_variants=$(get_option "caption_variants" "false")
+    local clean_video="$TEMP_DIR/final_video_clean.mp4"
+    local tracks="{}"
+    local variants="{}"
+    local language
+    
+    cp "$final_video" "$clean_video" || return 1
+    
+    for language in $(echo "$captions" | ./jq -r 'keys_unsorted[]'); do
+        local source=$(echo "$captions" | ./jq -r --arg lang "$language" '.[$lang]')
+        local extension="${source##*.}"
+        local caption_file="$TEMP_DIR/captions_${language}.${extension}"
+        local vtt_file="$TEMP_DIR/captions_${language}.vtt"
         
-        # 12. Subtle breathing effect (zoom in/out)
-        "scale=2560:1440:flags=lanczos,crop='1920+320*sin(t/($duration)*6.28)':'1080+180*sin(t/($duration)*6.28)':x='320*sin(t/($duration)*6.28)':y='180*sin(t/($duration)*6.28)'"
+        if ! fetch_input_file "$source" "$caption_file" >&2; then
+            log "Warning: Could not fetch $language captions, skipping" >&2
+            continue
+        fi
         
-        # 13. Gentle S-curve pan
-        "scale=2560:1440:flags=lanczos,crop='1920+100*sin(t/($duration)*3.14159)':'1080+50*sin(t/($duration)*3.14159)':x='320*sin(t/($duration)*3.14159)':y='180*cos(t/($duration)*3.14159)'"
+        # Sidecar track for players that support selectable subtitles
+        if [ "$extension" != "vtt" ]; then
+            ffmpeg -i "$caption_file" -y "$vtt_file" >&2 || { log "Warning: Could not convert $language captions" >&2; continue; }
+        fi
+        local vtt_key="videos/${project_id}_captions_${language}.vtt"
+        if upload_s3_file "$vtt_file" "$vtt_key" >&2; then
+            tracks=$(echo "$tracks" | ./jq -c --arg lang "$language" --arg key "$vtt_key" '.[$lang] = $key')
+        fi
         
-        # 14. Smooth arc motion
-        "scale=2560:1440:flags=lanczos,crop='1920+150*sin(t/($duration)*3.14159)':'1080+75*sin(t/($duration)*3.14159)':x='320*cos(t/($duration)*3.14159)':y='180*sin(t/($duration)*3.14159)'"
+        if [ "$language" = "$primary" ]; then
+            log "Burning $language captions into final video" >&2
+            # Burn to a temp file so a failed burn leaves the final video intact
+            local burned_video="$TEMP_DIR/final_video_captioned.mp4"
+            if ! burn_captions "$clean_video" "$caption_file" "$burned_video" >&2 || ! mv "$burned_video" "$final_video"; then
+                log "Warning: Failed to burn $language captions" >&2
+                rm -f "$burned_video"
+            fi
+        elif [ "$render_variants" = "true" ]; then
+            local variant_video="$TEMP_DIR/final_video_${language}.mp4"
+            local variant_key="videos/${project_id}_final_video_${language}.mp4"
+            if burn_captions "$clean_video" "$caption_file" "$variant_video" >&2 && \
+                upload_s3_file "$variant_video" "$variant_key" >&2; then
+                variants=$(echo "$variants" | ./jq -c --arg lang "$language" --arg key "$variant_key" '.[$lang] = $key')
+            fi
+            rm -f "$variant_video"
+        fi
         
-        # 15. Cinematic reveal (zoom out with drift)
-        "scale=3840:2160:flags=lanczos,crop='1920+960*cos(t/($duration)*3.14159)':'1080+540*cos(t/($duration)*3.14159)':x='960*cos(t/($duration)*3.14159)+200*sin(t/($duration)*2)':y='540*cos(t/($duration)*3.14159)+150*cos(t/($duration)*2)'"
-    )
+        rm -f "$caption_file" "$vtt_file"
+    done
     
-    # Get random effect
-    local effect_count=${#effects[@]}
-    local random_index=$((RANDOM % effect_count))
-    echo "${effects[$random_index]}"
+    rm -f "$clean_video"
+    echo ",\"caption_tracks\":$tracks,\"caption_variants\":$variants,\"primary_language\":\"$primary\""
 }
 
 # Combine videos with audio
@@ -177,13 +5650,44 @@ combine_videos_with_audio() {
     local video_list="$1"
     local audio_file="$2"
     local output_video="$3"
+    local audio_offset="${4:-0}"
+    local pad_audio="${5:-false}"
     
     log "Combining videos with audio"
     
     # Combine videos first
     local combined_video="$TEMP_DIR/combined_video.mp4"
-    log "Combining videos with FFmpeg..."
-    ffmpeg -f concat -safe 0 -i "$video_list" -c copy -y "$combined_video" || return 1
+    if uses_segment_transitions "$video_list"; then
+        log "Combining videos with $(get_default_transition) transitions..."
+        combine_videos_with_crossfade "$video_list" "$(get_transition_duration)" "$combined_video" || return 1
+        CONCAT_REPORT_FIELD=",\"concat\":{\"mode\":\"crossfade\"}"
+    elif uses_intermediate_segments; then
+        # Near-lossless segments get their single delivery encode here
+        log "Combining intermediate segments with the delivery encode..."
+        encode_ffmpeg -f concat -safe 0 -i "$video_list" \
+            "${SEGMENT_ENCODE_ARGS[@]}" \
+            -y "$combined_video" || return 1
+        CONCAT_REPORT_FIELD=",\"concat\":{\"mode\":\"delivery_encode\"}"
+    else
+        # Stream copy only when every segment shares the stream parameters
+        local mismatch=$(get_concat_mismatch "$video_list")
+        local started=$(date +%s%3N)
+        if [ -z "$mismatch" ]; then
+            log "Combining videos with FFmpeg..."
+            ffmpeg -f concat -safe 0 -i "$video_list" -c copy -y "$combined_video" || return 1
+            local seconds=$(awk -v s="$started" -v e="$(date +%s%3N)" 'BEGIN { printf "%.3f", (e - s) / 1000 }')
+            local saved=$(awk -v e="$(estimate_encode_seconds "$(get_video_duration "$combined_video")")" -v s="$seconds" \
+                'BEGIN { printf "%.1f", (e > s) ? e - s : 0 }')
+            log "Stream-copied segments in ${seconds}s (about ${saved}s saved over a re-encode)"
+            CONCAT_REPORT_FIELD=",\"concat\":{\"mode\":\"stream_copy\",\"seconds\":$seconds,\"seconds_saved\":$saved}"
+        else
+            log "Segments differ ($mismatch); re-encoding the combination"
+            combine_videos_with_reencode "$video_list" "$combined_video" || return 1
+            local seconds=$(awk -v s="$started" -v e="$(date +%s%3N)" 'BEGIN { printf "%.3f", (e - s) / 1000 }')
+            CONCAT_REPORT_FIELD=",\"concat\":$(./jq -nc --arg reason "$mismatch" --argjson seconds "$seconds" \
+                '{mode: "reencode", seconds: $seconds, reason: $reason}')"
+        fi
+    fi
     
     # Immediately cleanup segment files after combination to free space
     log "Cleaning up segment files after combination..."
@@ -192,7 +5696,22 @@ combine_videos_with_audio() {
     # Add audio if available
     if [ -f "$audio_file" ]; then
         log "Adding audio to combined video..."
-        ffmpeg -i "$combined_video" -i "$audio_file" -c:v copy -c:a aac -shortest -y "$output_video" || return 1
+        local audio_filters=()
+        if awk -v o="$audio_offset" 'BEGIN { exit !(o > 0) }'; then
+            # Delay narration so it starts after any prepended card
+            audio_filters+=("adelay=$(awk -v o="$audio_offset" 'BEGIN { printf "%d", o * 1000 }'):all=1")
+        fi
+        if [ "$pad_audio" = "true" ]; then
+            # Pad with silence so appended cards are not cut by -shortest
+            audio_filters+=("apad")
+        fi
+        
+        if [ ${#audio_filters[@]} -gt 0 ]; then
+            local audio_filter=$(IFS=","; echo "${audio_filters[*]}")
+            ffmpeg -i "$combined_video" -i "$audio_file" -af "$audio_filter" -c:v copy -c:a aac -shortest -y "$output_video" || return 1
+        else
+            ffmpeg -i "$combined_video" -i "$audio_file" -c:v copy -c:a aac -shortest -y "$output_video" || return 1
+        fi
         log "Added audio to video"
         
         # Remove intermediate combined video after audio is added
@@ -201,7 +5720,286 @@ combine_videos_with_audio() {
         mv "$combined_video" "$output_video"
     fi
     
-    log "Final video: $output_video"
+    log "Final video: $output_video"
+}
+
+# Record the applied accessibility settings in the project manifest for audits
+# Prints extra response fields
+record_accessibility_settings() {
+    local manifest_path="$1"
+    local manifest_key="$2"
+    
+    if ! is_high_contrast && [ "$(get_min_caption_size)" = "0" ]; then
+        return 0
+    fi
+    
+    local settings=$(./jq -nc \
+        --argjson high_contrast "$(is_high_contrast && echo true || echo false)" \
+        --argjson min_caption_size "$(get_min_caption_size)" \
+        --arg text "$HIGH_CONTRAST_TEXT" --arg background "$HIGH_CONTRAST_BACKGROUND" --arg accent "$HIGH_CONTRAST_ACCENT" \
+        --arg applied_at "$(date -u '+%Y-%m-%dT%H:%M:%SZ')" '{
+            high_contrast: $high_contrast,
+            palette: (if $high_contrast then {text: $text, background: $background, accent: $accent} else null end),
+            min_caption_size: $min_caption_size,
+            applied_at: $applied_at
+        }')
+    
+    ./jq --argjson settings "$settings" '.accessibility = $settings' "$manifest_path" > "$manifest_path.tmp" && \
+        mv "$manifest_path.tmp" "$manifest_path"
+    upload_s3_file "$manifest_path" "$manifest_key" >&2 || log "Warning: Could not record accessibility settings in manifest" >&2
+    echo ",\"accessibility\":$settings"
+}
+
+# Mux options.audio_description ("<key or url>" or {"src", "language", "title"})
+# into the final video as a second, alternate audio track
+# Narration is tagged with options.audio_language; prints extra response fields
+add_audio_description_track() {
+    local project_id="$1"
+    local final_video="$2"
+    local audio_offset="${3:-0}"
+    
+    local spec=$(get_option_json "audio_description")
+    if [ "$spec" = "null" ]; then
+        return 0
+    fi
+    
+    local source=$(echo "$spec" | ./jq -r 'if type == "string" then . else (.src // .url // empty) end')
+    local main_language=$(get_option "audio_language" "eng")
+    local language=$(echo "$spec" | ./jq -r --arg lang "$main_language" 'if type == "object" then (.language // $lang) else $lang end')
+    local title=$(echo "$spec" | ./jq -r 'if type == "object" then (.title // "Audio Description") else "Audio Description" end')
+    if [ -z "$source" ]; then
+        return 0
+    fi
+    
+    local description_file="$TEMP_DIR/audio_description.${source##*.}"
+    if ! fetch_input_file "$source" "$description_file" >&2; then
+        log "Warning: Could not download audio description track, skipping" >&2
+        return 0
+    fi
+    
+    log "Adding audio description track ($language)..." >&2
+    local delay_ms=$(awk -v o="$audio_offset" 'BEGIN { printf "%d", o * 1000 }')
+    local with_description="$TEMP_DIR/final_video_ad.mp4"
+    
+    # The description track follows the narration offset and is padded to the video length
+    local main_maps=() description_index=0
+    if ffprobe -v error -select_streams a -show_entries stream=index -of csv=p=0 "$final_video" | grep -q .; then
+        main_maps=(-map 0:a:0 -c:a:0 copy -metadata:s:a:0 "language=$main_language" -disposition:a:0 default)
+        description_index=1
+    fi
+    ffmpeg -i "$final_video" -i "$description_file" \
+        -filter_complex "[1:a]adelay=${delay_ms}:all=1,apad[ad]" \
+        -map 0:v "${main_maps[@]}" -map "[ad]" \
+        -c:v copy -c:a:$description_index aac -shortest \
+        -metadata:s:a:$description_index "language=$language" \
+        -metadata:s:a:$description_index "title=$title" \
+        -disposition:a:$description_index descriptions \
+        -movflags +faststart \
+        -y "$with_description" >&2 || { rm -f "$with_description" "$description_file"; return 1; }
+    
+    mv "$with_description" "$final_video"
+    rm -f "$description_file"
+    echo ",\"audio_tracks\":[$([ $description_index -eq 1 ] && echo "{\"language\":\"$main_language\",\"kind\":\"main\"},"){\"language\":\"$language\",\"kind\":\"description\"}]"
+}
+
+# Whip pan length in seconds
+WHIP_PAN_DURATION="0.4"
+
+# xfade custom expression for a whip pan: the outgoing frame slides off to the left
+# as the incoming one follows it in from the right, eased, with a horizontal motion
+# blur (five taps) that peaks mid-move
+get_whip_pan_expr() {
+    local sample_a="if(eq(PLANE,0),a0(ld(3),Y),if(eq(PLANE,1),a1(ld(3),Y),if(eq(PLANE,2),a2(ld(3),Y),a3(ld(3),Y))))"
+    local sample_b="if(eq(PLANE,0),b0(ld(3),Y),if(eq(PLANE,1),b1(ld(3),Y),if(eq(PLANE,2),b2(ld(3),Y),b3(ld(3),Y))))"
+    local expr="st(1,(1-P)*(1-P)*(3-2*(1-P)));st(2,W*0.04*sin(PI*(1-P)));st(0,X+ld(1)*W);st(4,0)"
+    local tap
+    for tap in -2 -1 0 1 2; do
+        # Sample position past the right edge of the outgoing frame reads the incoming one
+        expr="$expr;st(5,ld(0)+($tap)*ld(2));st(3,clip(if(lt(ld(5),W),ld(5),ld(5)-W),0,W-1));st(4,ld(4)+if(lt(ld(5),W),$sample_a,$sample_b))"
+    done
+    echo "$expr;ld(4)/5"
+}
+
+# Transition used at every segment boundary without its own (options.transition:
+# crossfade, dip_to_black, wipe, whip_pan or cut); the style's crossfade when unset
+get_default_transition() {
+    local transition=$(get_option "transition" "")
+    if [ -n "$transition" ]; then
+        echo "$transition"
+    elif awk -v f="$(get_style_crossfade)" 'BEGIN { exit !(f > 0) }'; then
+        echo "crossfade"
+    else
+        echo "cut"
+    fi
+}
+
+# Seconds for timed transitions (options.transition_duration, else the style's
+# crossfade, else 1)
+get_transition_duration() {
+    local duration=$(get_option "transition_duration" "")
+    if [ -z "$duration" ]; then
+        duration=$(get_style_crossfade)
+    fi
+    if ! awk -v d="$duration" 'BEGIN { exit !(d > 0) }' 2>/dev/null; then
+        duration="1"
+    fi
+    echo "$duration"
+}
+
+# xfade arguments for a named transition, then its length, on one line ("<args> <length>")
+# A cut is a one-frame fade so every boundary shares the padded xfade timeline
+get_xfade_transition() {
+    local transition="$1"
+    local duration="$2"
+    
+    local cut=$(awk -v fps="$DEFAULT_FPS" 'BEGIN { printf "%.3f", 1 / fps }')
+    case "$transition" in
+        crossfade) echo "transition=fade:duration=$duration $duration" ;;
+        dip_to_black) echo "transition=fadeblack:duration=$duration $duration" ;;
+        wipe) echo "transition=wipeleft:duration=$duration $duration" ;;
+        whip_pan) echo "transition=custom:expr='$(get_whip_pan_expr)':duration=$WHIP_PAN_DURATION $WHIP_PAN_DURATION" ;;
+        cut) echo "transition=fade:duration=$cut $cut" ;;
+        *)
+            record_warning "unknown_transition" "Unknown transition '$transition'; cutting instead"
+            echo "transition=fade:duration=$cut $cut"
+            ;;
+    esac
+}
+
+# Whether joining a list needs the xfade graph: any boundary that is not a plain
+# cut (the default transition is options.transition unless given)
+uses_segment_transitions() {
+    local video_list="$1"
+    local default_transition="${2:-$(get_default_transition)}"
+    
+    [ "$default_transition" != "cut" ] || \
+        awk '$2 != "cut" && $2 != "default" { found = 1 } END { exit !found }' "${video_list%.txt}_transitions.txt" 2>/dev/null
+}
+
+# A transition spec (a name or {type, duration}) as one "<type> [duration]" line
+# for a list's _transitions.txt; nothing when unset
+format_transition_spec() {
+    local spec="$1"
+    echo "$spec" | ./jq -r 'if type == "object" then "\(.type // "default") \(.duration // "" | tostring)"
+        elif type == "string" then . else empty end' 2>/dev/null
+}
+
+# Describe the first segment in a concat list whose codec, size, frame rate, pixel
+# format or timebase differs from the first one; nothing when all match
+get_concat_mismatch() {
+    local video_list="$1"
+    
+    local reference="" reference_name="" path
+    while IFS= read -r path; do
+        path="${path#file \'}"
+        path="${path%\'}"
+        local params=$(ffprobe -v error -select_streams v:0 \
+            -show_entries stream=codec_name,width,height,r_frame_rate,pix_fmt,time_base -of csv=p=0 "$path" 2>/dev/null)
+        if [ -z "$reference" ]; then
+            reference="$params"
+            reference_name=$(basename "$path")
+        elif [ "$params" != "$reference" ]; then
+            echo "$(basename "$path") is $params, $reference_name is $reference"
+            return 0
+        fi
+    done < "$video_list"
+}
+
+# Re-encode a concat list whose segments differ, scaling each to the output size and rate
+combine_videos_with_reencode() {
+    local video_list="$1"
+    local output_video="$2"
+    
+    local width="${DEFAULT_RESOLUTION%x*}" height="${DEFAULT_RESOLUTION#*x}"
+    local inputs=() filter="" labels="" count=0 path
+    while IFS= read -r path; do
+        path="${path#file \'}"
+        path="${path%\'}"
+        inputs+=(-i "$path")
+        filter+="[$count:v]scale=$width:$height:force_original_aspect_ratio=increase:flags=lanczos,crop=$width:$height,setsar=1,fps=$DEFAULT_FPS[v$count];"
+        labels+="[v$count]"
+        count=$((count + 1))
+    done < "$video_list"
+    
+    encode_ffmpeg "${inputs[@]}" \
+        -filter_complex "$filter${labels}concat=n=$count:v=1:a=0" \
+        "${SEGMENT_ENCODE_ARGS[@]}" \
+        -y "$output_video" || return 1
+}
+
+# Combine videos with transitions while keeping the original timeline length
+# Every segment but the last is padded by its outgoing transition length so audio
+# stays in sync; each segment enters with its own transition and duration (the
+# list's _transitions.txt holds "<path> <type> [duration]") or the default one
+# (options.transition unless given), timed transitions lasting the given seconds
+# but never more than half the incoming segment. Encoder "segment" writes with
+# SEGMENT_ENCODE_ARGS so the result concats with clips rendered directly
+combine_videos_with_crossfade() {
+    local video_list="$1"
+    local fade="$2"
+    local output_video="$3"
+    
+    local paths=()
+    while IFS= read -r path; do
+        paths+=("$path")
+    done < <(sed -n "s/^file '\(.*\)'$/\1/p" "$video_list")
+    
+    local count=${#paths[@]}
+    if [ "$count" -lt 2 ]; then
+        ffmpeg -f concat -safe 0 -i "$video_list" -c copy -y "$output_video" || return 1
+        return 0
+    fi
+    
+    # Transition into each segment after the first: xfade arguments and length
+    local transitions_file="${video_list%.txt}_transitions.txt"
+    local default_transition="${4:-$(get_default_transition)}"
+    local transition_args=()
+    local transition_lengths=()
+    for ((i = 1; i < count; i++)); do
+        local transition duration
+        read transition duration <<< "$(awk -v path="${paths[$i]}" '$1 == path { print $2, $3 }' "$transitions_file" 2>/dev/null | tail -1)"
+        if [ -n "$duration" ] && { ! [[ "$duration" =~ ^[0-9]*\.?[0-9]+$ ]] || ! awk -v d="$duration" 'BEGIN { exit !(d > 0) }'; }; then
+            record_warning "invalid_transition" "Transition duration '$duration' is not a positive number of seconds; using ${fade}s"
+            duration=""
+        fi
+        local length=$(awk -v f="${duration:-$fade}" -v d="$(get_video_duration "${paths[$i]}")" 'BEGIN { printf "%.3f", (d > 0 && f > d / 2) ? d / 2 : f }')
+        [ "$transition" = "default" ] && transition=""
+        local xfade=$(get_xfade_transition "${transition:-$default_transition}" "$length")
+        transition_args[$i]="${xfade% *}"
+        transition_lengths[$i]="${xfade##* }"
+    done
+    
+    local inputs=()
+    local filter=""
+    local offset=0
+    local last=$((count - 1))
+    for i in "${!paths[@]}"; do
+        inputs+=(-i "${paths[$i]}")
+        if [ "$i" -lt "$last" ]; then
+            filter+="[$i:v]tpad=stop_mode=clone:stop_duration=${transition_lengths[$((i + 1))]},settb=AVTB,fps=$DEFAULT_FPS[v$i];"
+        else
+            filter+="[$i:v]settb=AVTB,fps=$DEFAULT_FPS[v$i];"
+        fi
+    done
+    
+    local previous="v0"
+    for ((i = 1; i < count; i++)); do
+        local segment_duration=$(get_video_duration "${paths[$((i - 1))]}")
+        offset=$(awk -v o="$offset" -v d="$segment_duration" 'BEGIN { printf "%.3f", o + d }')
+        filter+="[$previous][v$i]xfade=${transition_args[$i]}:offset=$offset[x$i];"
+        previous="x$i"
+    done
+    filter="${filter%;}"
+    
+    local encode_args=($(get_video_codec_args) -preset "$(get_encode_preset)" $(get_encode_rate_args) -movflags +faststart -threads 2)
+    if [ "$5" = "segment" ]; then
+        encode_args=("${SEGMENT_ENCODE_ARGS[@]}")
+    fi
+    encode_ffmpeg "${inputs[@]}" \
+        -filter_complex "$filter" \
+        -map "[$previous]" \
+        "${encode_args[@]}" \
+        -y "$output_video" || return 1
 }
 
 # Get video duration
@@ -210,6 +6008,183 @@ get_video_duration() {
     ffprobe -v quiet -show_entries format=duration -of csv=p=0 "$video_path" 2>/dev/null || echo "0"
 }
 
+# Onset times (seconds from start, one per line) in an audio file: the rise in
+# RMS energy over ~23ms windows, kept where it peaks above the clip's mean plus
+# one standard deviation and at least 0.1s after the previous onset
+detect_audio_onsets() {
+    local audio_path="$1"
+    local start="$2"
+    local duration="$3"
+    
+    ffmpeg -v error -ss "$start" -t "$duration" -i "$audio_path" \
+        -af "aformat=sample_fmts=flt:sample_rates=22050:channel_layouts=mono,asetnsamples=n=512:p=0,astats=metadata=1:reset=1,ametadata=print:key=lavfi.astats.Overall.RMS_level:file=-" \
+        -f null - 2>/dev/null | \
+        awk '
+        /pts_time:/ { sub(/.*pts_time:/, ""); t = $1 + 0 }
+        /RMS_level=/ {
+            sub(/.*=/, ""); e = ($0 ~ /inf/) ? 0 : exp(log(10) * $0 / 20)
+            n++; time[n] = t; flux[n] = (n > 1 && e > last) ? e - last : 0; last = e
+        }
+        END {
+            if (n < 3) exit
+            for (i = 1; i <= n; i++) sum += flux[i]
+            mean = sum / n
+            for (i = 1; i <= n; i++) var += (flux[i] - mean) ^ 2
+            threshold = mean + sqrt(var / n)
+            previous = -1
+            for (i = 2; i < n; i++) {
+                if (flux[i] > threshold && flux[i] >= flux[i - 1] && flux[i] > flux[i + 1] && time[i] - previous >= 0.1) {
+                    printf "%.3f\n", time[i]; previous = time[i]
+                }
+            }
+        }'
+}
+
+# Beat times within this segment (segment-local seconds, one per line) for image
+# cuts to snap to: options.beat_times on the project timeline, or onsets detected
+# in the music track options.beat_sync names (URL, s3:// or key; the manifest's
+# audio_file is the narration, so it is never analysed); nothing when neither is set
+get_beat_grid() {
+    local segment_id="$1"
+    local duration="$2"
+    
+    local beat_times=$(get_option_json "beat_times")
+    if [ "$beat_times" != "null" ]; then
+        if ! echo "$beat_times" | ./jq -e 'type == "array" and all(.[]; type == "number")' > /dev/null; then
+            record_warning "invalid_beat_times" "beat_times must be an array of seconds on the project timeline; images keep their allocated durations"
+            return 0
+        fi
+        echo "$beat_times" | ./jq -r --argjson offset "$SEGMENT_START_TIME" --argjson d "$duration" \
+            'map(. - $offset | select(. > 0 and . < $d) | . * 1000 | round / 1000) | sort | .[]'
+        return 0
+    fi
+    
+    local beat_sync=$(get_option_json "beat_sync")
+    case "$beat_sync" in
+        null|false) return 0 ;;
+    esac
+    local source=$(echo "$beat_sync" | ./jq -r 'strings')
+    if [ -z "$source" ]; then
+        record_warning "invalid_beat_sync" "beat_sync must name a music track (URL, s3:// or key); images keep their allocated durations"
+        return 0
+    fi
+    
+    local audio_path="$TEMP_DIR/segment_${segment_id}_beat_audio"
+    if ! fetch_input_file "$source" "$audio_path" >&2; then
+        record_warning "beat_sync_failed" "Could not fetch the beat_sync track for segment $segment_id; images keep their allocated durations"
+        return 0
+    fi
+    local onsets=$(detect_audio_onsets "$audio_path" "$SEGMENT_START_TIME" "$duration")
+    rm -f "$audio_path"
+    if [ -z "$onsets" ]; then
+        record_warning "beat_sync_failed" "No beats detected in segment $segment_id's audio; images keep their allocated durations"
+        return 0
+    fi
+    echo "$onsets"
+}
+
+# Number of cuts between the given image durations that land on a beat
+count_beat_cuts() {
+    local beat_grid="$1"
+    shift
+    
+    echo "$@" | awk -v beats="$(echo $beat_grid)" '{
+        beat_count = split(beats, beat, " ")
+        for (i = 1; i < NF; i++) {
+            cut += $i
+            for (b = 1; b <= beat_count; b++) if (beat[b] - cut < 0.002 && cut - beat[b] < 0.002) { count++; break }
+        }
+    }
+    END { print count + 0 }'
+}
+
+# Seconds on screen for each of a segment's images, one per line: images with an
+# explicit duration keep it, the rest share the remaining time by weight (default
+# 1), and every image gets at least options.min_image_duration seconds (2 by
+# default) taken from the longer ones; when they cannot all get the minimum,
+# options.overflow_policy "drop" (default) drops images from the end and
+# "speed_up" lowers the minimum so every image is shown ("extend_segment" is
+# settled earlier by get_segment_duration). Given a beat grid (segment-local
+# seconds), each cut between two images without an explicit duration then moves
+# to the nearest beat between the halfway points to its neighbouring cuts that
+# still leaves both images the minimum
+allocate_image_durations() {
+    local images_json="$1"
+    local duration="$2"
+    local beat_grid="$3"
+    
+    echo "$images_json" | ./jq -r '.[] | "\(.duration // -1) \(.weight // 1)"' | \
+        awk -v total="$duration" -v min="$(get_min_image_duration)" -v policy="$(get_option "overflow_policy" "drop")" \
+            -v beats="$(echo $beat_grid)" '
+        { e[NR] = $1 + 0; pinned[NR] = ($1 + 0 >= 0); w[NR] = ($2 + 0 > 0) ? $2 + 0 : 1 }
+        END {
+            n = NR; if (n < 1) exit
+            if (min <= 0 || min > total || (policy == "speed_up" && n * min > total)) min = total / n
+            fit = int(total / min + 1e-9); if (fit < 1) fit = 1
+            if (n > fit) n = fit
+            fixed = 0; weighted = 0; weights = 0
+            for (i = 1; i <= n; i++) {
+                if (e[i] >= 0) fixed += e[i]; else { weighted++; weights += w[i] }
+            }
+            # Explicit durations give way so weighted images still get the minimum
+            room = total - min * weighted
+            if (fixed > room || weighted == 0) {
+                for (i = 1; i <= n; i++) if (e[i] >= 0) e[i] = (fixed > 0) ? e[i] * room / fixed : 0
+                fixed = room
+            }
+            for (i = 1; i <= n; i++) a[i] = (e[i] >= 0) ? e[i] : (total - fixed) * w[i] / weights
+            # Raise short images to the minimum, taking the time from the longer ones
+            for (pass = 0; pass < n; pass++) {
+                deficit = 0; spare = 0
+                for (i = 1; i <= n; i++) if (a[i] < min) { deficit += min - a[i]; a[i] = min } else spare += a[i] - min
+                if (deficit <= 1e-9 || spare <= 0) break
+                for (i = 1; i <= n; i++) if (a[i] > min) a[i] -= (a[i] - min) * deficit / spare
+            }
+            # Snap the cuts to the beat grid; cuts next to an explicit duration stay put
+            beat_count = split(beats, beat, " ")
+            if (beat_count > 0 && n > 1) {
+                cut[0] = 0
+                for (i = 1; i <= n; i++) cut[i] = cut[i - 1] + a[i]
+                snapped[0] = 0
+                for (i = 1; i < n; i++) {
+                    snapped[i] = cut[i]
+                    if (pinned[i] || pinned[i + 1]) continue
+                    low = (snapped[i - 1] + cut[i]) / 2; if (low < snapped[i - 1] + min) low = snapped[i - 1] + min
+                    high = (cut[i] + cut[i + 1]) / 2; if (high > cut[i + 1] - min) high = cut[i + 1] - min
+                    best = -1
+                    for (b = 1; b <= beat_count; b++) {
+                        distance = beat[b] - cut[i]; if (distance < 0) distance = -distance
+                        if (beat[b] >= low && beat[b] <= high && (best < 0 || distance < best)) { best = distance; snapped[i] = beat[b] + 0 }
+                    }
+                }
+                snapped[n] = total
+                for (i = 1; i <= n; i++) a[i] = snapped[i] - snapped[i - 1]
+            }
+            used = 0
+            for (i = 1; i < n; i++) { printf "%.3f\n", a[i]; used += sprintf("%.3f", a[i]) }
+            printf "%.3f\n", total - used
+        }'
+}
+
+# Minimum seconds per image (options.min_image_duration)
+get_min_image_duration() {
+    get_option "min_image_duration" "2"
+}
+
+# Segment duration after the overflow policy: "extend_segment" lengthens the
+# segment until every image gets the minimum time
+get_segment_duration() {
+    local images_json="$1"
+    local duration="$2"
+    
+    if [ "$(get_option "overflow_policy" "drop")" != "extend_segment" ]; then
+        echo "$duration"
+        return 0
+    fi
+    awk -v d="$duration" -v n="$(echo "$images_json" | ./jq 'length')" -v min="$(get_min_image_duration)" \
+        'BEGIN { needed = n * min; printf "%s\n", (needed > d) ? sprintf("%.3f", needed) : d }'
+}
+
 # Main processing function
 process_segment() {
     local project_id="$1"
@@ -219,26 +6194,367 @@ process_segment() {
     
     log "Processing segment: $segment_id"
     
-    # Parse images JSON and download first image
-    local first_image_url=$(echo "$images_json" | ./jq -r '.[0].url // empty')
-    if [ -z "$first_image_url" ]; then
+    local first_image=$(echo "$images_json" | ./jq -c '.[0] // {}')
+    if [ -z "$(get_image_source_url "$first_image")" ] && ! is_generated_image "$first_image"; then
         error_exit "No images found for segment $segment_id"
     fi
     
-    # Download image
-    local image_path="$TEMP_DIR/segment_${segment_id}_image.jpg"
-    download_image "$first_image_url" "$image_path" || error_exit "Failed to download image"
+    # Split the segment's time across its images (weights, explicit durations,
+    # minimum and overflow policy), snapping the cuts to any beat grid
+    local requested_duration="$duration"
+    duration=$(get_segment_duration "$images_json" "$duration")
+    if [ "$duration" != "$requested_duration" ]; then
+        record_warning "segment_extended" "Segment $segment_id extended from ${requested_duration}s to ${duration}s to fit its images"
+    fi
+    local beat_grid=$(get_beat_grid "$segment_id" "$duration")
+    local image_durations=($(allocate_image_durations "$images_json" "$duration" "$beat_grid"))
+    local image_count=${#image_durations[@]}
+    local total_images=$(echo "$images_json" | ./jq 'length')
+    if [ "$image_count" -lt "$total_images" ]; then
+        record_warning "images_dropped" "Segment $segment_id shows $image_count of $total_images images; the rest do not fit at $(get_min_image_duration)s each"
+    fi
+    log "Segment $segment_id: $image_count image(s), durations ${image_durations[*]}"
     
-    # Generate video
     local video_path="$TEMP_DIR/segment_${segment_id}_video.mp4"
-    generate_ken_burns_video "$image_path" "$video_path" "$duration" || error_exit "Failed to generate video"
+    local clip_list="$TEMP_DIR/segment_${segment_id}_clips.txt"
+    local render_ms=0
+    local render_cpu_ticks=0
+    local index
+    
+    # Download every image, a bounded number at a time; each job leaves its exit
+    # status next to the image
+    mark_stage "download"
+    local concurrency=$(get_download_concurrency)
+    local image_limits=()
+    log "Downloading $image_count image(s), $concurrency at a time"
+    for ((index = 0; index < image_count; index++)); do
+        local image_json=$(echo "$images_json" | ./jq -c --argjson i "$index" '.[$i]')
+        local image_path="$TEMP_DIR/segment_${segment_id}_image_$index.jpg"
+        
+        # Text slides and maps are drawn here rather than downloaded; a map's motion
+        # zooms toward its marker unless the item sets a focal point
+        local image_type=$(echo "$image_json" | ./jq -r '.type // empty')
+        if [ "$image_type" = "text_slide" ] || [ "$image_type" = "map" ]; then
+            image_limits[$index]="$MAX_IMAGE_BYTES"
+            download_status=0
+            if [ "$image_type" = "text_slide" ]; then
+                render_text_slide_image "$image_json" "$image_path" || download_status=1
+            else
+                local marker
+                if marker=($(render_map_image "$image_json" "$image_path")); then
+                    images_json=$(echo "$images_json" | ./jq -c --argjson i "$index" --argjson x "${marker[0]}" --argjson y "${marker[1]}" \
+                        '.[$i].focal_point //= {x: $x, y: $y}')
+                else
+                    download_status=1
+                fi
+            fi
+            echo "$download_status" > "$image_path.status"
+            continue
+        fi
+        
+        local image_url=$(get_image_source_url "$image_json")
+        if [ -z "$image_url" ]; then
+            error_exit "No source for image $index of segment $segment_id"
+        fi
+        
+        local image_limit="$MAX_IMAGE_BYTES"
+        if [[ "$image_url" == data:* ]] && [ "$MAX_INLINE_IMAGE_BYTES" -lt "$image_limit" ]; then
+            image_limit="$MAX_INLINE_IMAGE_BYTES"
+        fi
+        image_limits[$index]="$image_limit"
+        local request_json=$(get_image_request_json "$image_json")
+        while [ "$(jobs -rp | wc -l)" -ge "$concurrency" ]; do
+            sleep 0.1
+        done
+        (
+            download_status=0
+            cached_download_image "$image_url" "$image_path" "$request_json" "$image_limit" || download_status=$?
+            echo "$download_status" > "$image_path.status"
+        ) &
+    done
+    wait
+    prune_image_cache
+    
+    # Then validate every image before rendering any, so one bad image rejects the
+    # segment with a result for each
+    mark_stage "validate"
+    local validations=() images_failed=() invalid_count=0
+    for ((index = 0; index < image_count; index++)); do
+        local image_json=$(echo "$images_json" | ./jq -c --argjson i "$index" '.[$i]')
+        local image_path="$TEMP_DIR/segment_${segment_id}_image_$index.jpg"
+        local download_status=$(cat "$image_path.status" 2>/dev/null || echo 1)
+        rm -f "$image_path.status"
+        if [ "$download_status" -eq 2 ]; then
+            reject_payload_too_large "Image exceeds ${image_limits[$index]} bytes" "${image_limits[$index]}"
+            rm -f "$TEMP_DIR/segment_${segment_id}_image_"*
+            error_exit "Image too large"
+        elif [ "$download_status" -ne 0 ]; then
+            validations+=("$(echo "$image_json" | ./jq -c --argjson index "$index" \
+                '{index: $index, status: "invalid", reason: (if .type == "text_slide" or .type == "map" then "\(.type) could not be rendered" else "download failed" end)}')")
+            images_failed+=("$index")
+            invalid_count=$((invalid_count + 1))
+            continue
+        fi
+        
+        # HEIC, AVIF, PDF pages and SVGs become PNG before anything else reads them
+        local container=$(get_image_container "$image_path")
+        if [ -n "$container" ] && ! convert_image_to_intermediate "$image_path" "$container" "$image_json"; then
+            validations+=("$(./jq -nc --argjson index "$index" --arg format "$container" \
+                '{index: $index, status: "invalid", reason: "\($format) image could not be converted", source_format: $format}')")
+            invalid_count=$((invalid_count + 1))
+            continue
+        fi
+        
+        local validation
+        if validation=$(validate_image "$image_path" "$index" "$container"); then
+            auto_orient_image "$image_path"
+        else
+            invalid_count=$((invalid_count + 1))
+        fi
+        validations+=("$validation")
+    done
+    local image_validation=$(IFS=,; echo "[${validations[*]}]")
+    if [ "$invalid_count" -gt 0 ]; then
+        log "ERROR: $invalid_count of $image_count images in segment $segment_id are unusable" >&2
+        record_rejection 422 "$(./jq -nc --arg segment_id "$segment_id" --argjson images "$image_validation" \
+            --argjson images_failed "[$(IFS=,; echo "${images_failed[*]}")]" '{
+            error: "invalid_image",
+            error_type: "InvalidImage",
+            message: "Segment \($segment_id) has unusable images: \([$images[] | select(.status != "ok") | "#\(.index) \(.reason)"] | join(", "))",
+            segment_id: $segment_id,
+            images: $images,
+            images_failed: $images_failed
+        }')"
+        rm -f "$TEMP_DIR/segment_${segment_id}_image_"*
+        error_exit "Invalid images in segment $segment_id"
+    fi
+    
+    # options.dedupe_images: "remove" drops repeats of an image and shares their time
+    # among the rest, "vary_motion" keeps them with a different move each
+    local dedupe=$(get_option "dedupe_images" "off")
+    local duplicates_field=""
+    if [ "$dedupe" != "off" ] && [ "$image_count" -gt 1 ]; then
+        local first_of=($(get_duplicate_image_map "$segment_id" "$image_count"))
+        local duplicates=() repeats=()
+        for ((index = 0; index < image_count; index++)); do
+            if [ "${first_of[$index]}" -ne "$index" ]; then
+                duplicates+=("{\"index\":$index,\"duplicate_of\":${first_of[$index]}}")
+                repeats+=("$index")
+            fi
+        done
+        
+        if [ "${#duplicates[@]}" -gt 0 ]; then
+            if [ "$dedupe" = "remove" ]; then
+                images_json=$(drop_segment_images "$segment_id" "$images_json" "$image_count" "${repeats[*]}")
+                image_durations=($(allocate_image_durations "$images_json" "$duration" "$beat_grid"))
+                image_count=${#image_durations[@]}
+                log "Removed ${#duplicates[@]} duplicate image(s) from segment $segment_id, durations ${image_durations[*]}"
+            else
+                images_json=$(vary_duplicate_motion "$images_json" "${first_of[*]}")
+                log "Varying motion across ${#duplicates[@]} duplicate image(s) in segment $segment_id"
+            fi
+            duplicates_field=",\"duplicates\":{\"mode\":\"$dedupe\",\"images\":[$(IFS=,; echo "${duplicates[*]}")]}"
+        fi
+    fi
+    
+    # options.moderation screens every image for unsafe content first: "reject"
+    # fails the segment, "skip" drops flagged images and "blur" blurs them
+    local moderation=$(get_option "moderation" "off")
+    local moderation_field=""
+    if [ "$moderation" != "off" ]; then
+        mark_stage "moderate"
+        local findings=() flagged=()
+        for ((index = 0; index < image_count; index++)); do
+            local image_path="$TEMP_DIR/segment_${segment_id}_image_$index.jpg"
+            local labels="[]"
+            if is_generated_image "$(echo "$images_json" | ./jq -c --argjson i "$index" '.[$i]')"; then
+                :
+            elif ! labels=$(get_moderation_labels "$image_path"); then
+                rm -f "$TEMP_DIR/segment_${segment_id}_image_"*
+                record_rejection 503 "$(./jq -nc --arg segment_id "$segment_id" --argjson index "$index" '{
+                    error: "moderation_unavailable",
+                    error_type: "ModerationUnavailable",
+                    message: "Could not screen image \($index) of segment \($segment_id) for unsafe content",
+                    segment_id: $segment_id
+                }')"
+                error_exit "Moderation failed for image $index of segment $segment_id"
+            fi
+            
+            local action="none"
+            if [ "$labels" != "[]" ]; then
+                flagged+=("$index")
+                case "$moderation" in
+                    skip) action="skipped" ;;
+                    blur)
+                        action="blurred"
+                        blur_image "$image_path" || action="skipped"
+                        ;;
+                    *) action="rejected" ;;
+                esac
+                log "Image $index of segment $segment_id flagged ($(echo "$labels" | ./jq -r 'map(.name) | join(", ")')): $action"
+            fi
+            findings+=("$(./jq -nc --argjson index "$index" --argjson labels "$labels" --arg action "$action" \
+                '{index: $index, flagged: ($labels != []), labels: $labels, action: $action}')")
+        done
+        moderation_field=",\"moderation\":{\"policy\":\"$moderation\",\"images\":[$(IFS=,; echo "${findings[*]}")]}"
+        
+        local skipped=($(echo "[$(IFS=,; echo "${findings[*]}")]" | ./jq -r '.[] | select(.action == "skipped") | .index'))
+        if [ "${#flagged[@]}" -gt 0 ] && { [ "$moderation" = "reject" ] || [ "${#skipped[@]}" -eq "$image_count" ]; }; then
+            rm -f "$TEMP_DIR/segment_${segment_id}_image_"*
+            record_rejection 422 "$(./jq -nc --arg segment_id "$segment_id" --argjson moderation "${moderation_field#,\"moderation\":}" '{
+                error: "unsafe_content",
+                error_type: "UnsafeContent",
+                message: "Segment \($segment_id) has images flagged for unsafe content",
+                segment_id: $segment_id,
+                moderation: $moderation
+            }')"
+            error_exit "Unsafe content in segment $segment_id"
+        fi
+        if [ "${#skipped[@]}" -gt 0 ]; then
+            images_json=$(drop_segment_images "$segment_id" "$images_json" "$image_count" "${skipped[*]}")
+            image_durations=($(allocate_image_durations "$images_json" "$duration" "$beat_grid"))
+            image_count=${#image_durations[@]}
+            log "Skipped ${#skipped[@]} flagged image(s) in segment $segment_id, durations ${image_durations[*]}"
+        fi
+    fi
+    
+    # options.restoration repairs scanned photos, options.enhancements clean up each
+    # image, options.upscale enlarges small ones and options.fit (or an image's fit)
+    # pads it to the output shape, before the Ken Burns chain
+    local restoration=$(get_option "restoration" "none")
+    if [ "$restoration" != "none" ] && [ "$restoration" != "scanned_photo" ]; then
+        record_warning "invalid_restoration" "Unknown restoration preset '$restoration'; ignored"
+        restoration="none"
+    fi
+    local enhancement_filters=$(get_enhancement_filters)
+    local default_fit=$(get_option "fit" "cover")
+    local fits=$(echo "$images_json" | ./jq -r --arg fit "$default_fit" '.[] | .fit // $fit')
+    local upscale=$(get_option "upscale" "off")
+    if [ "$upscale" != "off" ] && [ "$upscale" != "lanczos" ] && [ "$upscale" != "external" ]; then
+        record_warning "invalid_upscale" "Unknown upscale method '$upscale'; images are not upscaled"
+        upscale="off"
+    fi
+    local preprocessing_field=""
+    if [ -n "$enhancement_filters" ] || [ "$restoration" != "none" ] || [ "$upscale" != "off" ] || \
+            echo "$fits" | grep -qvx "cover"; then
+        mark_stage "preprocess"
+        local preprocessing=()
+        for ((index = 0; index < image_count; index++)); do
+            local image_path="$TEMP_DIR/segment_${segment_id}_image_$index.jpg"
+            local report='{"applied":[],"details":{}}'
+            # Text slides and maps are drawn at the output size and need no repair
+            if is_generated_image "$(echo "$images_json" | ./jq -c --argjson i "$index" '.[$i]')"; then
+                preprocessing+=("{\"index\":$index,\"applied\":[]}")
+                continue
+            fi
+            if [ "$restoration" = "scanned_photo" ]; then
+                report=$(restore_scanned_image "$image_path")
+            fi
+            if [ -n "$enhancement_filters" ]; then
+                report=$(echo "$report" | ./jq -c --argjson applied "$(preprocess_image "$image_path" "$enhancement_filters")" '.applied += $applied')
+            fi
+            if [ "$upscale" != "off" ]; then
+                report=$(echo "$report" | ./jq -c --argjson upscale "$(upscale_image "$image_path" "$upscale")" '
+                    (if $upscale.applied then .applied += ["upscale"] else . end) | .details.upscale = $upscale')
+            fi
+            local fit=$(echo "$images_json" | ./jq -r --argjson i "$index" --arg fit "$default_fit" '.[$i].fit // $fit')
+            if [ "$fit" != "cover" ]; then
+                local canvas=$(fit_image_to_output "$image_path" "$fit" "$(echo "$images_json" | ./jq -c --argjson i "$index" '.[$i]')")
+                if [ -n "$canvas" ]; then
+                    report=$(echo "$report" | ./jq -c --arg fit "$fit" --arg canvas "$canvas" '.applied += [$fit] | .details.fit = {mode: $fit, canvas: $canvas}')
+                fi
+            fi
+            preprocessing+=("$(echo "$report" | ./jq -c --argjson index "$index" '{index: $index} + . | if .details == {} then del(.details) else . end')")
+        done
+        preprocessing_field=",\"preprocessing\":[$(IFS=,; echo "${preprocessing[*]}")]"
+    fi
+    
+    rm -f "$clip_list" "${clip_list%.txt}_transitions.txt"
+    SEGMENT_IMAGE_COUNT="$image_count"
+    if [ "$image_count" -gt 1 ] && [ "$(get_option "loop_style" "none")" = "bounce" ]; then
+        record_warning "loop_style_ignored" "loop_style bounce only applies to single-image segments; segment $segment_id has $image_count images"
+    fi
+    for ((index = 0; index < image_count; index++)); do
+        local image_json=$(echo "$images_json" | ./jq -c --argjson i "$index" '.[$i]')
+        local image_duration="${image_durations[$index]}"
+        local image_path="$TEMP_DIR/segment_${segment_id}_image_$index.jpg"
+        # Text slides and maps only zoom in, so panning never crops text and maps close
+        # in on their marker
+        local motion=$(echo "$image_json" | ./jq -r '.motion // (if .start_rect or .end_rect then "keyframes" elif .type == "text_slide" or .type == "map" then "zoom_in" else empty end)')
+        if [ -z "$motion" ]; then
+            motion=$(get_option "motion" "random")
+        fi
+        
+        # Later images roll their own motion so a seeded segment does not repeat one
+        # move, and time their own stages
+        SEGMENT_ID="$segment_id"
+        IMAGE_INDEX="$index"
+        local stage_suffix=""
+        if [ "$index" -gt 0 ]; then
+            SEGMENT_ID="${segment_id}_$index"
+            stage_suffix="_$index"
+        fi
+        
+        # Generate video; segment-wide overlays ride on the first image only
+        mark_stage "render$stage_suffix"
+        local clip_path="$TEMP_DIR/segment_${segment_id}_clip_$index.mp4"
+        local overlay_filter
+        if [ "$index" -eq 0 ]; then
+            overlay_filter=$(get_segment_overlay_filter "$segment_id" "$image_json" "$image_duration")
+        else
+            overlay_filter=$(get_image_overlay_filter "$segment_id" "$image_json")
+        fi
+        local credit_filter=$(get_credit_overlay_filter "$segment_id" "$images_json" "$index" "$image_duration")
+        if [ -n "$credit_filter" ]; then
+            overlay_filter="${overlay_filter:+$overlay_filter,}$credit_filter"
+        fi
+        local render_started=$(date +%s%3N)
+        local cpu_ticks_before=$(get_children_cpu_ticks)
+        generate_ken_burns_video "$image_path" "$clip_path" "$image_duration" "$motion" "$overlay_filter" "$image_json" "$segment_id" || error_exit "Failed to generate video"
+        render_ms=$((render_ms + $(date +%s%3N) - render_started))
+        render_cpu_ticks=$((render_cpu_ticks + $(get_children_cpu_ticks) - cpu_ticks_before))
+        echo "file '$clip_path'" >> "$clip_list"
+        if [ "$index" -gt 0 ]; then
+            local image_transition=$(format_transition_spec "$(echo "$image_json" | ./jq -c '.transition')")
+            if [ -n "$image_transition" ]; then
+                echo "$clip_path $image_transition" >> "${clip_list%.txt}_transitions.txt"
+            fi
+        fi
+        rm -f "$image_path" "${image_path%.*}_depth.png"
+    done
+    SEGMENT_ID="$segment_id"
+    IMAGE_INDEX="0"
+    SEGMENT_IMAGE_COUNT="1"
+    local motion_quality_field=$(get_motion_quality_field "$render_ms" "$render_cpu_ticks")
+    
+    # Clips share SEGMENT_ENCODE_ARGS, so several images join without re-encoding
+    # unless an image asks for a transition in (images otherwise cut)
+    if [ "$image_count" -eq 1 ]; then
+        mv "$TEMP_DIR/segment_${segment_id}_clip_0.mp4" "$video_path"
+    elif uses_segment_transitions "$clip_list" "cut"; then
+        combine_videos_with_crossfade "$clip_list" "$(get_transition_duration)" "$video_path" "cut" "segment" || error_exit "Failed to join image clips"
+    else
+        ffmpeg -f concat -safe 0 -i "$clip_list" -c copy -movflags +faststart -y "$video_path" || error_exit "Failed to join image clips"
+    fi
+    local image_durations_field=""
+    if [ "$image_count" -gt 1 ]; then
+        image_durations_field=",\"image_durations\":[$(IFS=,; echo "${image_durations[*]}")]"
+    fi
+    if [ "$duration" != "$requested_duration" ]; then
+        image_durations_field="$image_durations_field,\"requested_duration\":$requested_duration"
+    fi
+    if [ -n "$beat_grid" ]; then
+        image_durations_field="$image_durations_field,\"beat_cuts\":$(count_beat_cuts "$beat_grid" "${image_durations[@]}")"
+    fi
     
     # Upload segment video
+    mark_stage "upload"
     local s3_key="segments/$project_id/${segment_id}_segment.mp4"
     upload_s3_file "$video_path" "$s3_key" || error_exit "Failed to upload segment video"
+    tag_intermediate_object "$s3_key"
     
     # Aggressive cleanup - remove files immediately after upload
-    rm -f "$image_path" "$video_path"
+    rm -f "$video_path" "$clip_list" "${clip_list%.txt}_transitions.txt" "$TEMP_DIR/segment_${segment_id}_clip_"*
     
     # Also clean up any other temp files that might exist for this segment
     rm -f "$TEMP_DIR/segment_${segment_id}_"*
@@ -247,7 +6563,109 @@ process_segment() {
     local final_mem=$(df /tmp | tail -1 | awk '{print $4}')
     log "Segment $segment_id completed. Available /tmp space: ${final_mem}KB"
     
-    echo "{\"segment_id\":\"$segment_id\",\"segment_s3_key\":\"$s3_key\",\"duration\":$duration}"
+    echo "{\"segment_id\":\"$segment_id\",\"segment_s3_key\":\"$s3_key\",\"duration\":$duration,\"resolution\":\"$DEFAULT_RESOLUTION\",\"fps\":$DEFAULT_FPS$image_durations_field,\"image_validation\":$image_validation$duplicates_field$moderation_field$preprocessing_field$motion_quality_field$(get_warnings_field)$(get_s3_metrics_field)$(get_download_metrics_field)$(get_image_cache_field)$(get_resource_usage_field)}"
+}
+
+# Process a synthetic segment rendered from its spec instead of source images
+process_synthetic_segment() {
+    local project_id="$1"
+    local segment_id="$2"
+    local segment_type="$3"
+    local spec="$4"
+    local duration="$5"
+    
+    log "Processing $segment_type segment: $segment_id"
+    
+    mark_stage "render"
+    local video_path="$TEMP_DIR/segment_${segment_id}_video.mp4"
+    case "$segment_type" in
+        map)
+            generate_map_video "$spec" "$video_path" "$duration" || error_exit "Failed to generate map video"
+            ;;
+        title_reveal)
+            generate_title_reveal_video "$spec" "$video_path" "$duration" || error_exit "Failed to generate title video"
+            ;;
+        countdown)
+            generate_countdown_video "$spec" "$video_path" "$duration" || error_exit "Failed to generate countdown video"
+            ;;
+        *)
+            error_exit "Unknown segment type: $segment_type"
+            ;;
+    esac
+    
+    # Upload segment video
+    mark_stage "upload"
+    local s3_key="segments/$project_id/${segment_id}_segment.mp4"
+    upload_s3_file "$video_path" "$s3_key" || error_exit "Failed to upload segment video"
+    tag_intermediate_object "$s3_key"
+    
+    rm -f "$TEMP_DIR/segment_${segment_id}_"*
+    
+    echo "{\"segment_id\":\"$segment_id\",\"segment_s3_key\":\"$s3_key\",\"duration\":$duration,\"resolution\":\"$DEFAULT_RESOLUTION\",\"fps\":$DEFAULT_FPS$(get_s3_metrics_field)$(get_download_metrics_field)$(get_resource_usage_field)}"
+}
+
+# Delete the per-segment S3 objects (options.cleanup_segments) once the uploaded
+# final video matches the local file size; DeleteObjects takes 1000 keys per call
+# Prints extra response fields
+delete_intermediate_segments() {
+    local segments_json="$1"
+    local final_video="$2"
+    local final_s3_key="$3"
+    
+    if [ "$(get_option "cleanup_segments" "false")" != "true" ]; then
+        return 0
+    fi
+    
+    local uploaded_size=$(s3_with_retry s3api head-object --bucket "$BUCKET_NAME" --key "$final_s3_key" \
+        --query ContentLength --output text 2>/dev/null)
+    if [ "$uploaded_size" != "$(wc -c < "$final_video" | tr -d ' ')" ]; then
+        log "Warning: Final video not verified in S3, keeping segment objects" >&2
+        echo ",\"deleted_segments\":0"
+        return 0
+    fi
+    
+    local deleted=0 batch
+    while read -r batch; do
+        if [ -z "$batch" ]; then
+            continue
+        fi
+        local result=$(s3_with_retry s3api delete-objects --bucket "$BUCKET_NAME" --delete "$batch" --output json) || {
+            log "Warning: Failed to delete a batch of segment objects" >&2
+            continue
+        }
+        local count=$(echo "$result" | ./jq '.Deleted // [] | length' 2>/dev/null)
+        deleted=$((deleted + ${count:-0}))
+    done < <(echo "$segments_json" | ./jq -c '
+        [.[] | .segment_s3_key // empty | select(startswith("segments/"))] | unique
+        | range(0; length; 1000) as $i | {Objects: (.[$i:$i + 1000] | map({Key: .})), Quiet: false}')
+    
+    log "Deleted $deleted intermediate segment objects" >&2
+    echo ",\"deleted_segments\":$deleted"
+}
+
+# Partial-success report (options.partial_success): skipped segments with their
+# reasons and the merged gaps they leave on the project timeline
+# Prints extra response fields
+get_partial_success_fields() {
+    local failed_segments_file="$1"
+    
+    if [ "$(get_option "partial_success" "false")" != "true" ]; then
+        return 0
+    fi
+    
+    local failed="[]"
+    if [ -s "$failed_segments_file" ]; then
+        failed=$(./jq -sc 'sort_by(.start)' "$failed_segments_file")
+    fi
+    local gaps=$(echo "$failed" | ./jq -c '
+        reduce .[] as $f ([];
+            if length > 0 and $f.start <= .[-1].end + 0.001 then
+                .[-1].end = ([.[-1].end, $f.end] | max) | .[-1].segment_ids += [$f.segment_id]
+            else
+                . + [{start: $f.start, end: $f.end, segment_ids: [$f.segment_id]}]
+            end)
+        | map(.duration = (.end - .start))')
+    echo ",\"partial\":$(echo "$failed" | ./jq 'length > 0'),\"failed_segments\":$failed,\"timeline_gaps\":$gaps"
 }
 
 # Combine segments function with memory-efficient streaming
@@ -275,14 +6693,45 @@ combine_segments() {
     local total_segments=$(echo "$segments_json" | ./jq -r '.[] | .segment_s3_key' | wc -l)
     log "Total segments to process: $total_segments"
     
+    # Plan each segment's place on the project timeline (explicit start/end, else back to back)
+    local segment_plan=$(echo "$segments_json" | ./jq -c --arg default_transition "$(get_option "transition" "")" '
+        reduce .[] as $s ([]; . + [{
+            segment_id: ($s.segment_id // "" | tostring),
+            s3_key: ($s.segment_s3_key // ""),
+            error: ($s.error // null),
+            transition: ($s.transition // (if $default_transition == "" then null else $default_transition end)),
+            start: ($s.start_time // (if length > 0 then .[-1].end else 0 end) | tonumber),
+            end: $s.end_time
+        } | .end = (.end // (.start + ($s.duration // 0 | tonumber)) | tonumber)]) | .[]')
+    
+    # Segments that were never rendered or fail to download are recorded for the response
+    local failed_segments_file="$TEMP_DIR/failed_segments.jsonl"
+    rm -f "$failed_segments_file"
+    
+    # Per-segment transitions into each downloaded segment ("<path> <transition>")
+    local transitions_file="${video_list%.txt}_transitions.txt"
+    rm -f "$transitions_file"
+    
     # Process segments in batches
-    echo "$segments_json" | ./jq -r '.[] | .segment_s3_key' | while read s3_key; do
+    mark_stage "download"
+    echo "$segment_plan" | while read -r entry; do
+        local s3_key=$(echo "$entry" | ./jq -r '.s3_key')
+        local reason=""
         if [ -n "$s3_key" ]; then
             local video_path="$TEMP_DIR/segment_$(basename "$s3_key" .mp4).mp4"
             
             # Download segment video
-            if download_s3_file "$s3_key" "$video_path"; then
+            if ! download_s3_file "$s3_key" "$video_path"; then
+                reason="Failed to download $s3_key"
+            elif ! normalize_segment_video "$video_path"; then
+                reason="Failed to normalize $s3_key to ${DEFAULT_RESOLUTION}@${DEFAULT_FPS}fps"
+                rm -f "$video_path"
+            else
                 echo "file '$video_path'" >> "$video_list"
+                local transition=$(format_transition_spec "$(echo "$entry" | ./jq -c '.transition')")
+                if [ -n "$transition" ]; then
+                    echo "$video_path $transition" >> "$transitions_file"
+                fi
                 segment_count=$((segment_count + 1))
                 
                 # Log progress every 10 segments
@@ -292,9 +6741,14 @@ combine_segments() {
                     local remaining_space=$(df /tmp | tail -1 | awk '{print $4}')
                     log "Remaining /tmp space: ${remaining_space}KB"
                 fi
-            else
-                log "Warning: Failed to download $s3_key, skipping"
             fi
+        else
+            reason=$(echo "$entry" | ./jq -r '.error // "Segment was not rendered"')
+        fi
+        
+        if [ -n "$reason" ]; then
+            log "Warning: Segment $(echo "$entry" | ./jq -r '.segment_id'): $reason, skipping"
+            echo "$entry" | ./jq -c --arg reason "$reason" '{segment_id, s3_key, reason: $reason, start, end: .end}' >> "$failed_segments_file"
         fi
     done
     
@@ -318,22 +6772,117 @@ combine_segments() {
         download_s3_file "$audio_s3_key" "$audio_file" || log "Warning: Could not download audio file"
     fi
     
-    # Combine videos
+    # Add any generated opening card ahead of the first segment, then the event's intro
+    local audio_offset=$(prepend_opening_card "$video_list")
+    local intro_duration=$(add_bookend_card "$video_list" "intro")
+    audio_offset=$(awk -v a="$audio_offset" -v i="$intro_duration" 'BEGIN { print a + i }')
+    
+    # Add the event's outro and then the end screen after the last segment
+    local outro_duration=$(add_bookend_card "$video_list" "outro")
+    local end_screen_layout="$TEMP_DIR/end_screen.json"
+    local end_screen_duration=$(append_end_screen "$video_list" "$end_screen_layout")
+    local pad_audio="false"
+    if [ "$end_screen_duration" != "0" ] || [ "$outro_duration" != "0" ]; then
+        pad_audio="true"
+    fi
+    
+    # Combine videos; every encode from here on produces the delivered video
+    mark_stage "combine"
+    use_delivery_encode
     local final_video="$TEMP_DIR/final_video.mp4"
-    combine_videos_with_audio "$video_list" "$audio_file" "$final_video" || error_exit "Failed to combine videos"
+    local clip_boundaries=""
+    if get_option_json "progress_bar" | ./jq -e '. == true or type == "object"' > /dev/null 2>&1; then
+        clip_boundaries=$(get_clip_boundaries "$video_list")
+    fi
+    combine_videos_with_audio "$video_list" "$audio_file" "$final_video" "$audio_offset" "$pad_audio" || error_exit "Failed to combine videos"
+    
+    mark_stage "lower_thirds"
+    apply_lower_thirds "$final_video" "$audio_offset"
+    apply_progress_bar "$final_video" "$clip_boundaries"
+    apply_watermark "$final_video"
+    
+    # Burn the primary caption language and export the rest as sidecar tracks
+    mark_stage "captions"
+    local extra_fields=$(process_caption_tracks "$project_id" "$final_video")
+    extra_fields+=$(process_subtitles "$project_id" "$final_video")
+    if [ "$intro_duration" != "0" ] || [ "$outro_duration" != "0" ]; then
+        extra_fields+=",\"bookend_cards\":{\"intro\":$intro_duration,\"outro\":$outro_duration}"
+    fi
+    extra_fields+="$CONCAT_REPORT_FIELD"
+    
+    # Attach the audio description as an alternate track
+    extra_fields+=$(add_audio_description_track "$project_id" "$final_video" "$audio_offset")
+    extra_fields+=$(record_accessibility_settings "$manifest_path" "$manifest_key")
+    extra_fields+=$(get_partial_success_fields "$failed_segments_file")
     
     # Upload final video
+    mark_stage "upload"
     local final_s3_key="videos/${project_id}_final_video.mp4"
-    upload_s3_file "$final_video" "$final_s3_key" || error_exit "Failed to upload final video"
+    local download_filename=$(get_option "download_filename" "")
+    if [ -n "$download_filename" ] && [[ "$download_filename" != *.[mM][pP]4 ]]; then
+        download_filename="$download_filename.mp4"
+    fi
+    upload_s3_file "$final_video" "$final_s3_key" "$download_filename" || error_exit "Failed to upload final video"
+    
+    # HDR masters get a tonemapped SDR copy, which the renditions are derived from
+    local rendition_source="$final_video"
+    if [ "$HDR_OUTPUT" = "true" ]; then
+        mark_stage "sdr_fallback"
+        extra_fields+=",\"hdr\":true"
+        local sdr_video="$TEMP_DIR/final_video_sdr.mp4"
+        extra_fields+=$(encode_sdr_fallback "$project_id" "$final_video" "$sdr_video" "$download_filename")
+        if [ -f "$sdr_video" ]; then
+            rendition_source="$sdr_video"
+        fi
+    fi
+    
+    # Derive the requested renditions from the uploaded master
+    mark_stage "renditions"
+    extra_fields+=$(encode_renditions "$project_id" "$rendition_source" "$final_s3_key" "$download_filename")
+    
+    # Previews and HLS/DASH packages share the renditions' SDR source
+    mark_stage "previews"
+    extra_fields+=$(render_previews "$project_id" "$rendition_source")
+    
+    mark_stage "packaging"
+    extra_fields+=$(package_streaming_outputs "$project_id" "$rendition_source")
     
     # Get video duration
     local duration=$(get_video_duration "$final_video")
     
+    # Poster frame and scrubber thumbnails
+    mark_stage "thumbnails"
+    extra_fields+=$(render_poster "$project_id" "$rendition_source" "$duration")
+    extra_fields+=$(render_thumbnail_sprites "$project_id" "$rendition_source" "$duration")
+    
+    # Editing master from the full-quality (possibly HDR) master
+    mark_stage "mezzanine"
+    extra_fields+=$(export_mezzanine "$project_id" "$final_video" "$duration")
+    rm -f "$TEMP_DIR/final_video_sdr.mp4"
+    
+    # Remove intermediate segment objects now that the final video is in S3
+    extra_fields+=$(delete_intermediate_segments "$segments_json" "$final_video" "$final_s3_key")
+    
+    # Export end screen element positions with timings on the final timeline
+    if [ -f "$end_screen_layout" ]; then
+        local end_screen_s3_key="videos/${project_id}_end_screen.json"
+        ./jq --argjson total "$duration" '
+            ($total - .duration) as $start
+            | .start = $start
+            | .elements |= map(.start += $start | .end += $start)' "$end_screen_layout" > "$end_screen_layout.tmp"
+        mv "$end_screen_layout.tmp" "$end_screen_layout"
+        if upload_s3_file "$end_screen_layout" "$end_screen_s3_key"; then
+            extra_fields+=",\"end_screen_s3_key\":\"$end_screen_s3_key\""
+        fi
+        rm -f "$end_screen_layout"
+    fi
+    
     # Aggressive cleanup to free memory
+    mark_stage "cleanup"
     log "Cleaning up temporary files..."
     
     # Remove video list and manifest
-    rm -f "$video_list" "$audio_file" "$manifest_path"
+    rm -f "$video_list" "$transitions_file" "$audio_file" "$manifest_path" "$failed_segments_file"
     
     # Remove all segment videos (they're no longer needed)
     rm -f "$TEMP_DIR"/segment_*_segment.mp4
@@ -347,7 +6896,364 @@ combine_segments() {
     log "Cleanup complete: $remaining_files files remaining, ${final_space}KB available"
     
     log "Video combination completed"
-    echo "{\"video_s3_key\":\"$final_s3_key\",\"duration\":$duration,\"resolution\":\"$DEFAULT_RESOLUTION\",\"fps\":$DEFAULT_FPS}"
+    echo "{\"video_s3_key\":\"$final_s3_key\",\"duration\":$duration,\"resolution\":\"$DEFAULT_RESOLUTION\",\"fps\":$DEFAULT_FPS$extra_fields$(get_warnings_field)$(get_s3_metrics_field)$(get_download_metrics_field)$(get_resource_usage_field)}"
+}
+
+# Remove files that earlier invocations left in /tmp (a timed-out run never reaches
+# its cleanup); the font, LUT, image and runtime caches and the CloudFront key are reused across warm invocations
+sweep_stale_temp_files() {
+    local swept=$(find "$TEMP_DIR" -mindepth 1 -xdev -type f \
+        ! -path "$FONT_CACHE_DIR/*" ! -path "$LUT_CACHE_DIR/*" ! -path "$WATERMARK_CACHE_DIR/*" ! -path "$RUNTIME_CACHE_DIR/*" ! -path "$IMAGE_CACHE_DIR/*" ! -name "cloudfront_private_key.pem" \
+        ! -newermt "@$INVOCATION_START_TIME" -printf '%s\n' -delete 2>/dev/null | \
+        awk '{ files++; bytes += $1 } END { printf "%d %d", files, bytes }')
+    find "$TEMP_DIR" -mindepth 1 -xdev -depth -type d -empty ! -path "$FONT_CACHE_DIR" ! -path "$LUT_CACHE_DIR" ! -path "$WATERMARK_CACHE_DIR" ! -path "$RUNTIME_CACHE_DIR" ! -path "$IMAGE_CACHE_DIR" -delete 2>/dev/null || true
+    
+    local files="${swept% *}" bytes="${swept#* }"
+    if [ "$files" -gt 0 ]; then
+        log "Swept $files stale temp files, reclaimed $((bytes / 1024))KB (available: $(df /tmp | tail -1 | awk '{print $4}')KB)"
+    fi
+}
+
+# Check bundled binaries once per container; warm invocations find the stamp
+# file and skip straight to work
+ensure_runtime_initialized() {
+    local stamp="$RUNTIME_CACHE_DIR/initialized"
+    if [ -f "$stamp" ]; then
+        return 0
+    fi
+    
+    COLD_START="true"
+    mkdir -p "$RUNTIME_CACHE_DIR"
+    log "Cold start in $(pwd): $(ls | tr '\n' ' ')"
+    
+    if [ ! -x "./jq" ]; then
+        error_exit "jq binary is missing or not executable"
+    fi
+    if ! type -P ffmpeg > /dev/null 2>&1; then
+        error_exit "ffmpeg binary is missing"
+    fi
+    touch "$stamp"
+}
+
+# Check whether the bundled ffmpeg has a filter, probing the filter list lazily
+# on first use and caching it for the container's lifetime
+has_ffmpeg_filter() {
+    local filter="$1"
+    local filters_file="$RUNTIME_CACHE_DIR/ffmpeg_filters"
+    
+    if [ ! -s "$filters_file" ]; then
+        mkdir -p "$RUNTIME_CACHE_DIR"
+        ffmpeg -hide_banner -filters 2>/dev/null | awk '$3 ~ /->/ { print $2 }' > "$filters_file.part" || true
+        mv "$filters_file.part" "$filters_file"
+    fi
+    grep -qx "$filter" "$filters_file"
+}
+
+# Check whether the bundled ffmpeg has a video encoder, cached like the filter list
+has_ffmpeg_encoder() {
+    local encoder="$1"
+    local encoders_file="$RUNTIME_CACHE_DIR/ffmpeg_encoders"
+    
+    if [ ! -s "$encoders_file" ]; then
+        mkdir -p "$RUNTIME_CACHE_DIR"
+        ffmpeg -hide_banner -encoders 2>/dev/null | awk '$1 ~ /^V/ { print $2 }' > "$encoders_file.part" || true
+        mv "$encoders_file.part" "$encoders_file"
+    fi
+    grep -qx "$encoder" "$encoders_file"
+}
+
+# Answer a warm-up ping (provisioned concurrency, scheduled keep-warm) after
+# initializing the runtime, without rendering anything
+handle_warmup() {
+    local init_ms=$(awk '$1 == "init" { started = $2 } $1 == "warmup" { print $2 - started }' "$RESOURCE_USAGE_FILE")
+    log "Warm-up complete (cold_start: $COLD_START, init: ${init_ms}ms)"
+    echo "{\"statusCode\":200,\"body\":{\"warm\":true,\"cold_start\":$COLD_START,\"init_ms\":${init_ms:-0}}}"
+}
+
+# Start capturing debug output for this invocation when debug bundles are enabled;
+# the event is saved with URL query strings, headers, cookies and inline data redacted
+start_debug_capture() {
+    local project_id="$1"
+    local event="$2"
+    
+    if [ "$(get_option "debug_bundle" "$DEBUG_BUNDLE_ON_FAILURE")" != "true" ]; then
+        return 0
+    fi
+    
+    rm -rf "$DEBUG_BUNDLE_DIR"
+    mkdir -p "$DEBUG_BUNDLE_DIR"
+    echo "$event" | ./jq '
+        walk(if type == "object" then
+                with_entries(if (.key | test("^(headers|cookies)$")) then .value = "<redacted>"
+                    elif (.key | test("base64|^data$")) and (.value | type) == "string" then .value = "<\(.value | length) base64 chars>"
+                    else . end)
+            elif type == "string" and startswith("data:") then "<data URI, \(length) chars>"
+            elif type == "string" and test("^https?://[^?]*\\?") then sub("\\?.*$"; "?<redacted>")
+            else . end)' > "$DEBUG_BUNDLE_DIR/event.json" 2>/dev/null || true
+    
+    local segment_id=$(echo "$event" | ./jq -r '.segment_id // "combine"')
+    DEBUG_BUNDLE_S3_KEY="debug/$project_id/$(date -u +%Y%m%dT%H%M%SZ)_${segment_id}.tar.gz"
+    DEBUG_CAPTURE="true"
+}
+
+# Upload the debug bundle for a failed render: sanitized event, ffmpeg commands
+# (with their filtergraphs) and stderr, handler log, generated text/subtitle files and
+# ffprobe of the inputs left in /tmp; records a RenderFailed response with its key
+upload_debug_bundle() {
+    DEBUG_CAPTURE="false"
+    
+    local input
+    find "$TEMP_DIR" -maxdepth 1 -type f \( -name '*.jpg' -o -name '*.png' -o -name '*.mp4' \
+        -o -name '*.m4a' -o -name '*.mp3' -o -name '*.wav' \) | while read -r input; do
+        echo "== $(basename "$input") ($(wc -c < "$input") bytes)"
+        ffprobe -v error -show_format -show_streams -of json "$input" 2>&1
+    done > "$DEBUG_BUNDLE_DIR/ffprobe_inputs.txt"
+    find "$TEMP_DIR" -maxdepth 1 -type f \( -name '*.txt' -o -name '*.ass' -o -name '*.srt' -o -name '*.vtt' \) \
+        -size -1M -exec cp {} "$DEBUG_BUNDLE_DIR/" \; 2>/dev/null || true
+    
+    # Keep the bundle small: ffmpeg progress output dominates stderr
+    local stderr_log="$DEBUG_BUNDLE_DIR/ffmpeg_stderr.log"
+    if [ -f "$stderr_log" ]; then
+        tail -c 1048576 "$stderr_log" > "$stderr_log.tail" && mv "$stderr_log.tail" "$stderr_log"
+    fi
+    
+    local bundle="$TEMP_DIR/debug_bundle.tar.gz"
+    tar -czf "$bundle" -C "$DEBUG_BUNDLE_DIR" . || return 1
+    upload_s3_file "$bundle" "$DEBUG_BUNDLE_S3_KEY" >&2 || { rm -f "$bundle"; return 1; }
+    rm -f "$bundle"
+    
+    local message=$(grep -h 'ERROR' "$DEBUG_BUNDLE_DIR/handler.log" 2>/dev/null | tail -1 | sed 's/^\[[^]]*\] \(ERROR: \)\{0,1\}//')
+    log "Uploaded debug bundle: $DEBUG_BUNDLE_S3_KEY" >&2
+    record_rejection 500 "$(./jq -nc --arg message "${message:-Render failed}" --arg key "$DEBUG_BUNDLE_S3_KEY" \
+        '{error: "render_failed", error_type: "RenderFailed", message: $message, debug_bundle_s3_key: $key}')" || true
+}
+
+# Replace an S3-pointer event ({"payload_s3_key": ...}) with the event stored
+# at that key in the project bucket, and a compressed event ({"payload_gzip_base64": ...}
+# or {"payload_zstd_base64": ...}) with its decompressed JSON; other events pass through
+resolve_event_payload() {
+    local event="$1"
+    
+    local payload_file="$TEMP_DIR/event_payload.json"
+    local payload_source
+    local payload_s3_key=$(echo "$event" | ./jq -r '.payload_s3_key // empty' 2>/dev/null)
+    local gzip_payload=$(echo "$event" | ./jq -r '.payload_gzip_base64 // empty' 2>/dev/null)
+    local zstd_payload=$(echo "$event" | ./jq -r '.payload_zstd_base64 // empty' 2>/dev/null)
+    if [ -n "$payload_s3_key" ]; then
+        payload_source="S3 ($payload_s3_key)"
+        download_s3_file "$payload_s3_key" "$payload_file" >&2 || return 1
+    elif [ -n "$gzip_payload" ] || [ -n "$zstd_payload" ]; then
+        local decompress="gzip -dc"
+        payload_source="gzip payload"
+        if [ -z "$gzip_payload" ]; then
+            if ! command -v zstd > /dev/null 2>&1; then
+                log "ERROR: zstd is not available to decompress the event payload" >&2
+                return 1
+            fi
+            decompress="zstd -dcq"
+            payload_source="zstd payload"
+        fi
+        # Reading one byte past the limit detects oversized (or malicious) payloads
+        printf '%s' "$gzip_payload$zstd_payload" | base64 -d 2>/dev/null | $decompress 2>/dev/null | \
+            head -c $((MAX_DECOMPRESSED_EVENT_BYTES + 1)) > "$payload_file" || true
+        if [ "$(wc -c < "$payload_file")" -gt "$MAX_DECOMPRESSED_EVENT_BYTES" ]; then
+            log "ERROR: Decompressed event payload exceeds ${MAX_DECOMPRESSED_EVENT_BYTES} bytes" >&2
+            rm -f "$payload_file"
+            return 1
+        fi
+    else
+        echo "$event"
+        return 0
+    fi
+    
+    if [ ! -s "$payload_file" ] || ! ./jq -e 'type == "object"' "$payload_file" > /dev/null 2>&1; then
+        log "ERROR: Event payload from $payload_source is not a JSON object" >&2
+        rm -f "$payload_file"
+        return 1
+    fi
+    log "Loaded event payload from $payload_source ($(wc -c < "$payload_file") bytes)" >&2
+    cat "$payload_file"
+    rm -f "$payload_file"
+}
+
+# Print the handler response, with the profile summary when profiling; bodies over
+# RESPONSE_INLINE_MAX_BYTES go to S3 and are replaced by {"response_s3_key": ..., "response_bytes": ...}
+emit_response() {
+    local project_id="$1"
+    local body="$2"
+    
+    if [ "$PROFILE_TRACE" = "true" ]; then
+        stop_profile_trace
+        local profile=$(upload_profile_trace "$project_id")
+        if [ -n "$profile" ]; then
+            body=$(echo "$body" | ./jq -c --argjson profile "$profile" '. + {profile: $profile}')
+        fi
+    fi
+    
+    local body_bytes=$(printf '%s' "$body" | wc -c)
+    if [ "$body_bytes" -gt "$RESPONSE_INLINE_MAX_BYTES" ]; then
+        local response_key="responses/$project_id/$(date +%s%N).json"
+        local response_file="$TEMP_DIR/response_body.json"
+        printf '%s' "$body" > "$response_file"
+        if upload_s3_file "$response_file" "$response_key" >&2; then
+            body="{\"response_s3_key\":\"$response_key\",\"response_bytes\":$body_bytes}"
+        else
+            log "Warning: Could not offload ${body_bytes}-byte response to S3, returning it inline" >&2
+        fi
+        rm -f "$response_file"
+    fi
+    echo "{\"statusCode\":200,\"body\":$body}"
+}
+
+# Render a synthetic fixture across a matrix of output resolutions and image counts
+# ({"benchmark": {"resolutions": [...], "image_counts": [...], "duration": 3}}) and
+# report encode timings next to the deadline model's estimate; combinations that
+# no longer fit before the Lambda deadline are skipped and the report marked truncated
+run_benchmark() {
+    local spec="$1"
+    
+    local resolutions=$(echo "$spec" | ./jq -r '(.resolutions // ["1280x720", "1920x1080"])[]')
+    local image_counts=$(echo "$spec" | ./jq -r '(.image_counts // [1, 3])[]')
+    local duration=$(echo "$spec" | ./jq -r '.duration // 3')
+    local fixture="$TEMP_DIR/benchmark_fixture.jpg"
+    local clip="$TEMP_DIR/benchmark_clip.mp4"
+    local results_file="$TEMP_DIR/benchmark_results.jsonl"
+    local output_resolution="$DEFAULT_RESOLUTION"
+    local truncated="false"
+    rm -f "$results_file"
+    
+    # A photo-sized test pattern, so scaling costs match real uploads
+    ffmpeg -f lavfi -i "testsrc2=size=3000x2000" -frames:v 1 -y "$fixture" > /dev/null 2>&1 || return 1
+    
+    local resolution count index
+    for resolution in $resolutions; do
+        if [[ ! "$resolution" =~ ^[0-9]+x[0-9]+$ ]]; then
+            log "Warning: Skipping invalid benchmark resolution: $resolution" >&2
+            continue
+        fi
+        DEFAULT_RESOLUTION="$resolution"
+        for count in $image_counts; do
+            local estimated=$(awk -v n="$count" -v d="$duration" -v w="${resolution%x*}" -v h="${resolution#*x}" \
+                -v f="$ENCODE_SECONDS_PER_MEGAPIXEL" 'BEGIN { printf "%d", n * d * w * h / 1000000 * f + 0.999 }')
+            if [ "$estimated" -gt $(($(get_remaining_seconds) - RENDER_OVERHEAD_SECONDS)) ]; then
+                log "Skipping benchmark ${resolution} x${count}: estimated ${estimated}s exceeds remaining time" >&2
+                truncated="true"
+                continue
+            fi
+            
+            mark_stage "benchmark_${resolution}_x${count}"
+            local timings=""
+            for ((index = 0; index < count; index++)); do
+                local started=$(date +%s%N)
+                generate_ken_burns_video "$fixture" "$clip" "$duration" >&2 || return 1
+                timings+="$((($(date +%s%N) - started) / 1000000)) $(wc -c < "$clip")"$'\n'
+            done
+            printf '%s' "$timings" | awk -v r="$resolution" -v n="$count" -v d="$duration" -v e="$estimated" '
+                { total += $1; bytes += $2; if (min == "" || $1 < min) min = $1; if ($1 > max) max = $1 }
+                END {
+                    printf "{\"resolution\":\"%s\",\"image_count\":%d,\"render_seconds\":%.3f,\"estimated_seconds\":%d,", r, n, total / 1000, e
+                    printf "\"clip_seconds\":{\"min\":%.3f,\"avg\":%.3f,\"max\":%.3f},", min / 1000, total / n / 1000, max / 1000
+                    printf "\"realtime_factor\":%.2f,\"output_bytes\":%d}\n", n * d * 1000 / total, bytes
+                }' >> "$results_file"
+            log "Benchmark ${resolution} x${count}: $(tail -1 "$results_file")" >&2
+        done
+    done
+    DEFAULT_RESOLUTION="$output_resolution"
+    rm -f "$fixture" "$clip"
+    
+    local results=$(./jq -sc '.' "$results_file" 2>/dev/null || echo "[]")
+    rm -f "$results_file"
+    local ffmpeg_version=$(ffmpeg -version 2>/dev/null | head -1)
+    echo "{\"benchmark\":$(./jq -nc --arg version "$ffmpeg_version" --argjson duration "$duration" \
+        --argjson truncated "$truncated" --argjson results "$results" \
+        '{ffmpeg_version: $version, clip_duration: $duration, truncated: $truncated, results: $results}')$(get_resource_usage_field)}"
+}
+
+# Memory in use by the function in bytes: the cgroup's usage (v2, then v1), else
+# the host's MemTotal - MemAvailable
+get_memory_in_use() {
+    cat /sys/fs/cgroup/memory.current /sys/fs/cgroup/memory/memory.usage_in_bytes 2>/dev/null | head -1 | grep . || \
+        awk '/^MemTotal:/ { total = $2 } /^MemAvailable:/ { available = $2 } END { printf "%.0f\n", (total - available) * 1024 }' /proc/meminfo
+}
+
+# Start the timestamped xtrace when profiling is enabled. The trace goes through a
+# FIFO to awk, which keeps only "<epoch seconds> <function>" and stops writing at
+# PROFILE_TRACE_MAX_BYTES; memory in use is sampled every 250ms alongside
+start_profile_trace() {
+    if [ "$PROFILE_TRACE" != "true" ]; then
+        return 0
+    fi
+    rm -f "$PROFILE_TRACE_FILE" "$PROFILE_TRACE_FILE.fifo" "$PROFILE_MEMORY_FILE"
+    mkfifo "$PROFILE_TRACE_FILE.fifo" || return 0
+    awk -v max="$PROFILE_TRACE_MAX_BYTES" '
+        /^\++ [0-9]+\.[0-9]+ / { line = $2 " " $3; bytes += length(line) + 1; if (bytes <= max) print line }
+        END { if (bytes > max) print "truncated" }' < "$PROFILE_TRACE_FILE.fifo" > "$PROFILE_TRACE_FILE" &
+    PROFILE_TRACE_PID=$!
+    ( while kill -0 $$ 2>/dev/null; do echo "$EPOCHREALTIME $(get_memory_in_use)"; sleep 0.25; done ) > "$PROFILE_MEMORY_FILE" 2>/dev/null &
+    PROFILE_MEMORY_PID=$!
+    exec {PROFILE_TRACE_FD}> "$PROFILE_TRACE_FILE.fifo"
+    BASH_XTRACEFD=$PROFILE_TRACE_FD
+    PS4='+ ${EPOCHREALTIME} ${FUNCNAME[0]:-main} '
+    set -x
+}
+
+# Stop the trace and memory sampler, waiting for the trace file to be complete;
+# runs in the handler's shell, which holds the FIFO open
+stop_profile_trace() {
+    { set +x; } 2>/dev/null
+    exec {PROFILE_TRACE_FD}>&-
+    unset BASH_XTRACEFD
+    wait "$PROFILE_TRACE_PID" 2>/dev/null
+    kill "$PROFILE_MEMORY_PID" 2>/dev/null
+    wait "$PROFILE_MEMORY_PID" 2>/dev/null
+    rm -f "$PROFILE_TRACE_FILE.fifo"
+}
+
+# Upload the stopped trace and memory timeline gzipped and print {"s3_key": ...,
+# "memory_s3_key": ..., "peak_memory_bytes": ..., "truncated": ..., "top_functions":
+# {...}} where each traced line's wall time until the next is charged to its function
+upload_profile_trace() {
+    local project_id="$1"
+    
+    local profile_prefix="profiles/$project_id/$(date -u +%Y%m%dT%H%M%SZ)"
+    local top_functions=$(awk '
+        $1 ~ /^[0-9]+\.[0-9]+$/ {
+            if (previous != "") seconds[function_name] += $1 - previous
+            previous = $1; function_name = $2
+        }
+        END { for (name in seconds) printf "%s %.3f\n", name, seconds[name] }' "$PROFILE_TRACE_FILE" | \
+        sort -k2 -rn | head -10 | ./jq -Rnc '[inputs | split(" ") | {key: .[0], value: (.[1] | tonumber)}] | from_entries')
+    local truncated=$(grep -qx "truncated" "$PROFILE_TRACE_FILE" && echo "true" || echo "false")
+    local peak_memory=$(awk '$2 > peak { peak = $2 } END { printf "%.0f", peak }' "$PROFILE_MEMORY_FILE" 2>/dev/null)
+    
+    gzip -c "$PROFILE_TRACE_FILE" > "$PROFILE_TRACE_FILE.gz"
+    gzip -c "$PROFILE_MEMORY_FILE" > "$PROFILE_MEMORY_FILE.gz"
+    rm -f "$PROFILE_TRACE_FILE" "$PROFILE_MEMORY_FILE"
+    if upload_s3_file "$PROFILE_TRACE_FILE.gz" "$profile_prefix.trace.gz" >&2; then
+        local memory_field=""
+        if upload_s3_file "$PROFILE_MEMORY_FILE.gz" "$profile_prefix.memory.gz" >&2; then
+            memory_field=",\"memory_s3_key\":\"$profile_prefix.memory.gz\""
+        fi
+        echo "{\"s3_key\":\"$profile_prefix.trace.gz\"$memory_field,\"peak_memory_bytes\":${peak_memory:-0},\"truncated\":$truncated,\"top_functions\":${top_functions:-\{\}}}"
+    fi
+    rm -f "$PROFILE_TRACE_FILE.gz" "$PROFILE_MEMORY_FILE.gz"
+}
+# Record a non-fatal render warning ("<code> <message>" lines in RENDER_WARNINGS_FILE)
+record_warning() {
+    local code="$1"
+    local message="$2"
+    
+    log "WARNING: $message" >&2
+    echo "$code ${message//$'\n'/ }" >> "$RENDER_WARNINGS_FILE"
+}
+
+# Render warnings for this invocation as a response field
+get_warnings_field() {
+    if [ ! -s "$RENDER_WARNINGS_FILE" ]; then
+        return 0
+    fi
+    printf ',"warnings":%s' "$(./jq -R -s -c 'split("\n") | map(select(length > 0)
+        | capture("^(?<code>[^ ]+) (?<message>.*)$"))' "$RENDER_WARNINGS_FILE")"
 }
 
 # Main handler
@@ -355,29 +7261,52 @@ main() {
     local event="$1"
     
     log "Starting Ken Burns video generation"
+    sweep_stale_temp_files
+    start_profile_trace
+    rm -f "$S3_METRICS_FILE" "$DOWNLOAD_METRICS_FILE" "$IMAGE_CACHE_STATS_FILE" "$RESOURCE_USAGE_FILE" "$RENDER_WARNINGS_FILE" "$REJECTION_FILE"
+    mark_stage "init"
+    ensure_runtime_initialized
+    event=$(resolve_event_payload "$event") || error_exit "Failed to load event payload from S3"
     log "Event: $event"
     log "Event length: ${#event}"
     log "First 100 chars: ${event:0:100}"
     
-    # Debug jq binary
-    log "Checking jq binary..."
-    if [ -f "./jq" ]; then
-        log "jq binary exists"
-        if [ -x "./jq" ]; then
-            log "jq binary is executable"
-        else
-            log "jq binary is NOT executable"
-        fi
-    else
-        log "jq binary does not exist"
+    if [ "$(echo "$event" | ./jq -r '.warmup // false')" = "true" ]; then
+        mark_stage "warmup"
+        handle_warmup
+        return 0
+    fi
+    
+    local benchmark_spec=$(echo "$event" | ./jq -c '.benchmark // empty | if type == "object" then . else {} end')
+    if [ -n "$benchmark_spec" ]; then
+        mark_stage "benchmark"
+        result=$(run_benchmark "$benchmark_spec") || exit_with_rejection
+        emit_response "benchmark" "$result"
+        return 0
     fi
     
     # Parse event
     local project_id=$(echo "$event" | ./jq -r '.project_id // empty')
     local segment_id=$(echo "$event" | ./jq -r '.segment_id // empty')
     local images_json=$(echo "$event" | ./jq -r '.images // empty')
-    local duration=$(echo "$event" | ./jq -r '.duration // 5.0')
+    OPTIONS_JSON=$(echo "$event" | ./jq -c '.options // {}')
+    apply_look
+    apply_hdr_output
+    apply_encode_settings
+    mark_stage "setup"
+    start_debug_capture "$project_id" "$event"
+    load_custom_fonts
+    local duration=$(echo "$event" | ./jq -r '.duration // empty')
+    if [ -z "$duration" ]; then
+        duration=$(get_style_default_duration)
+    fi
     local segments_json=$(echo "$event" | ./jq -r '.segment_results // empty')
+    SEGMENT_START_TIME=$(echo "$event" | ./jq -r '.start_time // 0')
+    BOOKEND_CARDS=$(echo "$event" | ./jq -c '{intro, outro} | with_entries(select(.value != null))')
+    SUBTITLES_SPEC=$(echo "$event" | ./jq -c '{key: .subtitles_s3_key, mode: .subtitles_mode, encoding: .subtitles_encoding, style: .subtitles_style} | with_entries(select(.value != null))')
+    SEGMENT_ID="$segment_id"
+    local segment_type=$(echo "$event" | ./jq -r '.segment_type // empty')
+    local segment_spec=$(echo "$event" | ./jq -c '.segment_spec // {}')
     
     log "Parsed values:"
     log "  project_id: '$project_id'"
@@ -389,15 +7318,27 @@ main() {
         error_exit "project_id is required"
     fi
     
+    apply_output_format || exit_with_rejection
+    apply_output_fps || exit_with_rejection
+    align_output_to_segments "$event"
+    validate_renditions || exit_with_rejection
+    validate_event_limits "$event" || exit_with_rejection
+    check_render_deadline "$event" || exit_with_rejection
+    check_presigned_url_expiry "$event" || exit_with_rejection
+    
     # Check if this is segment processing or combination
-    if [ -n "$segment_id" ] && [ -n "$images_json" ]; then
+    if [ -n "$segment_id" ] && [ -n "$segment_type" ]; then
+        # Process synthetic segment (no source images)
+        result=$(process_synthetic_segment "$project_id" "$segment_id" "$segment_type" "$segment_spec" "$duration") || exit_with_rejection
+        emit_response "$project_id" "$result"
+    elif [ -n "$segment_id" ] && [ -n "$images_json" ]; then
         # Process single segment
-        result=$(process_segment "$project_id" "$segment_id" "$images_json" "$duration")
-        echo "{\"statusCode\":200,\"body\":$result}"
+        result=$(process_segment "$project_id" "$segment_id" "$images_json" "$duration") || exit_with_rejection
+        emit_response "$project_id" "$result"
     elif [ -n "$segments_json" ]; then
         # Combine segments
-        result=$(combine_segments "$project_id" "$segments_json")
-        echo "{\"statusCode\":200,\"body\":$result}"
+        result=$(combine_segments "$project_id" "$segments_json") || exit_with_rejection
+        emit_response "$project_id" "$result"
     else
         error_exit "Invalid event format"
     fi
@@ -3,9 +3,16 @@ require 'aws-sdk-s3'
 require 'json'
 require 'concurrent'
 require 'timeout'
+require 'securerandom'
+require 'zlib'
+require 'base64'
 require_relative '../../config/services'
 
 class LambdaService
+  # Events larger than this are sent gzipped (payload_gzip_base64), or stored in S3 and
+  # sent as a payload_s3_key pointer when even the compressed form does not fit
+  MAX_INLINE_PAYLOAD_BYTES = 256 * 1024
+
   def initialize(region = nil)
     @region = region || Config::AWS_CONFIG[:region]
     @lambda_client = Aws::Lambda::Client.new(
@@ -106,12 +113,65 @@ class LambdaService
         end
         duration = end_time - start_time
         
-        # Build images array for Lambda (array of {url: ...})
+        # Synthetic segments (e.g. travel maps) are rendered from their spec, not images
+        if seg['type'] && seg['type'] != 'images'
+          next {
+            project_id: project_id,
+            segment_id: (seg['id'] || index).to_s,
+            segment_index: index,
+            segment_type: seg['type'],
+            segment_spec: seg['spec'] || {},
+            duration: duration,
+            start_time: start_time,
+            end_time: end_time
+          }
+        end
+        
+        # Build images array for Lambda (array of {url: ...}); CloudFront-hosted images may
+        # carry a distribution path to sign plus per-image request headers and cookies, and
+        # small generated graphics may be inlined as a data: URL or base64 field; internal
+        # assets may be referenced by S3 key (optionally in another bucket) and fetched with IAM
         generated_images = seg['generated_images'] || []
         images = generated_images.map do |img|
           img_data = img.is_a?(Hash) ? img.transform_keys(&:to_s) : img
           url = img_data['url'] || img_data[:url]
-          { url: url } if url && !url.empty?
+          cloudfront_path = img_data['cloudfront_path']
+          base64_data = img_data['base64'] || img_data['data']
+          s3_key = img_data['s3_key']
+          # Text slides and maps carry their own content and are drawn by the Lambda
+          if %w[text_slide map].include?(img_data['type'])
+            next img_data.slice('type', 'title', 'body', 'background', 'gradient', 'text_color', 'title_font',
+                                'body_font', 'align', 'lat', 'lon', 'path', 'zoom', 'line_color', 'focal_point',
+                                'motion', 'transition', 'caption', 'credit', 'weight', 'duration').compact
+          end
+          next nil if [url, cloudfront_path, base64_data, s3_key].all? { |source| source.nil? || source.empty? }
+          {
+            url: url,
+            cloudfront_path: cloudfront_path,
+            base64: base64_data,
+            content_type: img_data['content_type'],
+            page: img_data['page'],
+            s3_key: s3_key,
+            bucket: img_data['bucket'],
+            motion: img_data['motion'],
+            start_rect: img_data['start_rect'],
+            end_rect: img_data['end_rect'],
+            focal_point: img_data['focal_point'],
+            depth_map_url: img_data['depth_map_url'],
+            rotation_degrees: img_data['rotation_degrees'],
+            pull_focus: img_data['pull_focus'],
+            fit: img_data['fit'],
+            pad_color: img_data['pad_color'],
+            pad_gradient: img_data['pad_gradient'],
+            lut: img_data['lut'],
+            caption: img_data['caption'],
+            transition: img_data['transition'],
+            credit: img_data['credit'],
+            weight: img_data['weight'],
+            duration: img_data['duration'],
+            headers: img_data['headers'],
+            cookies: img_data['cookies']
+          }.compact
         end.compact
         
         # Skip segments without images
@@ -127,7 +187,9 @@ class LambdaService
           images: images,
           duration: duration,
           start_time: start_time,
-          end_time: end_time
+          end_time: end_time,
+          transition: seg['transition'],
+          grade: seg['grade']
         }
       end.compact
       
@@ -144,6 +206,16 @@ class LambdaService
       results = futures.map(&:value)
       total_time = Time.now - total_start_time
       
+      # Carry each segment's id, timeline position and transition through to the
+      # combine step, failures included, so a failed segment leaves a gap of its length
+      results.each_with_index do |result, index|
+        task = segment_tasks[index]
+        result[:segment_id] ||= task[:segment_id]
+        result[:start_time] ||= task[:start_time]
+        result[:end_time] ||= task[:end_time]
+        result[:transition] ||= task[:transition] if task[:transition]
+      end
+      
       # Performance analysis
       cached_count = results.count { |r| r[:cached] }
       successful_count = results.count { |r| r[:success] }
@@ -236,20 +308,37 @@ class LambdaService
       end
       
       first_image_url = images[0][:url] || images[0]['url']
+      inline_data = images[0][:base64] || images[0]['base64']
       duration = segment_data[:duration] || 5.0
       
       # Download image to temp location
       require 'net/http'
       require 'uri'
       require 'tempfile'
+      require 'base64'
       
       temp_image = Tempfile.new(['segment_image', '.jpg'])
-      uri = URI(first_image_url)
       
-      Net::HTTP.start(uri.host, uri.port, use_ssl: uri.scheme == 'https') do |http|
-        response = http.get(uri.path)
-        temp_image.write(response.body)
+      if inline_data || first_image_url.to_s.start_with?('data:')
+        # Inline images are decoded instead of downloaded
+        temp_image.binmode
+        temp_image.write(Base64.decode64(inline_data || first_image_url.split(',', 2).last))
         temp_image.flush
+      elsif (s3_key = images[0][:s3_key] || images[0]['s3_key'])
+        # S3-referenced images are read with the service credentials
+        @s3_client.get_object(
+          bucket: images[0][:bucket] || images[0]['bucket'] || @bucket_name,
+          key: s3_key.delete_prefix('/'),
+          response_target: temp_image.path
+        )
+      else
+        uri = URI(first_image_url)
+        
+        Net::HTTP.start(uri.host, uri.port, use_ssl: uri.scheme == 'https') do |http|
+          response = http.get(uri.path)
+          temp_image.write(response.body)
+          temp_image.flush
+        end
       end
       
       # Create output path
@@ -272,7 +361,8 @@ class LambdaService
         s3_service.instance_variable_get(:@s3_client).put_object(
           bucket: Config::AWS_CONFIG[:s3_bucket],
           key: s3_key,
-          body: File.read(temp_video.path)
+          body: File.read(temp_video.path),
+          content_type: 'video/mp4'
         )
         
         # Clean up
@@ -330,6 +420,13 @@ class LambdaService
         end_time: segment_data[:end_time],
         options: options.merge(segment_processing: true)
       }
+      # A segment's grade (e.g. one era per chapter) overrides the project-wide grade
+      payload[:options] = payload[:options].merge(grade: segment_data[:grade]) if segment_data[:grade]
+      
+      if segment_data[:segment_type]
+        payload[:segment_type] = segment_data[:segment_type]
+        payload[:segment_spec] = segment_data[:segment_spec]
+      end
       
       # Debug: Check for nil values in payload
       puts "    Debug - Payload: project_id=#{payload[:project_id]}, segment_id=#{payload[:segment_id]}, segment_index=#{payload[:segment_index]}, images=#{payload[:images].class}, duration=#{payload[:duration]}, start_time=#{payload[:start_time]}, end_time=#{payload[:end_time]}"
@@ -353,7 +450,7 @@ class LambdaService
       
       # Invoke Lambda function for this segment with retry logic and fallback
       lambda_start = Time.now
-      puts "    ⚡ Invoking Lambda for segment #{segment_data[:segment_id]} (#{payload[:images].length} images)..."
+      puts "    ⚡ Invoking Lambda for segment #{segment_data[:segment_id]} (#{(payload[:images] || []).length} images)..."
       response = invoke_lambda_function_with_retry(payload, segment_data[:segment_id])
       lambda_time = Time.now - lambda_start
       
@@ -415,6 +512,11 @@ class LambdaService
         segment_results: segment_results,
         options: options.merge(video_combination: true)
       }
+      # Subtitles (burned in, uploaded as a sidecar, or both) and the intro/outro
+      # cards are combine-level inputs
+      %i[subtitles_s3_key subtitles_mode subtitles_encoding subtitles_style intro outro].each do |key|
+        payload[key] = options[key] if options[key]
+      end
       
       # Invoke Lambda function for video combination with timeout handling
       puts "  🔧 Payload for combination: #{payload.keys.join(', ')}"
@@ -530,6 +632,53 @@ class LambdaService
     end
   end
 
+  # Warm Lambda containers ahead of a render burst without rendering anything
+  # @param count [Integer] Number of concurrent warm-up invocations
+  # @return [Hash] Warm-up result with cold start count and init times
+  def warm_up_function(count = 1)
+    puts "🔥 Warming up #{count} Lambda container(s)..."
+    
+    futures = count.times.map do
+      Concurrent::Future.execute { invoke_lambda_function({ warmup: true }) }
+    end
+    results = futures.map(&:value).compact
+    warmed = results.select { |result| result[:success] }
+    cold_starts = warmed.count { |result| result[:cold_start] }
+    
+    puts "  ✅ Warmed #{warmed.size}/#{count} (#{cold_starts} cold starts)"
+    {
+      success: warmed.size == count,
+      warmed: warmed.size,
+      cold_starts: cold_starts,
+      init_ms: warmed.map { |result| result[:init_ms] }.compact
+    }
+  end
+
+  # Benchmark the render pipeline on synthetic fixtures inside Lambda
+  # @param resolutions [Array<String>] Output resolutions (e.g. '1920x1080')
+  # @param image_counts [Array<Integer>] Images rendered per combination
+  # @param duration [Float] Clip length per image in seconds
+  # @return [Hash] Benchmark result with per-combination timings
+  def benchmark_function(resolutions: %w[1280x720 1920x1080], image_counts: [1, 3], duration: 3)
+    puts "⏱️  Benchmarking Lambda function: #{resolutions.join(', ')} x #{image_counts.join(', ')} images"
+    
+    response = invoke_lambda_function(
+      benchmark: { resolutions: resolutions, image_counts: image_counts, duration: duration }
+    )
+    
+    if response[:success] && response[:benchmark]
+      response[:benchmark]['results'].each do |result|
+        puts "  📊 #{result['resolution']} x#{result['image_count']}: #{result['render_seconds']}s " \
+             "(#{result['realtime_factor']}x realtime, model estimate #{result['estimated_seconds']}s)"
+      end
+      puts "  ⚠️  Matrix truncated by the Lambda time limit" if response[:benchmark]['truncated']
+    else
+      puts "❌ Benchmark failed: #{response[:error]}"
+    end
+    
+    response
+  end
+
   # Get function configuration
   # @return [Hash] Function configuration
   def get_function_configuration
@@ -636,6 +785,24 @@ class LambdaService
       # If successful, return immediately
       return result if result[:success]
       
+      # Oversized requests would fail the same way locally, so skip the fallback
+      if result[:error_type] == 'PayloadTooLarge'
+        puts "    ❌ Request too large for segment #{segment_id}: #{result[:error]}"
+        return result
+      end
+      
+      # Expired presigned image URLs fail everywhere until they are re-minted upstream
+      if %w[PresignedUrlExpired PresignedUrlExpiresDuringRender].include?(result[:error_type])
+        puts "    ⌛ Presigned URL expiry for segment #{segment_id}: #{result[:error]}"
+        return result
+      end
+      
+      # Jobs that cannot finish before the Lambda deadline go straight to the worker path
+      if result[:error_type] == 'InsufficientTimeRemaining'
+        puts "    ⏱️  Lambda time budget too small for segment #{segment_id}: #{result[:error]}"
+        return result.merge(needs_fallback: true)
+      end
+      
       # If failed but not retryable, return immediately
       unless retryable_error_from_result?(result)
         puts "    ❌ Non-retryable error for segment #{segment_id}: #{result[:error]}"
@@ -824,6 +991,24 @@ class LambdaService
     end
   end
 
+  # Upload an oversized event to S3 and build the pointer event the handler resolves
+  # @param payload [Hash] Original event
+  # @param payload_json [String] Serialized event
+  # @return [String] Pointer event JSON
+  def store_payload_in_s3(payload, payload_json)
+    project_id = payload[:project_id] || payload['project_id']
+    s3_key = "payloads/#{project_id}/#{Time.now.strftime('%Y%m%d_%H%M%S')}_#{SecureRandom.hex(4)}.json"
+    puts "    📦 Payload is #{payload_json.bytesize} bytes, storing in S3: #{s3_key}"
+    
+    @s3_client.put_object(
+      bucket: @bucket_name,
+      key: s3_key,
+      body: payload_json,
+      content_type: 'application/json'
+    )
+    { payload_s3_key: s3_key }.to_json
+  end
+
   # Invoke Lambda function
   # @param payload [Hash] Function payload
   # @return [Hash] Invocation result
@@ -835,9 +1020,20 @@ class LambdaService
       puts "    Debug - Payload keys: #{payload.keys.join(', ')}"
       puts "    Debug - Payload values: #{payload.values.map(&:class).join(', ')}"
       
+      payload_json = payload.to_json
+      if payload_json.bytesize > MAX_INLINE_PAYLOAD_BYTES
+        compressed_json = { payload_gzip_base64: Base64.strict_encode64(Zlib.gzip(payload_json)) }.to_json
+        payload_json = if compressed_json.bytesize <= MAX_INLINE_PAYLOAD_BYTES
+          puts "    📦 Payload is #{payload_json.bytesize} bytes, sending gzipped (#{compressed_json.bytesize} bytes)"
+          compressed_json
+        else
+          store_payload_in_s3(payload, payload_json)
+        end
+      end
+      
       response = @lambda_client.invoke(
         function_name: @function_name,
-        payload: payload.to_json,
+        payload: payload_json,
         invocation_type: 'RequestResponse',
         log_type: 'Tail'
       )
@@ -867,6 +1063,34 @@ class LambdaService
           response_body['body']
         end
         
+        # Oversized response bodies are left in S3 behind a pointer
+        if body['response_s3_key']
+          puts "    Debug - Fetching #{body['response_bytes']}-byte response from S3: #{body['response_s3_key']}"
+          body = JSON.parse(@s3_client.get_object(bucket: @bucket_name, key: body['response_s3_key']).body.read)
+        end
+        
+        # Typed rejections (e.g. 413 PayloadTooLarge) come back in the handler's statusCode
+        if response_body['statusCode'].to_i >= 400
+          puts "    Debug - Lambda rejected request: #{body['error_type']} #{body['message']}"
+          return {
+            success: false,
+            status_code: response_body['statusCode'],
+            error: body['message'] || body['error'],
+            error_type: body['error_type'],
+            limit: body['limit'],
+            actual: body['actual'],
+            estimated_seconds: body['estimated_seconds'],
+            remaining_seconds: body['remaining_seconds'],
+            url: body['url'],
+            expires_at: body['expires_at'],
+            images: body['images'],
+            images_failed: body['images_failed'],
+            moderation: body['moderation'],
+            estimated_finish_at: body['estimated_finish_at'],
+            debug_bundle_s3_key: body['debug_bundle_s3_key']
+          }.compact
+        end
+        
         # Generate presigned URL for video access
         s3_key = body['video_s3_key'] || body['segment_s3_key']
         video_url = if s3_key
@@ -882,8 +1106,50 @@ class LambdaService
           video_s3_key: body['video_s3_key'],
           segment_s3_key: body['segment_s3_key'],
           duration: body['duration'],
+          requested_duration: body['requested_duration'],
+          image_durations: body['image_durations'],
+          beat_cuts: body['beat_cuts'],
+          image_validation: body['image_validation'],
+          image_cache: body['image_cache'],
+          duplicates: body['duplicates'],
+          moderation: body['moderation'],
+          preprocessing: body['preprocessing'],
           resolution: body['resolution'] || '1920x1080',
+          renditions: body['renditions'],
+          hdr: body['hdr'],
+          sdr_video_s3_key: body['sdr_video_s3_key'],
+          hls: body['hls'],
+          dash: body['dash'],
+          preview_gif_s3_key: body['preview_gif_s3_key'],
+          preview_webp_s3_key: body['preview_webp_s3_key'],
+          poster_s3_key: body['poster_s3_key'],
+          thumbnails_sprite_s3_key: body['thumbnails_sprite_s3_key'],
+          thumbnails_vtt_s3_key: body['thumbnails_vtt_s3_key'],
+          mezzanine_s3_key: body['mezzanine_s3_key'],
+          concat: body['concat'],
           fps: body['fps'] || 24,
+          end_screen_s3_key: body['end_screen_s3_key'],
+          bookend_cards: body['bookend_cards'],
+          subtitles: body['subtitles'],
+          caption_tracks: body['caption_tracks'],
+          caption_variants: body['caption_variants'],
+          primary_language: body['primary_language'],
+          audio_tracks: body['audio_tracks'],
+          accessibility: body['accessibility'],
+          s3_metrics: body['s3_metrics'],
+          download_metrics: body['download_metrics'],
+          resource_usage: body['resource_usage'],
+          motion_quality: body['motion_quality'],
+          warnings: body['warnings'],
+          partial: body['partial'],
+          failed_segments: body['failed_segments'],
+          timeline_gaps: body['timeline_gaps'],
+          deleted_segments: body['deleted_segments'],
+          warm: body['warm'],
+          cold_start: body['cold_start'],
+          init_ms: body['init_ms'],
+          benchmark: body['benchmark'],
+          profile: body['profile'],
           generated_at: Time.now.iso8601,
           project_id: body['project_id']
         }
@@ -13,6 +13,21 @@ REGION="us-east-1"
 TIMEOUT=900
 MEMORY_SIZE=3008
 
+# Lambda layer with pdftoppm (poppler) and rsvg-convert (librsvg) for PDF and SVG
+# images; built in an Amazon Linux 2 container unless DOCUMENT_TOOLS_LAYER_ARN
+# names an existing layer version
+DOCUMENT_TOOLS_LAYER_NAME="ken-burns-document-tools"
+
+# Optional CloudFront signing for cloudfront_path images, download host policy
+# and PROFILE_TRACE=true profiling (set before deploying; host lists are passed
+# with ; separators)
+LAMBDA_ENV_VARS="S3_BUCKET=burns-videos,LAMBDA_TIMEOUT_SECONDS=$TIMEOUT"
+for ENV_VAR in CLOUDFRONT_DOMAIN CLOUDFRONT_KEY_PAIR_ID CLOUDFRONT_PRIVATE_KEY_PARAM DOWNLOAD_ALLOWED_HOSTS DOWNLOAD_DENIED_HOSTS PROFILE_TRACE; do
+    if [ -n "${!ENV_VAR}" ]; then
+        LAMBDA_ENV_VARS="$LAMBDA_ENV_VARS,$ENV_VAR=${!ENV_VAR//,/;}"
+    fi
+done
+
 echo "🚀 Deploying Bash-based Lambda function for Ken Burns video generation..."
 echo "  📝 Function: $FUNCTION_NAME"
 echo "  🐚 Runtime: $RUNTIME"
@@ -30,8 +45,9 @@ echo "\n📦 Creating minimal deployment package..."
 echo "🔧 Compiling Go bootstrap..."
 cd lambda
 GOOS=linux GOARCH=amd64 go build -o ../$DEPLOY_DIR/bootstrap bootstrap.go
+GOOS=linux GOARCH=amd64 go build -o ../$DEPLOY_DIR/qrgen qr_code_generator.go
 cd ..
-chmod +x $DEPLOY_DIR/bootstrap
+chmod +x $DEPLOY_DIR/bootstrap $DEPLOY_DIR/qrgen
 cp lambda/ken_burns_video_generator.sh $DEPLOY_DIR/ken_burns_video_generator.sh
 chmod +x $DEPLOY_DIR/ken_burns_video_generator.sh
 
@@ -59,6 +75,14 @@ cp ffmpeg-*-amd64-static/ffmpeg .
 cp ffmpeg-*-amd64-static/ffprobe .
 chmod +x ffmpeg ffprobe
 
+# HEIC photos need the HEVC decoder and AVIF needs an AV1 one; older static builds
+# also lack the HEIF tile grid support iPhone images rely on
+for DECODER in hevc libdav1d; do
+    if ! ./ffmpeg -hide_banner -decoders 2>/dev/null | grep -q " $DECODER "; then
+        echo "  ⚠️  ffmpeg build has no $DECODER decoder; HEIC/AVIF images will be rejected"
+    fi
+done
+
 # Download jq binary (cached)
 echo "🔧 Checking jq binary..."
 JQ_URL="https://github.com/stedolan/jq/releases/download/jq-1.6/jq-linux64"
@@ -74,6 +98,87 @@ fi
 cp "../$JQ_CACHE" jq
 chmod +x jq
 
+# Download fonts for text overlays (cached)
+echo "🔤 Checking overlay fonts..."
+FONTS_URL="https://github.com/dejavu-fonts/dejavu-fonts/releases/download/version_2_37/dejavu-fonts-ttf-2.37.tar.bz2"
+FONTS_CACHE="$CACHE_DIR/dejavu-fonts-ttf-2.37.tar.bz2"
+
+if [ ! -f "../$FONTS_CACHE" ]; then
+    echo "  📥 Downloading fonts..."
+    curl -L -o "../$FONTS_CACHE" $FONTS_URL
+else
+    echo "  ✅ Using cached fonts"
+fi
+
+mkdir -p fonts
+tar -xjf "../$FONTS_CACHE"
+cp dejavu-fonts-ttf-2.37/ttf/DejaVuSans.ttf dejavu-fonts-ttf-2.37/ttf/DejaVuSans-Bold.ttf fonts/
+rm -rf dejavu-fonts-ttf-2.37
+
+# Font repositories are read at the commit recorded in scripts/fonts.lock and each
+# downloaded font must match the sha256 recorded there ("<name> <commit>" and
+# "<file> <sha256>" lines); a missing or mismatched entry stops the deploy, and
+# the lock file is only ever changed by hand
+FONTS_LOCK="../scripts/fonts.lock"
+font_lock_entry() {
+    awk -v name="$1" '$1 == name { print $2 }' "$FONTS_LOCK" 2>/dev/null
+}
+
+pinned_font_commit() {
+    local name="$1"
+    local repository="$2"
+    
+    local commit=$(font_lock_entry "$name")
+    if [[ ! "$commit" =~ ^[0-9a-f]{40}$ ]]; then
+        echo "  ❌ No commit pinned for $name in scripts/fonts.lock; add \"$name <commit>\" (see git ls-remote $repository refs/heads/main)" >&2
+        return 1
+    fi
+    echo "$commit"
+}
+
+# Check a downloaded font against its scripts/fonts.lock checksum, dropping it
+# from the cache on a mismatch so the next deploy downloads it again
+verify_font_checksum() {
+    local file="$1"
+    local name="$2"
+    
+    local expected=$(font_lock_entry "$name")
+    local actual=$( (sha256sum "$file" 2>/dev/null || shasum -a 256 "$file") | cut -d' ' -f1)
+    if [ -z "$expected" ]; then
+        echo "  ❌ No sha256 for $name in scripts/fonts.lock; once the download is checked, add \"$name $actual\"" >&2
+        return 1
+    fi
+    if [ "$actual" != "$expected" ]; then
+        echo "  ❌ $name has sha256 $actual, scripts/fonts.lock expects $expected" >&2
+        rm -f "$file"
+        return 1
+    fi
+}
+
+# Noto fonts for complex-script (Arabic, Hebrew) text rendered through libass
+NOTO_COMMIT=$(pinned_font_commit notofonts https://github.com/notofonts/notofonts.github.io.git)
+NOTO_BASE_URL="https://github.com/notofonts/notofonts.github.io/raw/$NOTO_COMMIT/fonts"
+for NOTO_FONT in NotoSans NotoSansArabic NotoSansHebrew; do
+    NOTO_CACHE="$CACHE_DIR/${NOTO_FONT}-Regular-${NOTO_COMMIT:0:12}.ttf"
+    if [ ! -f "../$NOTO_CACHE" ]; then
+        echo "  📥 Downloading ${NOTO_FONT}..."
+        curl -fL -o "../$NOTO_CACHE" "$NOTO_BASE_URL/$NOTO_FONT/hinted/ttf/${NOTO_FONT}-Regular.ttf"
+    fi
+    verify_font_checksum "../$NOTO_CACHE" "${NOTO_FONT}-Regular.ttf"
+    cp "../$NOTO_CACHE" "fonts/${NOTO_FONT}-Regular.ttf"
+done
+
+# Noto Emoji outline font for emoji in overlays and captions; emoji render
+# monochrome in the text color, since neither libass nor drawtext draws color glyphs
+GOOGLE_FONTS_COMMIT=$(pinned_font_commit google-fonts https://github.com/google/fonts.git)
+EMOJI_CACHE="$CACHE_DIR/NotoEmoji-Regular-${GOOGLE_FONTS_COMMIT:0:12}.ttf"
+if [ ! -f "../$EMOJI_CACHE" ]; then
+    echo "  📥 Downloading NotoEmoji..."
+    curl -fL -o "../$EMOJI_CACHE" "https://github.com/google/fonts/raw/$GOOGLE_FONTS_COMMIT/ofl/notoemoji/NotoEmoji%5Bwght%5D.ttf"
+fi
+verify_font_checksum "../$EMOJI_CACHE" NotoEmoji-Regular.ttf
+cp "../$EMOJI_CACHE" fonts/NotoEmoji-Regular.ttf
+
 # Clean up ffmpeg download
 rm -rf ffmpeg-*-amd64-static ffmpeg.tar.xz
 
@@ -139,6 +244,14 @@ fi
 
 # Create custom policy for S3 access
 echo "\n📋 Creating custom IAM policy..."
+
+# Partner image sources readable by the function: objects behind any access point
+# (still gated by the access point policy) plus PARTNER_SOURCE_BUCKETS (comma-separated)
+SOURCE_READ_RESOURCES='"arn:aws:s3:*:*:accesspoint/*/object/*"'
+for SOURCE_BUCKET in ${PARTNER_SOURCE_BUCKETS//,/ }; do
+    SOURCE_READ_RESOURCES="$SOURCE_READ_RESOURCES, \"arn:aws:s3:::$SOURCE_BUCKET/*\""
+done
+
 cat > lambda-policy.json << EOF
 {
     "Version": "2012-10-17",
@@ -148,6 +261,8 @@ cat > lambda-policy.json << EOF
             "Action": [
                 "s3:GetObject",
                 "s3:PutObject",
+                "s3:PutObjectTagging",
+                "s3:DeleteObject",
                 "s3:ListBucket"
             ],
             "Resource": [
@@ -155,6 +270,29 @@ cat > lambda-policy.json << EOF
                 "arn:aws:s3:::burns-videos/*"
             ]
         },
+        {
+            "Effect": "Allow",
+            "Action": [
+                "s3:GetObject"
+            ],
+            "Resource": [$SOURCE_READ_RESOURCES]
+        },
+        {
+            "Effect": "Allow",
+            "Action": [
+                "rekognition:DetectFaces",
+                "rekognition:DetectLabels",
+                "rekognition:DetectModerationLabels"
+            ],
+            "Resource": "*"
+        },
+        {
+            "Effect": "Allow",
+            "Action": [
+                "ssm:GetParameter"
+            ],
+            "Resource": "arn:aws:ssm:*:*:parameter/burns/*"
+        },
         {
             "Effect": "Allow",
             "Action": [
@@ -191,6 +329,39 @@ ROLE_ARN=$(aws iam get-role --role-name $ROLE_NAME --region $REGION --query Role
 
 echo "  📋 Role ARN: $ROLE_ARN"
 
+# Build and publish the document tools layer (cached); the binaries land in
+# /opt/bin (on PATH) and their libraries in /opt/lib (on LD_LIBRARY_PATH)
+echo "\n📄 Checking document tools layer..."
+LAYER_ARGS=()
+if [ -z "$DOCUMENT_TOOLS_LAYER_ARN" ]; then
+    LAYER_CACHE="$CACHE_DIR/document-tools-layer.zip"
+    if [ ! -f "$LAYER_CACHE" ] && command -v docker > /dev/null 2>&1; then
+        echo "  🔨 Building pdftoppm and rsvg-convert in Amazon Linux 2..."
+        docker run --rm -v "$PWD/$CACHE_DIR:/out" amazonlinux:2 bash -c '
+            set -e
+            yum install -y -q poppler-utils librsvg2-tools zip > /dev/null
+            mkdir -p /layer/bin /layer/lib
+            cp /usr/bin/pdftoppm /usr/bin/rsvg-convert /layer/bin/
+            ldd /usr/bin/pdftoppm /usr/bin/rsvg-convert | awk "/=> \// { print \$3 }" | sort -u | \
+                grep -vE "/(libc|libm|libdl|libpthread|librt|ld-linux[^/]*)\.so" | xargs -I{} cp -L {} /layer/lib/
+            cd /layer && zip -qr /out/document-tools-layer.zip bin lib'
+    fi
+    if [ -f "$LAYER_CACHE" ]; then
+        DOCUMENT_TOOLS_LAYER_ARN=$(aws lambda publish-layer-version \
+            --layer-name $DOCUMENT_TOOLS_LAYER_NAME \
+            --zip-file fileb://$LAYER_CACHE \
+            --compatible-runtimes $RUNTIME \
+            --region $REGION \
+            --query LayerVersionArn --output text)
+    fi
+fi
+if [ -n "$DOCUMENT_TOOLS_LAYER_ARN" ]; then
+    echo "  ✅ Layer: $DOCUMENT_TOOLS_LAYER_ARN"
+    LAYER_ARGS=(--layers "$DOCUMENT_TOOLS_LAYER_ARN")
+else
+    echo "  ⚠️  No document tools layer (needs docker or DOCUMENT_TOOLS_LAYER_ARN); PDF and SVG images will be rejected"
+fi
+
 # Check if function exists
 echo "\n🔍 Checking if Lambda function exists..."
 if aws lambda get-function --function-name $FUNCTION_NAME --region $REGION > /dev/null 2>&1; then
@@ -216,7 +387,8 @@ if aws lambda get-function --function-name $FUNCTION_NAME --region $REGION > /de
         --function-name $FUNCTION_NAME \
         --timeout $TIMEOUT \
         --memory-size $MEMORY_SIZE \
-        --environment Variables={S3_BUCKET=burns-videos} \
+        --environment "Variables={$LAMBDA_ENV_VARS}" \
+        "${LAYER_ARGS[@]}" \
         --region $REGION
 else
     echo "  📝 Creating new function..."
@@ -233,7 +405,8 @@ else
             --code S3Bucket=burns-videos,S3Key=lambda-deployments/lambda_bash_deployment.zip \
             --timeout $TIMEOUT \
             --memory-size $MEMORY_SIZE \
-            --environment Variables={S3_BUCKET=burns-videos} \
+            --environment "Variables={$LAMBDA_ENV_VARS}" \
+            "${LAYER_ARGS[@]}" \
             --region $REGION
     else
         aws lambda create-function \
@@ -244,7 +417,8 @@ else
             --zip-file fileb://lambda_bash_deployment.zip \
             --timeout $TIMEOUT \
             --memory-size $MEMORY_SIZE \
-            --environment Variables={S3_BUCKET=burns-videos} \
+            --environment "Variables={$LAMBDA_ENV_VARS}" \
+            "${LAYER_ARGS[@]}" \
             --region $REGION
     fi
 fi
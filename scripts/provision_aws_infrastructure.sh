@@ -95,10 +95,63 @@ create_s3_bucket() {
                     "Expiration": {
                         "Days": 14
                     }
+                },
+                {
+                    "ID": "intermediate-segments",
+                    "Status": "Enabled",
+                    "Filter": {
+                        "And": {
+                            "Prefix": "segments/",
+                            "Tags": [{"Key": "lifecycle", "Value": "intermediate"}]
+                        }
+                    },
+                    "Expiration": {
+                        "Days": 3
+                    }
+                },
+                {
+                    "ID": "event-payloads",
+                    "Status": "Enabled",
+                    "Filter": {
+                        "Prefix": "payloads/"
+                    },
+                    "Expiration": {
+                        "Days": 1
+                    }
+                },
+                {
+                    "ID": "debug-bundles",
+                    "Status": "Enabled",
+                    "Filter": {
+                        "Prefix": "debug/"
+                    },
+                    "Expiration": {
+                        "Days": 14
+                    }
+                },
+                {
+                    "ID": "profiles",
+                    "Status": "Enabled",
+                    "Filter": {
+                        "Prefix": "profiles/"
+                    },
+                    "Expiration": {
+                        "Days": 14
+                    }
+                },
+                {
+                    "ID": "handler-responses",
+                    "Status": "Enabled",
+                    "Filter": {
+                        "Prefix": "responses/"
+                    },
+                    "Expiration": {
+                        "Days": 1
+                    }
                 }
             ]
         }'
-    log_success "Lifecycle policy configured (14 days)"
+    log_success "Lifecycle policy configured (14 days, intermediate segments 3 days, payloads and responses 1 day, debug bundles and profiles 14 days)"
 }
 
 # Create IAM role for Lambda
@@ -159,6 +212,7 @@ create_iam_policy() {
             "Action": [
                 "s3:GetObject",
                 "s3:PutObject",
+                "s3:PutObjectTagging",
                 "s3:DeleteObject",
                 "s3:ListBucket"
             ],
@@ -0,0 +1,69 @@
+#!/bin/bash
+
+# Tests for the named looks registry (lambda_bash_deployment/looks.json) and
+# the handler's apply_look merge. Run from the repository root:
+#   bash scripts/test_looks.sh
+
+cd "$(dirname "$0")/../lambda_bash_deployment"
+HANDLER="./ken_burns_video_generator.sh"
+
+# Load the handler's functions without running the stdin entry point
+source <(sed '/^# Always read from stdin/,$d' "$HANDLER") > /dev/null 2>&1
+set +e
+
+RENDER_WARNINGS_FILE=$(mktemp)
+trap 'rm -f "$RENDER_WARNINGS_FILE"' EXIT
+FAILURES=0
+
+fail() {
+    echo "FAIL: $1"
+    FAILURES=$((FAILURES + 1))
+}
+
+# Every look needs a description and an options object
+invalid=$(./jq -r 'to_entries[] | select((.value.description | type) != "string" or (.value.options | type) != "object") | .key' "$LOOKS_FILE")
+[ -z "$invalid" ] || fail "looks without a description or options: $invalid"
+
+# Every option a look sets must be one the handler reads
+for key in $(./jq -r '[.[].options | keys[]] | unique[]' "$LOOKS_FILE"); do
+    grep -q "get_option \"$key\"" "$HANDLER" || fail "look option '$key' is not read by the handler"
+done
+
+# Numeric options stay within the ranges the handler accepts
+out_of_range=$(./jq -r 'to_entries[] | .key as $look | .value.options |
+    select(.max_zoom < 1 or .crf < 0 or .crf > 51 or .default_duration <= 0 or .crossfade < 0 or
+        .motion_zoom_velocity < 0 or .motion_pan_velocity < 0 or (.hold_in // 0) < 0 or (.hold_out // 0) < 0) |
+    $look' "$LOOKS_FILE")
+[ -z "$out_of_range" ] || fail "looks with out-of-range options: $out_of_range"
+
+# Explicit event options win over the look's defaults
+OPTIONS_JSON='{"look":"documentary_subtle","crf":30}'
+apply_look > /dev/null
+[ "$(get_option "crf" "")" = "30" ] || fail "explicit crf was overridden by the look"
+[ "$(get_option "motion_profile" "")" = "hold" ] || fail "look default motion_profile was not applied"
+[ "$(get_option "look" "")" = "documentary_subtle" ] || fail "look name was dropped from the options"
+
+# Nested event options merge into the look rather than replacing it
+OPTIONS_JSON='{"look":"social_punchy","transition":{"type":"crossfade"}}'
+apply_look > /dev/null
+[ "$(echo "$OPTIONS_JSON" | ./jq -r '.transition.type')" = "crossfade" ] || fail "explicit transition was overridden by the look"
+
+# An unknown look is reported and leaves the options untouched
+OPTIONS_JSON='{"look":"no_such_look","crf":21}'
+: > "$RENDER_WARNINGS_FILE"
+apply_look > /dev/null 2>&1
+[ "$OPTIONS_JSON" = '{"look":"no_such_look","crf":21}' ] || fail "unknown look changed the options"
+grep -q '^unknown_look ' "$RENDER_WARNINGS_FILE" || fail "unknown look was not reported"
+
+# No look is a no-op
+OPTIONS_JSON='{"crf":21}'
+: > "$RENDER_WARNINGS_FILE"
+apply_look > /dev/null
+[ "$OPTIONS_JSON" = '{"crf":21}' ] || fail "options changed without a look"
+[ ! -s "$RENDER_WARNINGS_FILE" ] || fail "warning recorded without a look"
+
+if [ "$FAILURES" -gt 0 ]; then
+    echo "$FAILURES looks test(s) failed"
+    exit 1
+fi
+echo "looks tests passed"